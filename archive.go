@@ -0,0 +1,459 @@
+package snapdir
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ExportTar writes the entries of snapshot to w as a tar archive, with
+// their modes, modification times, symlinks and, if recorded, owners.
+// Entries without a modification time get the Unix epoch.
+func ExportTar(w io.Writer, snapshot ProjectSnapshot) error {
+	if snapshot.Parent != "" {
+		return fmt.Errorf("snapshot is incremental, open it with OpenSnapshot to include its parent %s", snapshot.Parent)
+	}
+
+	tw := tar.NewWriter(w)
+	for _, file := range snapshot.Files {
+		if file.Deleted {
+			continue
+		}
+		hdr := &tar.Header{
+			Name:    file.Path,
+			Mode:    int64(archiveMode(file).Perm()),
+			ModTime: archiveTime(file),
+		}
+		if file.Owner != nil {
+			hdr.Uid, hdr.Gid = file.Owner.UID, file.Owner.GID
+		}
+
+		var data []byte
+		switch {
+		case file.IsDir:
+			hdr.Typeflag = tar.TypeDir
+			hdr.Name += "/"
+		case file.Link != "":
+			hdr.Typeflag = tar.TypeSymlink
+			hdr.Linkname = file.Link
+		default:
+			var err error
+			if data, err = file.Data(); err != nil {
+				return err
+			}
+			hdr.Typeflag = tar.TypeReg
+			hdr.Size = int64(len(data))
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("failed to write archive entry %s: %w", file.Path, err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			return fmt.Errorf("failed to write archive entry %s: %w", file.Path, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("failed to write archive: %w", err)
+	}
+	return nil
+}
+
+// ExportZip writes the entries of snapshot to w as a zip archive. Symlinks
+// are stored the way Info-ZIP does, as entries whose contents are the link
+// target. Zip archives cannot hold owners.
+func ExportZip(w io.Writer, snapshot ProjectSnapshot) error {
+	if snapshot.Parent != "" {
+		return fmt.Errorf("snapshot is incremental, open it with OpenSnapshot to include its parent %s", snapshot.Parent)
+	}
+
+	zw := zip.NewWriter(w)
+	for _, file := range snapshot.Files {
+		if file.Deleted {
+			continue
+		}
+		hdr := &zip.FileHeader{Name: file.Path, Method: zip.Deflate, Modified: archiveTime(file)}
+		hdr.SetMode(archiveMode(file))
+
+		var data []byte
+		switch {
+		case file.IsDir:
+			hdr.Name += "/"
+			hdr.Method = zip.Store
+		case file.Link != "":
+			data = []byte(file.Link)
+		default:
+			var err error
+			if data, err = file.Data(); err != nil {
+				return err
+			}
+		}
+
+		fw, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return fmt.Errorf("failed to write archive entry %s: %w", file.Path, err)
+		}
+		if _, err := fw.Write(data); err != nil {
+			return fmt.Errorf("failed to write archive entry %s: %w", file.Path, err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("failed to write archive: %w", err)
+	}
+	return nil
+}
+
+// archiveMode returns the mode an entry is exported with
+func archiveMode(file FileInfo) fs.FileMode {
+	mode := fs.FileMode(file.Mode).Perm()
+	switch {
+	case file.IsDir:
+		if mode == 0 {
+			mode = dirPerms
+		}
+		return fs.ModeDir | mode
+	case file.Link != "":
+		return fs.ModeSymlink | fs.ModePerm
+	case mode == 0:
+		return defaultPerms
+	}
+	return mode
+}
+
+// archiveTime returns the modification time an entry is exported with
+func archiveTime(file FileInfo) time.Time {
+	if file.ModTime != "" {
+		if t, err := ParseModTime(file.ModTime); err == nil {
+			return t
+		}
+	}
+	return time.Unix(0, 0)
+}
+
+// ImportTar reads a tar archive, compressed with gzip or not, and returns
+// it as a snapshot. Directories, regular files, symlinks and hard links are
+// imported with their modes and modification times, and owners if
+// opts.PreserveOwner is set; other entry types are skipped with a warning.
+// Entries that would land outside the root, symlinks pointing outside it,
+// directly or through other symlinks, and entries that break opts.Limits
+// fail the import. Secrets are handled
+// according to opts.Secrets as for CloneFS.
+func ImportTar(ctx context.Context, r io.Reader, opts Options) (ProjectSnapshot, error) {
+	r, err := gunzipReader(r)
+	if err != nil {
+		return ProjectSnapshot{}, fmt.Errorf("failed to read archive: %w", err)
+	}
+
+	im := newImporter(opts)
+	tr := tar.NewReader(r)
+	for {
+		if err := ctx.Err(); err != nil {
+			return ProjectSnapshot{}, err
+		}
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return ProjectSnapshot{}, fmt.Errorf("failed to read archive: %w", err)
+		}
+
+		entry := FileInfo{Mode: uint32(hdr.FileInfo().Mode().Perm())}
+		if opts.PreserveOwner {
+			entry.Owner = &Owner{UID: hdr.Uid, GID: hdr.Gid}
+		}
+		var data []byte
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			entry.IsDir = true
+		case tar.TypeReg:
+			entry.Size = hdr.Size
+		case tar.TypeSymlink:
+			if hdr.Linkname == "" {
+				return ProjectSnapshot{}, fmt.Errorf("archive entry %s is a symlink without a target", hdr.Name)
+			}
+			entry.Link = hdr.Linkname
+		case tar.TypeLink:
+			if data, err = im.hardLink(hdr.Linkname); err != nil {
+				return ProjectSnapshot{}, err
+			}
+			entry.Size = int64(len(data))
+		default:
+			im.opts.logger().Warn("skipping unsupported archive entry", "path", hdr.Name, "type", string(hdr.Typeflag))
+			continue
+		}
+
+		ok, err := im.begin(&entry, hdr.Name, hdr.ModTime)
+		if err != nil {
+			return ProjectSnapshot{}, err
+		}
+		if !ok {
+			continue
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			if data, err = io.ReadAll(tr); err != nil {
+				return ProjectSnapshot{}, fmt.Errorf("failed to read archive entry %s: %w", entry.Path, err)
+			}
+		}
+		im.add(entry, data)
+	}
+	return im.finish()
+}
+
+// ImportZip reads the zip archive of the given size from r and returns it
+// as a snapshot, like ImportTar. Symlinks are recognized by their Unix mode.
+func ImportZip(ctx context.Context, r io.ReaderAt, size int64, opts Options) (ProjectSnapshot, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return ProjectSnapshot{}, fmt.Errorf("failed to read archive: %w", err)
+	}
+
+	im := newImporter(opts)
+	for _, f := range zr.File {
+		if err := ctx.Err(); err != nil {
+			return ProjectSnapshot{}, err
+		}
+
+		mode := f.Mode()
+		entry := FileInfo{Mode: uint32(mode.Perm())}
+		switch {
+		case mode.IsDir():
+			entry.IsDir = true
+		case mode&fs.ModeSymlink != 0, mode.IsRegular():
+			entry.Size = int64(f.UncompressedSize64)
+		default:
+			im.opts.logger().Warn("skipping unsupported archive entry", "path", f.Name, "mode", mode.String())
+			continue
+		}
+
+		ok, err := im.begin(&entry, f.Name, f.Modified)
+		if err != nil {
+			return ProjectSnapshot{}, err
+		}
+		if !ok {
+			continue
+		}
+		if entry.IsDir {
+			im.add(entry, nil)
+			continue
+		}
+
+		data, err := readZipFile(f, entry.Size)
+		if err != nil {
+			return ProjectSnapshot{}, fmt.Errorf("failed to read archive entry %s: %w", entry.Path, err)
+		}
+		if mode&fs.ModeSymlink != 0 {
+			entry.Link, entry.Size, data = string(data), 0, nil
+			if entry.Link == "" {
+				return ProjectSnapshot{}, fmt.Errorf("archive entry %s is a symlink without a target", entry.Path)
+			}
+			if err := checkLinkTarget(entry.Path, entry.Link); err != nil {
+				return ProjectSnapshot{}, err
+			}
+		}
+		im.add(entry, data)
+	}
+	return im.finish()
+}
+
+// readZipFile reads a zip entry, failing if it holds more than size bytes
+func readZipFile(f *zip.File, size int64) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(io.LimitReader(rc, size+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != size {
+		return nil, fmt.Errorf("size does not match its header")
+	}
+	return data, nil
+}
+
+// importer collects the entries of an archive into a snapshot
+type importer struct {
+	opts     Options
+	checker  *limitChecker
+	secrets  *secretScanner
+	snapshot ProjectSnapshot
+	index    map[string]int
+}
+
+func newImporter(opts Options) *importer {
+	return &importer{
+		opts:     opts,
+		checker:  newLimitChecker(opts),
+		secrets:  newSecretScanner(opts),
+		snapshot: ProjectSnapshot{Version: Version, Files: []FileInfo{}},
+		index:    make(map[string]int),
+	}
+}
+
+// begin sets the path and modification time of an entry from its archive
+// header and checks it against the limits before its contents are read,
+// along with its symlink target if that is known already. It returns false
+// for the root directory, which has no entry of its own.
+func (im *importer) begin(entry *FileInfo, name string, modTime time.Time) (bool, error) {
+	p, err := archivePath(name)
+	if err != nil || p == "." {
+		return false, err
+	}
+	entry.Path = p
+	if entry.Link != "" {
+		if err := checkLinkTarget(p, entry.Link); err != nil {
+			return false, err
+		}
+	}
+	if t := im.opts.normalizeModTime(modTime); !t.IsZero() {
+		entry.ModTime = FormatModTime(t)
+	}
+	return true, im.checker.check(*entry)
+}
+
+// add stores an entry with its contents. A later entry for the same path
+// replaces the earlier one, as when the archive is extracted.
+func (im *importer) add(entry FileInfo, data []byte) {
+	if entry.hasData() {
+		entry.SetData(data)
+		entry.Size = int64(len(data))
+		entry.SHA256 = HashContents(data)
+		im.secrets.scan(&entry)
+	}
+	im.opts.logger().Debug("imported", "path", entry.Path)
+
+	if i, ok := im.index[entry.Path]; ok {
+		im.snapshot.Files[i] = entry
+		return
+	}
+	im.index[entry.Path] = len(im.snapshot.Files)
+	im.snapshot.Files = append(im.snapshot.Files, entry)
+}
+
+// hardLink returns the contents of the file a tar hard link points to
+func (im *importer) hardLink(name string) ([]byte, error) {
+	p, err := archivePath(name)
+	if err != nil {
+		return nil, err
+	}
+	i, ok := im.index[p]
+	if !ok || !im.snapshot.Files[i].hasData() {
+		return nil, fmt.Errorf("archive entry links to %s, which is not an earlier file", name)
+	}
+	return im.snapshot.Files[i].Data()
+}
+
+// finish returns the imported snapshot
+func (im *importer) finish() (ProjectSnapshot, error) {
+	if err := checkLinkChains(im.snapshot.Files); err != nil {
+		return ProjectSnapshot{}, err
+	}
+	if err := im.secrets.finish(); err != nil {
+		return ProjectSnapshot{}, err
+	}
+	if im.opts.Reproducible {
+		sort.Slice(im.snapshot.Files, func(i, j int) bool {
+			return im.snapshot.Files[i].Path < im.snapshot.Files[j].Path
+		})
+	}
+	return im.snapshot, nil
+}
+
+// checkLinkTarget rejects the target of the symlink entry p if it is
+// absolute or, resolved from the directory of p, leads outside the root, so
+// an imported tree cannot point at files elsewhere once it is restored. The
+// target is resolved lexically, without following other links.
+func checkLinkTarget(p, target string) error {
+	resolved := path.Join(path.Dir(p), target)
+	if path.IsAbs(target) || filepath.IsAbs(filepath.FromSlash(target)) || strings.Contains(target, `\`) ||
+		resolved == ".." || strings.HasPrefix(resolved, "../") {
+		return fmt.Errorf("archive entry %s is a symlink to %q, which is outside the root", p, target)
+	}
+	return nil
+}
+
+// maxLinkFollows is how many symlinks resolving one link target may pass
+// through, like the limit of the Linux kernel
+const maxLinkFollows = 40
+
+// checkLinkChains resolves the target of every symlink entry through the
+// other symlinks of the tree, as the file system will once it is restored,
+// and rejects a link that leads outside the root that way. checkLinkTarget
+// alone accepts y -> "." and z -> "y/..", but z points at the parent of the
+// root. Links that need too many steps to resolve are rejected too.
+func checkLinkChains(files []FileInfo) error {
+	links := make(map[string]string)
+	for _, file := range files {
+		if file.Link != "" {
+			links[file.Path] = file.Link
+		}
+	}
+	for _, file := range files {
+		if file.Link == "" {
+			continue
+		}
+		follows := maxLinkFollows
+		if _, err := resolveLink(links, path.Dir(file.Path), file.Link, &follows); err != nil {
+			return fmt.Errorf("archive entry %s is a symlink to %q, which %w", file.Path, file.Link, err)
+		}
+	}
+	return nil
+}
+
+// resolveLink returns the root relative path that the relative symlink
+// target leads to from dir, following the symlinks in links. follows is
+// the number of symlinks that may still be followed.
+func resolveLink(links map[string]string, dir, target string, follows *int) (string, error) {
+	current := dir
+	for _, elem := range strings.Split(target, "/") {
+		switch elem {
+		case "", ".":
+		case "..":
+			if current == "." {
+				return "", errors.New("is outside the root")
+			}
+			current = path.Dir(current)
+		default:
+			current = path.Join(current, elem)
+			next, ok := links[current]
+			if !ok {
+				continue
+			}
+			if *follows--; *follows < 0 {
+				return "", errors.New("goes through too many symlinks")
+			}
+			resolved, err := resolveLink(links, path.Dir(current), next, follows)
+			if err != nil {
+				return "", err
+			}
+			current = resolved
+		}
+	}
+	return current, nil
+}
+
+// archivePath turns the name of an archive entry into a snapshot path,
+// dropping a leading "./" and trailing slashes. Names that are absolute,
+// contain ".." or are otherwise not clean are rejected, so no entry can
+// escape the root.
+func archivePath(name string) (string, error) {
+	p := strings.TrimRight(strings.TrimPrefix(name, "./"), "/")
+	if p == "" || p == "." {
+		return ".", nil
+	}
+	if err := checkEntryPath(p); err != nil {
+		return "", fmt.Errorf("archive entry %q is outside the root", name)
+	}
+	return p, nil
+}
@@ -0,0 +1,287 @@
+package snapdir
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io/fs"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// archiveSnapshot is exported and imported again by the archive tests
+var archiveSnapshot = ProjectSnapshot{Version: Version, Files: []FileInfo{
+	{Path: "bin", IsDir: true, Mode: 0750, ModTime: "2024-03-01T10:00:00Z"},
+	{Path: "bin/run.sh", Mode: 0755, ModTime: "2024-03-01T10:00:00Z", Contents: "#!/bin/sh\necho hi\n"},
+	{Path: "logo.png", Mode: 0644, ModTime: "2024-03-01T10:00:00Z", Contents: "iVBORw0KGgo=", Encoding: EncodingBase64},
+	{Path: "run", Mode: 0777, ModTime: "2024-03-01T10:00:00Z", Link: "bin/run.sh"},
+}}
+
+func TestExportImportArchives(t *testing.T) {
+	ctx := context.Background()
+
+	// Imported entries get their sizes and hashes filled in
+	want := make([]FileInfo, len(archiveSnapshot.Files))
+	for i, file := range archiveSnapshot.Files {
+		if file.hasData() {
+			data, _ := file.Data()
+			file.Size, file.SHA256 = int64(len(data)), HashContents(data)
+		}
+		want[i] = file
+	}
+
+	tests := []struct {
+		name    string
+		export  func(*bytes.Buffer) error
+		imports func([]byte) (ProjectSnapshot, error)
+	}{
+		{
+			name:   "tar",
+			export: func(buf *bytes.Buffer) error { return ExportTar(buf, archiveSnapshot) },
+			imports: func(data []byte) (ProjectSnapshot, error) {
+				return ImportTar(ctx, bytes.NewReader(data), Options{})
+			},
+		},
+		{
+			name: "tar.gz",
+			export: func(buf *bytes.Buffer) error {
+				gz := gzip.NewWriter(buf)
+				if err := ExportTar(gz, archiveSnapshot); err != nil {
+					return err
+				}
+				return gz.Close()
+			},
+			imports: func(data []byte) (ProjectSnapshot, error) {
+				return ImportTar(ctx, bytes.NewReader(data), Options{})
+			},
+		},
+		{
+			name:   "zip",
+			export: func(buf *bytes.Buffer) error { return ExportZip(buf, archiveSnapshot) },
+			imports: func(data []byte) (ProjectSnapshot, error) {
+				return ImportZip(ctx, bytes.NewReader(data), int64(len(data)), Options{})
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := tt.export(&buf); err != nil {
+				t.Fatalf("export error = %v", err)
+			}
+			got, err := tt.imports(buf.Bytes())
+			if err != nil {
+				t.Fatalf("import error = %v", err)
+			}
+			if !reflect.DeepEqual(got.Files, want) {
+				t.Errorf("imported entries:\n%+v\nwant:\n%+v", got.Files, want)
+			}
+		})
+	}
+}
+
+func TestImportTarEntries(t *testing.T) {
+	mtime := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		headers []tar.Header
+		paths   []string
+		wantErr bool
+	}{
+		{
+			name: "leading dot and root entry",
+			headers: []tar.Header{
+				{Name: "./", Typeflag: tar.TypeDir},
+				{Name: "./src/", Typeflag: tar.TypeDir},
+				{Name: "./src/a.txt", Typeflag: tar.TypeReg},
+			},
+			paths: []string{"src", "src/a.txt"},
+		},
+		{
+			name: "hard link copies contents",
+			headers: []tar.Header{
+				{Name: "a.txt", Typeflag: tar.TypeReg},
+				{Name: "b.txt", Typeflag: tar.TypeLink, Linkname: "a.txt"},
+			},
+			paths: []string{"a.txt", "b.txt"},
+		},
+		{
+			name: "later entry replaces earlier one",
+			headers: []tar.Header{
+				{Name: "a.txt", Typeflag: tar.TypeReg},
+				{Name: "a.txt", Typeflag: tar.TypeSymlink, Linkname: "b.txt"},
+			},
+			paths: []string{"a.txt"},
+		},
+		{
+			name:    "device skipped",
+			headers: []tar.Header{{Name: "null", Typeflag: tar.TypeChar}},
+		},
+		{name: "parent path", headers: []tar.Header{{Name: "../evil.sh", Typeflag: tar.TypeReg}}, wantErr: true},
+		{name: "nested parent path", headers: []tar.Header{{Name: "a/../../evil.sh", Typeflag: tar.TypeReg}}, wantErr: true},
+		{name: "absolute path", headers: []tar.Header{{Name: "/etc/cron.d/evil", Typeflag: tar.TypeReg}}, wantErr: true},
+		{name: "absolute hard link", headers: []tar.Header{{Name: "a", Typeflag: tar.TypeLink, Linkname: "/etc/shadow"}}, wantErr: true},
+		{name: "hard link to missing file", headers: []tar.Header{{Name: "a", Typeflag: tar.TypeLink, Linkname: "b"}}, wantErr: true},
+		{name: "symlink without target", headers: []tar.Header{{Name: "a", Typeflag: tar.TypeSymlink}}, wantErr: true},
+		{
+			name:    "symlink to sibling directory",
+			headers: []tar.Header{{Name: "a/b", Typeflag: tar.TypeSymlink, Linkname: "../c/d"}},
+			paths:   []string{"a/b"},
+		},
+		{name: "absolute symlink", headers: []tar.Header{{Name: "a", Typeflag: tar.TypeSymlink, Linkname: "/etc/shadow"}}, wantErr: true},
+		{name: "parent symlink", headers: []tar.Header{{Name: "a", Typeflag: tar.TypeSymlink, Linkname: "../x"}}, wantErr: true},
+		{name: "nested parent symlink", headers: []tar.Header{{Name: "a/b", Typeflag: tar.TypeSymlink, Linkname: "c/../../../x"}}, wantErr: true},
+		{
+			name: "symlink through symlink",
+			headers: []tar.Header{
+				{Name: "a/b", Typeflag: tar.TypeSymlink, Linkname: "../c/d"},
+				{Name: "c", Typeflag: tar.TypeSymlink, Linkname: "e"},
+			},
+			paths: []string{"a/b", "c"},
+		},
+		{
+			name: "chained symlink outside",
+			headers: []tar.Header{
+				{Name: "y", Typeflag: tar.TypeSymlink, Linkname: "."},
+				{Name: "z", Typeflag: tar.TypeSymlink, Linkname: "y/.."},
+			},
+			wantErr: true,
+		},
+		{
+			name: "chained symlink outside in reverse order",
+			headers: []tar.Header{
+				{Name: "z", Typeflag: tar.TypeSymlink, Linkname: "y/.."},
+				{Name: "y", Typeflag: tar.TypeSymlink, Linkname: "."},
+			},
+			wantErr: true,
+		},
+		{
+			name: "symlink loop",
+			headers: []tar.Header{
+				{Name: "a", Typeflag: tar.TypeSymlink, Linkname: "b"},
+				{Name: "b", Typeflag: tar.TypeSymlink, Linkname: "a"},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			tw := tar.NewWriter(&buf)
+			for _, hdr := range tt.headers {
+				hdr.Mode, hdr.ModTime = 0644, mtime
+				var data []byte
+				if hdr.Typeflag == tar.TypeReg {
+					data = []byte("data")
+					hdr.Size = int64(len(data))
+				}
+				if err := tw.WriteHeader(&hdr); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := tw.Write(data); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := tw.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			snapshot, err := ImportTar(context.Background(), &buf, Options{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ImportTar() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var paths []string
+			for _, file := range snapshot.Files {
+				paths = append(paths, file.Path)
+				if file.hasData() && file.Contents != "data" {
+					t.Errorf("entry %s has contents %q", file.Path, file.Contents)
+				}
+			}
+			if !reflect.DeepEqual(paths, tt.paths) {
+				t.Errorf("ImportTar() paths = %v, want %v", paths, tt.paths)
+			}
+		})
+	}
+}
+
+func TestImportZipSymlinkTargets(t *testing.T) {
+	tests := []struct {
+		target  string
+		wantErr bool
+	}{
+		{target: "b.txt"},
+		{target: "../b.txt"},
+		{target: "../../b.txt", wantErr: true},
+		{target: "/etc/passwd", wantErr: true},
+		{target: `..\..\b.txt`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			var buf bytes.Buffer
+			zw := zip.NewWriter(&buf)
+			hdr := &zip.FileHeader{Name: "dir/link"}
+			hdr.SetMode(fs.ModeSymlink | 0777)
+			fw, err := zw.CreateHeader(hdr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := fw.Write([]byte(tt.target)); err != nil {
+				t.Fatal(err)
+			}
+			if err := zw.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			snapshot, err := ImportZip(context.Background(), bytes.NewReader(buf.Bytes()), int64(buf.Len()), Options{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ImportZip() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (len(snapshot.Files) != 1 || snapshot.Files[0].Link != tt.target) {
+				t.Errorf("ImportZip() = %+v, want a link to %s", snapshot.Files, tt.target)
+			}
+		})
+	}
+}
+
+func TestImportLimits(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		fw, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fw.Write([]byte(strings.Repeat("x", 100))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, limits := range []RestoreLimits{{MaxEntries: 2}, {MaxFileSize: 99}, {MaxTotalSize: 250}} {
+		opts := Options{Limits: limits}
+		_, err := ImportZip(context.Background(), bytes.NewReader(buf.Bytes()), int64(buf.Len()), opts)
+		if !errors.Is(err, ErrLimitExceeded) {
+			t.Errorf("ImportZip() with %+v error = %v, want %v", limits, err, ErrLimitExceeded)
+		}
+	}
+}
+
+func TestExportIncremental(t *testing.T) {
+	snapshot := ProjectSnapshot{Version: Version, Parent: "base.json"}
+	if err := ExportTar(&bytes.Buffer{}, snapshot); err == nil {
+		t.Error("ExportTar() should reject incremental snapshots")
+	}
+	if err := ExportZip(&bytes.Buffer{}, snapshot); err == nil {
+		t.Error("ExportZip() should reject incremental snapshots")
+	}
+}
@@ -0,0 +1,79 @@
+package snapdir
+
+import "math/bits"
+
+// Files larger than chunkThreshold are stored in a repository as a list of
+// content-defined chunks instead of a single blob, so a small change to a
+// large file only stores the chunks around the change again
+const chunkThreshold = 4 << 20
+
+// chunker splits data into chunks whose boundaries depend on the content
+// around them rather than on offsets, using a gear rolling hash. Inserting
+// or removing bytes only moves the boundaries next to the change.
+type chunker struct {
+	minSize int
+	maxSize int
+	mask    uint64
+}
+
+// defaultChunker produces chunks of 1 MiB on average, between 256 KiB and
+// 4 MiB
+var defaultChunker = newChunker(256<<10, 20, 4<<20)
+
+// newChunker returns a chunker for chunks of minSize to maxSize bytes with
+// an average size of about 2^avgBits bytes past minSize
+func newChunker(minSize, avgBits, maxSize int) chunker {
+	// The top bits of the hash depend on the most bytes, so boundaries are
+	// decided by those
+	mask := uint64(1)<<avgBits - 1
+	return chunker{
+		minSize: minSize,
+		maxSize: maxSize,
+		mask:    bits.RotateLeft64(mask, 64-avgBits),
+	}
+}
+
+// gearTable maps every byte to a pseudo-random value. It is generated from a
+// fixed seed because chunk boundaries, and with them deduplication, must
+// not change between runs or versions.
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	state := uint64(0x736e617064697221) // "snapdir!"
+	for i := range table {
+		// splitmix64
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// Split returns the chunks of data. The chunks share data's backing array.
+func (c chunker) Split(data []byte) [][]byte {
+	var chunks [][]byte
+	for len(data) > 0 {
+		n := c.boundary(data)
+		chunks = append(chunks, data[:n])
+		data = data[n:]
+	}
+	return chunks
+}
+
+// boundary returns the length of the first chunk of data
+func (c chunker) boundary(data []byte) int {
+	if len(data) <= c.minSize {
+		return len(data)
+	}
+
+	end := min(len(data), c.maxSize)
+	var hash uint64
+	for i := c.minSize; i < end; i++ {
+		hash = hash<<1 + gearTable[data[i]]
+		if hash&c.mask == 0 {
+			return i + 1
+		}
+	}
+	return end
+}
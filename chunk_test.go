@@ -0,0 +1,72 @@
+package snapdir
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+// randomData returns n pseudo-random bytes that are the same on every run
+func randomData(n int, seed int64) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func TestChunkerSplit(t *testing.T) {
+	c := newChunker(1<<10, 12, 16<<10)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "empty", data: nil},
+		{name: "below minimum", data: randomData(500, 1)},
+		{name: "random", data: randomData(1<<20, 2)},
+		{name: "zeros", data: make([]byte, 100<<10)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chunks := c.Split(tt.data)
+			if got := bytes.Join(chunks, nil); !bytes.Equal(got, tt.data) {
+				t.Fatal("chunks do not add up to the input")
+			}
+			for i, chunk := range chunks {
+				if len(chunk) > c.maxSize {
+					t.Errorf("chunk %d has %d bytes, more than the maximum %d", i, len(chunk), c.maxSize)
+				}
+				if len(chunk) < c.minSize && i != len(chunks)-1 {
+					t.Errorf("chunk %d has %d bytes, less than the minimum %d", i, len(chunk), c.minSize)
+				}
+			}
+		})
+	}
+}
+
+func TestChunkerIsContentDefined(t *testing.T) {
+	c := newChunker(1<<10, 12, 16<<10)
+	original := randomData(1<<20, 3)
+
+	// Insert a byte in the middle; only the chunks around it should change
+	changed := make([]byte, 0, len(original)+1)
+	changed = append(changed, original[:len(original)/2]...)
+	changed = append(changed, 0x42)
+	changed = append(changed, original[len(original)/2:]...)
+
+	known := make(map[string]bool)
+	for _, chunk := range c.Split(original) {
+		known[HashContents(chunk)] = true
+	}
+
+	chunks := c.Split(changed)
+	newChunks := 0
+	for _, chunk := range chunks {
+		if !known[HashContents(chunk)] {
+			newChunks++
+		}
+	}
+	if newChunks > 2 {
+		t.Errorf("%d of %d chunks changed after inserting one byte, want at most 2", newChunks, len(chunks))
+	}
+}
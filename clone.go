@@ -0,0 +1,431 @@
+package snapdir
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// shouldIgnore checks if a path should be ignored based on patterns
+func shouldIgnore(p string, patterns []string, logger *slog.Logger) bool {
+	for _, pattern := range patterns {
+		matched, err := path.Match(pattern, path.Base(p))
+		if err != nil {
+			logger.Warn("invalid ignore pattern", "pattern", pattern, "error", err)
+			continue
+		}
+		if matched {
+			return true
+		}
+
+		// Check if path contains pattern as a directory component
+		if strings.Contains(p, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadGitignore loads .gitignore patterns from the root of fsys
+func loadGitignore(fsys fs.FS, logger *slog.Logger) []string {
+	patterns := []string{".git"}
+
+	file, err := fsys.Open(".gitignore")
+	if err != nil {
+		logger.Debug("no .gitignore found, using default patterns")
+		return patterns
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+
+	if err := scanner.Err(); err != nil {
+		logger.Warn("error reading .gitignore", "error", err)
+	}
+
+	return patterns
+}
+
+// Clone snapshots the directory src and writes the snapshot as JSON to w,
+// compressed if opts.Compression is set and encrypted if opts.Recipients
+// is set. Entries are written as soon as they have been read, so memory use
+// does not grow with the size of the tree. If Clone fails, w may hold a
+// partial snapshot. With SecretsFail every file is scanned before the
+// first byte is written, reading the files twice, so a partial snapshot
+// never contains a secret that made Clone fail.
+func Clone(ctx context.Context, src string, w io.Writer, opts Options) error {
+	if src == "" {
+		return fmt.Errorf("source path cannot be empty")
+	}
+
+	sourceInfo, err := os.Stat(src)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("source does not exist: %s", src)
+		}
+		return fmt.Errorf("failed to stat source: %w", err)
+	}
+
+	if !sourceInfo.IsDir() {
+		return fmt.Errorf("source must be a directory: %s", src)
+	}
+
+	opts, err = opts.withGitFiles(ctx, src)
+	if err != nil {
+		return err
+	}
+
+	opts.logger().Debug("starting snapshot", "source", src)
+	return cloneTo(ctx, dirFS(src), w, opts)
+}
+
+// cloneTo snapshots fsys and writes the snapshot to w, compressing and
+// encrypting it as opts say
+func cloneTo(ctx context.Context, fsys fs.FS, w io.Writer, opts Options) error {
+	entries, err := collectEntries(ctx, fsys, opts)
+	if err != nil {
+		return err
+	}
+
+	if opts.Secrets == SecretsFail {
+		if err := scanEntries(ctx, fsys, entries, opts); err != nil {
+			return err
+		}
+	}
+
+	ew, err := EncodeWriter(w, opts.Compression, opts.Recipients...)
+	if err != nil {
+		return err
+	}
+
+	secrets := newSecretScanner(opts)
+	sw := newSnapshotWriter(ew)
+	if err := sw.Begin(opts.snapshotHeader()); err != nil {
+		return err
+	}
+	err = readFiles(ctx, fsys, entries, opts, nil, func(entry FileInfo) error {
+		secrets.scan(&entry)
+		return sw.Write(entry)
+	})
+	if err != nil {
+		return err
+	}
+	if err := secrets.finish(); err != nil {
+		return err
+	}
+	if err := sw.End(); err != nil {
+		return err
+	}
+	return ew.Close()
+}
+
+// scanEntries reads the file entries collected by collectEntries and scans
+// them for secrets without writing anything. Findings are logged, but
+// progress and debug messages are left to the pass that writes the
+// snapshot.
+func scanEntries(ctx context.Context, fsys fs.FS, entries []FileInfo, opts Options) error {
+	secrets := newSecretScanner(opts)
+	opts.Progress = nil
+	opts.Logger = nil
+	err := readFiles(ctx, fsys, entries, opts, nil, func(entry FileInfo) error {
+		secrets.scan(&entry)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return secrets.finish()
+}
+
+// CloneFS creates a snapshot of fsys. It applies the same ignore rules and
+// size limit as Clone, so snapshots can be taken of embedded assets,
+// in-memory test trees, zip archives or other snapshots. With
+// opts.Symlinks, symlinks are recorded as links if fsys has a ReadLink
+// method, like *FS; they are followed otherwise.
+func CloneFS(ctx context.Context, fsys fs.FS, opts Options) (ProjectSnapshot, error) {
+	entries, err := collectEntries(ctx, fsys, opts)
+	if err != nil {
+		return ProjectSnapshot{}, err
+	}
+
+	secrets := newSecretScanner(opts)
+	snapshot := opts.snapshotHeader()
+	snapshot.Files = make([]FileInfo, 0, len(entries))
+	err = readFiles(ctx, fsys, entries, opts, nil, func(entry FileInfo) error {
+		secrets.scan(&entry)
+		snapshot.Files = append(snapshot.Files, entry)
+		return nil
+	})
+	if err != nil {
+		return ProjectSnapshot{}, err
+	}
+	if err := secrets.finish(); err != nil {
+		return ProjectSnapshot{}, err
+	}
+
+	return snapshot, nil
+}
+
+// readFiles reads and hashes the file entries collected by collectEntries
+// using opts.Jobs workers and passes every entry to emit in its original
+// order. Entries for which skip returns true are passed on without being
+// read; skip may be nil. Workers read at most a few files ahead of emit,
+// which keeps memory bounded when emit is slower than reading. The first
+// error in entry order is returned and stops all workers.
+func readFiles(ctx context.Context, fsys fs.FS, entries []FileInfo, opts Options, skip func(FileInfo) bool, emit func(FileInfo) error) error {
+	logger := opts.logger()
+	jobs := opts.jobs()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// needsRead reports whether entry i is handed to a worker
+	needsRead := make([]bool, len(entries))
+	var progress Progress
+	for i, entry := range entries {
+		if !entry.hasData() {
+			continue
+		}
+		needsRead[i] = skip == nil || !skip(entry)
+		progress.FilesTotal++
+		progress.BytesTotal += entry.Size
+	}
+	opts.reportProgress(progress)
+
+	type result struct {
+		entry FileInfo
+		err   error
+	}
+	// window holds one token for every entry that is being read or waiting
+	// to be emitted; the feeder blocks once it is full. Entry i delivers its
+	// result in slot i % len(ring), which the entry before it in that slot
+	// has left by the time i gets a token.
+	window := make(chan struct{}, 2*jobs)
+	ring := make([]chan result, cap(window))
+	for i := range ring {
+		ring[i] = make(chan result, 1)
+	}
+	work := make(chan int)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(work)
+		for i := range entries {
+			select {
+			case window <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			if !needsRead[i] {
+				ring[i%len(ring)] <- result{entry: entries[i]}
+				continue
+			}
+			select {
+			case work <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for n := 0; n < jobs; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				entry := entries[i]
+				err := ctx.Err()
+				if err == nil {
+					err = readEntry(fsys, &entry, opts.StatCache)
+				}
+				ring[i%len(ring)] <- result{entry: entry, err: err}
+			}
+		}()
+	}
+
+	err := func() error {
+		for i := range entries {
+			var res result
+			select {
+			case res = <-ring[i%len(ring)]:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			if res.err != nil {
+				return res.err
+			}
+
+			if err := emit(res.entry); err != nil {
+				return err
+			}
+			logger.Debug("added", "path", res.entry.Path)
+
+			<-window
+			if res.entry.hasData() {
+				progress.FilesDone++
+				progress.BytesDone += res.entry.Size
+				opts.reportProgress(progress)
+			}
+		}
+		return nil
+	}()
+
+	cancel()
+	wg.Wait()
+
+	if err != nil {
+		return err
+	}
+
+	logger.Debug("snapshot complete", "files", progress.FilesDone, "entries", len(entries))
+	return nil
+}
+
+// readEntry reads the contents of a file entry and records its size and
+// hash. A hash already taken from the stat cache is kept unless the file
+// turns out to have a different size than when it was listed.
+func readEntry(fsys fs.FS, entry *FileInfo, cache *StatCache) error {
+	data, err := fs.ReadFile(fsys, entry.Path)
+	if err != nil {
+		return fmt.Errorf("failed to read file %s: %w", entry.Path, err)
+	}
+	if entry.SHA256 == "" || int64(len(data)) != entry.Size {
+		entry.SHA256 = HashContents(data)
+		if cache != nil {
+			cache.setHash(entry.Path, entry.SHA256)
+		}
+	}
+	entry.SetData(data)
+	entry.Size = int64(len(data))
+	return nil
+}
+
+// collectEntries walks fsys and returns the entries that belong in a
+// snapshot, applying ignore patterns and the size limit. File entries carry
+// their size as reported by the file system but no contents yet. With a
+// parent snapshot, only the differences to the parent are returned.
+func collectEntries(ctx context.Context, fsys fs.FS, opts Options) ([]FileInfo, error) {
+	logger := opts.logger()
+	maxFileSize := opts.maxFileSize()
+
+	// Sources holding only tracked files have neither .git nor anything
+	// .gitignore would exclude
+	var patterns []string
+	if !opts.tracked {
+		patterns = loadGitignore(fsys, logger)
+	}
+	if len(opts.Ignore) > 0 {
+		patterns = append(patterns, opts.Ignore...)
+	}
+	logger.Debug("using ignore patterns", "patterns", patterns)
+
+	entries := make([]FileInfo, 0)
+	err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return fmt.Errorf("error accessing %s: %w", p, err)
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if p == "." {
+			return nil
+		}
+
+		if opts.gitFiles != nil && !opts.gitFiles.includes(p, d.IsDir(), logger) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		if shouldIgnore(p, patterns, logger) {
+			logger.Debug("ignoring", "path", p)
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return fmt.Errorf("failed to get file info for %s: %w", p, err)
+		}
+
+		lfs, readLinks := fsys.(readLinkFS)
+		readLinks = readLinks && opts.Symlinks
+		if info.Mode()&fs.ModeSymlink != 0 && !readLinks {
+			// A followed symlink is stored as the file it points to, so its
+			// size, mode, times and stat cache entry are those of the target
+			if info, err = fs.Stat(fsys, p); err != nil {
+				return fmt.Errorf("failed to follow symlink %s: %w", p, err)
+			}
+		}
+
+		fileInfo := FileInfo{
+			Path:  p,
+			IsDir: d.IsDir(),
+			Mode:  uint32(info.Mode().Perm()),
+		}
+		if modTime := opts.normalizeModTime(info.ModTime()); !modTime.IsZero() {
+			fileInfo.ModTime = FormatModTime(modTime)
+		}
+		if opts.PreserveOwner {
+			fileInfo.Owner = fileOwner(info)
+		}
+
+		if readLinks && info.Mode()&fs.ModeSymlink != 0 {
+			if fileInfo.Link, err = lfs.ReadLink(p); err != nil {
+				return fmt.Errorf("failed to read symlink %s: %w", p, err)
+			}
+		} else if !d.IsDir() {
+			if info.Size() > maxFileSize {
+				logger.Debug("skipping large file", "path", p, "size", info.Size())
+				return nil
+			}
+			fileInfo.Size = info.Size()
+			if opts.StatCache != nil {
+				fileInfo.SHA256 = opts.StatCache.lookup(p, info)
+			}
+		}
+
+		entries = append(entries, fileInfo)
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Reproducible {
+		// Walk order puts "a/b" before "a.b"; a plain byte order sort does
+		// not depend on how the file system lists directories
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].Path < entries[j].Path
+		})
+	}
+
+	if opts.Parent != nil {
+		entries = diffParent(entries, opts.Parent.Snapshot)
+	}
+
+	return entries, nil
+}
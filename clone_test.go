@@ -0,0 +1,681 @@
+package snapdir
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestShouldIgnore(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		patterns []string
+		want     bool
+	}{
+		{
+			name:     "matches exact filename",
+			path:     "test.log",
+			patterns: []string{"*.log"},
+			want:     true,
+		},
+		{
+			name:     "matches directory name",
+			path:     "node_modules/package",
+			patterns: []string{"node_modules"},
+			want:     true,
+		},
+		{
+			name:     "no match",
+			path:     "src/main.go",
+			patterns: []string{"*.log", "node_modules"},
+			want:     false,
+		},
+		{
+			name:     "matches nested directory",
+			path:     "src/.git/config",
+			patterns: []string{".git"},
+			want:     true,
+		},
+		{
+			name:     "empty patterns",
+			path:     "any/path",
+			patterns: []string{},
+			want:     false,
+		},
+		{
+			name:     "matches wildcard pattern",
+			path:     "test.tmp",
+			patterns: []string{"*.tmp", "*.log"},
+			want:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := shouldIgnore(tt.path, tt.patterns, Options{}.logger()); got != tt.want {
+				t.Errorf("shouldIgnore() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadGitignore(t *testing.T) {
+	tests := []struct {
+		name             string
+		gitignoreContent string
+		wantPatterns     []string
+	}{
+		{
+			name: "basic gitignore",
+			gitignoreContent: `# Comment
+node_modules
+*.log
+.env`,
+			wantPatterns: []string{".git", "node_modules", "*.log", ".env"},
+		},
+		{
+			name: "empty lines and comments",
+			gitignoreContent: `
+# Comment
+
+dist
+
+# Another comment
+build
+`,
+			wantPatterns: []string{".git", "dist", "build"},
+		},
+		{
+			name:             "empty gitignore",
+			gitignoreContent: "",
+			wantPatterns:     []string{".git"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Create temp directory
+			tmpDir := t.TempDir()
+
+			// Write .gitignore file
+			gitignorePath := filepath.Join(tmpDir, ".gitignore")
+			if err := os.WriteFile(gitignorePath, []byte(tt.gitignoreContent), 0644); err != nil {
+				t.Fatalf("failed to write .gitignore: %v", err)
+			}
+
+			got := loadGitignore(os.DirFS(tmpDir), Options{}.logger())
+
+			if len(got) != len(tt.wantPatterns) {
+				t.Errorf("loadGitignore() returned %d patterns, want %d", len(got), len(tt.wantPatterns))
+			}
+
+			for i, pattern := range tt.wantPatterns {
+				if i >= len(got) || got[i] != pattern {
+					t.Errorf("pattern[%d] = %v, want %v", i, got[i], pattern)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadGitignoreNotFound(t *testing.T) {
+	tmpDir := t.TempDir()
+	patterns := loadGitignore(os.DirFS(tmpDir), Options{}.logger())
+
+	// Should return default patterns even if .gitignore doesn't exist
+	if len(patterns) != 1 || patterns[0] != ".git" {
+		t.Errorf("expected default patterns [.git], got %v", patterns)
+	}
+}
+
+func TestCloneFSMaxFileSize(t *testing.T) {
+	fsys := fstest.MapFS{
+		"small.txt": {Data: make([]byte, 16)},
+		"big.dat":   {Data: make([]byte, 64)},
+	}
+	tests := []struct {
+		maxFileSize int64
+		want        string
+	}{
+		{maxFileSize: 0, want: "big.dat small.txt"},
+		{maxFileSize: 32, want: "small.txt"},
+		{maxFileSize: -1, want: "big.dat small.txt"},
+	}
+	for _, tt := range tests {
+		snapshot, err := CloneFS(context.Background(), fsys, Options{MaxFileSize: tt.maxFileSize})
+		if err != nil {
+			t.Fatalf("CloneFS() error = %v", err)
+		}
+		var paths []string
+		for _, file := range snapshot.Files {
+			paths = append(paths, file.Path)
+		}
+		if got := strings.Join(paths, " "); got != tt.want {
+			t.Errorf("CloneFS() with MaxFileSize %d = %q, want %q", tt.maxFileSize, got, tt.want)
+		}
+	}
+}
+
+func TestCloneFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		".gitignore":          {Data: []byte("*.log\n")},
+		"main.go":             {Data: []byte("package main"), Mode: 0644, ModTime: time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)},
+		"debug.log":           {Data: []byte("log")},
+		"assets/logo.bin":     {Data: []byte{0x00, 0xff}, Mode: 0600},
+		"assets/big.dat":      {Data: make([]byte, 64)},
+		"tmp/scratch.txt":     {Data: []byte("scratch")},
+		"docs/guide/intro.md": {Data: []byte("intro")},
+	}
+
+	snapshot, err := CloneFS(context.Background(), fsys, Options{Ignore: []string{"tmp"}, MaxFileSize: 32})
+	if err != nil {
+		t.Fatalf("CloneFS() error = %v", err)
+	}
+
+	if snapshot.Version != Version {
+		t.Errorf("snapshot version = %v, want %v", snapshot.Version, Version)
+	}
+
+	var paths []string
+	files := make(map[string]FileInfo)
+	for _, file := range snapshot.Files {
+		paths = append(paths, file.Path)
+		files[file.Path] = file
+	}
+	// .gitignore itself is caught by the default .git pattern
+	want := "assets assets/logo.bin docs docs/guide docs/guide/intro.md main.go"
+	if got := strings.Join(paths, " "); got != want {
+		t.Errorf("snapshot paths = %q, want %q", got, want)
+	}
+
+	logo := files["assets/logo.bin"]
+	data, err := logo.Data()
+	if err != nil {
+		t.Fatalf("Data() error = %v", err)
+	}
+	if string(data) != "\x00\xff" || logo.Mode != 0600 || logo.Size != 2 {
+		t.Errorf("assets/logo.bin = %+v", logo)
+	}
+	if logo.SHA256 != HashContents(data) {
+		t.Errorf("assets/logo.bin hash = %s", logo.SHA256)
+	}
+
+	if got := files["main.go"].ModTime; got != "2024-05-01T00:00:00Z" {
+		t.Errorf("main.go mtime = %q", got)
+	}
+	if got := files["docs/guide/intro.md"].ModTime; got != "" {
+		t.Errorf("entries without a modification time should omit it, got %q", got)
+	}
+}
+
+func TestCloneFSFromSnapshot(t *testing.T) {
+	original := testFSSnapshot()
+	fsys, err := NewFS(original)
+	if err != nil {
+		t.Fatalf("NewFS() error = %v", err)
+	}
+
+	snapshot, err := CloneFS(context.Background(), fsys, Options{})
+	if err != nil {
+		t.Fatalf("CloneFS() error = %v", err)
+	}
+
+	roundTrip, err := NewFS(snapshot)
+	if err != nil {
+		t.Fatalf("NewFS() error = %v", err)
+	}
+	for _, file := range original.Files {
+		if file.IsDir {
+			continue
+		}
+		want, _ := file.Data()
+		got, err := roundTrip.ReadFile(file.Path)
+		if err != nil {
+			t.Errorf("ReadFile(%s) error = %v", file.Path, err)
+			continue
+		}
+		if string(got) != string(want) {
+			t.Errorf("ReadFile(%s) = %q, want %q", file.Path, got, want)
+		}
+	}
+}
+
+func TestCloneFSWalkError(t *testing.T) {
+	if _, err := CloneFS(context.Background(), os.DirFS("/nonexistent/path"), Options{}); err == nil {
+		t.Error("CloneFS() should fail for a missing root")
+	}
+}
+
+func TestClone(t *testing.T) {
+	src := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(src, "dir"), 0755); err != nil {
+		t.Fatalf("failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "dir", "file.txt"), []byte("content"), 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	var out bytes.Buffer
+	if err := Clone(context.Background(), src, &out, Options{Logger: logger}); err != nil {
+		t.Fatalf("Clone() error = %v", err)
+	}
+
+	var snapshot ProjectSnapshot
+	if err := json.Unmarshal(out.Bytes(), &snapshot); err != nil {
+		t.Fatalf("Clone() wrote invalid JSON: %v", err)
+	}
+	if len(snapshot.Files) != 2 || snapshot.Files[1].Path != "dir/file.txt" || snapshot.Files[1].Contents != "content" {
+		t.Errorf("Clone() snapshot = %+v", snapshot.Files)
+	}
+
+	if !strings.Contains(logs.String(), "path=dir/file.txt") {
+		t.Errorf("injected logger did not receive progress messages:\n%s", logs.String())
+	}
+}
+
+func TestCloneInvalidSource(t *testing.T) {
+	tmpFile := filepath.Join(t.TempDir(), "file.txt")
+	if err := os.WriteFile(tmpFile, []byte("content"), 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		src  string
+	}{
+		{name: "empty source", src: ""},
+		{name: "missing source", src: "/nonexistent/path"},
+		{name: "file as source", src: tmpFile},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			if err := Clone(context.Background(), tt.src, &out, Options{}); err == nil {
+				t.Error("Clone() should fail")
+			}
+			if out.Len() != 0 {
+				t.Errorf("Clone() wrote output on failure: %q", out.String())
+			}
+		})
+	}
+}
+
+func TestCloneConcurrentOptions(t *testing.T) {
+	fsys := fstest.MapFS{
+		"keep.txt": {Data: []byte("keep")},
+		"a.tmp":    {Data: []byte("a")},
+		"b.bak":    {Data: []byte("b")},
+	}
+
+	// Options are per call, so concurrent clones with different ignore
+	// patterns must not influence each other
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		ignore := "*.tmp"
+		want := "b.bak keep.txt"
+		if i%2 == 1 {
+			ignore, want = "*.bak", "a.tmp keep.txt"
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			snapshot, err := CloneFS(context.Background(), fsys, Options{Ignore: []string{ignore}})
+			if err != nil {
+				t.Errorf("CloneFS() error = %v", err)
+				return
+			}
+			var paths []string
+			for _, file := range snapshot.Files {
+				paths = append(paths, file.Path)
+			}
+			if got := strings.Join(paths, " "); got != want {
+				t.Errorf("CloneFS() with ignore %q = %q, want %q", ignore, got, want)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestCloneFSCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	fsys := fstest.MapFS{"file.txt": {Data: []byte("content")}}
+	if _, err := CloneFS(ctx, fsys, Options{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("CloneFS() error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestCloneFSProgress(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a.txt":     {Data: []byte("aaaa")},
+		"dir/b.txt": {Data: []byte("bb")},
+	}
+
+	var updates []Progress
+	_, err := CloneFS(context.Background(), fsys, Options{
+		Progress: func(p Progress) { updates = append(updates, p) },
+	})
+	if err != nil {
+		t.Fatalf("CloneFS() error = %v", err)
+	}
+
+	want := []Progress{
+		{FilesDone: 0, FilesTotal: 2, BytesDone: 0, BytesTotal: 6},
+		{FilesDone: 1, FilesTotal: 2, BytesDone: 4, BytesTotal: 6},
+		{FilesDone: 2, FilesTotal: 2, BytesDone: 6, BytesTotal: 6},
+	}
+	if len(updates) != len(want) {
+		t.Fatalf("got %d progress updates, want %d: %+v", len(updates), len(want), updates)
+	}
+	for i := range want {
+		if updates[i] != want[i] {
+			t.Errorf("update %d = %+v, want %+v", i, updates[i], want[i])
+		}
+	}
+}
+
+// countingFS counts how many files have been opened
+type countingFS struct {
+	fs.FS
+	opened atomic.Int64
+}
+
+func (c *countingFS) Open(name string) (fs.File, error) {
+	if name != "." && name != ".gitignore" && path.Ext(name) == ".txt" {
+		c.opened.Add(1)
+	}
+	return c.FS.Open(name)
+}
+
+// followFS follows the symlinks of a MapFS when files are opened, as
+// os.DirFS does, while directory listings still report them as symlinks
+type followFS struct {
+	fstest.MapFS
+}
+
+func (f followFS) Open(name string) (fs.File, error) {
+	if file, ok := f.MapFS[name]; ok && file.Mode&fs.ModeSymlink != 0 {
+		name = path.Join(path.Dir(name), string(file.Data))
+	}
+	return f.MapFS.Open(name)
+}
+
+// linkFS returns a tree with target.txt, last modified at modTime, and
+// link.txt, a symlink to it that never changes
+func linkFS(contents string, modTime time.Time) fs.FS {
+	return followFS{fstest.MapFS{
+		"target.txt": {Data: []byte(contents), Mode: 0644, ModTime: modTime},
+		"link.txt":   {Data: []byte("target.txt"), Mode: fs.ModeSymlink | 0777, ModTime: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}}
+}
+
+func manyFilesFS(n int) fstest.MapFS {
+	fsys := fstest.MapFS{}
+	for i := 0; i < n; i++ {
+		fsys[fmt.Sprintf("dir%d/file%03d.txt", i%3, i)] = &fstest.MapFile{Data: []byte(fmt.Sprintf("content %d", i))}
+	}
+	return fsys
+}
+
+func TestCloneFSParallelIsDeterministic(t *testing.T) {
+	fsys := manyFilesFS(200)
+
+	sequential, err := CloneFS(context.Background(), fsys, Options{Jobs: 1})
+	if err != nil {
+		t.Fatalf("CloneFS() error = %v", err)
+	}
+
+	for _, jobs := range []int{2, 8, 32} {
+		parallel, err := CloneFS(context.Background(), fsys, Options{Jobs: jobs})
+		if err != nil {
+			t.Fatalf("CloneFS(jobs=%d) error = %v", jobs, err)
+		}
+		if !reflect.DeepEqual(parallel, sequential) {
+			t.Errorf("CloneFS(jobs=%d) differs from sequential clone", jobs)
+		}
+	}
+}
+
+func TestReadFilesBackpressure(t *testing.T) {
+	const jobs = 4
+	fsys := &countingFS{FS: manyFilesFS(100)}
+
+	entries, err := collectEntries(context.Background(), fsys, Options{})
+	if err != nil {
+		t.Fatalf("collectEntries() error = %v", err)
+	}
+
+	emitted := int64(0)
+	maxAhead := int64(0)
+	err = readFiles(context.Background(), fsys, entries, Options{Jobs: jobs}, nil, func(entry FileInfo) error {
+		// A slow consumer gives the workers every chance to run ahead
+		time.Sleep(time.Millisecond)
+		if !entry.IsDir {
+			emitted++
+		}
+		if ahead := fsys.opened.Load() - emitted; ahead > maxAhead {
+			maxAhead = ahead
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("readFiles() error = %v", err)
+	}
+
+	if maxAhead > 2*jobs {
+		t.Errorf("workers read %d files ahead of the consumer, want at most %d", maxAhead, 2*jobs)
+	}
+}
+
+func TestReadFilesOrderWithSkippedEntries(t *testing.T) {
+	fsys := manyFilesFS(100)
+
+	entries, err := collectEntries(context.Background(), fsys, Options{})
+	if err != nil {
+		t.Fatalf("collectEntries() error = %v", err)
+	}
+
+	// Skipped entries share the result slots with read ones, so mixing them
+	// must still emit every entry once and in order
+	skip := func(entry FileInfo) bool { return strings.HasSuffix(entry.Path, "0.txt") }
+	for _, jobs := range []int{1, 3, 16} {
+		var paths []string
+		err := readFiles(context.Background(), fsys, entries, Options{Jobs: jobs}, skip, func(entry FileInfo) error {
+			paths = append(paths, entry.Path)
+			if !entry.IsDir && !skip(entry) && entry.SHA256 == "" {
+				t.Errorf("jobs=%d: %s was not read", jobs, entry.Path)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("readFiles(jobs=%d) error = %v", jobs, err)
+		}
+		if len(paths) != len(entries) {
+			t.Fatalf("readFiles(jobs=%d) emitted %d entries, want %d", jobs, len(paths), len(entries))
+		}
+		for i, entry := range entries {
+			if paths[i] != entry.Path {
+				t.Fatalf("readFiles(jobs=%d) emitted %s at %d, want %s", jobs, paths[i], i, entry.Path)
+			}
+		}
+	}
+}
+
+func TestReadFilesReportsFirstError(t *testing.T) {
+	fsys := manyFilesFS(50)
+
+	entries, err := collectEntries(context.Background(), fsys, Options{})
+	if err != nil {
+		t.Fatalf("collectEntries() error = %v", err)
+	}
+
+	// Remove two files after the walk so that reading them fails; the error
+	// for the one earlier in entry order must win
+	var missing []string
+	for _, entry := range entries {
+		if !entry.IsDir && len(missing) < 2 {
+			missing = append(missing, entry.Path)
+		}
+	}
+	for _, p := range missing {
+		delete(fsys, p)
+	}
+
+	for i := 0; i < 10; i++ {
+		err = readFiles(context.Background(), fsys, entries, Options{Jobs: 8}, nil, func(FileInfo) error { return nil })
+		if err == nil || !strings.Contains(err.Error(), missing[0]) {
+			t.Fatalf("readFiles() error = %v, want error for %s", err, missing[0])
+		}
+	}
+}
+
+func TestCloneMatchesCloneFS(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+	}{
+		{name: "empty directory", files: map[string]string{}},
+		{name: "nested files", files: map[string]string{
+			"a.txt":         "a",
+			"dir/b.txt":     "<b & c>",
+			"dir/sub/c.txt": "line1\nline2\n",
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := t.TempDir()
+			for p, content := range tt.files {
+				full := filepath.Join(src, filepath.FromSlash(p))
+				if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+					t.Fatalf("failed to create directory: %v", err)
+				}
+				if err := os.WriteFile(full, []byte(content), 0644); err != nil {
+					t.Fatalf("failed to write file: %v", err)
+				}
+			}
+
+			var streamed bytes.Buffer
+			if err := Clone(context.Background(), src, &streamed, Options{Jobs: 4}); err != nil {
+				t.Fatalf("Clone() error = %v", err)
+			}
+
+			snapshot, err := CloneFS(context.Background(), os.DirFS(src), Options{})
+			if err != nil {
+				t.Fatalf("CloneFS() error = %v", err)
+			}
+			want, err := json.MarshalIndent(snapshot, "", "  ")
+			if err != nil {
+				t.Fatalf("failed to marshal snapshot: %v", err)
+			}
+
+			if streamed.String() != string(want) {
+				t.Errorf("Clone() output:\n%s\nwant:\n%s", streamed.String(), want)
+			}
+		})
+	}
+}
+
+func TestCloneReproducible(t *testing.T) {
+	files := map[string]string{
+		"a.b":       "dot",
+		"a/b":       "slash",
+		"z.txt":     "z",
+		"dir/x.txt": "x",
+	}
+
+	makeTree := func(modTime time.Time) string {
+		src := t.TempDir()
+		for p, content := range files {
+			full := filepath.Join(src, filepath.FromSlash(p))
+			if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+				t.Fatalf("failed to create directory: %v", err)
+			}
+			if err := os.WriteFile(full, []byte(content), 0644); err != nil {
+				t.Fatalf("failed to write file: %v", err)
+			}
+		}
+		// Directories as well as files get the same time
+		err := filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+			if err != nil || p == src {
+				return err
+			}
+			return os.Chtimes(p, modTime, modTime)
+		})
+		if err != nil {
+			t.Fatalf("failed to set times: %v", err)
+		}
+		return src
+	}
+
+	first := makeTree(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	second := makeTree(time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC))
+
+	clone := func(src string, opts Options) string {
+		var out bytes.Buffer
+		if err := Clone(context.Background(), src, &out, opts); err != nil {
+			t.Fatalf("Clone() error = %v", err)
+		}
+		return out.String()
+	}
+
+	t.Run("identical output for identical trees", func(t *testing.T) {
+		opts := Options{Reproducible: true, Jobs: 4}
+		a, b := clone(first, opts), clone(second, opts)
+		if a != b {
+			t.Errorf("reproducible snapshots differ:\n%s\n%s", a, b)
+		}
+		if strings.Contains(a, `"mtime"`) {
+			t.Errorf("reproducible snapshot without SOURCE_DATE_EPOCH contains mtimes:\n%s", a)
+		}
+	})
+
+	t.Run("canonical order", func(t *testing.T) {
+		snapshot, err := CloneFS(context.Background(), os.DirFS(first), Options{Reproducible: true})
+		if err != nil {
+			t.Fatalf("CloneFS() error = %v", err)
+		}
+		var paths []string
+		for _, file := range snapshot.Files {
+			paths = append(paths, file.Path)
+		}
+		want := "a a.b a/b dir dir/x.txt z.txt"
+		if got := strings.Join(paths, " "); got != want {
+			t.Errorf("paths = %q, want %q", got, want)
+		}
+	})
+
+	t.Run("source date epoch clamps times", func(t *testing.T) {
+		epoch := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+		opts := Options{Reproducible: true, SourceDateEpoch: epoch}
+
+		a, b := clone(first, opts), clone(second, opts)
+		if !strings.Contains(a, `"mtime": "2020-01-01T00:00:00Z"`) {
+			t.Errorf("times before SOURCE_DATE_EPOCH should be kept:\n%s", a)
+		}
+		if !strings.Contains(b, `"mtime": "2022-01-01T00:00:00Z"`) || strings.Contains(b, "2024-06-01") {
+			t.Errorf("times after SOURCE_DATE_EPOCH should be clamped:\n%s", b)
+		}
+	})
+}
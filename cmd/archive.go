@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/supperdoggy/snapdir"
+)
+
+// zipMagic starts every zip archive, including empty ones, which consist of
+// the end of central directory record alone
+var zipMagic = [][]byte{[]byte("PK\x03\x04"), []byte("PK\x05\x06")}
+
+// exportArchive writes a snapshot as a tar, gzip-compressed tar or zip
+// archive, chosen by the extension of outputFile. A tar archive is written
+// to standard output for "-".
+func exportArchive(configFile, outputFile string, opts snapdir.Options) error {
+	if err := validateInput(configFile); err != nil {
+		return fmt.Errorf("invalid config file: %w", err)
+	}
+
+	var export func(io.Writer, snapdir.ProjectSnapshot) error
+	name := strings.ToLower(outputFile)
+	switch {
+	case outputFile == stdioName:
+		export = snapdir.ExportTar
+	case strings.HasSuffix(name, ".zip"):
+		export = snapdir.ExportZip
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		export = func(w io.Writer, snapshot snapdir.ProjectSnapshot) error {
+			gz := gzip.NewWriter(w)
+			if err := snapdir.ExportTar(gz, snapshot); err != nil {
+				return err
+			}
+			return gz.Close()
+		}
+	case strings.HasSuffix(name, ".tar"):
+		export = snapdir.ExportTar
+	default:
+		return fmt.Errorf("unknown archive format for %s (want .tar, .tar.gz, .tgz or .zip)", outputFile)
+	}
+
+	snapshot, err := openSnapshot(configFile, opts)
+	if err != nil {
+		return err
+	}
+
+	return writeOutputFile(outputFile, func(w io.Writer) error {
+		return export(w, snapshot)
+	})
+}
+
+// importArchive reads a tar, gzip-compressed tar or zip archive, detected
+// from its contents, and writes it as a snapshot file, compressed and
+// encrypted as opts say. "-" reads the archive from standard input.
+func importArchive(ctx context.Context, archiveFile, outputFile string, opts snapdir.Options) error {
+	var (
+		snapshot snapdir.ProjectSnapshot
+		err      error
+	)
+	if archiveFile == stdioName {
+		snapshot, err = importStream(ctx, stdin, opts)
+	} else {
+		snapshot, err = importFile(ctx, archiveFile, opts)
+	}
+	if err != nil {
+		return err
+	}
+
+	return writeOutputFile(outputFile, func(w io.Writer) error {
+		return writeSnapshot(w, snapshot, opts)
+	})
+}
+
+// importFile imports the archive file archiveFile
+func importFile(ctx context.Context, archiveFile string, opts snapdir.Options) (snapdir.ProjectSnapshot, error) {
+	if err := validatePath(archiveFile, true); err != nil {
+		return snapdir.ProjectSnapshot{}, fmt.Errorf("invalid archive: %w", err)
+	}
+
+	f, err := os.Open(archiveFile)
+	if err != nil {
+		return snapdir.ProjectSnapshot{}, fmt.Errorf("failed to open archive: %w", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return snapdir.ProjectSnapshot{}, fmt.Errorf("failed to open archive: %w", err)
+	}
+	magic := make([]byte, 4)
+	n, _ := io.ReadFull(f, magic)
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return snapdir.ProjectSnapshot{}, fmt.Errorf("failed to read archive: %w", err)
+	}
+
+	if isZip(magic[:n]) {
+		return snapdir.ImportZip(ctx, f, info.Size(), opts)
+	}
+	return snapdir.ImportTar(ctx, f, opts)
+}
+
+// importStream imports an archive from r. Zip archives need random access,
+// so they are read into memory first.
+func importStream(ctx context.Context, r io.Reader, opts snapdir.Options) (snapdir.ProjectSnapshot, error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(4); !isZip(magic) {
+		return snapdir.ImportTar(ctx, br, opts)
+	}
+
+	data, err := io.ReadAll(br)
+	if err != nil {
+		return snapdir.ProjectSnapshot{}, fmt.Errorf("failed to read archive: %w", err)
+	}
+	return snapdir.ImportZip(ctx, bytes.NewReader(data), int64(len(data)), opts)
+}
+
+// isZip reports whether data starts like a zip archive
+func isZip(data []byte) bool {
+	for _, magic := range zipMagic {
+		if bytes.HasPrefix(data, magic) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/supperdoggy/snapdir"
+)
+
+func TestExportImportArchive(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "src")
+	if err := os.MkdirAll(filepath.Join(source, "bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(source, "bin", "run.sh"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(source, "notes.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	snapshotFile := filepath.Join(dir, "snapshot.json")
+	if err := cloneProject(ctx, source, snapshotFile, snapdir.Options{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := exportArchive(snapshotFile, filepath.Join(dir, "out.rar"), snapdir.Options{}); err == nil {
+		t.Error("exportArchive() should reject unknown formats")
+	}
+
+	for _, name := range []string{"out.tar", "out.tar.gz", "out.tgz", "out.zip"} {
+		t.Run(name, func(t *testing.T) {
+			archive := filepath.Join(dir, name)
+			if err := exportArchive(snapshotFile, archive, snapdir.Options{}); err != nil {
+				t.Fatalf("exportArchive() error = %v", err)
+			}
+
+			imported := filepath.Join(dir, name+".json")
+			if err := importArchive(ctx, archive, imported, snapdir.Options{}); err != nil {
+				t.Fatalf("importArchive() error = %v", err)
+			}
+			restored := filepath.Join(dir, name+"-restored")
+			if err := restoreProject(ctx, imported, restored, nil, snapdir.Options{}); err != nil {
+				t.Fatalf("restoreProject() error = %v", err)
+			}
+
+			snapshot, err := snapdir.OpenSnapshot(snapshotFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			changes, err := snapdir.Diff(ctx, snapshot, restored, snapdir.Options{})
+			if err != nil || len(changes) != 0 {
+				t.Errorf("restored archive differs from source: %v, %v", changes, err)
+			}
+		})
+	}
+}
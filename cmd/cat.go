@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"path"
+	"strings"
+
+	"github.com/supperdoggy/snapdir"
+)
+
+// cleanSnapshotPath normalizes a user supplied path to the slash separated,
+// root relative form used for entries in a snapshot
+func cleanSnapshotPath(p string) string {
+	p = path.Clean("/" + strings.ReplaceAll(p, `\`, "/"))
+	return strings.TrimPrefix(p, "/")
+}
+
+// catFile writes the raw contents of a single snapshot entry to w. A full
+// snapshot is streamed, so reading stops as soon as the entry is found;
+// an incremental one is merged with its parents first. Encrypted
+// snapshots are decrypted with opts.Identities.
+func catFile(configFile, filePath string, opts snapdir.Options, w io.Writer, logger *slog.Logger) error {
+	if err := validateInput(configFile); err != nil {
+		return fmt.Errorf("invalid config file: %w", err)
+	}
+
+	target := cleanSnapshotPath(filePath)
+	if target == "" {
+		return fmt.Errorf("path is a directory: %s", filePath)
+	}
+
+	var (
+		found bool
+		entry snapdir.FileInfo
+	)
+	_, err := scanInput(configFile, opts, func(fi snapdir.FileInfo) error {
+		if fi.Path != target || fi.Deleted {
+			return nil
+		}
+		found = true
+		entry = fi
+		return snapdir.ErrStopScan
+	})
+	if err != nil {
+		return err
+	}
+
+	if !found {
+		return fmt.Errorf("path not found in snapshot: %s", target)
+	}
+	if entry.IsDir {
+		return fmt.Errorf("path is a directory: %s", target)
+	}
+	if entry.Link != "" {
+		return fmt.Errorf("path is a symlink to %s: %s", entry.Link, target)
+	}
+
+	data, err := entry.Data()
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.Write(data); err != nil {
+		return fmt.Errorf("failed to write contents of %s: %w", target, err)
+	}
+
+	logger.Debug("wrote file contents", "path", target, "bytes", len(data))
+	return nil
+}
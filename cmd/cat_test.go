@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/supperdoggy/snapdir"
+)
+
+func writeTestSnapshot(t *testing.T, snapshot snapdir.ProjectSnapshot) string {
+	t.Helper()
+
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		t.Fatalf("failed to marshal snapshot: %v", err)
+	}
+
+	snapshotFile := filepath.Join(t.TempDir(), "snapshot.json")
+	if err := os.WriteFile(snapshotFile, data, 0644); err != nil {
+		t.Fatalf("failed to write snapshot file: %v", err)
+	}
+	return snapshotFile
+}
+
+// writeIncrementalSnapshot writes a full snapshot holding a.txt, b.txt and
+// old.txt and an incremental one next to it that changes b.txt and deletes
+// old.txt, and returns the path of the incremental one
+func writeIncrementalSnapshot(t *testing.T) string {
+	t.Helper()
+
+	parentFile := writeTestSnapshot(t, snapdir.ProjectSnapshot{
+		Version: version,
+		Files: []snapdir.FileInfo{
+			{Path: "a.txt", Contents: "unchanged", Mode: 0644},
+			{Path: "b.txt", Contents: "old", Mode: 0644},
+			{Path: "old.txt", Contents: "deleted", Mode: 0644},
+		},
+	})
+	data, err := json.MarshalIndent(snapdir.ProjectSnapshot{
+		Version: version,
+		Parent:  filepath.Base(parentFile),
+		Files: []snapdir.FileInfo{
+			{Path: "b.txt", Contents: "changed", Mode: 0644},
+			{Path: "old.txt", Deleted: true},
+		},
+	}, "", "  ")
+	if err != nil {
+		t.Fatalf("failed to marshal snapshot: %v", err)
+	}
+	snapshotFile := filepath.Join(filepath.Dir(parentFile), "incremental.json")
+	if err := os.WriteFile(snapshotFile, data, 0644); err != nil {
+		t.Fatalf("failed to write snapshot file: %v", err)
+	}
+	return snapshotFile
+}
+
+func TestCatFile(t *testing.T) {
+	binary := snapdir.FileInfo{Path: "bin/data.bin"}
+	binary.SetData([]byte{0x00, 0xff, 0xfe, 'a'})
+
+	snapshotFile := writeTestSnapshot(t, snapdir.ProjectSnapshot{
+		Version: version,
+		Files: []snapdir.FileInfo{
+			{Path: "file1.txt", Contents: "content1", Mode: 0644},
+			{Path: "dir1", IsDir: true, Mode: 0755},
+			{Path: "dir1/file2.txt", Contents: "content2", Mode: 0644},
+			{Path: "bin", IsDir: true, Mode: 0755},
+			binary,
+		},
+	})
+
+	tests := []struct {
+		name    string
+		path    string
+		want    []byte
+		wantErr bool
+	}{
+		{
+			name: "top level file",
+			path: "file1.txt",
+			want: []byte("content1"),
+		},
+		{
+			name: "nested file",
+			path: "dir1/file2.txt",
+			want: []byte("content2"),
+		},
+		{
+			name: "unclean path",
+			path: "./dir1//file2.txt",
+			want: []byte("content2"),
+		},
+		{
+			name: "binary file",
+			path: "bin/data.bin",
+			want: []byte{0x00, 0xff, 0xfe, 'a'},
+		},
+		{
+			name:    "missing path",
+			path:    "missing.txt",
+			wantErr: true,
+		},
+		{
+			name:    "directory",
+			path:    "dir1",
+			wantErr: true,
+		},
+		{
+			name:    "root",
+			path:    "/",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			err := catFile(snapshotFile, tt.path, snapdir.Options{}, &buf, newLogger(io.Discard, false))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("catFile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !bytes.Equal(buf.Bytes(), tt.want) {
+				t.Errorf("catFile() wrote %q, want %q", buf.Bytes(), tt.want)
+			}
+		})
+	}
+}
+
+func TestCatFileStopsEarly(t *testing.T) {
+	// Everything after the entry is garbage, so cat only succeeds if it
+	// stops reading once the entry is found
+	snapshotFile := filepath.Join(t.TempDir(), "snapshot.json")
+	data := `{"version": "1.0.0", "files": [{"path": "a.txt", "contents": "first"}, garbage`
+	if err := os.WriteFile(snapshotFile, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := catFile(snapshotFile, "a.txt", snapdir.Options{}, &buf, newLogger(io.Discard, false)); err != nil {
+		t.Fatalf("catFile() error = %v", err)
+	}
+	if buf.String() != "first" {
+		t.Errorf("catFile() wrote %q, want %q", buf.String(), "first")
+	}
+}
+
+func TestCatFileInvalidConfig(t *testing.T) {
+	var buf bytes.Buffer
+	if err := catFile("/nonexistent/config.json", "file.txt", snapdir.Options{}, &buf, newLogger(io.Discard, false)); err == nil {
+		t.Error("catFile() should fail for a missing config file")
+	}
+}
+
+func TestCatFileIncremental(t *testing.T) {
+	snapshotFile := writeIncrementalSnapshot(t)
+	logger := newLogger(io.Discard, false)
+
+	tests := []struct {
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{path: "a.txt", want: "unchanged"},
+		{path: "b.txt", want: "changed"},
+		{path: "old.txt", wantErr: true},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		err := catFile(snapshotFile, tt.path, snapdir.Options{}, &buf, logger)
+		if (err != nil) != tt.wantErr || buf.String() != tt.want {
+			t.Errorf("catFile(%s) = %q, %v", tt.path, buf.String(), err)
+		}
+	}
+
+	// The parent of a snapshot on standard input cannot be found
+	data, err := os.ReadFile(snapshotFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useStdio(t, data)
+	err = catFile(stdioName, "a.txt", snapdir.Options{}, io.Discard, logger)
+	if err == nil || !strings.Contains(err.Error(), "incremental") {
+		t.Errorf("catFile(-) error = %v, want incremental snapshots rejected", err)
+	}
+}
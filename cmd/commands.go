@@ -0,0 +1,259 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Flags shared by groups of commands
+var (
+	logFlags     = []string{"v", "verbose"}
+	decryptFlags = []string{"identity", "passphrase-file"}
+	parentFlags  = []string{"external-parents"}
+	walkFlags    = []string{"ignore", "jobs", "git", "stat-cache", "symlinks", "skip-larger-than"}
+	secretFlags  = []string{"secrets", "secret-rules"}
+	limitFlags   = []string{"max-entries", "max-total-size", "max-file-size", "max-depth", "max-path-length"}
+	configFlags  = []string{"profile"}
+)
+
+// command describes a subcommand for parsing and help
+type command struct {
+	name string
+	// usage holds the positional arguments of each form of the command
+	usage   []string
+	summary string
+	// minArgs is the number of positional arguments required, and
+	// optionalArgs how many more may follow
+	minArgs      int
+	optionalArgs int
+	// flags names the flags of the command, which must be defined on
+	// flag.CommandLine
+	flags []string
+}
+
+// flagList joins groups of flag names
+func flagList(groups ...[]string) []string {
+	var names []string
+	for _, group := range groups {
+		names = append(names, group...)
+	}
+	return names
+}
+
+// commands lists every subcommand in the order of the help text
+var commands = []command{
+	{
+		name:    "clone",
+		usage:   []string{"<source_dir> <output.json>"},
+		summary: "Create a snapshot of a directory, or with -git-ref of a git commit",
+		minArgs: 2,
+		flags:   flagList(logFlags, configFlags, walkFlags, secretFlags, decryptFlags, parentFlags, []string{"owner", "reproducible", "parent", "recipient", "compress", "git-ref"}),
+	},
+	{
+		name:    "restore",
+		usage:   []string{"<config.json> <destination_dir>", "<repo>@<id> <destination_dir>"},
+		summary: "Recreate a snapshot in a new directory",
+		minArgs: 2,
+		flags:   flagList(logFlags, configFlags, decryptFlags, parentFlags, limitFlags, []string{"jobs", "owner", "key", "secret-values", "git-init", "git-commit-message", "git-branch"}),
+	},
+	{
+		name:    "flatten",
+		usage:   []string{"<config.json> <output.json>"},
+		summary: "Merge an incremental snapshot with its parents into a full one",
+		minArgs: 2,
+		flags:   flagList(logFlags, configFlags, decryptFlags, parentFlags, []string{"recipient", "compress"}),
+	},
+	{
+		name:    "diff",
+		usage:   []string{"<config.json> <directory>"},
+		summary: "List what changed in a directory since a snapshot was taken",
+		minArgs: 2,
+		flags:   flagList(logFlags, configFlags, decryptFlags, parentFlags, walkFlags),
+	},
+	{
+		name:    "export",
+		usage:   []string{"<config.json> <out.tar|out.tar.gz|out.zip>"},
+		summary: "Write a snapshot as a tar or zip archive",
+		minArgs: 2,
+		flags:   flagList(logFlags, decryptFlags, parentFlags),
+	},
+	{
+		name:    "import",
+		usage:   []string{"<archive> <output.json>"},
+		summary: "Turn a tar or zip archive into a snapshot",
+		minArgs: 2,
+		flags:   flagList(logFlags, configFlags, secretFlags, limitFlags, []string{"owner", "reproducible", "recipient", "compress", "passphrase-file"}),
+	},
+	{
+		name:    "keygen",
+		usage:   []string{"<key_file>"},
+		summary: "Generate a key pair for encrypting snapshots",
+		minArgs: 1,
+		flags:   logFlags,
+	},
+	{
+		name:    "keygen-sign",
+		usage:   []string{"<key_file>"},
+		summary: "Generate a key pair for signing snapshots",
+		minArgs: 1,
+		flags:   logFlags,
+	},
+	{
+		name:    "sign",
+		usage:   []string{"<config.json> <signing_key_file>"},
+		summary: "Sign a snapshot file",
+		minArgs: 2,
+		flags:   flagList(logFlags, decryptFlags),
+	},
+	{
+		name:    "verify",
+		usage:   []string{"-key <keys> <config.json>", "<repo_dir>"},
+		summary: "Check the signature of a snapshot, or without -key the integrity of a repository",
+		minArgs: 1,
+		flags:   flagList(logFlags, decryptFlags, []string{"key"}),
+	},
+	{
+		name:    "repo",
+		usage:   []string{"init <repo_dir>"},
+		summary: "Create an empty repository",
+		minArgs: 2,
+		flags:   logFlags,
+	},
+	{
+		name:    "save",
+		usage:   []string{"<repo_dir> <source_dir>"},
+		summary: "Save a snapshot of a directory to a repository",
+		minArgs: 2,
+		flags:   flagList(logFlags, configFlags, walkFlags, []string{"owner", "reproducible", "m", "message"}),
+	},
+	{
+		name:    "log",
+		usage:   []string{"<repo_dir>"},
+		summary: "List the snapshots of a repository, newest first",
+		minArgs: 1,
+		flags:   logFlags,
+	},
+	{
+		name:    "tag",
+		usage:   []string{"<repo_dir> <name> <id>"},
+		summary: "Name a snapshot of a repository",
+		minArgs: 3,
+		flags:   logFlags,
+	},
+	{
+		name:    "untag",
+		usage:   []string{"<repo_dir> <name>"},
+		summary: "Remove a tag",
+		minArgs: 2,
+		flags:   logFlags,
+	},
+	{
+		name:    "forget",
+		usage:   []string{"<repo_dir>"},
+		summary: "Remove the snapshots a retention policy does not keep",
+		minArgs: 1,
+		flags:   flagList(logFlags, []string{"keep-last", "keep-daily"}),
+	},
+	{
+		name:    "gc",
+		usage:   []string{"<repo_dir>"},
+		summary: "Delete file contents no snapshot refers to",
+		minArgs: 1,
+		flags:   logFlags,
+	},
+	{
+		name:    "cat",
+		usage:   []string{"<config.json> <path>"},
+		summary: "Print a single file of a snapshot",
+		minArgs: 2,
+		flags:   flagList(logFlags, decryptFlags, parentFlags),
+	},
+	{
+		name:         "ls",
+		usage:        []string{"<config.json> [prefix]"},
+		summary:      "List the entries of a snapshot",
+		minArgs:      1,
+		optionalArgs: 1,
+		flags:        flagList(logFlags, decryptFlags, parentFlags, []string{"R", "tree", "glob", "mtime", "hash"}),
+	},
+	{
+		name:    "info",
+		usage:   []string{"<config.json>"},
+		summary: "Summarize a snapshot",
+		minArgs: 1,
+		flags:   flagList(logFlags, decryptFlags, parentFlags),
+	},
+}
+
+// findCommand returns the command called name
+func findCommand(name string) (command, bool) {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd, true
+		}
+	}
+	return command{}, false
+}
+
+// flagSet returns a flag set holding the flags of the command, taken from
+// all, so that values are shared with flags given before the command
+func (cmd command) flagSet(all *flag.FlagSet, handling flag.ErrorHandling) *flag.FlagSet {
+	fs := flag.NewFlagSet(cmd.name, handling)
+	for _, name := range cmd.flags {
+		f := all.Lookup(name)
+		if f == nil {
+			panic("undefined flag -" + name + " of command " + cmd.name)
+		}
+		fs.Var(f.Value, f.Name, f.Usage)
+	}
+	fs.Usage = func() { cmd.printUsage(fs.Output(), fs) }
+	return fs
+}
+
+// printUsage prints the help of the command
+func (cmd command) printUsage(w io.Writer, fs *flag.FlagSet) {
+	fmt.Fprintf(w, "Usage:\n")
+	for _, usage := range cmd.usage {
+		fmt.Fprintf(w, "  %s %s %s [flags]\n", os.Args[0], cmd.name, usage)
+	}
+	fmt.Fprintf(w, "\n%s.\n\nFlags:\n", cmd.summary)
+	fs.PrintDefaults()
+}
+
+// parseCommandArgs parses the flags of fs anywhere in args and returns the
+// positional arguments. Everything after "--" is positional.
+func parseCommandArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		rest := fs.Args()
+		if parsed := len(args) - len(rest); parsed > 0 && args[parsed-1] == "--" {
+			return append(positional, rest...), nil
+		}
+		if len(rest) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+}
+
+// checkGlobalFlags fails if a flag given before the command is not one the
+// command accepts
+func checkGlobalFlags(all, fs *flag.FlagSet, cmd command) error {
+	var unsupported []string
+	all.Visit(func(f *flag.Flag) {
+		if fs.Lookup(f.Name) == nil {
+			unsupported = append(unsupported, "-"+f.Name)
+		}
+	})
+	if len(unsupported) > 0 {
+		return fmt.Errorf("%s does not accept %s", cmd.name, strings.Join(unsupported, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestMain runs main instead of the tests when the test binary is started
+// by runCLI
+func TestMain(m *testing.M) {
+	if os.Getenv("SNAPDIR_TEST_MAIN") == "1" {
+		os.Args = append([]string{"snapdir"}, os.Args[1:]...)
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runCLI runs snapdir with args in dir and returns its standard output,
+// standard error and exit code
+func runCLI(t *testing.T, dir string, args ...string) (string, string, int) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Dir = dir
+	// A config file of the user must not change the outcome
+	cmd.Env = append(os.Environ(), "SNAPDIR_TEST_MAIN=1", "XDG_CONFIG_HOME="+filepath.Join(dir, ".config"))
+	var stdout, stderr strings.Builder
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	code := 0
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		code = exitErr.ExitCode()
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return stdout.String(), stderr.String(), code
+}
+
+func TestParseCommandArgs(t *testing.T) {
+	tests := []struct {
+		name       string
+		args       []string
+		positional []string
+		verbose    bool
+		ignore     string
+		wantErr    bool
+	}{
+		{name: "flags first", args: []string{"-v", "-ignore", "*.log", "src", "out.json"}, positional: []string{"src", "out.json"}, verbose: true, ignore: "*.log"},
+		{name: "flags last", args: []string{"src", "out.json", "-v", "--ignore", "*.log"}, positional: []string{"src", "out.json"}, verbose: true, ignore: "*.log"},
+		{name: "flags between", args: []string{"src", "-ignore=*.log", "out.json"}, positional: []string{"src", "out.json"}, ignore: "*.log"},
+		{name: "stdio argument", args: []string{"src", "-", "-v"}, positional: []string{"src", "-"}, verbose: true},
+		{name: "double dash", args: []string{"src", "--", "-v"}, positional: []string{"src", "-v"}},
+		{name: "unknown flag", args: []string{"src", "out.json", "-bogus"}, wantErr: true},
+		{name: "missing value", args: []string{"src", "-ignore"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			all := flag.NewFlagSet("snapdir", flag.ContinueOnError)
+			verbose := all.Bool("v", false, "")
+			ignore := all.String("ignore", "", "")
+			fs := command{name: "clone", flags: []string{"v", "ignore"}}.flagSet(all, flag.ContinueOnError)
+			fs.SetOutput(&strings.Builder{})
+
+			positional, err := parseCommandArgs(fs, tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseCommandArgs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(positional, tt.positional) || *verbose != tt.verbose || *ignore != tt.ignore {
+				t.Errorf("parseCommandArgs() = %q, -v %v, -ignore %q", positional, *verbose, *ignore)
+			}
+		})
+	}
+}
+
+func TestCommandHelp(t *testing.T) {
+	dir := t.TempDir()
+	for _, cmd := range commands {
+		t.Run(cmd.name, func(t *testing.T) {
+			_, stderr, code := runCLI(t, dir, cmd.name, "-h")
+			if code != 0 || !strings.Contains(stderr, cmd.summary) || !strings.Contains(stderr, "-verbose") {
+				t.Errorf("%s -h exited %d:\n%s", cmd.name, code, stderr)
+			}
+		})
+	}
+
+	_, stderr, _ := runCLI(t, dir, "clone", "-h")
+	if strings.Contains(stderr, "-keep-last") {
+		t.Errorf("clone -h lists flags of other commands:\n%s", stderr)
+	}
+}
+
+func TestCLIFlagPlacement(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "src"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, contents := range map[string]string{"keep.txt": "keep", "skip.tmp": "skip"} {
+		if err := os.WriteFile(filepath.Join(dir, "src", name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Flags after the arguments used to be ignored silently
+	_, stderr, code := runCLI(t, dir, "clone", "src", "after.json", "-ignore", "*.tmp", "-v")
+	if code != 0 || !strings.Contains(stderr, "level=DEBUG") {
+		t.Fatalf("clone with trailing flags exited %d:\n%s", code, stderr)
+	}
+	stdout, _, _ := runCLI(t, dir, "ls", "after.json")
+	if strings.Contains(stdout, "skip.tmp") || !strings.Contains(stdout, "keep.txt") {
+		t.Errorf("-ignore after the arguments was not applied:\n%s", stdout)
+	}
+
+	// Flags before the command still work
+	if _, stderr, code := runCLI(t, dir, "-ignore", "*.tmp", "clone", "src", "before.json"); code != 0 {
+		t.Fatalf("clone with leading flags exited %d:\n%s", code, stderr)
+	}
+
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{name: "unknown flag", args: []string{"clone", "src", "x.json", "-bogus"}, want: "-bogus"},
+		{name: "flag of another command", args: []string{"clone", "src", "x.json", "-keep-last", "3"}, want: "-keep-last"},
+		{name: "leading flag of another command", args: []string{"-R", "clone", "src", "x.json"}, want: "clone does not accept -R"},
+		{name: "too many arguments", args: []string{"info", "after.json", "extra"}, want: "wrong number of arguments"},
+		{name: "unknown command", args: []string{"clown", "src"}, want: `unknown command "clown"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, stderr, code := runCLI(t, dir, tt.args...)
+			if code == 0 || !strings.Contains(stderr, tt.want) {
+				t.Errorf("snapdir %v exited %d, want failure mentioning %q:\n%s", tt.args, code, tt.want, stderr)
+			}
+		})
+	}
+	if _, err := os.Stat(filepath.Join(dir, "x.json")); !os.IsNotExist(err) {
+		t.Error("a command with bad flags still ran")
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// projectConfigNames are the config files looked for in the source
+// directory; the first one found is used
+var projectConfigNames = []string{".snapdir.toml", ".snapdir.yaml", ".snapdir.yml"}
+
+// configKeys are the flags a config file may set
+var configKeys = flagList(limitFlags, []string{"ignore", "compress", "recipient", "jobs", "git", "reproducible", "owner", "secrets", "symlinks", "skip-larger-than"})
+
+// configValue is a flag value read from a config file
+type configValue struct {
+	value string
+	file  string
+}
+
+// config holds the flag values of the config files of a command
+type config struct {
+	// values holds the top level settings by flag name
+	values map[string]configValue
+	// profiles holds the settings of each named profile
+	profiles map[string]map[string]configValue
+	// files lists the files read, in order
+	files []string
+}
+
+// userConfigPath returns the path of the config file of the user,
+// $XDG_CONFIG_HOME/snapdir/config, or "" if there is no config directory.
+// Without XDG_CONFIG_HOME the platform's config directory is used.
+func userConfigPath() string {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		var err error
+		if dir, err = os.UserConfigDir(); err != nil {
+			return ""
+		}
+	}
+	return filepath.Join(dir, "snapdir", "config")
+}
+
+// configDir returns the directory whose project config applies to the
+// command: the source directory of clone, save and diff. Other commands
+// have no source and only read the user config, so a config file in
+// whatever directory they run in cannot change what they do.
+func configDir(name string, args []string) string {
+	switch name {
+	case "clone":
+		return args[0]
+	case "save", "diff":
+		return args[1]
+	}
+	return ""
+}
+
+// loadConfig reads the user config file and then the project config file
+// in dir, if dir is not empty, whose settings take precedence. Missing
+// files are skipped.
+func loadConfig(dir string) (*config, error) {
+	cfg := &config{
+		values:   make(map[string]configValue),
+		profiles: make(map[string]map[string]configValue),
+	}
+
+	paths := []string{userConfigPath()}
+	for _, name := range projectConfigNames {
+		if dir == "" {
+			break
+		}
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err == nil {
+			paths = append(paths, path)
+			break
+		}
+	}
+
+	for i, path := range paths {
+		if path == "" {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config: %w", err)
+		}
+		var tree map[string]any
+		if isYAMLConfig(path, string(data)) {
+			err = yaml.Unmarshal(data, &tree)
+		} else {
+			_, err = toml.Decode(string(data), &tree)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if err := cfg.add(path, tree, i > 0); err != nil {
+			return nil, err
+		}
+		cfg.files = append(cfg.files, path)
+	}
+	return cfg, nil
+}
+
+// add merges the settings of a parsed config file into cfg. A project file
+// comes with the tree it configures, so it may not set restore limits.
+func (cfg *config) add(path string, tree map[string]any, project bool) error {
+	for _, key := range slices.Sorted(maps.Keys(tree)) {
+		if key != "profiles" {
+			if err := addConfigValue(cfg.values, path, key, tree[key], project); err != nil {
+				return err
+			}
+			continue
+		}
+		profiles, ok := tree[key].(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s: profiles must be a table of profiles", path)
+		}
+		for _, name := range slices.Sorted(maps.Keys(profiles)) {
+			settings, ok := profiles[name].(map[string]any)
+			if !ok {
+				return fmt.Errorf("%s: profile %s must be a table of settings", path, name)
+			}
+			if cfg.profiles[name] == nil {
+				cfg.profiles[name] = make(map[string]configValue)
+			}
+			for _, key := range slices.Sorted(maps.Keys(settings)) {
+				if err := addConfigValue(cfg.profiles[name], path, key, settings[key], project); err != nil {
+					return fmt.Errorf("%w in profile %s", err, name)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// addConfigValue stores the setting key of a config file in values
+func addConfigValue(values map[string]configValue, path, key string, v any, project bool) error {
+	if !slices.Contains(configKeys, key) {
+		return fmt.Errorf("%s: unknown setting %q", path, key)
+	}
+	if project && slices.Contains(limitFlags, key) {
+		return fmt.Errorf("%s: %s can only be set in the user config or on the command line", path, key)
+	}
+	value, ok := configScalar(v)
+	if list, isList := v.([]any); isList {
+		// List flags take comma-separated values
+		items := make([]string, len(list))
+		ok = true
+		for i := 0; i < len(list) && ok; i++ {
+			items[i], ok = configScalar(list[i])
+		}
+		value = strings.Join(items, ",")
+	}
+	if !ok {
+		return fmt.Errorf("%s: %s must be a string, number, boolean or a list of them", path, key)
+	}
+	values[key] = configValue{value: value, file: path}
+	return nil
+}
+
+// apply sets the flags of fs that were not given on the command line to the
+// values of the config, overlaid with those of profile if it is not empty.
+// Settings the command has no flag for are logged at debug level.
+func (cfg *config) apply(fs *flag.FlagSet, given map[string]bool, profile string, logger *slog.Logger) error {
+	values := make(map[string]configValue, len(cfg.values))
+	for key, value := range cfg.values {
+		values[key] = value
+	}
+	if profile != "" {
+		settings, ok := cfg.profiles[profile]
+		if !ok {
+			return fmt.Errorf("profile %q is not defined in any config file", profile)
+		}
+		for key, value := range settings {
+			values[key] = value
+		}
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		// Settings for other commands are skipped, so one config file can
+		// serve all of them
+		value := values[key]
+		if fs.Lookup(key) == nil {
+			logger.Debug("config setting not used by this command", "setting", key, "file", value.file)
+			continue
+		}
+		if given[key] {
+			continue
+		}
+		if err := fs.Set(key, value.value); err != nil {
+			return fmt.Errorf("%s: invalid value for %s: %w", value.file, key, err)
+		}
+	}
+	return nil
+}
+
+// applyConfig loads the config files of the command and sets the flags of
+// fs that were not given on the command line from them
+func applyConfig(all, fs *flag.FlagSet, dir, profile string, logger *slog.Logger) error {
+	cfg, err := loadConfig(dir)
+	if err != nil {
+		return err
+	}
+	if len(cfg.files) > 0 {
+		logger.Debug("using config", "files", cfg.files, "profile", profile)
+	}
+
+	given := make(map[string]bool)
+	all.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	return cfg.apply(fs, given, profile, logger)
+}
+
+// configScalar returns a string, number or boolean of a config file as a
+// flag value
+func configScalar(v any) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case bool:
+		return strconv.FormatBool(v), true
+	case int:
+		return strconv.Itoa(v), true
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	}
+	return "", false
+}
+
+// isYAMLConfig reports whether the config file at path is YAML rather than
+// TOML. Files without a known extension are YAML if their first setting
+// uses a colon instead of an equals sign.
+func isYAMLConfig(path, data string) bool {
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		return true
+	case ".toml":
+		return false
+	}
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line == "---" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			return false
+		}
+		colon, equals := strings.Index(line, ":"), strings.Index(line, "=")
+		return colon >= 0 && (equals < 0 || colon < equals)
+	}
+	return false
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// configSettings flattens a parsed config into setting=value strings,
+// with profile settings prefixed by the profile name
+func configSettings(cfg *config) map[string]string {
+	settings := make(map[string]string)
+	for key, value := range cfg.values {
+		settings[key] = value.value
+	}
+	for name, profile := range cfg.profiles {
+		for key, value := range profile {
+			settings[name+"."+key] = value.value
+		}
+	}
+	return settings
+}
+
+func TestLoadConfigFormats(t *testing.T) {
+	want := map[string]string{
+		"ignore":           "*.log,dist,a#b",
+		"skip-larger-than": "2G",
+		"reproducible":     "true",
+		"recipient":        "snapdir-pub-1",
+		"release.compress": "gzip",
+		"release.jobs":     "4",
+		"release.ignore":   "",
+	}
+
+	tests := []struct {
+		name string
+		file string
+		data string
+	}{
+		{
+			name: "toml",
+			file: ".snapdir.toml",
+			data: `# Defaults for the project
+ignore = [
+  "*.log", # logs
+  'dist',
+  "a#b",
+]
+skip-larger-than = "2G"
+reproducible = true
+recipient = ["snapdir-pub-1"]
+
+[profiles.release]
+compress = "gzip"
+jobs = 4
+ignore = []
+`,
+		},
+		{
+			name: "yaml",
+			file: ".snapdir.yaml",
+			data: `---
+# Defaults for the project
+ignore:
+- "*.log"  # logs
+- dist
+- a#b
+skip-larger-than: 2G
+reproducible: true
+recipient: [snapdir-pub-1]
+profiles:
+  release:
+    compress: gzip
+    jobs: 4
+    ignore: []
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, tt.file), []byte(tt.data), 0644); err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := loadConfig(dir)
+			if err != nil {
+				t.Fatalf("loadConfig() error = %v", err)
+			}
+			if got := configSettings(cfg); !reflect.DeepEqual(got, want) {
+				t.Errorf("loadConfig() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		data string
+		want string
+	}{
+		{name: "unknown setting", file: ".snapdir.toml", data: "ignore = []\nverbose = true\n", want: ".snapdir.toml: unknown setting \"verbose\""},
+		{name: "unknown profile setting", file: ".snapdir.yaml", data: "profiles:\n  ci:\n    key: x\n", want: ".snapdir.yaml: unknown setting \"key\" in profile ci"},
+		{name: "toml syntax", file: ".snapdir.toml", data: "jobs = 1\nignore\n", want: ".snapdir.toml: toml: line"},
+		{name: "toml duplicate", file: ".snapdir.toml", data: "jobs = 1\njobs = 2\n", want: "toml: line 2"},
+		{name: "yaml syntax", file: ".snapdir.yaml", data: "jobs: 1\nignore: [a\n", want: ".snapdir.yaml: yaml: line"},
+		{name: "yaml duplicate", file: ".snapdir.yaml", data: "jobs: 1\njobs: 2\n", want: "yaml: unmarshal errors:\n  line 2"},
+		{name: "yaml alias", file: ".snapdir.yaml", data: "ignore: *.log\n", want: ".snapdir.yaml: yaml:"},
+		{name: "table as value", file: ".snapdir.toml", data: "[ignore]\nx = 1\n", want: ": ignore must be a string, number, boolean or a list of them"},
+		{name: "nested list", file: ".snapdir.toml", data: "ignore = [[\"a\"]]\n", want: ": ignore must be a string"},
+		{name: "date", file: ".snapdir.toml", data: "git = 2024-01-01\n", want: ": git must be a string"},
+		{name: "yaml null", file: ".snapdir.yaml", data: "git:\n", want: ": git must be a string"},
+		{name: "profiles value", file: ".snapdir.toml", data: "profiles = \"ci\"\n", want: ": profiles must be a table of profiles"},
+		{name: "profile value", file: ".snapdir.yaml", data: "profiles:\n  ci: fast\n", want: ": profile ci must be a table of settings"},
+		{name: "yaml list", file: ".snapdir.yaml", data: "- a\n", want: "cannot unmarshal"},
+		{name: "project limit", file: ".snapdir.toml", data: "max-entries = 10\n", want: ": max-entries can only be set in the user config"},
+		{name: "project profile limit", file: ".snapdir.yaml", data: "profiles:\n  big:\n    max-file-size: 1G\n", want: ": max-file-size can only be set in the user config"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, tt.file), []byte(tt.data), 0644); err != nil {
+				t.Fatal(err)
+			}
+			_, err := loadConfig(dir)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("loadConfig() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", home)
+	if err := os.MkdirAll(filepath.Join(home, "snapdir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// The user config has no extension; it is read as YAML or TOML
+	// depending on its contents
+	user := "jobs: 2\ngit: tracked\nprofiles:\n  ci:\n    secrets: fail\n    owner: true\n"
+	if err := os.WriteFile(userConfigPath(), []byte(user), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	project := "jobs = 4\n[profiles.ci]\nsecrets = \"off\"\n"
+	if err := os.WriteFile(filepath.Join(dir, ".snapdir.toml"), []byte(project), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Only the first project config is read
+	if err := os.WriteFile(filepath.Join(dir, ".snapdir.yaml"), []byte("jobs: 8\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := loadConfig(dir)
+	if err != nil {
+		t.Fatalf("loadConfig() error = %v", err)
+	}
+	want := map[string]string{"jobs": "4", "git": "tracked", "ci.secrets": "off", "ci.owner": "true"}
+	if got := configSettings(cfg); !reflect.DeepEqual(got, want) {
+		t.Errorf("loadConfig() = %v, want %v", got, want)
+	}
+
+	empty, err := loadConfig(t.TempDir())
+	if err != nil || len(empty.files) != 1 {
+		t.Errorf("loadConfig() without a project config = %v, %v", empty.files, err)
+	}
+}
+
+func TestConfigApply(t *testing.T) {
+	// max-file-size is skipped and logged, as the flag set has no such flag
+	cfg := &config{
+		values: map[string]configValue{
+			"ignore":        {value: "*.log"},
+			"jobs":          {value: "2"},
+			"max-file-size": {value: "1M"},
+		},
+		profiles: map[string]map[string]configValue{
+			"release": {"jobs": {value: "8"}, "reproducible": {value: "true"}},
+			"broken":  {"jobs": {value: "many", file: "config"}},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		args    []string
+		profile string
+		want    map[string]string
+		wantLog string
+		wantErr string
+	}{
+		{
+			name:    "defaults",
+			want:    map[string]string{"ignore": "*.log", "jobs": "2", "reproducible": "false"},
+			wantLog: "setting=max-file-size",
+		},
+		{
+			name:    "flags win",
+			args:    []string{"-ignore", "*.tmp", "-reproducible=false"},
+			profile: "release",
+			want:    map[string]string{"ignore": "*.tmp", "jobs": "8", "reproducible": "false"},
+		},
+		{
+			name:    "profile",
+			profile: "release",
+			want:    map[string]string{"ignore": "*.log", "jobs": "8", "reproducible": "true"},
+		},
+		{name: "unknown profile", profile: "debug", wantErr: `profile "debug" is not defined`},
+		{name: "invalid value", profile: "broken", wantErr: "config: invalid value for jobs"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := flag.NewFlagSet("clone", flag.ContinueOnError)
+			fs.SetOutput(io.Discard)
+			fs.String("ignore", "", "")
+			fs.Int("jobs", 0, "")
+			fs.Bool("reproducible", false, "")
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+			given := make(map[string]bool)
+			fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+			var log bytes.Buffer
+			err := cfg.apply(fs, given, tt.profile, newLogger(&log, true))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("apply() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("apply() error = %v", err)
+			}
+			got := map[string]string{
+				"ignore":       fs.Lookup("ignore").Value.String(),
+				"jobs":         fs.Lookup("jobs").Value.String(),
+				"reproducible": fs.Lookup("reproducible").Value.String(),
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("apply() = %v, want %v", got, tt.want)
+			}
+			if !strings.Contains(log.String(), tt.wantLog) {
+				t.Errorf("apply() logged %q, want %q", log.String(), tt.wantLog)
+			}
+		})
+	}
+}
+
+func TestCLIConfig(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	if err := os.MkdirAll(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"keep.txt": "keep",
+		"a.log":    "log",
+		"b.tmp":    "tmp",
+		".snapdir.yaml": `ignore: ["*.log"]
+profiles:
+  release:
+    compress: gzip
+`,
+	}
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(src, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	list := func(snapshot string) string {
+		t.Helper()
+		stdout, stderr, code := runCLI(t, dir, "ls", snapshot)
+		if code != 0 {
+			t.Fatalf("ls %s exited %d:\n%s", snapshot, code, stderr)
+		}
+		return stdout
+	}
+
+	if _, stderr, code := runCLI(t, dir, "clone", "src", "config.json"); code != 0 {
+		t.Fatalf("clone exited %d:\n%s", code, stderr)
+	}
+	if got := list("config.json"); strings.Contains(got, "a.log") || !strings.Contains(got, "b.tmp") {
+		t.Errorf("config ignore patterns were not applied:\n%s", got)
+	}
+
+	// Flags replace config settings, and profiles add to them
+	if _, stderr, code := runCLI(t, dir, "clone", "src", "release.json", "-profile", "release", "-ignore", "*.tmp"); code != 0 {
+		t.Fatalf("clone -profile exited %d:\n%s", code, stderr)
+	}
+	if got := list("release.json"); !strings.Contains(got, "a.log") || strings.Contains(got, "b.tmp") {
+		t.Errorf("-ignore did not override the config:\n%s", got)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "release.json"))
+	if err != nil || !strings.HasPrefix(string(data), "\x1f\x8b") {
+		t.Errorf("profile compression was not applied: %v", err)
+	}
+
+	if _, stderr, code := runCLI(t, dir, "clone", "src", "x.json", "-profile", "nightly"); code == 0 || !strings.Contains(stderr, `profile "nightly"`) {
+		t.Errorf("clone with an unknown profile exited %d:\n%s", code, stderr)
+	}
+}
+
+func TestCLIConfigSkipLargerThan(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	if err := os.MkdirAll(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"small.txt":     "small",
+		"big.txt":       strings.Repeat("x", 2048),
+		".snapdir.toml": "skip-larger-than = \"1K\"\n",
+		// max-file-size only limits restores, so clone just logs it
+		"../.config/snapdir/config": "max-file-size = \"1\"\n",
+	}
+	if err := os.MkdirAll(filepath.Join(dir, ".config", "snapdir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(src, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		args    []string
+		wantBig bool
+	}{
+		{name: "config"},
+		{name: "flag wins", args: []string{"-skip-larger-than", "-1"}, wantBig: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append([]string{"clone", "src", "out.json"}, tt.args...)
+			_, stderr, code := runCLI(t, dir, args...)
+			if code != 0 {
+				t.Fatalf("clone exited %d:\n%s", code, stderr)
+			}
+			stdout, stderr, code := runCLI(t, dir, "ls", "out.json")
+			if code != 0 {
+				t.Fatalf("ls exited %d:\n%s", code, stderr)
+			}
+			if got := strings.Contains(stdout, "big.txt"); got != tt.wantBig {
+				t.Errorf("snapshot has big.txt = %v, want %v:\n%s", got, tt.wantBig, stdout)
+			}
+		})
+	}
+
+	_, stderr, _ := runCLI(t, dir, "clone", "-v", "src", "out.json")
+	if !strings.Contains(stderr, "setting=max-file-size") {
+		t.Errorf("clone did not log the unused max-file-size setting:\n%s", stderr)
+	}
+}
+
+func TestCLIConfigOnlyFromSource(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	if err := os.MkdirAll(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "a.txt"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// A config file in the working directory would break every command
+	// that read it
+	if err := os.WriteFile(filepath.Join(dir, ".snapdir.toml"), []byte("jobs = \"many\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	commands := [][]string{
+		{"clone", "src", "snapshot.json"},
+		{"restore", "snapshot.json", "restored"},
+		{"ls", "snapshot.json"},
+	}
+	for _, args := range commands {
+		if _, stderr, code := runCLI(t, dir, args...); code != 0 {
+			t.Errorf("%s exited %d:\n%s", args[0], code, stderr)
+		}
+	}
+}
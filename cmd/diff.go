@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/supperdoggy/snapdir"
+)
+
+// changeMarks are the single letter markers diff prints for each kind of
+// change, like git status --short
+var changeMarks = map[snapdir.ChangeKind]string{
+	snapdir.Added:    "A",
+	snapdir.Modified: "M",
+	snapdir.Deleted:  "D",
+}
+
+// diffProject prints the changes of directory since the snapshot in
+// configFile was taken and returns how many there are
+func diffProject(ctx context.Context, configFile, directory string, opts snapdir.Options, w io.Writer) (int, error) {
+	if err := validateInput(configFile); err != nil {
+		return 0, fmt.Errorf("invalid config file: %w", err)
+	}
+
+	snapshot, err := openSnapshot(configFile, opts)
+	if err != nil {
+		return 0, err
+	}
+
+	changes, err := snapdir.Diff(ctx, snapshot, directory, opts)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, change := range changes {
+		fmt.Fprintf(w, "%s %s\n", changeMarks[change.Kind], change.Path)
+	}
+	return len(changes), nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/supperdoggy/snapdir"
+)
+
+func TestDiffProject(t *testing.T) {
+	ctx := context.Background()
+	source := t.TempDir()
+	snapshotFile := filepath.Join(t.TempDir(), "snapshot.json")
+
+	for name, content := range map[string]string{"keep.txt": "keep", "edit.txt": "edit", "gone.txt": "gone"} {
+		if err := os.WriteFile(filepath.Join(source, name), []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+	}
+	if err := cloneProject(ctx, source, snapshotFile, snapdir.Options{}); err != nil {
+		t.Fatalf("cloneProject() error = %v", err)
+	}
+
+	var out bytes.Buffer
+	n, err := diffProject(ctx, snapshotFile, source, snapdir.Options{}, &out)
+	if err != nil {
+		t.Fatalf("diffProject() error = %v", err)
+	}
+	if n != 0 || out.Len() != 0 {
+		t.Errorf("diffProject() = %d changes, output %q, want none", n, out.String())
+	}
+
+	if err := os.WriteFile(filepath.Join(source, "edit.txt"), []byte("EDIT"), 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(source, "new.txt"), []byte("new"), 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if err := os.Remove(filepath.Join(source, "gone.txt")); err != nil {
+		t.Fatalf("failed to remove file: %v", err)
+	}
+
+	out.Reset()
+	n, err = diffProject(ctx, snapshotFile, source, snapdir.Options{}, &out)
+	if err != nil {
+		t.Fatalf("diffProject() error = %v", err)
+	}
+	want := "M edit.txt\nD gone.txt\nA new.txt\n"
+	if n != 3 || out.String() != want {
+		t.Errorf("diffProject() = %d changes, output %q, want 3 and %q", n, out.String(), want)
+	}
+
+	if _, err := diffProject(ctx, filepath.Join(source, "missing.json"), source, snapdir.Options{}, &out); err == nil {
+		t.Error("diffProject() should fail for a missing snapshot")
+	}
+}
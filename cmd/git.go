@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/supperdoggy/snapdir"
+)
+
+// cloneGitRef creates a snapshot of the tree of a commit in a local git
+// repository
+func cloneGitRef(ctx context.Context, repoDir, ref, outputFile string, opts snapdir.Options) error {
+	if err := validatePath(repoDir, true); err != nil {
+		return fmt.Errorf("invalid repository path: %w", err)
+	}
+
+	err := writeOutputFile(outputFile, func(w io.Writer) error {
+		return snapdir.CloneGit(ctx, repoDir, ref, w, opts)
+	})
+	if err != nil {
+		return err
+	}
+
+	if opts.Logger != nil {
+		opts.Logger.Debug("snapshot saved", "output", outputFile)
+	}
+	return nil
+}
+
+// checkCommitRestore fails if git could not commit a restore to destination,
+// so a missing identity is found before anything is restored. Git runs in
+// the closest existing parent of destination, which is created later.
+// Restores never write into an existing repository, so there is no merge
+// mode that commits on a new branch; that case gets an error of its own.
+func checkCommitRestore(ctx context.Context, destination string) error {
+	if _, err := os.Stat(filepath.Join(destination, ".git")); err == nil {
+		return fmt.Errorf("cannot use -git-init: %s is already a git repository; restores only create new repositories and cannot commit to a branch of an existing one", destination)
+	}
+
+	dir, err := filepath.Abs(destination)
+	if err != nil {
+		return err
+	}
+	for dir = filepath.Dir(dir); ; dir = filepath.Dir(dir) {
+		if info, err := os.Stat(dir); (err == nil && info.IsDir()) || dir == filepath.Dir(dir) {
+			break
+		}
+	}
+	if err := snapdir.CheckGitIdentity(ctx, dir); err != nil {
+		return fmt.Errorf("cannot use -git-init: %w", err)
+	}
+	return nil
+}
+
+// commitRestore turns a restored destination into a git repository holding
+// one commit of the restored tree. Without a message the commit is named
+// after the restored snapshot.
+func commitRestore(ctx context.Context, destination, source, branch, message string) error {
+	if message == "" {
+		if source == stdioName {
+			source = "snapshot from standard input"
+		}
+		message = "Restore " + source
+	}
+	if err := snapdir.InitGitRepository(ctx, destination, branch, message); err != nil {
+		return fmt.Errorf("snapshot restored to %s, but committing it failed: %w", destination, err)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/supperdoggy/snapdir"
+)
+
+// testGit runs git in dir with a fixed identity, skipping the test if git
+// is not installed
+func testGit(t *testing.T, dir string, args ...string) {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com",
+		"GIT_CONFIG_GLOBAL=/dev/null", "GIT_CONFIG_NOSYSTEM=1",
+	)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git %v: %v\n%s", args, err, out)
+	}
+}
+
+func TestCloneGitRef(t *testing.T) {
+	dir := t.TempDir()
+	repo := filepath.Join(dir, "repo")
+	if err := os.MkdirAll(repo, 0755); err != nil {
+		t.Fatal(err)
+	}
+	testGit(t, repo, "init", "-q")
+	if err := os.WriteFile(filepath.Join(repo, "main.go"), []byte("package main\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	testGit(t, repo, "add", ".")
+	testGit(t, repo, "commit", "-q", "-m", "initial")
+	testGit(t, repo, "tag", "v1.0.0")
+	if err := os.WriteFile(filepath.Join(repo, "main.go"), []byte("package changed\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	output := filepath.Join(dir, "release.json")
+	if err := cloneGitRef(ctx, repo, "v1.0.0", output, snapdir.Options{}); err != nil {
+		t.Fatalf("cloneGitRef() error = %v", err)
+	}
+	snapshot, err := snapdir.OpenSnapshot(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshot.Files) != 1 || snapshot.Files[0].Contents != "package main\n" {
+		t.Errorf("cloneGitRef() snapshot = %+v", snapshot.Files)
+	}
+
+	if err := cloneGitRef(ctx, repo, "v9.9.9", filepath.Join(dir, "missing.json"), snapdir.Options{}); err == nil {
+		t.Error("cloneGitRef() should fail for an unknown ref")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "missing.json")); !os.IsNotExist(err) {
+		t.Error("cloneGitRef() left an output file behind after failing")
+	}
+}
+
+func TestRestoreGitInitWithoutIdentity(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	// No config files, no identity variables and no identity guessed
+	// from the host name
+	for _, k := range []string{"GIT_AUTHOR_NAME", "GIT_AUTHOR_EMAIL", "GIT_COMMITTER_NAME", "GIT_COMMITTER_EMAIL", "EMAIL", "GIT_CONFIG_GLOBAL"} {
+		t.Setenv(k, "")
+		os.Unsetenv(k)
+	}
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	t.Setenv("GIT_CONFIG_COUNT", "1")
+	t.Setenv("GIT_CONFIG_KEY_0", "user.useConfigOnly")
+	t.Setenv("GIT_CONFIG_VALUE_0", "true")
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "template.json"), []byte(`{"version":"1.0","files":[{"path":"README.md","contents":"hi"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, stderr, code := runCLI(t, dir, "restore", "-git-init", "template.json", "new/project")
+	if code == 0 || !strings.Contains(stderr, "identity") {
+		t.Errorf("restore -git-init exited %d, want a missing identity:\n%s", code, stderr)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "new")); !os.IsNotExist(err) {
+		t.Error("restore -git-init restored the snapshot before failing")
+	}
+}
+
+func TestRestoreGitInitExistingRepository(t *testing.T) {
+	dir := t.TempDir()
+	testGit(t, dir, "init", "-q", "existing")
+	if err := os.WriteFile(filepath.Join(dir, "template.json"), []byte(`{"version":"1.0","files":[{"path":"README.md","contents":"hi"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, stderr, code := runCLI(t, dir, "restore", "-git-init", "template.json", "existing")
+	if code == 0 || !strings.Contains(stderr, "already a git repository") {
+		t.Errorf("restore -git-init into a repository exited %d:\n%s", code, stderr)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "existing", "README.md")); !os.IsNotExist(err) {
+		t.Error("restore -git-init wrote into the existing repository")
+	}
+}
+
+func TestCommitRestore(t *testing.T) {
+	for _, kv := range []string{"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com", "GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com"} {
+		k, v, _ := strings.Cut(kv, "=")
+		t.Setenv(k, v)
+	}
+	dir := t.TempDir()
+	testGit(t, dir, "--version")
+
+	snapshotFile := filepath.Join(dir, "template.json")
+	if err := os.WriteFile(snapshotFile, []byte(`{"version":"1.0","files":[{"path":"README.md","contents":"hi"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	destination := filepath.Join(dir, "project")
+	if err := restoreProject(ctx, snapshotFile, destination, nil, snapdir.Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := commitRestore(ctx, destination, "template.json", "", ""); err != nil {
+		t.Fatalf("commitRestore() error = %v", err)
+	}
+
+	out, err := exec.Command("git", "-C", destination, "log", "--format=%s").Output()
+	if err != nil || string(out) != "Restore template.json\n" {
+		t.Errorf("git log = %q, %v", out, err)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/supperdoggy/snapdir"
+)
+
+// infoTopFiles is the number of largest files shown by the info command
+const infoTopFiles = 10
+
+// extensionStats aggregates the files sharing one file extension
+type extensionStats struct {
+	Extension string
+	Files     int
+	Bytes     int64
+}
+
+// snapshotStats summarizes the contents of a snapshot
+type snapshotStats struct {
+	Version    string
+	Files      int
+	Dirs       int
+	TotalBytes int64
+	Largest    []snapdir.FileInfo
+	Extensions []extensionStats
+}
+
+// collectStats computes summary statistics for a snapshot whose entries
+// have their sizes filled in
+func collectStats(snapshot snapdir.ProjectSnapshot, top int) snapshotStats {
+	stats := snapshotStats{Version: snapshot.Version}
+	byExt := make(map[string]*extensionStats)
+	var files []snapdir.FileInfo
+
+	for _, entry := range snapshot.Files {
+		if entry.IsDir {
+			stats.Dirs++
+			continue
+		}
+
+		stats.Files++
+		stats.TotalBytes += entry.Size
+		files = append(files, entry)
+
+		ext := strings.ToLower(path.Ext(entry.Path))
+		if ext == "" {
+			ext = "(none)"
+		}
+		if byExt[ext] == nil {
+			byExt[ext] = &extensionStats{Extension: ext}
+		}
+		byExt[ext].Files++
+		byExt[ext].Bytes += entry.Size
+	}
+
+	sort.SliceStable(files, func(i, j int) bool {
+		return files[i].Size > files[j].Size
+	})
+	if len(files) > top {
+		files = files[:top]
+	}
+	stats.Largest = files
+
+	for _, ext := range byExt {
+		stats.Extensions = append(stats.Extensions, *ext)
+	}
+	sort.Slice(stats.Extensions, func(i, j int) bool {
+		a, b := stats.Extensions[i], stats.Extensions[j]
+		if a.Bytes != b.Bytes {
+			return a.Bytes > b.Bytes
+		}
+		return a.Extension < b.Extension
+	})
+
+	return stats
+}
+
+// formatBytes formats a byte count using binary units
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// printInfo prints a summary of a snapshot: version, entry counts, total
+// size, the largest files and a breakdown by extension
+func printInfo(configFile string, opts snapdir.Options, w io.Writer) error {
+	snapshot, err := loadEntries(configFile, opts)
+	if err != nil {
+		return err
+	}
+
+	stats := collectStats(snapshot, infoTopFiles)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	name := configFile
+	if name == stdioName {
+		name = "(standard input)"
+	}
+	fmt.Fprintf(tw, "Snapshot:\t%s\n", name)
+	fmt.Fprintf(tw, "Version:\t%s\n", stats.Version)
+	fmt.Fprintf(tw, "Entries:\t%d (%d files, %d directories)\n", stats.Files+stats.Dirs, stats.Files, stats.Dirs)
+	fmt.Fprintf(tw, "Total size:\t%s (%d bytes)\n", formatBytes(stats.TotalBytes), stats.TotalBytes)
+	if err := tw.Flush(); err != nil {
+		return fmt.Errorf("failed to write info: %w", err)
+	}
+
+	if len(stats.Largest) > 0 {
+		fmt.Fprintf(w, "\nLargest files:\n")
+		tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+		for _, file := range stats.Largest {
+			fmt.Fprintf(tw, "  %s\t  %s\n", formatBytes(file.Size), file.Path)
+		}
+		if err := tw.Flush(); err != nil {
+			return fmt.Errorf("failed to write info: %w", err)
+		}
+
+		fmt.Fprintf(w, "\nBy extension:\n")
+		tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		for _, ext := range stats.Extensions {
+			noun := "files"
+			if ext.Files == 1 {
+				noun = "file"
+			}
+			fmt.Fprintf(tw, "  %s\t%d %s\t%s\n", ext.Extension, ext.Files, noun, formatBytes(ext.Bytes))
+		}
+		if err := tw.Flush(); err != nil {
+			return fmt.Errorf("failed to write info: %w", err)
+		}
+	}
+
+	return nil
+}
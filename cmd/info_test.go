@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/supperdoggy/snapdir"
+)
+
+func TestCollectStats(t *testing.T) {
+	snapshot := snapdir.ProjectSnapshot{
+		Version: version,
+		Files: []snapdir.FileInfo{
+			{Path: "src", IsDir: true},
+			{Path: "src/main.go", Size: 300},
+			{Path: "src/util.go", Size: 100},
+			{Path: "logo.PNG", Size: 5000},
+			{Path: "Makefile", Size: 50},
+		},
+	}
+
+	stats := collectStats(snapshot, 2)
+
+	if stats.Files != 4 || stats.Dirs != 1 {
+		t.Errorf("counts = %d files, %d dirs, want 4 files, 1 dir", stats.Files, stats.Dirs)
+	}
+	if stats.TotalBytes != 5450 {
+		t.Errorf("TotalBytes = %d, want 5450", stats.TotalBytes)
+	}
+
+	if len(stats.Largest) != 2 || stats.Largest[0].Path != "logo.PNG" || stats.Largest[1].Path != "src/main.go" {
+		t.Errorf("Largest = %+v", stats.Largest)
+	}
+
+	wantExt := []extensionStats{
+		{Extension: ".png", Files: 1, Bytes: 5000},
+		{Extension: ".go", Files: 2, Bytes: 400},
+		{Extension: "(none)", Files: 1, Bytes: 50},
+	}
+	if len(stats.Extensions) != len(wantExt) {
+		t.Fatalf("Extensions = %+v, want %+v", stats.Extensions, wantExt)
+	}
+	for i, want := range wantExt {
+		if stats.Extensions[i] != want {
+			t.Errorf("Extensions[%d] = %+v, want %+v", i, stats.Extensions[i], want)
+		}
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{1536, "1.5 KiB"},
+		{100 * 1024 * 1024, "100.0 MiB"},
+		{3 * 1024 * 1024 * 1024, "3.0 GiB"},
+	}
+
+	for _, tt := range tests {
+		if got := formatBytes(tt.n); got != tt.want {
+			t.Errorf("formatBytes(%d) = %q, want %q", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestPrintInfo(t *testing.T) {
+	snapshotFile := writeTestSnapshot(t, snapdir.ProjectSnapshot{
+		Version: version,
+		Files: []snapdir.FileInfo{
+			{Path: "docs", IsDir: true, Mode: 0755},
+			{Path: "docs/guide.md", Contents: "# Guide", Mode: 0644},
+			{Path: "main.go", Contents: "package main", Mode: 0644},
+		},
+	})
+
+	var buf bytes.Buffer
+	if err := printInfo(snapshotFile, snapdir.Options{}, &buf); err != nil {
+		t.Fatalf("printInfo() error = %v", err)
+	}
+
+	out := buf.String()
+	for _, want := range []string{
+		"Version:     " + version,
+		"Entries:     3 (2 files, 1 directories)",
+		"Total size:  19 B (19 bytes)",
+		"main.go",
+		".md  1 file  7 B",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("printInfo() output missing %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestPrintInfoIncremental(t *testing.T) {
+	snapshotFile := writeIncrementalSnapshot(t)
+
+	var buf bytes.Buffer
+	if err := printInfo(snapshotFile, snapdir.Options{}, &buf); err != nil {
+		t.Fatalf("printInfo() error = %v", err)
+	}
+	out := buf.String()
+	for _, want := range []string{
+		"Entries:     2 (2 files, 0 directories)",
+		"Total size:  16 B (16 bytes)",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("printInfo() output missing %q:\n%s", want, out)
+		}
+	}
+}
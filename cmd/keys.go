@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/supperdoggy/snapdir"
+)
+
+// passphraseEnv names the environment variable holding the passphrase of
+// encrypted snapshots
+const passphraseEnv = "SNAPDIR_PASSPHRASE"
+
+// generateKey writes a new secret key to keyFile, which must not exist yet,
+// and prints its public key to w
+func generateKey(keyFile string, w io.Writer) error {
+	identity, err := snapdir.GenerateX25519Identity()
+	if err != nil {
+		return err
+	}
+	return writeKeyFile(keyFile, identity.String(), identity.Recipient().String(), w)
+}
+
+// writeKeyFile writes a secret key, with its public key as a comment, to
+// keyFile, which must not exist yet, and prints the public key to w
+func writeKeyFile(keyFile, secret, public string, w io.Writer) error {
+	file, err := os.OpenFile(keyFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create key file: %w", err)
+	}
+	_, err = fmt.Fprintf(file, "# public key: %s\n%s\n", public, secret)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(keyFile)
+		return fmt.Errorf("failed to write key file: %w", err)
+	}
+
+	fmt.Fprintf(w, "Public key: %s\n", public)
+	return nil
+}
+
+// loadIdentities reads the secret keys in keyFile, one per line
+func loadIdentities(keyFile string) ([]snapdir.Identity, error) {
+	var identities []snapdir.Identity
+	err := readKeyFile(keyFile, func(line string) error {
+		identity, err := snapdir.ParseX25519Identity(line)
+		if err != nil {
+			return err
+		}
+		identities = append(identities, identity)
+		return nil
+	})
+	return identities, err
+}
+
+// readKeyFile calls parse for every key in keyFile. Empty lines and lines
+// starting with # are skipped; a file without keys is an error.
+func readKeyFile(keyFile string, parse func(line string) error) error {
+	file, err := os.Open(keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to open key file: %w", err)
+	}
+	defer file.Close()
+
+	keys := 0
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := parse(line); err != nil {
+			return fmt.Errorf("%s:%d: %w", keyFile, n, err)
+		}
+		keys++
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read key file: %w", err)
+	}
+	if keys == 0 {
+		return fmt.Errorf("no keys found in %s", keyFile)
+	}
+	return nil
+}
+
+// parseRecipients parses a comma-separated list of public keys
+func parseRecipients(list string) ([]snapdir.Recipient, error) {
+	var recipients []snapdir.Recipient
+	for _, key := range strings.Split(list, ",") {
+		recipient, err := snapdir.ParseX25519Recipient(strings.TrimSpace(key))
+		if err != nil {
+			return nil, err
+		}
+		recipients = append(recipients, recipient)
+	}
+	return recipients, nil
+}
+
+// readPassphrase returns the passphrase from passphraseFile or, if that is
+// empty, from the SNAPDIR_PASSPHRASE environment variable. It returns an
+// empty string if neither is set.
+func readPassphrase(passphraseFile string) (string, error) {
+	if passphraseFile == "" {
+		return os.Getenv(passphraseEnv), nil
+	}
+	data, err := os.ReadFile(passphraseFile)
+	if err != nil {
+		return "", fmt.Errorf("failed to read passphrase file: %w", err)
+	}
+	passphrase := strings.TrimRight(string(data), "\r\n")
+	if passphrase == "" {
+		return "", fmt.Errorf("passphrase file %s is empty", passphraseFile)
+	}
+	return passphrase, nil
+}
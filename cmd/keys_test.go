@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/supperdoggy/snapdir"
+)
+
+func TestGenerateAndLoadKey(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "key.txt")
+
+	var out bytes.Buffer
+	if err := generateKey(keyFile, &out); err != nil {
+		t.Fatalf("generateKey() error = %v", err)
+	}
+	if err := generateKey(keyFile, io.Discard); err == nil {
+		t.Error("generateKey() should not overwrite an existing key file")
+	}
+
+	info, err := os.Stat(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("key file mode = %o, want 600", perm)
+	}
+
+	identities, err := loadIdentities(keyFile)
+	if err != nil {
+		t.Fatalf("loadIdentities() error = %v", err)
+	}
+	public := strings.TrimSpace(strings.TrimPrefix(out.String(), "Public key: "))
+	identity := identities[0].(*snapdir.X25519Identity)
+	if identity.Recipient().String() != public {
+		t.Errorf("loaded key has public key %s, printed %s", identity.Recipient(), public)
+	}
+
+	if _, err := parseRecipients(public + ", " + public); err != nil {
+		t.Errorf("parseRecipients() error = %v", err)
+	}
+	if _, err := parseRecipients("not-a-key"); err == nil {
+		t.Error("parseRecipients() should reject invalid keys")
+	}
+}
+
+func TestEncryptedSnapshotCommands(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "src")
+	if err := os.MkdirAll(source, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(source, "notes.txt"), []byte("classified"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	keyFile := filepath.Join(dir, "key.txt")
+	var out bytes.Buffer
+	if err := generateKey(keyFile, &out); err != nil {
+		t.Fatal(err)
+	}
+	recipients, err := parseRecipients(strings.TrimPrefix(strings.TrimSpace(out.String()), "Public key: "))
+	if err != nil {
+		t.Fatal(err)
+	}
+	identities, err := loadIdentities(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	snapshotFile := filepath.Join(dir, "snapshot.json")
+	if err := cloneProject(ctx, source, snapshotFile, snapdir.Options{Recipients: recipients}); err != nil {
+		t.Fatalf("cloneProject() error = %v", err)
+	}
+	data, err := os.ReadFile(snapshotFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("notes.txt")) {
+		t.Fatal("snapshot was written in plaintext")
+	}
+
+	// Every reader fails without the key and with the wrong one
+	wrong := []snapdir.Identity{snapdir.Passphrase("wrong")}
+	if err := catFile(snapshotFile, "notes.txt", snapdir.Options{}, io.Discard, newLogger(io.Discard, false)); !errors.Is(err, snapdir.ErrEncrypted) {
+		t.Errorf("catFile() without key error = %v", err)
+	}
+	if err := listSnapshot(snapshotFile, "", listOptions{read: snapdir.Options{Identities: wrong}}, io.Discard); !errors.Is(err, snapdir.ErrWrongKey) {
+		t.Errorf("listSnapshot() with wrong key error = %v", err)
+	}
+	if err := restoreProject(ctx, snapshotFile, filepath.Join(dir, "fail"), nil, snapdir.Options{}); err == nil {
+		t.Error("restoreProject() without key should fail")
+	}
+	if _, err := diffProject(ctx, snapshotFile, source, snapdir.Options{Identities: wrong}, io.Discard); err == nil {
+		t.Error("diffProject() with wrong key should fail")
+	}
+
+	var buf bytes.Buffer
+	if err := catFile(snapshotFile, "notes.txt", snapdir.Options{Identities: identities}, &buf, newLogger(io.Discard, false)); err != nil {
+		t.Fatalf("catFile() error = %v", err)
+	}
+	if buf.String() != "classified" {
+		t.Errorf("catFile() wrote %q", buf.String())
+	}
+
+	buf.Reset()
+	if err := listSnapshot(snapshotFile, "", listOptions{read: snapdir.Options{Identities: identities}}, &buf); err != nil {
+		t.Fatalf("listSnapshot() error = %v", err)
+	}
+	if !strings.Contains(buf.String(), "notes.txt") {
+		t.Errorf("listSnapshot() output = %q", buf.String())
+	}
+
+	opts := snapdir.Options{Identities: identities}
+	changes, err := diffProject(ctx, snapshotFile, source, opts, io.Discard)
+	if err != nil || changes != 0 {
+		t.Errorf("diffProject() = %d, %v, want no changes", changes, err)
+	}
+
+	restored := filepath.Join(dir, "restored")
+	if err := restoreProject(ctx, snapshotFile, restored, nil, opts); err != nil {
+		t.Fatalf("restoreProject() error = %v", err)
+	}
+	content, err := os.ReadFile(filepath.Join(restored, "notes.txt"))
+	if err != nil || string(content) != "classified" {
+		t.Errorf("restored file = %q, %v", content, err)
+	}
+}
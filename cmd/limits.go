@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/supperdoggy/snapdir"
+)
+
+// byteSize is a flag holding a size in bytes, given as a plain number or
+// with a K, M, G or T suffix (powers of 1024). Negative values mean no
+// limit.
+type byteSize int64
+
+func (s *byteSize) String() string {
+	return strconv.FormatInt(int64(*s), 10)
+}
+
+func (s *byteSize) Set(value string) error {
+	value = strings.TrimSpace(value)
+	shift := 0
+	if n := len(value); n > 0 {
+		switch strings.ToUpper(value[n-1:]) {
+		case "K":
+			shift = 10
+		case "M":
+			shift = 20
+		case "G":
+			shift = 30
+		case "T":
+			shift = 40
+		}
+		if shift > 0 {
+			value = value[:n-1]
+		}
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid size %q", value)
+	}
+	if n > 0 && n > (1<<63-1)>>shift {
+		return fmt.Errorf("size %q is too large", value)
+	}
+	*s = byteSize(n << shift)
+	return nil
+}
+
+// checkSnapshotFile reads a snapshot file one entry at a time and fails if
+// it breaks opts.Limits, before it is loaded into memory as a whole
+func checkSnapshotFile(configFile string, opts snapdir.Options) error {
+	f, err := os.Open(configFile)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	defer f.Close()
+
+	if err := snapdir.CheckSnapshot(f, opts); err != nil {
+		return fmt.Errorf("refusing to restore %s: %w", configFile, err)
+	}
+	return nil
+}
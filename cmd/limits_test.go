@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/supperdoggy/snapdir"
+)
+
+func TestByteSize(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    int64
+		wantErr bool
+	}{
+		{"1024", 1024, false},
+		{"10K", 10 << 10, false},
+		{"500m", 500 << 20, false},
+		{"2G", 2 << 30, false},
+		{"1T", 1 << 40, false},
+		{"-1", -1, false},
+		{"", 0, true},
+		{"1.5G", 0, true},
+		{"G", 0, true},
+		{"9999999T", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			var size byteSize
+			err := size.Set(tt.input)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Set(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			}
+			if !tt.wantErr && int64(size) != tt.want {
+				t.Errorf("Set(%q) = %d, want %d", tt.input, size, tt.want)
+			}
+		})
+	}
+}
+
+func TestRestoreProjectLimits(t *testing.T) {
+	dir := t.TempDir()
+	snapshotFile := filepath.Join(dir, "snapshot.json")
+	input := `{"version": "1.0.0", "files": [{"path": "a/b/c/d.txt", "contents": "deep"}]}`
+	if err := os.WriteFile(snapshotFile, []byte(input), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	restored := filepath.Join(dir, "restored")
+	opts := snapdir.Options{Limits: snapdir.RestoreLimits{MaxDepth: 3}}
+	if err := restoreProject(ctx, snapshotFile, restored, nil, opts); !errors.Is(err, snapdir.ErrLimitExceeded) {
+		t.Errorf("restoreProject() error = %v, want %v", err, snapdir.ErrLimitExceeded)
+	}
+	if _, err := os.Stat(restored); !os.IsNotExist(err) {
+		t.Error("restoreProject() wrote a snapshot over the limits")
+	}
+
+	opts.Limits.MaxDepth = 4
+	if err := restoreProject(ctx, snapshotFile, restored, nil, opts); err != nil {
+		t.Errorf("restoreProject() error = %v", err)
+	}
+}
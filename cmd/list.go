@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/supperdoggy/snapdir"
+)
+
+// shortHashLen is the number of hex digits of a content hash shown by ls
+const shortHashLen = 12
+
+// listOptions controls what the ls command prints
+type listOptions struct {
+	recursive bool
+	tree      bool
+	pattern   string
+	showTime  bool
+	showHash  bool
+
+	// read decrypts encrypted snapshots and follows their parents
+	read snapdir.Options
+}
+
+// loadEntries reads the entries of a snapshot, merged with its parents if
+// it is incremental, without keeping file contents in memory. Sizes are
+// filled in for snapshots that do not record them. Encrypted snapshots are
+// decrypted with opts.Identities.
+func loadEntries(configFile string, opts snapdir.Options) (snapdir.ProjectSnapshot, error) {
+	if err := validateInput(configFile); err != nil {
+		return snapdir.ProjectSnapshot{}, fmt.Errorf("invalid config file: %w", err)
+	}
+
+	snapshot := snapdir.ProjectSnapshot{Files: make([]snapdir.FileInfo, 0)}
+	var err error
+	snapshot.Version, err = scanInput(configFile, opts, func(fi snapdir.FileInfo) error {
+		if fi.Deleted {
+			return nil
+		}
+		fi.Size = fi.DataSize()
+		fi.Contents = ""
+		snapshot.Files = append(snapshot.Files, fi)
+		return nil
+	})
+	if err != nil {
+		return snapdir.ProjectSnapshot{}, err
+	}
+	return snapshot, nil
+}
+
+// isUnder reports whether p is inside the snapshot directory dir
+func isUnder(p, dir string) bool {
+	return dir == "" || strings.HasPrefix(p, dir+"/")
+}
+
+// listSnapshot prints the entries of a snapshot below prefix
+func listSnapshot(configFile, prefix string, opts listOptions, w io.Writer) error {
+	if _, err := path.Match(opts.pattern, ""); err != nil {
+		return fmt.Errorf("invalid pattern %q: %w", opts.pattern, err)
+	}
+
+	snapshot, err := loadEntries(configFile, opts.read)
+	if err != nil {
+		return err
+	}
+
+	prefix = cleanSnapshotPath(prefix)
+	entries := snapshot.Files
+
+	if prefix != "" {
+		var (
+			target      *snapdir.FileInfo
+			hasChildren bool
+		)
+		for i := range entries {
+			if entries[i].Path == prefix {
+				target = &entries[i]
+			} else if isUnder(entries[i].Path, prefix) {
+				hasChildren = true
+			}
+		}
+
+		if target == nil && !hasChildren {
+			return fmt.Errorf("path not found in snapshot: %s", prefix)
+		}
+
+		// Like ls, a file operand lists just that file
+		if target != nil && !target.IsDir {
+			if matchesPattern(*target, opts.pattern) {
+				printLongEntry(w, *target, opts, len(fmt.Sprint(target.Size)))
+			}
+			return nil
+		}
+	}
+
+	if opts.tree {
+		printTree(w, entries, prefix, opts.pattern)
+		return nil
+	}
+
+	var selected []snapdir.FileInfo
+	for _, entry := range entries {
+		if !isUnder(entry.Path, prefix) {
+			continue
+		}
+		rel := strings.TrimPrefix(entry.Path, prefix+"/")
+		if prefix == "" {
+			rel = entry.Path
+		}
+		if !opts.recursive && strings.Contains(rel, "/") {
+			continue
+		}
+		if !matchesPattern(entry, opts.pattern) {
+			continue
+		}
+		selected = append(selected, entry)
+	}
+
+	sort.Slice(selected, func(i, j int) bool {
+		return selected[i].Path < selected[j].Path
+	})
+
+	sizeWidth := 1
+	for _, entry := range selected {
+		if n := len(fmt.Sprint(entry.Size)); n > sizeWidth {
+			sizeWidth = n
+		}
+	}
+
+	for _, entry := range selected {
+		printLongEntry(w, entry, opts, sizeWidth)
+	}
+
+	return nil
+}
+
+// matchesPattern reports whether the base name of an entry matches a glob
+// pattern. An empty pattern matches everything.
+func matchesPattern(entry snapdir.FileInfo, pattern string) bool {
+	if pattern == "" {
+		return true
+	}
+	matched, _ := path.Match(pattern, path.Base(entry.Path))
+	return matched
+}
+
+// printLongEntry prints one entry in ls -l style: mode, size, optional
+// modification time and hash, and path
+func printLongEntry(w io.Writer, entry snapdir.FileInfo, opts listOptions, sizeWidth int) {
+	mode := fs.FileMode(entry.Mode).Perm()
+	if entry.IsDir {
+		mode |= fs.ModeDir
+	}
+	if entry.Link != "" {
+		mode |= fs.ModeSymlink
+	}
+
+	fields := []string{mode.String(), fmt.Sprintf("%*d", sizeWidth, entry.Size)}
+
+	if opts.showTime {
+		modTime := strings.Repeat("-", len("2006-01-02 15:04"))
+		if t, err := snapdir.ParseModTime(entry.ModTime); err == nil {
+			modTime = t.Local().Format("2006-01-02 15:04")
+		}
+		fields = append(fields, modTime)
+	}
+
+	if opts.showHash {
+		hash := strings.Repeat("-", shortHashLen)
+		if len(entry.SHA256) >= shortHashLen {
+			hash = entry.SHA256[:shortHashLen]
+		}
+		fields = append(fields, hash)
+	}
+
+	name := entry.Path
+	if entry.Link != "" {
+		name += " -> " + entry.Link
+	}
+	fields = append(fields, name)
+	fmt.Fprintln(w, strings.Join(fields, "  "))
+}
+
+// printTree prints the entries below prefix as an indented tree. With a
+// pattern only matching entries and the directories leading to them are shown.
+func printTree(w io.Writer, entries []snapdir.FileInfo, prefix, pattern string) {
+	included := make(map[string]bool)
+	for _, entry := range entries {
+		if !isUnder(entry.Path, prefix) || !matchesPattern(entry, pattern) {
+			continue
+		}
+		if pattern != "" && entry.IsDir {
+			continue
+		}
+		for p := entry.Path; p != prefix && p != "."; p = path.Dir(p) {
+			included[p] = true
+		}
+	}
+
+	children := make(map[string][]string)
+	for p := range included {
+		parent := path.Dir(p)
+		if parent == "." {
+			parent = ""
+		}
+		children[parent] = append(children[parent], p)
+	}
+	for _, names := range children {
+		sort.Strings(names)
+	}
+
+	root := prefix
+	if root == "" {
+		root = "."
+	}
+	fmt.Fprintln(w, root)
+
+	var walk func(dir, indent string)
+	walk = func(dir, indent string) {
+		names := children[dir]
+		for i, p := range names {
+			branch, next := "├── ", "│   "
+			if i == len(names)-1 {
+				branch, next = "└── ", "    "
+			}
+			fmt.Fprintf(w, "%s%s%s\n", indent, branch, path.Base(p))
+			walk(p, indent+next)
+		}
+	}
+	walk(prefix, "")
+}
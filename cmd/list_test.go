@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/supperdoggy/snapdir"
+)
+
+func listTestSnapshot(t *testing.T) string {
+	t.Helper()
+
+	return writeTestSnapshot(t, snapdir.ProjectSnapshot{
+		Version: version,
+		Files: []snapdir.FileInfo{
+			{Path: "README.md", Contents: "readme", Mode: 0644, SHA256: snapdir.HashContents([]byte("readme"))},
+			{Path: "src", IsDir: true, Mode: 0755},
+			{Path: "src/main.go", Contents: "package main", Mode: 0644},
+			{Path: "src/util", IsDir: true, Mode: 0755},
+			{Path: "src/util/util.go", Contents: "package util", Mode: 0644},
+			{Path: "src/util/notes.txt", Contents: "notes", Mode: 0600},
+		},
+	})
+}
+
+func TestListSnapshot(t *testing.T) {
+	snapshotFile := listTestSnapshot(t)
+
+	tests := []struct {
+		name   string
+		prefix string
+		opts   listOptions
+		want   string
+	}{
+		{
+			name: "top level",
+			want: "-rw-r--r--  6  README.md\n" +
+				"drwxr-xr-x  0  src\n",
+		},
+		{
+			name:   "directory prefix",
+			prefix: "src",
+			want: "-rw-r--r--  12  src/main.go\n" +
+				"drwxr-xr-x   0  src/util\n",
+		},
+		{
+			name:   "file prefix",
+			prefix: "./src/util/notes.txt",
+			want:   "-rw-------  5  src/util/notes.txt\n",
+		},
+		{
+			name:   "recursive",
+			prefix: "src",
+			opts:   listOptions{recursive: true},
+			want: "-rw-r--r--  12  src/main.go\n" +
+				"drwxr-xr-x   0  src/util\n" +
+				"-rw-------   5  src/util/notes.txt\n" +
+				"-rw-r--r--  12  src/util/util.go\n",
+		},
+		{
+			name: "recursive with glob",
+			opts: listOptions{recursive: true, pattern: "*.go"},
+			want: "-rw-r--r--  12  src/main.go\n" +
+				"-rw-r--r--  12  src/util/util.go\n",
+		},
+		{
+			name: "hash column",
+			opts: listOptions{showHash: true},
+			want: "-rw-r--r--  6  " + snapdir.HashContents([]byte("readme"))[:shortHashLen] + "  README.md\n" +
+				"drwxr-xr-x  0  ------------  src\n",
+		},
+		{
+			name: "tree",
+			opts: listOptions{tree: true},
+			want: ".\n" +
+				"├── README.md\n" +
+				"└── src\n" +
+				"    ├── main.go\n" +
+				"    └── util\n" +
+				"        ├── notes.txt\n" +
+				"        └── util.go\n",
+		},
+		{
+			name:   "tree with prefix and glob",
+			prefix: "src",
+			opts:   listOptions{tree: true, pattern: "*.txt"},
+			want: "src\n" +
+				"└── util\n" +
+				"    └── notes.txt\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := listSnapshot(snapshotFile, tt.prefix, tt.opts, &buf); err != nil {
+				t.Fatalf("listSnapshot() error = %v", err)
+			}
+			if got := buf.String(); got != tt.want {
+				t.Errorf("listSnapshot() output:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListSnapshotErrors(t *testing.T) {
+	snapshotFile := listTestSnapshot(t)
+
+	tests := []struct {
+		name       string
+		configFile string
+		prefix     string
+		opts       listOptions
+	}{
+		{
+			name:       "missing prefix",
+			configFile: snapshotFile,
+			prefix:     "docs",
+		},
+		{
+			name:       "invalid pattern",
+			configFile: snapshotFile,
+			opts:       listOptions{pattern: "[a-"},
+		},
+		{
+			name:       "missing config",
+			configFile: "/nonexistent/config.json",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := listSnapshot(tt.configFile, tt.prefix, tt.opts, &buf); err == nil {
+				t.Error("listSnapshot() should fail")
+			}
+		})
+	}
+}
+
+func TestListSnapshotModTime(t *testing.T) {
+	snapshotFile := writeTestSnapshot(t, snapdir.ProjectSnapshot{
+		Version: version,
+		Files: []snapdir.FileInfo{
+			{Path: "a.txt", Contents: "a", Mode: 0644, ModTime: "2024-03-01T12:30:00Z"},
+			{Path: "b.txt", Contents: "b", Mode: 0644},
+		},
+	})
+
+	var buf bytes.Buffer
+	if err := listSnapshot(snapshotFile, "", listOptions{showTime: true}, &buf); err != nil {
+		t.Fatalf("listSnapshot() error = %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %q", buf.String())
+	}
+	if !strings.Contains(lines[0], "2024-03-0") {
+		t.Errorf("expected modification time in %q", lines[0])
+	}
+	if !strings.Contains(lines[1], "----------------") {
+		t.Errorf("expected placeholder for missing modification time in %q", lines[1])
+	}
+}
+
+func TestListSnapshotIncremental(t *testing.T) {
+	snapshotFile := writeIncrementalSnapshot(t)
+
+	var buf bytes.Buffer
+	if err := listSnapshot(snapshotFile, "", listOptions{}, &buf); err != nil {
+		t.Fatalf("listSnapshot() error = %v", err)
+	}
+	want := "-rw-r--r--  9  a.txt\n" +
+		"-rw-r--r--  7  b.txt\n"
+	if buf.String() != want {
+		t.Errorf("listSnapshot() =\n%s\nwant\n%s", buf.String(), want)
+	}
+
+	data, err := os.ReadFile(snapshotFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	useStdio(t, data)
+	if err := listSnapshot(stdioName, "", listOptions{}, io.Discard); err == nil || !strings.Contains(err.Error(), "incremental") {
+		t.Errorf("listSnapshot(-) error = %v, want incremental snapshots rejected", err)
+	}
+}
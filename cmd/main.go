@@ -2,96 +2,51 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
-	"io/fs"
+	"io"
 	"log"
+	"log/slog"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
-)
+	"syscall"
+	"time"
 
-const (
-	version        = "1.0.0"
-	defaultPerms   = 0644
-	dirPerms       = 0755
-	maxFileSize    = 100 * 1024 * 1024 // 100MB limit
-	jsonIndent     = "  "
+	"github.com/supperdoggy/snapdir"
 )
 
-var (
-	verbose        bool
-	ignorePatterns []string
+const (
+	version      = snapdir.Version
+	defaultPerms = 0644
 )
 
-// FileInfo represents a file or directory in the snapshot
-type FileInfo struct {
-	Path     string `json:"path"`
-	Contents string `json:"contents,omitempty"`
-	IsDir    bool   `json:"is_dir"`
-	Mode     uint32 `json:"mode,omitempty"`
-}
-
-// ProjectSnapshot represents the complete directory snapshot
-type ProjectSnapshot struct {
-	Version string     `json:"version"`
-	Files   []FileInfo `json:"files"`
-}
-
-// shouldIgnore checks if a path should be ignored based on patterns
-func shouldIgnore(path string, patterns []string) bool {
-	for _, pattern := range patterns {
-		matched, err := filepath.Match(pattern, filepath.Base(path))
-		if err != nil {
-			logVerbose("Warning: invalid pattern %q: %v", pattern, err)
-			continue
-		}
-		if matched {
-			return true
-		}
-
-		// Check if path contains pattern as a directory component
-		if strings.Contains(filepath.ToSlash(path), pattern) {
-			return true
-		}
+// newLogger returns the logger used by the CLI. Verbose mode shows progress
+// messages, otherwise only warnings and errors are logged.
+func newLogger(w io.Writer, verbose bool) *slog.Logger {
+	level := slog.LevelWarn
+	if verbose {
+		level = slog.LevelDebug
 	}
-	return false
+	return slog.New(slog.NewTextHandler(w, &slog.HandlerOptions{Level: level}))
 }
 
-// loadGitignore loads .gitignore patterns from the source directory
-func loadGitignore(source string) []string {
-	patterns := []string{".git"}
-	gitignorePath := filepath.Join(source, ".gitignore")
-
-	file, err := os.Open(gitignorePath)
-	if err != nil {
-		logVerbose("No .gitignore found, using default patterns")
-		return patterns
-	}
-	defer file.Close()
-
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" || strings.HasPrefix(line, "#") {
-			continue
-		}
-		patterns = append(patterns, line)
+// sourceDateEpoch reads the SOURCE_DATE_EPOCH environment variable used by
+// reproducible builds. It returns the zero time if the variable is not set.
+func sourceDateEpoch() (time.Time, error) {
+	value := os.Getenv("SOURCE_DATE_EPOCH")
+	if value == "" {
+		return time.Time{}, nil
 	}
-
-	if err := scanner.Err(); err != nil {
-		logVerbose("Warning: error reading .gitignore: %v", err)
-	}
-
-	return patterns
-}
-
-// logVerbose logs a message if verbose mode is enabled
-func logVerbose(format string, args ...any) {
-	if verbose {
-		log.Printf(format, args...)
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid SOURCE_DATE_EPOCH %q: %w", value, err)
 	}
+	return time.Unix(seconds, 0).UTC(), nil
 }
 
 // validatePath ensures a path exists and is accessible
@@ -113,180 +68,235 @@ func validatePath(path string, mustExist bool) error {
 }
 
 // cloneProject creates a snapshot of the source directory
-func cloneProject(source, outputFile string) error {
+func cloneProject(ctx context.Context, source, outputFile string, opts snapdir.Options) error {
 	if err := validatePath(source, true); err != nil {
 		return fmt.Errorf("invalid source path: %w", err)
 	}
 
-	sourceInfo, err := os.Stat(source)
+	err := writeOutputFile(outputFile, func(w io.Writer) error {
+		return snapdir.Clone(ctx, source, w, opts)
+	})
 	if err != nil {
-		return fmt.Errorf("failed to stat source: %w", err)
-	}
-
-	if !sourceInfo.IsDir() {
-		return fmt.Errorf("source must be a directory: %s", source)
+		return err
 	}
 
-	patterns := loadGitignore(source)
-	if len(ignorePatterns) > 0 {
-		patterns = append(patterns, ignorePatterns...)
+	if opts.Logger != nil {
+		opts.Logger.Debug("snapshot saved", "output", outputFile)
 	}
+	return nil
+}
 
-	logVerbose("Starting snapshot of %s", source)
-	logVerbose("Ignore patterns: %v", patterns)
-
-	snapshot := ProjectSnapshot{
-		Version: version,
-		Files:   make([]FileInfo, 0),
-	}
-
-	fileCount := 0
-	err = filepath.WalkDir(source, func(path string, d fs.DirEntry, err error) error {
-		if err != nil {
-			return fmt.Errorf("error accessing %s: %w", path, err)
-		}
-
-		relPath, err := filepath.Rel(source, path)
-		if err != nil {
-			return fmt.Errorf("failed to get relative path for %s: %w", path, err)
-		}
-
-		if relPath == "." {
-			return nil
-		}
-
-		if shouldIgnore(relPath, patterns) {
-			logVerbose("Ignoring: %s", relPath)
-			if d.IsDir() {
-				return filepath.SkipDir
-			}
-			return nil
-		}
-
-		info, err := d.Info()
-		if err != nil {
-			return fmt.Errorf("failed to get file info for %s: %w", path, err)
-		}
-
-		fileInfo := FileInfo{
-			Path:  filepath.ToSlash(relPath),
-			IsDir: d.IsDir(),
-			Mode:  uint32(info.Mode().Perm()),
+// writeOutputFile calls write with a temporary file next to outputFile and
+// only renames it into place once write succeeded, so a failed command
+// never leaves a truncated snapshot behind. For "-" it writes to standard
+// output instead.
+func writeOutputFile(outputFile string, write func(io.Writer) error) error {
+	if outputFile == stdioName {
+		bw := bufio.NewWriter(stdout)
+		if err := write(bw); err != nil {
+			return err
 		}
-
-		if !d.IsDir() {
-			if info.Size() > maxFileSize {
-				logVerbose("Skipping large file: %s (size: %d bytes)", relPath, info.Size())
-				return nil
-			}
-
-			data, err := os.ReadFile(path)
-			if err != nil {
-				return fmt.Errorf("failed to read file %s: %w", path, err)
-			}
-			fileInfo.Contents = string(data)
-			fileCount++
+		if err := bw.Flush(); err != nil {
+			return fmt.Errorf("failed to write output: %w", err)
 		}
-
-		snapshot.Files = append(snapshot.Files, fileInfo)
-		logVerbose("Added: %s", relPath)
-
 		return nil
-	})
+	}
 
+	tmp, err := os.CreateTemp(filepath.Dir(outputFile), ".snapdir-*.json")
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to create output file: %w", err)
 	}
+	defer os.Remove(tmp.Name())
 
-	logVerbose("Snapshot complete: %d files, %d total entries", fileCount, len(snapshot.Files))
-
-	jsonData, err := json.MarshalIndent(snapshot, "", jsonIndent)
-	if err != nil {
-		return fmt.Errorf("failed to marshal JSON: %w", err)
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return err
 	}
 
-	if err := os.WriteFile(outputFile, jsonData, defaultPerms); err != nil {
+	if err := tmp.Chmod(defaultPerms); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write output file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write output file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), outputFile); err != nil {
 		return fmt.Errorf("failed to write output file: %w", err)
 	}
-
-	logVerbose("Snapshot saved to: %s", outputFile)
 	return nil
 }
 
-// restoreProject restores a directory from a snapshot file
-func restoreProject(configFile, destination string) error {
-	if err := validatePath(configFile, true); err != nil {
+// flattenSnapshot merges an incremental snapshot with its chain of parents
+// into a single full snapshot, written as opts say
+func flattenSnapshot(configFile, outputFile string, opts snapdir.Options) error {
+	if err := validateInput(configFile); err != nil {
 		return fmt.Errorf("invalid config file: %w", err)
 	}
 
-	data, err := os.ReadFile(configFile)
+	snapshot, err := openSnapshot(configFile, opts)
 	if err != nil {
-		return fmt.Errorf("failed to read config file: %w", err)
-	}
-
-	var snapshot ProjectSnapshot
-	if err := json.Unmarshal(data, &snapshot); err != nil {
-		return fmt.Errorf("failed to parse config file: %w", err)
+		return err
 	}
 
-	logVerbose("Restoring snapshot (version: %s) to %s", snapshot.Version, destination)
+	return writeOutputFile(outputFile, func(w io.Writer) error {
+		return writeSnapshot(w, snapshot, opts)
+	})
+}
 
-	if _, err := os.Stat(destination); err == nil {
-		return fmt.Errorf("destination already exists: %s (remove it first or choose a different location)", destination)
+// writeSnapshot writes a snapshot that is in memory as JSON, compressed and
+// encrypted as opts say
+func writeSnapshot(w io.Writer, snapshot snapdir.ProjectSnapshot, opts snapdir.Options) error {
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal JSON: %w", err)
 	}
 
-	if err := os.MkdirAll(destination, dirPerms); err != nil {
-		return fmt.Errorf("failed to create destination directory: %w", err)
+	ew, err := snapdir.EncodeWriter(w, opts.Compression, opts.Recipients...)
+	if err != nil {
+		return err
 	}
+	if _, err := ew.Write(data); err != nil {
+		return err
+	}
+	return ew.Close()
+}
 
-	for _, file := range snapshot.Files {
-		path := filepath.Join(destination, filepath.FromSlash(file.Path))
-
-		if file.IsDir {
-			if err := os.MkdirAll(path, fs.FileMode(file.Mode)); err != nil {
-				return fmt.Errorf("failed to create directory %s: %w", file.Path, err)
-			}
-			logVerbose("Created directory: %s", file.Path)
-		} else {
-			parentDir := filepath.Dir(path)
-			if err := os.MkdirAll(parentDir, dirPerms); err != nil {
-				return fmt.Errorf("failed to create parent directory for %s: %w", file.Path, err)
-			}
+// restoreProject restores a directory from a snapshot file, or from
+// standard input for "-". If trusted keys are given, nothing is written
+// unless the snapshot carries a valid signature by one of them.
+func restoreProject(ctx context.Context, configFile, destination string, trusted []*snapdir.VerifyKey, opts snapdir.Options) error {
+	if configFile == stdioName {
+		if len(trusted) > 0 {
+			return fmt.Errorf("signatures can only be checked for snapshot files")
+		}
+		// Restore checks the stream against the limits as it decodes it
+		return snapdir.Restore(ctx, stdin, destination, opts)
+	}
+	if err := validatePath(configFile, true); err != nil {
+		return fmt.Errorf("invalid config file: %w", err)
+	}
 
-			mode := fs.FileMode(file.Mode)
-			if mode == 0 {
-				mode = defaultPerms
-			}
+	if err := checkSnapshotFile(configFile, opts); err != nil {
+		return err
+	}
 
-			if err := os.WriteFile(path, []byte(file.Contents), mode); err != nil {
-				return fmt.Errorf("failed to write file %s: %w", file.Path, err)
-			}
-			logVerbose("Restored file: %s", file.Path)
+	var (
+		snapshot snapdir.ProjectSnapshot
+		err      error
+	)
+	if len(trusted) > 0 {
+		var signer *snapdir.VerifyKey
+		snapshot, signer, err = snapdir.OpenSignedSnapshotOptions(configFile, trusted, opts)
+		if err != nil {
+			return err
+		}
+		if opts.Logger != nil {
+			opts.Logger.Debug("signature verified", "signer", signer.String())
+		}
+	} else {
+		snapshot, err = snapdir.OpenSnapshotOptions(configFile, opts)
+		if err != nil {
+			return fmt.Errorf("failed to read config file: %w", err)
 		}
 	}
 
-	logVerbose("Restore complete: %d entries restored", len(snapshot.Files))
-	return nil
+	return snapdir.RestoreSnapshot(ctx, snapshot, destination, opts)
 }
 
 func printUsage() {
 	fmt.Fprintf(os.Stderr, "snapdir v%s - Directory snapshot and restore tool\n\n", version)
 	fmt.Fprintf(os.Stderr, "Usage:\n")
-	fmt.Fprintf(os.Stderr, "  %s clone <source_dir> <output.json> [flags]\n", os.Args[0])
-	fmt.Fprintf(os.Stderr, "  %s restore <config.json> <destination_dir> [flags]\n\n", os.Args[0])
-	fmt.Fprintf(os.Stderr, "Flags:\n")
-	flag.PrintDefaults()
+	for _, cmd := range commands {
+		for _, usage := range cmd.usage {
+			fmt.Fprintf(os.Stderr, "  %s %s %s [flags]\n", os.Args[0], cmd.name, usage)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "\nFlags may come before or after the arguments; run \"%s <command> -h\" to list\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "the flags of a command. A snapshot or archive file of \"-\" means standard input\n")
+	fmt.Fprintf(os.Stderr, "or output. Use %s -version to show version information.\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Flags not given default to the settings of .snapdir.toml or .snapdir.yaml in the\n")
+	fmt.Fprintf(os.Stderr, "source directory and of $XDG_CONFIG_HOME/snapdir/config; -profile picks a profile.\n")
 	fmt.Fprintf(os.Stderr, "\nExamples:\n")
 	fmt.Fprintf(os.Stderr, "  %s clone ./myproject snapshot.json -v\n", os.Args[0])
 	fmt.Fprintf(os.Stderr, "  %s restore snapshot.json ./restored -v\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s clone ./myproject - | ssh host snapdir restore - ./restored\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s clone -git tracked+untracked ./myrepo snapshot.json\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s clone -git-ref v1.2.0 ./myrepo release.json\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s restore -git-init -git-branch main template.json ./newproject\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s clone -parent monday.json ./myproject tuesday.json\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s diff -stat-cache .snapdir-cache snapshot.json ./myproject\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s clone -recipient snapdir-pub-... ./myproject secret.json\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s restore -identity key.txt secret.json ./restored\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s clone -secrets redact ./myproject shareable.json\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s clone -profile release -compress gzip ./myproject release.json\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s restore -key trusted-keys.txt template.json ./restored\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s save ./backups ./myproject\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s restore ./backups@latest ./restored\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s forget -keep-last 7 -keep-daily 30 ./backups\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s cat snapshot.json src/main.go\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s ls -R -glob '*.go' snapshot.json src\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s info snapshot.json\n", os.Args[0])
+}
+
+// requireArgs exits with usage information unless at least n positional
+// arguments were given
+func requireArgs(args []string, n int) {
+	if len(args) < n {
+		printUsage()
+		os.Exit(1)
+	}
 }
 
 func main() {
+	var verbose bool
 	flag.BoolVar(&verbose, "v", false, "Enable verbose logging")
 	flag.BoolVar(&verbose, "verbose", false, "Enable verbose logging (alias)")
 	var ignoreFlag string
 	flag.StringVar(&ignoreFlag, "ignore", "", "Additional ignore patterns (comma-separated)")
 	showVersion := flag.Bool("version", false, "Show version information")
+	jobs := flag.Int("jobs", 0, "Number of files to process in parallel (0 = one per CPU)")
+	reproducible := flag.Bool("reproducible", false, "Sort entries and drop modification times (or clamp them to SOURCE_DATE_EPOCH) for byte-identical snapshots")
+	gitFlag := flag.String("git", "off", "Take the files of a git work tree from git: tracked, tracked+untracked, all or off (use .gitignore)")
+	gitRef := flag.String("git-ref", "", "Snapshot this commit, tag or branch of the local git repository given as source")
+	gitInit := flag.Bool("git-init", false, "Create a git repository in the destination and commit the restored tree")
+	gitMessage := flag.String("git-commit-message", "", "Message of the -git-init commit (default \"Restore <snapshot>\")")
+	gitBranch := flag.String("git-branch", "", "Branch the -git-init commit is made on (default: git's default branch)")
+	parentFile := flag.String("parent", "", "Write an incremental snapshot against this parent snapshot")
+	externalParents := flag.Bool("external-parents", false, "Follow parents of incremental snapshots that are absolute or outside the snapshot directory")
+	statCachePath := flag.String("stat-cache", "", "File caching the hashes of unchanged files")
+	var message string
+	flag.StringVar(&message, "m", "", "Message recorded with the snapshot")
+	flag.StringVar(&message, "message", "", "Message recorded with the snapshot (alias)")
+	var policy snapdir.RetentionPolicy
+	flag.IntVar(&policy.KeepLast, "keep-last", 0, "Keep the n most recent snapshots")
+	flag.IntVar(&policy.KeepDaily, "keep-daily", 0, "Keep the most recent snapshot of each of the last n days")
+	recipientsFlag := flag.String("recipient", "", "Encrypt the snapshot to these public keys (comma-separated)")
+	identityFile := flag.String("identity", "", "File with secret keys that decrypt encrypted snapshots")
+	passphraseFile := flag.String("passphrase-file", "", "File holding the passphrase that encrypts written snapshots and decrypts read ones (default $"+passphraseEnv+")")
+	trustedFlag := flag.String("key", "", "Trusted public signing keys or files listing them (comma-separated); restore requires a valid signature by one")
+	secretsFlag := flag.String("secrets", "warn", "What to do with secrets found in files: warn, fail, redact or off")
+	secretRulesFile := flag.String("secret-rules", "", "JSON file with secret rules used in addition to the built-in ones")
+	secretValuesFile := flag.String("secret-values", "", "File of name=value lines filling in redacted secrets")
+	var limits snapdir.RestoreLimits
+	flag.IntVar(&limits.MaxEntries, "max-entries", snapdir.DefaultMaxEntries, "Most files and directories a snapshot may have (-1 = no limit)")
+	limits.MaxTotalSize = snapdir.DefaultMaxTotalSize
+	flag.Var((*byteSize)(&limits.MaxTotalSize), "max-total-size", "Largest total size of all files, e.g. 10G (-1 = no limit)")
+	limits.MaxFileSize = snapdir.DefaultMaxFileSize
+	flag.Var((*byteSize)(&limits.MaxFileSize), "max-file-size", "Largest size of a single file, e.g. 500M (-1 = no limit)")
+	flag.IntVar(&limits.MaxDepth, "max-depth", snapdir.DefaultMaxDepth, "Deepest directory nesting of an entry path (-1 = no limit)")
+	flag.IntVar(&limits.MaxPathLength, "max-path-length", snapdir.DefaultMaxPathLength, "Longest entry path in bytes (-1 = no limit)")
+	compressFlag := flag.String("compress", "none", "Compress written snapshots: gzip or none")
+	profile := flag.String("profile", "", "Use the settings of this profile of the config files")
+	var skipLargerThan byteSize = snapdir.DefaultMaxFileSize
+	flag.Var(&skipLargerThan, "skip-larger-than", "Leave files larger than this out of snapshots, e.g. 1G (-1 = no limit)")
+	symlinks := flag.Bool("symlinks", false, "Record symlinks as links instead of following them")
+	preserveOwner := flag.Bool("owner", false, "Record file ownership on clone and restore it on restore (usually requires root)")
+	var listOpts listOptions
+	flag.BoolVar(&listOpts.recursive, "R", false, "List entries recursively")
+	flag.BoolVar(&listOpts.tree, "tree", false, "Show entries as a tree")
+	flag.StringVar(&listOpts.pattern, "glob", "", "Only show entries whose name matches a glob pattern")
+	flag.BoolVar(&listOpts.showTime, "mtime", false, "Show modification times")
+	flag.BoolVar(&listOpts.showHash, "hash", false, "Show content hashes")
 
 	flag.Usage = printUsage
 	flag.Parse()
@@ -297,39 +307,319 @@ func main() {
 	}
 
 	args := flag.Args()
-	if len(args) < 3 {
+	requireArgs(args, 1)
+
+	cmd, ok := findCommand(args[0])
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Error: unknown command %q\n\n", args[0])
 		printUsage()
-		os.Exit(1)
+		os.Exit(2)
+	}
+	cmdFlags := cmd.flagSet(flag.CommandLine, flag.ExitOnError)
+	if err := checkGlobalFlags(flag.CommandLine, cmdFlags, cmd); err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	positional, _ := parseCommandArgs(cmdFlags, args[1:])
+	if len(positional) < cmd.minArgs || len(positional) > cmd.minArgs+cmd.optionalArgs {
+		fmt.Fprintf(os.Stderr, "Error: wrong number of arguments for %s\n\n", cmd.name)
+		cmdFlags.Usage()
+		os.Exit(2)
+	}
+	args = append([]string{cmd.name}, positional...)
+
+	logger := newLogger(os.Stderr, verbose)
+	if cmdFlags.Lookup("profile") != nil {
+		err := applyConfig(flag.CommandLine, cmdFlags, configDir(cmd.name, positional), *profile, logger)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
 	}
 
+	opts := snapdir.Options{
+		Logger:          logger,
+		Jobs:            *jobs,
+		MaxFileSize:     int64(skipLargerThan),
+		Symlinks:        *symlinks,
+		PreserveOwner:   *preserveOwner,
+		Reproducible:    *reproducible,
+		Message:         message,
+		Limits:          limits,
+		ExternalParents: *externalParents,
+	}
+	epoch, err := sourceDateEpoch()
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	opts.SourceDateEpoch = epoch
+	if *statCachePath != "" {
+		opts.StatCache, err = snapdir.OpenStatCache(*statCachePath)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+	}
+	if *recipientsFlag != "" {
+		opts.Recipients, err = parseRecipients(*recipientsFlag)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+	}
+	if *identityFile != "" {
+		opts.Identities, err = loadIdentities(*identityFile)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+	}
+	passphrase, err := readPassphrase(*passphraseFile)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	if passphrase != "" {
+		opts.Recipients = append(opts.Recipients, snapdir.Passphrase(passphrase))
+		opts.Identities = append(opts.Identities, snapdir.Passphrase(passphrase))
+	}
+	opts.Secrets, err = snapdir.ParseSecretAction(*secretsFlag)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	opts.Compression, err = snapdir.ParseCompression(*compressFlag)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	opts.Git, err = snapdir.ParseGitFiles(*gitFlag)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	if *secretRulesFile != "" {
+		opts.SecretRules, err = loadSecretRules(*secretRulesFile)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+	}
+	if *secretValuesFile != "" {
+		opts.SecretValues, err = loadSecretValues(*secretValuesFile)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+	}
+	var trusted []*snapdir.VerifyKey
+	if *trustedFlag != "" {
+		trusted, err = parseTrustedKeys(*trustedFlag)
+		if err != nil {
+			log.Fatalf("Error: %v", err)
+		}
+	}
 	if ignoreFlag != "" {
-		ignorePatterns = strings.Split(ignoreFlag, ",")
-		for i := range ignorePatterns {
-			ignorePatterns[i] = strings.TrimSpace(ignorePatterns[i])
+		opts.Ignore = strings.Split(ignoreFlag, ",")
+		for i := range opts.Ignore {
+			opts.Ignore[i] = strings.TrimSpace(opts.Ignore[i])
+		}
+	}
+
+	// Ctrl-C cancels the running command, which cleans up partial output
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// withProgress renders a progress bar on stderr while fn runs, unless
+	// stderr is not a terminal or verbose logging would garble it
+	withProgress := func(label string, fn func(snapdir.Options) error) error {
+		if verbose || !isTerminal(os.Stderr) {
+			return fn(opts)
+		}
+		bar := newProgressBar(os.Stderr, label)
+		progressOpts := opts
+		progressOpts.Progress = bar.Update
+		err := fn(progressOpts)
+		bar.Finish()
+		return err
+	}
+
+	// saveStatCache writes the stat cache back after a successful command;
+	// failing to do so only costs time on the next run
+	saveStatCache := func() {
+		if opts.StatCache == nil {
+			return
+		}
+		if err := opts.StatCache.Save(); err != nil {
+			opts.Logger.Warn("failed to save stat cache", "error", err)
 		}
 	}
 
 	command := args[0]
 
-	var err error
 	switch command {
 	case "clone":
-		err = cloneProject(args[1], args[2])
+		if *parentFile != "" {
+			opts.Parent, err = snapdir.OpenParentOptions(*parentFile, args[2], opts)
+			if err != nil {
+				log.Fatalf("Error: failed to load parent snapshot: %v", err)
+			}
+		}
+		err = withProgress("Cloning", func(opts snapdir.Options) error {
+			if *gitRef != "" {
+				return cloneGitRef(ctx, args[1], *gitRef, args[2], opts)
+			}
+			return cloneProject(ctx, args[1], args[2], opts)
+		})
 		if err != nil {
 			log.Fatalf("Error: failed to create snapshot: %v", err)
 		}
-		fmt.Println("Snapshot created successfully")
+		saveStatCache()
+		fmt.Fprintln(os.Stderr, "Snapshot created successfully")
 
 	case "restore":
-		err = restoreProject(args[1], args[2])
+		if !*gitInit && (*gitMessage != "" || *gitBranch != "") {
+			log.Fatalf("Error: -git-commit-message and -git-branch require -git-init")
+		}
+		if *gitInit {
+			if err := checkCommitRestore(ctx, args[2]); err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+		}
+		err = withProgress("Restoring", func(opts snapdir.Options) error {
+			if repoDir, ref, ok := splitRepoRef(args[1]); ok {
+				if len(trusted) > 0 {
+					return fmt.Errorf("signatures can only be checked for snapshot files")
+				}
+				return restoreFromRepo(ctx, repoDir, ref, args[2], opts)
+			}
+			return restoreProject(ctx, args[1], args[2], trusted, opts)
+		})
 		if err != nil {
 			log.Fatalf("Error: failed to restore snapshot: %v", err)
 		}
-		fmt.Println("Snapshot restored successfully")
+		if *gitInit {
+			if err := commitRestore(ctx, args[2], args[1], *gitBranch, *gitMessage); err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+		}
+		fmt.Fprintln(os.Stderr, "Snapshot restored successfully")
+
+	case "flatten":
+		if err := flattenSnapshot(args[1], args[2], opts); err != nil {
+			log.Fatalf("Error: failed to flatten snapshot: %v", err)
+		}
+		fmt.Fprintln(os.Stderr, "Snapshot flattened successfully")
+
+	case "export":
+		if err := exportArchive(args[1], args[2], opts); err != nil {
+			log.Fatalf("Error: failed to export snapshot: %v", err)
+		}
+		fmt.Fprintln(os.Stderr, "Snapshot exported successfully")
+
+	case "import":
+		if err := importArchive(ctx, args[1], args[2], opts); err != nil {
+			log.Fatalf("Error: failed to import archive: %v", err)
+		}
+		fmt.Fprintln(os.Stderr, "Archive imported successfully")
+
+	case "diff":
+		changes, err := diffProject(ctx, args[1], args[2], opts, os.Stdout)
+		if err != nil {
+			log.Fatalf("Error: failed to compare snapshot: %v", err)
+		}
+		saveStatCache()
+		if changes > 0 {
+			os.Exit(1)
+		}
+
+	case "keygen":
+		if err := generateKey(args[1], os.Stdout); err != nil {
+			log.Fatalf("Error: failed to generate key: %v", err)
+		}
+
+	case "keygen-sign":
+		if err := generateSigningKey(args[1], os.Stdout); err != nil {
+			log.Fatalf("Error: failed to generate signing key: %v", err)
+		}
+
+	case "sign":
+		if err := signSnapshot(args[1], args[2], opts.Identities, os.Stdout); err != nil {
+			log.Fatalf("Error: failed to sign snapshot: %v", err)
+		}
+
+	case "repo":
+		if args[1] != "init" {
+			fmt.Fprintf(os.Stderr, "Error: unknown repo command %q\n\n", args[1])
+			printUsage()
+			os.Exit(1)
+		}
+		if err := initRepo(args[2], os.Stdout); err != nil {
+			log.Fatalf("Error: failed to initialize repository: %v", err)
+		}
+
+	case "save":
+		var id string
+		err = withProgress("Saving", func(opts snapdir.Options) error {
+			var saveErr error
+			id, saveErr = saveSnapshot(ctx, args[1], args[2], opts)
+			return saveErr
+		})
+		if err != nil {
+			log.Fatalf("Error: failed to save snapshot: %v", err)
+		}
+		saveStatCache()
+		fmt.Printf("Saved snapshot %s\n", id[:shortHashLen])
+
+	case "log":
+		if err := printLog(args[1], os.Stdout); err != nil {
+			log.Fatalf("Error: failed to read snapshot log: %v", err)
+		}
+
+	case "tag":
+		if err := tagSnapshot(args[1], args[2], args[3]); err != nil {
+			log.Fatalf("Error: failed to tag snapshot: %v", err)
+		}
+
+	case "untag":
+		if err := untagSnapshot(args[1], args[2]); err != nil {
+			log.Fatalf("Error: failed to remove tag: %v", err)
+		}
+
+	case "forget":
+		if err := forgetSnapshots(args[1], policy, os.Stdout); err != nil {
+			log.Fatalf("Error: failed to forget snapshots: %v", err)
+		}
+
+	case "gc":
+		if err := collectGarbage(args[1], os.Stdout); err != nil {
+			log.Fatalf("Error: failed to collect garbage: %v", err)
+		}
+
+	case "verify":
+		// With trusted keys verify checks a snapshot signature, otherwise
+		// the integrity of a repository
+		if len(trusted) > 0 {
+			if err := verifySnapshot(args[1], trusted, opts.Identities, os.Stdout); err != nil {
+				log.Fatalf("Error: signature check failed: %v", err)
+			}
+			break
+		}
+		if err := verifyRepo(ctx, args[1], os.Stdout); err != nil {
+			log.Fatalf("Error: repository check failed: %v", err)
+		}
+
+	case "cat":
+		err = catFile(args[1], args[2], opts, os.Stdout, opts.Logger)
+		if err != nil {
+			log.Fatalf("Error: failed to read file from snapshot: %v", err)
+		}
+
+	case "ls":
+		prefix := ""
+		if len(args) > 2 {
+			prefix = args[2]
+		}
+		listOpts.read = opts
+		err = listSnapshot(args[1], prefix, listOpts, os.Stdout)
+		if err != nil {
+			log.Fatalf("Error: failed to list snapshot: %v", err)
+		}
+
+	case "info":
+		err = printInfo(args[1], opts, os.Stdout)
+		if err != nil {
+			log.Fatalf("Error: failed to read snapshot info: %v", err)
+		}
 
-	default:
-		fmt.Fprintf(os.Stderr, "Error: unknown command %q\n\n", command)
-		printUsage()
-		os.Exit(1)
 	}
 }
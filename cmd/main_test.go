@@ -1,135 +1,17 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
-)
-
-func TestShouldIgnore(t *testing.T) {
-	tests := []struct {
-		name     string
-		path     string
-		patterns []string
-		want     bool
-	}{
-		{
-			name:     "matches exact filename",
-			path:     "test.log",
-			patterns: []string{"*.log"},
-			want:     true,
-		},
-		{
-			name:     "matches directory name",
-			path:     "node_modules/package",
-			patterns: []string{"node_modules"},
-			want:     true,
-		},
-		{
-			name:     "no match",
-			path:     "src/main.go",
-			patterns: []string{"*.log", "node_modules"},
-			want:     false,
-		},
-		{
-			name:     "matches nested directory",
-			path:     "src/.git/config",
-			patterns: []string{".git"},
-			want:     true,
-		},
-		{
-			name:     "empty patterns",
-			path:     "any/path",
-			patterns: []string{},
-			want:     false,
-		},
-		{
-			name:     "matches wildcard pattern",
-			path:     "test.tmp",
-			patterns: []string{"*.tmp", "*.log"},
-			want:     true,
-		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			if got := shouldIgnore(tt.path, tt.patterns); got != tt.want {
-				t.Errorf("shouldIgnore() = %v, want %v", got, tt.want)
-			}
-		})
-	}
-}
-
-func TestLoadGitignore(t *testing.T) {
-	tests := []struct {
-		name            string
-		gitignoreContent string
-		wantPatterns    []string
-	}{
-		{
-			name: "basic gitignore",
-			gitignoreContent: `# Comment
-node_modules
-*.log
-.env`,
-			wantPatterns: []string{".git", "node_modules", "*.log", ".env"},
-		},
-		{
-			name: "empty lines and comments",
-			gitignoreContent: `
-# Comment
-
-dist
-
-# Another comment
-build
-`,
-			wantPatterns: []string{".git", "dist", "build"},
-		},
-		{
-			name:            "empty gitignore",
-			gitignoreContent: "",
-			wantPatterns:    []string{".git"},
-		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			// Create temp directory
-			tmpDir := t.TempDir()
-
-			// Write .gitignore file
-			gitignorePath := filepath.Join(tmpDir, ".gitignore")
-			if err := os.WriteFile(gitignorePath, []byte(tt.gitignoreContent), 0644); err != nil {
-				t.Fatalf("failed to write .gitignore: %v", err)
-			}
-
-			got := loadGitignore(tmpDir)
-
-			if len(got) != len(tt.wantPatterns) {
-				t.Errorf("loadGitignore() returned %d patterns, want %d", len(got), len(tt.wantPatterns))
-			}
+	"time"
 
-			for i, pattern := range tt.wantPatterns {
-				if i >= len(got) || got[i] != pattern {
-					t.Errorf("pattern[%d] = %v, want %v", i, got[i], pattern)
-				}
-			}
-		})
-	}
-}
-
-func TestLoadGitignoreNotFound(t *testing.T) {
-	tmpDir := t.TempDir()
-	patterns := loadGitignore(tmpDir)
-
-	// Should return default patterns even if .gitignore doesn't exist
-	if len(patterns) != 1 || patterns[0] != ".git" {
-		t.Errorf("expected default patterns [.git], got %v", patterns)
-	}
-}
+	"github.com/supperdoggy/snapdir"
+)
 
 func TestValidatePath(t *testing.T) {
 	tests := []struct {
@@ -212,7 +94,7 @@ func TestCloneProject(t *testing.T) {
 
 	// Clone the project
 	outputFile := filepath.Join(tmpDir, "snapshot.json")
-	if err := cloneProject(tmpDir, outputFile); err != nil {
+	if err := cloneProject(context.Background(), tmpDir, outputFile, snapdir.Options{}); err != nil {
 		t.Fatalf("cloneProject() error = %v", err)
 	}
 
@@ -222,7 +104,7 @@ func TestCloneProject(t *testing.T) {
 		t.Fatalf("failed to read snapshot: %v", err)
 	}
 
-	var snapshot ProjectSnapshot
+	var snapshot snapdir.ProjectSnapshot
 	if err := json.Unmarshal(data, &snapshot); err != nil {
 		t.Fatalf("failed to unmarshal snapshot: %v", err)
 	}
@@ -279,7 +161,7 @@ func TestCloneProjectInvalidSource(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			tmpOutput := filepath.Join(t.TempDir(), "output.json")
-			err := cloneProject(tt.source, tmpOutput)
+			err := cloneProject(context.Background(), tt.source, tmpOutput, snapdir.Options{})
 			if (err != nil) != tt.wantErr {
 				t.Errorf("cloneProject() error = %v, wantErr %v", err, tt.wantErr)
 			}
@@ -295,7 +177,7 @@ func TestCloneProjectFileAsSource(t *testing.T) {
 	}
 
 	outputFile := filepath.Join(tmpDir, "snapshot.json")
-	err := cloneProject(tmpFile, outputFile)
+	err := cloneProject(context.Background(), tmpFile, outputFile, snapdir.Options{})
 	if err == nil {
 		t.Error("cloneProject() should fail when source is a file, not directory")
 	}
@@ -303,9 +185,9 @@ func TestCloneProjectFileAsSource(t *testing.T) {
 
 func TestRestoreProject(t *testing.T) {
 	// Create a snapshot
-	snapshot := ProjectSnapshot{
+	snapshot := snapdir.ProjectSnapshot{
 		Version: version,
-		Files: []FileInfo{
+		Files: []snapdir.FileInfo{
 			{Path: "file1.txt", Contents: "content1", IsDir: false, Mode: 0644},
 			{Path: "dir1", IsDir: true, Mode: 0755},
 			{Path: "dir1/file2.txt", Contents: "content2", IsDir: false, Mode: 0644},
@@ -328,7 +210,7 @@ func TestRestoreProject(t *testing.T) {
 
 	// Restore the project
 	destDir := filepath.Join(tmpDir, "restored")
-	if err := restoreProject(snapshotFile, destDir); err != nil {
+	if err := restoreProject(context.Background(), snapshotFile, destDir, nil, snapdir.Options{}); err != nil {
 		t.Fatalf("restoreProject() error = %v", err)
 	}
 
@@ -393,7 +275,7 @@ func TestRestoreProjectInvalidConfig(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			configFile := tt.setupConfig(t)
 			destDir := filepath.Join(t.TempDir(), "dest")
-			err := restoreProject(configFile, destDir)
+			err := restoreProject(context.Background(), configFile, destDir, nil, snapdir.Options{})
 			if (err != nil) != tt.wantErr {
 				t.Errorf("restoreProject() error = %v, wantErr %v", err, tt.wantErr)
 			}
@@ -402,9 +284,9 @@ func TestRestoreProjectInvalidConfig(t *testing.T) {
 }
 
 func TestRestoreProjectExistingDestination(t *testing.T) {
-	snapshot := ProjectSnapshot{
+	snapshot := snapdir.ProjectSnapshot{
 		Version: version,
-		Files:   []FileInfo{{Path: "file.txt", Contents: "content", IsDir: false, Mode: 0644}},
+		Files:   []snapdir.FileInfo{{Path: "file.txt", Contents: "content", IsDir: false, Mode: 0644}},
 	}
 
 	tmpDir := t.TempDir()
@@ -425,7 +307,7 @@ func TestRestoreProjectExistingDestination(t *testing.T) {
 	}
 
 	// Should fail because destination exists
-	err = restoreProject(snapshotFile, destDir)
+	err = restoreProject(context.Background(), snapshotFile, destDir, nil, snapdir.Options{})
 	if err == nil {
 		t.Error("restoreProject() should fail when destination already exists")
 	}
@@ -454,13 +336,13 @@ func TestCloneAndRestore(t *testing.T) {
 
 	// Clone
 	snapshotFile := filepath.Join(t.TempDir(), "snapshot.json")
-	if err := cloneProject(originalDir, snapshotFile); err != nil {
+	if err := cloneProject(context.Background(), originalDir, snapshotFile, snapdir.Options{}); err != nil {
 		t.Fatalf("cloneProject() error = %v", err)
 	}
 
 	// Restore
 	restoredDir := filepath.Join(t.TempDir(), "restored")
-	if err := restoreProject(snapshotFile, restoredDir); err != nil {
+	if err := restoreProject(context.Background(), snapshotFile, restoredDir, nil, snapdir.Options{}); err != nil {
 		t.Fatalf("restoreProject() error = %v", err)
 	}
 
@@ -478,13 +360,208 @@ func TestCloneAndRestore(t *testing.T) {
 	}
 }
 
-func TestLogVerbose(t *testing.T) {
-	// Test that logVerbose doesn't panic
-	verbose = false
-	logVerbose("test message")
+func TestNewLogger(t *testing.T) {
+	tests := []struct {
+		name      string
+		verbose   bool
+		wantDebug bool
+	}{
+		{name: "quiet", verbose: false, wantDebug: false},
+		{name: "verbose", verbose: true, wantDebug: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger := newLogger(&buf, tt.verbose)
+
+			logger.Debug("debug message", "path", "a.txt")
+			logger.Warn("warning message")
+
+			if got := strings.Contains(buf.String(), "debug message"); got != tt.wantDebug {
+				t.Errorf("debug message logged = %v, want %v:\n%s", got, tt.wantDebug, buf.String())
+			}
+			if !strings.Contains(buf.String(), "warning message") {
+				t.Errorf("warning message not logged:\n%s", buf.String())
+			}
+		})
+	}
+}
+
+func TestCloneAndRestoreBinary(t *testing.T) {
+	originalDir := t.TempDir()
+	binaryData := []byte{0x00, 0x01, 0xff, 0xfe, 0x80, '\n'}
+	if err := os.WriteFile(filepath.Join(originalDir, "data.bin"), binaryData, 0644); err != nil {
+		t.Fatalf("failed to write binary file: %v", err)
+	}
+
+	snapshotFile := filepath.Join(t.TempDir(), "snapshot.json")
+	if err := cloneProject(context.Background(), originalDir, snapshotFile, snapdir.Options{}); err != nil {
+		t.Fatalf("cloneProject() error = %v", err)
+	}
+
+	restoredDir := filepath.Join(t.TempDir(), "restored")
+	if err := restoreProject(context.Background(), snapshotFile, restoredDir, nil, snapdir.Options{}); err != nil {
+		t.Fatalf("restoreProject() error = %v", err)
+	}
+
+	content, err := os.ReadFile(filepath.Join(restoredDir, "data.bin"))
+	if err != nil {
+		t.Fatalf("failed to read restored file: %v", err)
+	}
+	if string(content) != string(binaryData) {
+		t.Errorf("binary content = %v, want %v", content, binaryData)
+	}
+}
+
+func TestCloneProjectKeepsExistingOutputOnFailure(t *testing.T) {
+	outputFile := filepath.Join(t.TempDir(), "snapshot.json")
+	if err := os.WriteFile(outputFile, []byte("previous snapshot"), 0644); err != nil {
+		t.Fatalf("failed to write output file: %v", err)
+	}
+
+	if err := cloneProject(context.Background(), "/nonexistent/path", outputFile, snapdir.Options{}); err == nil {
+		t.Fatal("cloneProject() should fail for a missing source")
+	}
+
+	data, err := os.ReadFile(outputFile)
+	if err != nil {
+		t.Fatalf("failed to read output file: %v", err)
+	}
+	if string(data) != "previous snapshot" {
+		t.Errorf("output file was modified by a failed clone: %q", data)
+	}
+
+	entries, err := os.ReadDir(filepath.Dir(outputFile))
+	if err != nil {
+		t.Fatalf("failed to read output directory: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("failed clone left temporary files behind: %v", entries)
+	}
+}
+
+func TestSourceDateEpoch(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    time.Time
+		wantErr bool
+	}{
+		{name: "unset", value: "", want: time.Time{}},
+		{name: "valid", value: "1700000000", want: time.Unix(1700000000, 0).UTC()},
+		{name: "invalid", value: "yesterday", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SOURCE_DATE_EPOCH", tt.value)
+
+			got, err := sourceDateEpoch()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("sourceDateEpoch() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("sourceDateEpoch() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIncrementalCloneRestoreAndFlatten(t *testing.T) {
+	ctx := context.Background()
+	source := t.TempDir()
+	snapshots := t.TempDir()
+
+	write := func(name, content string) {
+		if err := os.WriteFile(filepath.Join(source, name), []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+	}
+	write("keep.txt", "keep")
+	write("remove.txt", "remove")
+
+	full := filepath.Join(snapshots, "full.json")
+	if err := cloneProject(ctx, source, full, snapdir.Options{}); err != nil {
+		t.Fatalf("cloneProject() error = %v", err)
+	}
+
+	write("new.txt", "new")
+	if err := os.Remove(filepath.Join(source, "remove.txt")); err != nil {
+		t.Fatalf("failed to remove file: %v", err)
+	}
+	incremental := filepath.Join(snapshots, "incremental.json")
+	parent, err := snapdir.OpenParent(full, incremental)
+	if err != nil {
+		t.Fatalf("OpenParent() error = %v", err)
+	}
+	if err := cloneProject(ctx, source, incremental, snapdir.Options{Parent: parent}); err != nil {
+		t.Fatalf("cloneProject() error = %v", err)
+	}
+
+	flat := filepath.Join(snapshots, "flat.json")
+	if err := flattenSnapshot(incremental, flat, snapdir.Options{}); err != nil {
+		t.Fatalf("flattenSnapshot() error = %v", err)
+	}
+	data, err := os.ReadFile(flat)
+	if err != nil {
+		t.Fatalf("failed to read flattened snapshot: %v", err)
+	}
+	var flattened snapdir.ProjectSnapshot
+	if err := json.Unmarshal(data, &flattened); err != nil {
+		t.Fatalf("failed to parse flattened snapshot: %v", err)
+	}
+	if flattened.Parent != "" || len(flattened.Files) != 2 {
+		t.Errorf("flattened snapshot = %+v, want keep.txt and new.txt without a parent", flattened)
+	}
+
+	for _, snapshot := range []string{incremental, flat} {
+		restored := filepath.Join(t.TempDir(), "restored")
+		if err := restoreProject(ctx, snapshot, restored, nil, snapdir.Options{}); err != nil {
+			t.Fatalf("restoreProject(%s) error = %v", filepath.Base(snapshot), err)
+		}
+		for name, want := range map[string]string{"keep.txt": "keep", "new.txt": "new"} {
+			content, err := os.ReadFile(filepath.Join(restored, name))
+			if err != nil || string(content) != want {
+				t.Errorf("%s: %s = %q, %v, want %q", filepath.Base(snapshot), name, content, err, want)
+			}
+		}
+		if _, err := os.Stat(filepath.Join(restored, "remove.txt")); !os.IsNotExist(err) {
+			t.Errorf("%s: deleted file was restored", filepath.Base(snapshot))
+		}
+	}
+}
+
+func TestCLIExternalParents(t *testing.T) {
+	dir := t.TempDir()
+	for _, sub := range []string{"src", "nightly"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "src", "a.txt"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, stderr, code := runCLI(t, dir, "clone", "src", "full.json"); code != 0 {
+		t.Fatalf("clone exited %d:\n%s", code, stderr)
+	}
+	// The parent is recorded as ../full.json
+	if _, stderr, code := runCLI(t, dir, "clone", "-parent", "full.json", "src", "nightly/inc.json"); code != 0 {
+		t.Fatalf("clone -parent exited %d:\n%s", code, stderr)
+	}
 
-	verbose = true
-	logVerbose("test message with args: %s %d", "hello", 42)
+	if _, stderr, code := runCLI(t, dir, "ls", "nightly/inc.json"); code == 0 || !strings.Contains(stderr, "outside its directory") {
+		t.Errorf("ls exited %d, want the parent rejected:\n%s", code, stderr)
+	}
+	if _, stderr, code := runCLI(t, dir, "restore", "nightly/inc.json", "restored"); code == 0 {
+		t.Errorf("restore exited %d, want the parent rejected:\n%s", code, stderr)
+	}
 
-	verbose = false
+	stdout, stderr, code := runCLI(t, dir, "ls", "-external-parents", "nightly/inc.json")
+	if code != 0 || !strings.Contains(stdout, "a.txt") {
+		t.Errorf("ls -external-parents exited %d:\n%s%s", code, stdout, stderr)
+	}
+	if _, stderr, code := runCLI(t, dir, "restore", "-external-parents", "nightly/inc.json", "restored"); code != 0 {
+		t.Errorf("restore -external-parents exited %d:\n%s", code, stderr)
+	}
 }
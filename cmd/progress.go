@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/supperdoggy/snapdir"
+)
+
+const (
+	progressBarWidth    = 30
+	progressMinInterval = 100 * time.Millisecond
+)
+
+// isTerminal reports whether f is attached to a terminal
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// progressBar renders snapdir.Progress updates as a single, redrawn line
+type progressBar struct {
+	w        io.Writer
+	label    string
+	last     time.Time
+	drawn    bool
+	finished bool
+}
+
+// newProgressBar returns a progress bar that draws to w
+func newProgressBar(w io.Writer, label string) *progressBar {
+	return &progressBar{w: w, label: label}
+}
+
+// Update redraws the bar. Redraws are throttled, except for the final update.
+func (b *progressBar) Update(p snapdir.Progress) {
+	done := p.FilesDone == p.FilesTotal
+	if !done && time.Since(b.last) < progressMinInterval {
+		return
+	}
+	b.last = time.Now()
+
+	fraction := 1.0
+	if p.BytesTotal > 0 {
+		fraction = float64(p.BytesDone) / float64(p.BytesTotal)
+	} else if p.FilesTotal > 0 {
+		fraction = float64(p.FilesDone) / float64(p.FilesTotal)
+	}
+	fraction = min(max(fraction, 0), 1)
+
+	filled := int(fraction * progressBarWidth)
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", progressBarWidth-filled)
+
+	fmt.Fprintf(b.w, "\r%s [%s] %3.0f%%  %d/%d files  %s/%s\033[K",
+		b.label, bar, fraction*100, p.FilesDone, p.FilesTotal,
+		formatBytes(p.BytesDone), formatBytes(p.BytesTotal))
+	b.drawn = true
+}
+
+// Finish ends the progress line so later output starts on a fresh line
+func (b *progressBar) Finish() {
+	if b.drawn && !b.finished {
+		fmt.Fprintln(b.w)
+	}
+	b.finished = true
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/supperdoggy/snapdir"
+)
+
+func TestProgressBar(t *testing.T) {
+	var buf bytes.Buffer
+	bar := newProgressBar(&buf, "Cloning")
+
+	bar.Update(snapdir.Progress{FilesDone: 0, FilesTotal: 4, BytesDone: 0, BytesTotal: 2048})
+	// Throttled: an intermediate update right after the first is dropped
+	bar.Update(snapdir.Progress{FilesDone: 1, FilesTotal: 4, BytesDone: 512, BytesTotal: 2048})
+	// The final update is always drawn
+	bar.Update(snapdir.Progress{FilesDone: 4, FilesTotal: 4, BytesDone: 2048, BytesTotal: 2048})
+	bar.Finish()
+
+	out := buf.String()
+	if strings.Contains(out, "1/4 files") {
+		t.Errorf("throttled update was drawn:\n%q", out)
+	}
+	for _, want := range []string{"Cloning [", "  0%  0/4 files", "100%  4/4 files  2.0 KiB/2.0 KiB"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("progress output missing %q:\n%q", want, out)
+		}
+	}
+	if !strings.HasSuffix(out, "\n") {
+		t.Errorf("Finish() should end the progress line:\n%q", out)
+	}
+}
+
+func TestProgressBarFinishWithoutUpdates(t *testing.T) {
+	var buf bytes.Buffer
+	bar := newProgressBar(&buf, "Restoring")
+	bar.Finish()
+
+	if buf.Len() != 0 {
+		t.Errorf("Finish() without updates wrote %q", buf.String())
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/supperdoggy/snapdir"
+)
+
+// splitRepoRef splits a restore source of the form <repo>@<id> into the
+// repository directory and snapshot reference. Existing files are always
+// treated as snapshot files, even if their name contains an @.
+func splitRepoRef(arg string) (repoDir, ref string, ok bool) {
+	if _, err := os.Stat(arg); err == nil {
+		return "", "", false
+	}
+	i := strings.LastIndex(arg, "@")
+	if i <= 0 {
+		return "", "", false
+	}
+	return arg[:i], arg[i+1:], true
+}
+
+// initRepo creates an empty repository
+func initRepo(dir string, w io.Writer) error {
+	if _, err := snapdir.InitRepository(dir); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Initialized empty repository in %s\n", dir)
+	return nil
+}
+
+// saveSnapshot saves the source directory into a repository and returns
+// the ID of the new snapshot
+func saveSnapshot(ctx context.Context, repoDir, source string, opts snapdir.Options) (string, error) {
+	repo, err := snapdir.OpenRepository(repoDir)
+	if err != nil {
+		return "", err
+	}
+
+	manifest, err := repo.Save(ctx, source, opts)
+	if err != nil {
+		return "", err
+	}
+	return manifest.ID, nil
+}
+
+// restoreFromRepo restores the snapshot ref of a repository
+func restoreFromRepo(ctx context.Context, repoDir, ref, destination string, opts snapdir.Options) error {
+	repo, err := snapdir.OpenRepository(repoDir)
+	if err != nil {
+		return err
+	}
+
+	id, err := repo.Resolve(ref)
+	if err != nil {
+		return err
+	}
+
+	if opts.Logger != nil {
+		opts.Logger.Debug("restoring from repository", "repository", repoDir, "snapshot", id)
+	}
+	return repo.Restore(ctx, id, destination, opts)
+}
+
+// printLog lists the snapshots of a repository, newest first
+func printLog(repoDir string, w io.Writer) error {
+	repo, err := snapdir.OpenRepository(repoDir)
+	if err != nil {
+		return err
+	}
+
+	manifests, err := repo.List()
+	if err != nil {
+		return err
+	}
+	tags, err := repo.Tags()
+	if err != nil {
+		return err
+	}
+
+	tagsByID := make(map[string][]string)
+	for name, id := range tags {
+		tagsByID[id] = append(tagsByID[id], name)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "ID\tTIME\tSOURCE\tSIZE\tTAGS\tMESSAGE\n")
+	for i := len(manifests) - 1; i >= 0; i-- {
+		manifest := manifests[i]
+
+		saved := manifest.Time
+		if t, err := snapdir.ParseModTime(manifest.Time); err == nil {
+			saved = t.Local().Format("2006-01-02 15:04:05")
+		}
+
+		names := tagsByID[manifest.ID]
+		sort.Strings(names)
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			manifest.ID[:shortHashLen], saved, manifest.Source,
+			formatBytes(manifest.TotalSize()), strings.Join(names, ","), manifest.Message)
+	}
+	if err := tw.Flush(); err != nil {
+		return fmt.Errorf("failed to write log: %w", err)
+	}
+	return nil
+}
+
+// tagSnapshot points the tag name at the snapshot ref
+func tagSnapshot(repoDir, name, ref string) error {
+	repo, err := snapdir.OpenRepository(repoDir)
+	if err != nil {
+		return err
+	}
+
+	id, err := repo.Resolve(ref)
+	if err != nil {
+		return err
+	}
+	return repo.Tag(name, id)
+}
+
+// untagSnapshot removes a tag
+func untagSnapshot(repoDir, name string) error {
+	repo, err := snapdir.OpenRepository(repoDir)
+	if err != nil {
+		return err
+	}
+	return repo.Untag(name)
+}
+
+// forgetSnapshots removes the snapshots that policy does not keep and lists
+// them on w
+func forgetSnapshots(repoDir string, policy snapdir.RetentionPolicy, w io.Writer) error {
+	repo, err := snapdir.OpenRepository(repoDir)
+	if err != nil {
+		return err
+	}
+
+	removed, err := repo.Forget(policy)
+	for _, manifest := range removed {
+		fmt.Fprintf(w, "Removed snapshot %s (%s)\n", manifest.ID[:shortHashLen], manifest.Time)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "%d snapshots removed, run gc to free their space\n", len(removed))
+	return nil
+}
+
+// collectGarbage deletes the blobs no snapshot refers to
+func collectGarbage(repoDir string, w io.Writer) error {
+	repo, err := snapdir.OpenRepository(repoDir)
+	if err != nil {
+		return err
+	}
+
+	stats, err := repo.GC()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "Removed %d unreferenced blobs, freed %s\n", stats.Blobs, formatBytes(stats.Bytes))
+	return nil
+}
+
+// verifyRepo checks the snapshots and blobs of a repository and lists any
+// problems on w
+func verifyRepo(ctx context.Context, repoDir string, w io.Writer) error {
+	repo, err := snapdir.OpenRepository(repoDir)
+	if err != nil {
+		return err
+	}
+
+	report, err := repo.Verify(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, problem := range report.Problems {
+		fmt.Fprintln(w, problem)
+	}
+	if len(report.Problems) > 0 {
+		return fmt.Errorf("found %d problems in %d snapshots", len(report.Problems), report.Snapshots)
+	}
+
+	fmt.Fprintf(w, "Checked %d snapshots and %d files, no problems found\n", report.Snapshots, report.Files)
+	return nil
+}
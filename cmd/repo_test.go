@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/supperdoggy/snapdir"
+)
+
+func TestSplitRepoRef(t *testing.T) {
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "backup@2024.json")
+	if err := os.WriteFile(existing, []byte("{}"), 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	tests := []struct {
+		arg     string
+		wantDir string
+		wantRef string
+		wantOK  bool
+	}{
+		{arg: "backups@latest", wantDir: "backups", wantRef: "latest", wantOK: true},
+		{arg: "me@host/backups@1a2b", wantDir: "me@host/backups", wantRef: "1a2b", wantOK: true},
+		{arg: "backups@", wantDir: "backups", wantRef: "", wantOK: true},
+		{arg: "snapshot.json", wantOK: false},
+		{arg: "@latest", wantOK: false},
+		{arg: existing, wantOK: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.arg, func(t *testing.T) {
+			dir, ref, ok := splitRepoRef(tt.arg)
+			if ok != tt.wantOK || dir != tt.wantDir || ref != tt.wantRef {
+				t.Errorf("splitRepoRef(%q) = (%q, %q, %v), want (%q, %q, %v)",
+					tt.arg, dir, ref, ok, tt.wantDir, tt.wantRef, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestSaveAndRestoreFromRepo(t *testing.T) {
+	ctx := context.Background()
+	tmpDir := t.TempDir()
+	repoDir := filepath.Join(tmpDir, "repo")
+	source := filepath.Join(tmpDir, "source")
+
+	if err := os.MkdirAll(filepath.Join(source, "src"), 0755); err != nil {
+		t.Fatalf("failed to create source: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(source, "src", "main.go"), []byte("package main"), 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := initRepo(repoDir, &out); err != nil {
+		t.Fatalf("initRepo() error = %v", err)
+	}
+	if !strings.Contains(out.String(), "Initialized empty repository") {
+		t.Errorf("initRepo() output = %q", out.String())
+	}
+
+	id, err := saveSnapshot(ctx, repoDir, source, snapdir.Options{})
+	if err != nil {
+		t.Fatalf("saveSnapshot() error = %v", err)
+	}
+
+	for _, ref := range []string{id[:shortHashLen], "latest"} {
+		dst := filepath.Join(t.TempDir(), "restored")
+		if err := restoreFromRepo(ctx, repoDir, ref, dst, snapdir.Options{}); err != nil {
+			t.Fatalf("restoreFromRepo(%s) error = %v", ref, err)
+		}
+		data, err := os.ReadFile(filepath.Join(dst, "src", "main.go"))
+		if err != nil {
+			t.Fatalf("failed to read restored file: %v", err)
+		}
+		if string(data) != "package main" {
+			t.Errorf("restored content = %q", data)
+		}
+	}
+
+	if _, err := saveSnapshot(ctx, filepath.Join(tmpDir, "missing"), source, snapdir.Options{}); err == nil {
+		t.Error("saveSnapshot() should fail for a missing repository")
+	}
+	if err := restoreFromRepo(ctx, repoDir, "ffff", filepath.Join(tmpDir, "out"), snapdir.Options{}); err == nil {
+		t.Error("restoreFromRepo() should fail for an unknown snapshot")
+	}
+}
+
+func TestRepoHistoryCommands(t *testing.T) {
+	ctx := context.Background()
+	tmpDir := t.TempDir()
+	repoDir := filepath.Join(tmpDir, "repo")
+	source := filepath.Join(tmpDir, "source")
+
+	if err := os.MkdirAll(source, 0755); err != nil {
+		t.Fatalf("failed to create source: %v", err)
+	}
+	if err := initRepo(repoDir, io.Discard); err != nil {
+		t.Fatalf("initRepo() error = %v", err)
+	}
+
+	var ids []string
+	for i, content := range []string{"first version", "second version", "third"} {
+		if err := os.WriteFile(filepath.Join(source, "file.txt"), []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+		id, err := saveSnapshot(ctx, repoDir, source, snapdir.Options{Message: fmt.Sprintf("save %d", i+1)})
+		if err != nil {
+			t.Fatalf("saveSnapshot() error = %v", err)
+		}
+		ids = append(ids, id)
+	}
+
+	if err := tagSnapshot(repoDir, "v1-template", ids[0][:8]); err != nil {
+		t.Fatalf("tagSnapshot() error = %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := printLog(repoDir, &out); err != nil {
+		t.Fatalf("printLog() error = %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("printLog() printed %d lines, want header and 3 snapshots:\n%s", len(lines), out.String())
+	}
+	if !strings.HasPrefix(lines[1], ids[2][:shortHashLen]) || !strings.Contains(lines[1], "save 3") {
+		t.Errorf("newest snapshot should come first, got %q", lines[1])
+	}
+	if !strings.Contains(lines[3], "v1-template") || !strings.Contains(lines[3], "13 B") {
+		t.Errorf("oldest snapshot line = %q, want tag and size", lines[3])
+	}
+
+	out.Reset()
+	if err := forgetSnapshots(repoDir, snapdir.RetentionPolicy{KeepLast: 1}, &out); err != nil {
+		t.Fatalf("forgetSnapshots() error = %v", err)
+	}
+	if !strings.Contains(out.String(), ids[1][:shortHashLen]) || strings.Contains(out.String(), ids[0][:shortHashLen]) {
+		t.Errorf("forgetSnapshots() should remove only the untagged old snapshot:\n%s", out.String())
+	}
+
+	out.Reset()
+	if err := collectGarbage(repoDir, &out); err != nil {
+		t.Fatalf("collectGarbage() error = %v", err)
+	}
+	if !strings.Contains(out.String(), "Removed 1 unreferenced blobs") {
+		t.Errorf("collectGarbage() output = %q", out.String())
+	}
+
+	if err := untagSnapshot(repoDir, "v1-template"); err != nil {
+		t.Fatalf("untagSnapshot() error = %v", err)
+	}
+	if err := forgetSnapshots(repoDir, snapdir.RetentionPolicy{}, io.Discard); err == nil {
+		t.Error("forgetSnapshots() should reject an empty policy")
+	}
+}
+
+func TestVerifyRepo(t *testing.T) {
+	ctx := context.Background()
+	tmpDir := t.TempDir()
+	repoDir := filepath.Join(tmpDir, "repo")
+	source := filepath.Join(tmpDir, "source")
+
+	if err := os.MkdirAll(source, 0755); err != nil {
+		t.Fatalf("failed to create source: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(source, "file.txt"), []byte("contents"), 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if err := initRepo(repoDir, io.Discard); err != nil {
+		t.Fatalf("initRepo() error = %v", err)
+	}
+	if _, err := saveSnapshot(ctx, repoDir, source, snapdir.Options{}); err != nil {
+		t.Fatalf("saveSnapshot() error = %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := verifyRepo(ctx, repoDir, &out); err != nil {
+		t.Fatalf("verifyRepo() error = %v", err)
+	}
+	if !strings.Contains(out.String(), "Checked 1 snapshots and 1 files, no problems found") {
+		t.Errorf("verifyRepo() output = %q", out.String())
+	}
+
+	sum := snapdir.HashContents([]byte("contents"))
+	if err := os.Remove(filepath.Join(repoDir, "blobs", sum[:2], sum)); err != nil {
+		t.Fatalf("failed to remove blob: %v", err)
+	}
+	out.Reset()
+	if err := verifyRepo(ctx, repoDir, &out); err == nil {
+		t.Error("verifyRepo() should fail for a missing blob")
+	}
+	if !strings.Contains(out.String(), "file.txt") {
+		t.Errorf("verifyRepo() should name the damaged file, got %q", out.String())
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/supperdoggy/snapdir"
+)
+
+// loadSecretRules returns the default secret rules followed by the rules in
+// rulesFile
+func loadSecretRules(rulesFile string) ([]snapdir.SecretRule, error) {
+	file, err := os.Open(rulesFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open secret rules: %w", err)
+	}
+	defer file.Close()
+
+	extra, err := snapdir.LoadSecretRules(file)
+	if err != nil {
+		return nil, err
+	}
+	rules := append([]snapdir.SecretRule{}, snapdir.DefaultSecretRules...)
+	return append(rules, extra...), nil
+}
+
+// loadSecretValues reads the values of redacted secrets from valuesFile,
+// one name=value pair per line. Empty lines and lines starting with # are
+// skipped.
+func loadSecretValues(valuesFile string) (map[string]string, error) {
+	file, err := os.Open(valuesFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open secret values: %w", err)
+	}
+	defer file.Close()
+
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected name=value", valuesFile, n)
+		}
+		values[strings.TrimSpace(name)] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read secret values: %w", err)
+	}
+	return values, nil
+}
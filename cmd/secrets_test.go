@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/supperdoggy/snapdir"
+)
+
+func TestCloneRedactAndRestoreSecrets(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "src")
+	if err := os.MkdirAll(source, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(source, ".env"), []byte("DATABASE_PASSWORD=hunter2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(source, "app.cfg"), []byte("license = LIC-0042-ABCD\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	rulesFile := filepath.Join(dir, "rules.json")
+	if err := os.WriteFile(rulesFile, []byte(`[{"name": "license", "pattern": "LIC-[0-9]{4}-[A-Z]{4}"}]`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := loadSecretRules(rulesFile)
+	if err != nil {
+		t.Fatalf("loadSecretRules() error = %v", err)
+	}
+	if len(rules) != len(snapdir.DefaultSecretRules)+1 {
+		t.Errorf("loadSecretRules() returned %d rules, want the defaults and one more", len(rules))
+	}
+
+	ctx := context.Background()
+	snapshotFile := filepath.Join(dir, "snapshot.json")
+	opts := snapdir.Options{Secrets: snapdir.SecretsFail, SecretRules: rules}
+	if err := cloneProject(ctx, source, snapshotFile, opts); !errors.Is(err, snapdir.ErrSecretsFound) {
+		t.Errorf("cloneProject() with fail error = %v, want %v", err, snapdir.ErrSecretsFound)
+	}
+	if _, err := os.Stat(snapshotFile); !os.IsNotExist(err) {
+		t.Error("cloneProject() with fail left a snapshot behind")
+	}
+
+	opts.Secrets = snapdir.SecretsRedact
+	if err := cloneProject(ctx, source, snapshotFile, opts); err != nil {
+		t.Fatalf("cloneProject() with redact error = %v", err)
+	}
+
+	valuesFile := filepath.Join(dir, "values.env")
+	values := "# filled in on restore\ndotenv-value-1=correct horse\nlicense-1=LIC-9999-ZZZZ\n"
+	if err := os.WriteFile(valuesFile, []byte(values), 0600); err != nil {
+		t.Fatal(err)
+	}
+	secretValues, err := loadSecretValues(valuesFile)
+	if err != nil {
+		t.Fatalf("loadSecretValues() error = %v", err)
+	}
+
+	restored := filepath.Join(dir, "restored")
+	if err := restoreProject(ctx, snapshotFile, restored, nil, snapdir.Options{SecretValues: secretValues}); err != nil {
+		t.Fatalf("restoreProject() error = %v", err)
+	}
+	for name, want := range map[string]string{
+		".env":    "DATABASE_PASSWORD=correct horse\n",
+		"app.cfg": "license = LIC-9999-ZZZZ\n",
+	} {
+		data, err := os.ReadFile(filepath.Join(restored, name))
+		if err != nil || string(data) != want {
+			t.Errorf("restored %s = %q, %v, want %q", name, data, err, want)
+		}
+	}
+
+	if err := os.WriteFile(valuesFile, []byte("no separator\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadSecretValues(valuesFile); err == nil {
+		t.Error("loadSecretValues() should reject lines without =")
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/supperdoggy/snapdir"
+)
+
+// generateSigningKey writes a new signing key to keyFile, which must not
+// exist yet, and prints its public key to w
+func generateSigningKey(keyFile string, w io.Writer) error {
+	key, err := snapdir.GenerateSigningKey()
+	if err != nil {
+		return err
+	}
+	return writeKeyFile(keyFile, key.String(), key.Public().String(), w)
+}
+
+// loadSigningKey reads the signing key in keyFile
+func loadSigningKey(keyFile string) (*snapdir.SigningKey, error) {
+	var key *snapdir.SigningKey
+	err := readKeyFile(keyFile, func(line string) error {
+		if key != nil {
+			return fmt.Errorf("more than one signing key")
+		}
+		var err error
+		key, err = snapdir.ParseSigningKey(line)
+		return err
+	})
+	return key, err
+}
+
+// parseTrustedKeys parses a comma-separated list of public signing keys.
+// Items that are not keys name files listing keys, one per line.
+func parseTrustedKeys(list string) ([]*snapdir.VerifyKey, error) {
+	var trusted []*snapdir.VerifyKey
+	add := func(s string) error {
+		key, err := snapdir.ParseVerifyKey(s)
+		if err != nil {
+			return err
+		}
+		trusted = append(trusted, key)
+		return nil
+	}
+
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if key, err := snapdir.ParseVerifyKey(item); err == nil {
+			trusted = append(trusted, key)
+			continue
+		}
+		if err := readKeyFile(item, add); err != nil {
+			return nil, err
+		}
+	}
+	return trusted, nil
+}
+
+// signSnapshot signs the snapshot in configFile with the key in keyFile and
+// stores the signature next to it
+func signSnapshot(configFile, keyFile string, identities []snapdir.Identity, w io.Writer) error {
+	if err := requireFile(configFile, "signatures are stored next to the snapshot file"); err != nil {
+		return err
+	}
+	if err := validatePath(configFile, true); err != nil {
+		return fmt.Errorf("invalid config file: %w", err)
+	}
+	key, err := loadSigningKey(keyFile)
+	if err != nil {
+		return err
+	}
+
+	sig, err := snapdir.SignFile(configFile, key, identities...)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Signed %s (digest %s) with %s\n", configFile, sig.Digest[:shortHashLen], sig.Key)
+	return nil
+}
+
+// verifySnapshot checks that the snapshot in configFile carries a valid
+// signature by one of the trusted keys
+func verifySnapshot(configFile string, trusted []*snapdir.VerifyKey, identities []snapdir.Identity, w io.Writer) error {
+	if err := requireFile(configFile, "signatures are stored next to the snapshot file"); err != nil {
+		return err
+	}
+	if err := validatePath(configFile, true); err != nil {
+		return fmt.Errorf("invalid config file: %w", err)
+	}
+
+	signer, err := snapdir.VerifyFile(configFile, trusted, identities...)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Good signature from %s\n", signer)
+	return nil
+}
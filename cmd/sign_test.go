@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/supperdoggy/snapdir"
+)
+
+func TestSignVerifyAndRestore(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "src")
+	if err := os.MkdirAll(source, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(source, "template.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	snapshotFile := filepath.Join(dir, "snapshot.json")
+	if err := cloneProject(ctx, source, snapshotFile, snapdir.Options{}); err != nil {
+		t.Fatal(err)
+	}
+
+	keyFile := filepath.Join(dir, "signing.key")
+	var out bytes.Buffer
+	if err := generateSigningKey(keyFile, &out); err != nil {
+		t.Fatalf("generateSigningKey() error = %v", err)
+	}
+	public := strings.TrimPrefix(strings.TrimSpace(out.String()), "Public key: ")
+
+	// Trusted keys can be listed inline or in files
+	trustedFile := filepath.Join(dir, "trusted.txt")
+	if err := os.WriteFile(trustedFile, []byte("# team templates\n"+public+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	trusted, err := parseTrustedKeys(trustedFile)
+	if err != nil || len(trusted) != 1 {
+		t.Fatalf("parseTrustedKeys() = %d keys, %v", len(trusted), err)
+	}
+	if _, err := parseTrustedKeys(public + "," + trustedFile); err != nil {
+		t.Errorf("parseTrustedKeys() error = %v", err)
+	}
+	if _, err := parseTrustedKeys(filepath.Join(dir, "missing.txt")); err == nil {
+		t.Error("parseTrustedKeys() should fail for a missing file")
+	}
+
+	restored := filepath.Join(dir, "unsigned")
+	if err := restoreProject(ctx, snapshotFile, restored, trusted, snapdir.Options{}); !errors.Is(err, snapdir.ErrNotSigned) {
+		t.Errorf("restoreProject() of unsigned snapshot error = %v, want %v", err, snapdir.ErrNotSigned)
+	}
+	if _, err := os.Stat(restored); !os.IsNotExist(err) {
+		t.Error("restoreProject() wrote an unsigned snapshot")
+	}
+
+	if err := signSnapshot(snapshotFile, keyFile, nil, io.Discard); err != nil {
+		t.Fatalf("signSnapshot() error = %v", err)
+	}
+	out.Reset()
+	if err := verifySnapshot(snapshotFile, trusted, nil, &out); err != nil {
+		t.Fatalf("verifySnapshot() error = %v", err)
+	}
+	if !strings.Contains(out.String(), public) {
+		t.Errorf("verifySnapshot() output = %q", out.String())
+	}
+
+	restored = filepath.Join(dir, "signed")
+	if err := restoreProject(ctx, snapshotFile, restored, trusted, snapdir.Options{}); err != nil {
+		t.Fatalf("restoreProject() error = %v", err)
+	}
+
+	// A snapshot changed after signing is rejected before anything is written
+	data, err := os.ReadFile(snapshotFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(snapshotFile, bytes.Replace(data, []byte("hello"), []byte("evil!"), 1), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifySnapshot(snapshotFile, trusted, nil, io.Discard); !errors.Is(err, snapdir.ErrBadSignature) {
+		t.Errorf("verifySnapshot() after tampering error = %v, want %v", err, snapdir.ErrBadSignature)
+	}
+	restored = filepath.Join(dir, "tampered")
+	if err := restoreProject(ctx, snapshotFile, restored, trusted, snapdir.Options{}); !errors.Is(err, snapdir.ErrBadSignature) {
+		t.Errorf("restoreProject() after tampering error = %v, want %v", err, snapdir.ErrBadSignature)
+	}
+	if _, err := os.Stat(restored); !os.IsNotExist(err) {
+		t.Error("restoreProject() wrote a tampered snapshot")
+	}
+}
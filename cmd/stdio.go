@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/supperdoggy/snapdir"
+)
+
+// stdioName stands for standard input or output where a command expects
+// a snapshot or archive file
+const stdioName = "-"
+
+// stdin and stdout are what stdioName reads and writes; tests replace them
+var (
+	stdin  io.Reader = os.Stdin
+	stdout io.Writer = os.Stdout
+)
+
+// validateInput ensures the input file name exists, unless it names
+// standard input
+func validateInput(name string) error {
+	if name == stdioName {
+		return nil
+	}
+	return validatePath(name, true)
+}
+
+// openInput opens the input file name, or standard input for "-"
+func openInput(name string) (io.ReadCloser, error) {
+	if name == stdioName {
+		return io.NopCloser(stdin), nil
+	}
+	return os.Open(name)
+}
+
+// openSnapshot reads the snapshot file name, merged with its parents as
+// opts allow, or a full snapshot from standard input for "-"
+func openSnapshot(name string, opts snapdir.Options) (snapdir.ProjectSnapshot, error) {
+	if name == stdioName {
+		return snapdir.ReadSnapshotOptions(stdin, opts)
+	}
+	return snapdir.OpenSnapshotOptions(name, opts)
+}
+
+// scanInput calls fn for every entry of the snapshot file name, or of
+// standard input for "-", and returns the snapshot version. Full snapshots
+// are streamed, so fn can stop reading early with snapdir.ErrStopScan;
+// incremental ones are first merged with their parents as opts allow.
+func scanInput(name string, opts snapdir.Options, fn func(snapdir.FileInfo) error) (string, error) {
+	file, err := openInput(name)
+	if err != nil {
+		return "", fmt.Errorf("failed to open config file: %w", err)
+	}
+	defer file.Close()
+
+	header, err := snapdir.ScanSnapshotOptions(file, opts, fn)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse config file: %w", err)
+	}
+	if header.Parent == "" {
+		return header.Version, nil
+	}
+
+	if name == stdioName {
+		return "", fmt.Errorf("snapshot is incremental, its parent %s can only be found from a snapshot file", header.Parent)
+	}
+	snapshot, err := snapdir.OpenSnapshotOptions(name, opts)
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range snapshot.Files {
+		if err := fn(entry); err != nil {
+			if errors.Is(err, snapdir.ErrStopScan) {
+				break
+			}
+			return "", err
+		}
+	}
+	return snapshot.Version, nil
+}
+
+// requireFile fails for standard input where a command needs a real file
+func requireFile(name, why string) error {
+	if name == stdioName {
+		return fmt.Errorf("%s, so standard input cannot be used", why)
+	}
+	return nil
+}
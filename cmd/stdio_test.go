@@ -0,0 +1,163 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/supperdoggy/snapdir"
+)
+
+// useStdio points stdin and stdout at in and a new buffer, which is
+// returned, for the duration of the test
+func useStdio(t *testing.T, in []byte) *bytes.Buffer {
+	t.Helper()
+	oldIn, oldOut := stdin, stdout
+	t.Cleanup(func() { stdin, stdout = oldIn, oldOut })
+
+	var out bytes.Buffer
+	stdin, stdout = bytes.NewReader(in), &out
+	return &out
+}
+
+func TestStdioPipeline(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "src")
+	if err := os.MkdirAll(source, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(source, "main.go"), []byte("package main\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	// snapdir clone src - | gzip
+	out := useStdio(t, nil)
+	if err := cloneProject(ctx, source, "-", snapdir.Options{}); err != nil {
+		t.Fatalf("cloneProject() to stdout error = %v", err)
+	}
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write(out.Bytes())
+	gz.Close()
+
+	tests := []struct {
+		name string
+		run  func() error
+		want string
+	}{
+		{
+			name: "restore",
+			run: func() error {
+				destination := filepath.Join(dir, "restored")
+				if err := restoreProject(ctx, "-", destination, nil, snapdir.Options{}); err != nil {
+					return err
+				}
+				data, err := os.ReadFile(filepath.Join(destination, "main.go"))
+				if string(data) != "package main\n" {
+					t.Errorf("restored main.go = %q, %v", data, err)
+				}
+				return nil
+			},
+		},
+		{
+			name: "flatten",
+			run:  func() error { return flattenSnapshot("-", "-", snapdir.Options{}) },
+			want: `"path": "main.go"`,
+		},
+		{
+			name: "cat",
+			run:  func() error { return catFile("-", "main.go", snapdir.Options{}, stdout, newLogger(io.Discard, false)) },
+			want: "package main\n",
+		},
+		{
+			name: "ls",
+			run:  func() error { return listSnapshot("-", "", listOptions{}, stdout) },
+			want: "main.go",
+		},
+		{
+			name: "info",
+			run:  func() error { return printInfo("-", snapdir.Options{}, stdout) },
+			want: "(standard input)",
+		},
+		{
+			name: "export",
+			run:  func() error { return exportArchive("-", "-", snapdir.Options{}) },
+			want: "package main\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := useStdio(t, compressed.Bytes())
+			if err := tt.run(); err != nil {
+				t.Fatalf("error = %v", err)
+			}
+			if !strings.Contains(out.String(), tt.want) {
+				t.Errorf("stdout = %q, want it to contain %q", out.String(), tt.want)
+			}
+		})
+	}
+
+	// The export is a tar archive that import reads back from stdin
+	out = useStdio(t, compressed.Bytes())
+	if err := exportArchive("-", "-", snapdir.Options{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tar.NewReader(bytes.NewReader(out.Bytes())).Next(); err != nil {
+		t.Errorf("export to stdout is not a tar archive: %v", err)
+	}
+	imported := useStdio(t, out.Bytes())
+	if err := importArchive(ctx, "-", "-", snapdir.Options{}); err != nil {
+		t.Fatalf("importArchive() from stdin error = %v", err)
+	}
+	snapshot, err := snapdir.ReadSnapshot(imported)
+	if err != nil || len(snapshot.Files) != 1 || snapshot.Files[0].Contents != "package main\n" {
+		t.Errorf("imported snapshot = %+v, %v", snapshot, err)
+	}
+}
+
+func TestStdioNeedsFile(t *testing.T) {
+	useStdio(t, []byte(`{"version":"1.0.0","files":[]}`))
+	key, err := snapdir.GenerateSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := signSnapshot("-", "key.txt", nil, io.Discard); err == nil {
+		t.Error("signSnapshot() should reject standard input")
+	}
+	if err := verifySnapshot("-", []*snapdir.VerifyKey{key.Public()}, nil, io.Discard); err == nil {
+		t.Error("verifySnapshot() should reject standard input")
+	}
+	trusted := []*snapdir.VerifyKey{key.Public()}
+	if err := restoreProject(context.Background(), "-", filepath.Join(t.TempDir(), "out"), trusted, snapdir.Options{}); err == nil {
+		t.Error("restoreProject() should not check signatures of standard input")
+	}
+}
+
+func TestStdioLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		snapshot string
+		limits   snapdir.RestoreLimits
+	}{
+		{name: "unsafe path", snapshot: `{"version":"1.0.0","files":[{"path":"../escape.txt","contents":"x"}]}`},
+		{name: "too many entries", snapshot: `{"version":"1.0.0","files":[{"path":"a"},{"path":"b"}]}`, limits: snapdir.RestoreLimits{MaxEntries: 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useStdio(t, []byte(tt.snapshot))
+			if _, err := openSnapshot("-", snapdir.Options{Limits: tt.limits}); err == nil {
+				t.Error("openSnapshot() should apply the restore checks to standard input")
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package snapdir
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+)
+
+// ChangeKind describes how an entry differs between a snapshot and a tree
+type ChangeKind string
+
+// Kinds of changes reported by Diff
+const (
+	Added    ChangeKind = "added"
+	Modified ChangeKind = "modified"
+	Deleted  ChangeKind = "deleted"
+)
+
+// Change is an entry that differs between a snapshot and a tree
+type Change struct {
+	Path string
+	Kind ChangeKind
+}
+
+// Diff compares the directory dir with snapshot and returns the entries
+// that were added, modified or deleted since the snapshot was taken
+func Diff(ctx context.Context, snapshot ProjectSnapshot, dir string, opts Options) ([]Change, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat directory: %w", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("not a directory: %s", dir)
+	}
+	opts, err = opts.withGitFiles(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	return DiffFS(ctx, snapshot, dirFS(dir), opts)
+}
+
+// DiffFS compares fsys with snapshot like Diff. The same ignore rules and
+// size limit as for CloneFS apply. Files are only read when their type,
+// mode and size match the snapshot and their hash is not in
+// opts.StatCache.
+func DiffFS(ctx context.Context, snapshot ProjectSnapshot, fsys fs.FS, opts Options) ([]Change, error) {
+	if snapshot.Parent != "" {
+		return nil, fmt.Errorf("snapshot is incremental, open it with OpenSnapshot to include its parent %s", snapshot.Parent)
+	}
+
+	opts.Parent = nil
+	entries, err := collectEntries(ctx, fsys, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	previous := make(map[string]FileInfo, len(snapshot.Files))
+	for _, file := range snapshot.Files {
+		if !file.Deleted {
+			previous[file.Path] = file
+		}
+	}
+
+	var (
+		changes []Change
+		hashes  []FileInfo
+	)
+	seen := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		seen[entry.Path] = true
+
+		old, ok := previous[entry.Path]
+		switch {
+		case !ok:
+			changes = append(changes, Change{Path: entry.Path, Kind: Added})
+		case old.IsDir != entry.IsDir || old.Link != entry.Link || (old.Mode != 0 && old.Mode != entry.Mode):
+			changes = append(changes, Change{Path: entry.Path, Kind: Modified})
+		case entry.Link != "":
+			// A symlink with the same target is unchanged
+		case !entry.IsDir && old.DataSize() != entry.Size:
+			changes = append(changes, Change{Path: entry.Path, Kind: Modified})
+		case !entry.IsDir:
+			hashes = append(hashes, entry)
+		}
+	}
+
+	for _, file := range snapshot.Files {
+		if !file.Deleted && !seen[file.Path] {
+			changes = append(changes, Change{Path: file.Path, Kind: Deleted})
+		}
+	}
+
+	// Files that may be unchanged are compared by hash, reading only those
+	// the stat cache does not know
+	skip := func(entry FileInfo) bool { return entry.SHA256 != "" }
+	err = readFiles(ctx, fsys, hashes, opts, skip, func(entry FileInfo) error {
+		old := previous[entry.Path]
+		want := old.SHA256
+		if want == "" {
+			data, err := old.Data()
+			if err != nil {
+				return err
+			}
+			want = HashContents(data)
+		}
+		if entry.SHA256 != want {
+			changes = append(changes, Change{Path: entry.Path, Kind: Modified})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return walkOrderLess(changes[i].Path, changes[j].Path)
+	})
+	return changes, nil
+}
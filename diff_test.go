@@ -0,0 +1,120 @@
+package snapdir
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestDiffFS(t *testing.T) {
+	old := time.Now().Add(-time.Hour)
+	base := fstest.MapFS{
+		"same.txt":    {Data: []byte("same"), Mode: 0644, ModTime: old},
+		"edit.txt":    {Data: []byte("aaaa"), Mode: 0644, ModTime: old},
+		"grow.txt":    {Data: []byte("short"), Mode: 0644, ModTime: old},
+		"chmod.sh":    {Data: []byte("#!/bin/sh"), Mode: 0644, ModTime: old},
+		"gone.txt":    {Data: []byte("gone"), Mode: 0644, ModTime: old},
+		"dir":         {Mode: fs.ModeDir | 0755, ModTime: old},
+		"dir/sub.txt": {Data: []byte("sub"), Mode: 0644, ModTime: old},
+	}
+	snapshot, err := CloneFS(context.Background(), base, Options{})
+	if err != nil {
+		t.Fatalf("CloneFS() error = %v", err)
+	}
+
+	current := fstest.MapFS{
+		"same.txt":    base["same.txt"],
+		"edit.txt":    {Data: []byte("bbbb"), Mode: 0644, ModTime: old},
+		"grow.txt":    {Data: []byte("much longer"), Mode: 0644, ModTime: old},
+		"chmod.sh":    {Data: []byte("#!/bin/sh"), Mode: 0755, ModTime: old},
+		"new.txt":     {Data: []byte("new"), Mode: 0644, ModTime: old},
+		"dir":         base["dir"],
+		"dir/sub.txt": base["dir/sub.txt"],
+	}
+
+	changes, err := DiffFS(context.Background(), snapshot, current, Options{})
+	if err != nil {
+		t.Fatalf("DiffFS() error = %v", err)
+	}
+	want := []Change{
+		{Path: "chmod.sh", Kind: Modified},
+		{Path: "edit.txt", Kind: Modified},
+		{Path: "gone.txt", Kind: Deleted},
+		{Path: "grow.txt", Kind: Modified},
+		{Path: "new.txt", Kind: Added},
+	}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("DiffFS() = %v, want %v", changes, want)
+	}
+
+	// Identical trees have no changes, and with a warm stat cache no file
+	// has to be read to tell
+	cache, err := OpenStatCache(filepath.Join(t.TempDir(), "statcache.json"))
+	if err != nil {
+		t.Fatalf("OpenStatCache() error = %v", err)
+	}
+	for run := 0; run < 2; run++ {
+		counting := &countingFS{FS: base}
+		changes, err := DiffFS(context.Background(), snapshot, counting, Options{StatCache: cache})
+		if err != nil {
+			t.Fatalf("DiffFS() error = %v", err)
+		}
+		if len(changes) != 0 {
+			t.Errorf("run %d: DiffFS() = %v, want no changes", run, changes)
+		}
+		if run == 1 && counting.opened.Load() != 0 {
+			t.Errorf("cached run read %d files, want 0", counting.opened.Load())
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "file.txt"), []byte("before"), 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	snapshot, err := CloneFS(context.Background(), os.DirFS(dir), Options{})
+	if err != nil {
+		t.Fatalf("CloneFS() error = %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "file.txt"), []byte("after!"), 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	changes, err := Diff(context.Background(), snapshot, dir, Options{})
+	if err != nil {
+		t.Fatalf("Diff() error = %v", err)
+	}
+	if want := []Change{{Path: "file.txt", Kind: Modified}}; !reflect.DeepEqual(changes, want) {
+		t.Errorf("Diff() = %v, want %v", changes, want)
+	}
+
+	if _, err := Diff(context.Background(), snapshot, filepath.Join(dir, "missing"), Options{}); err == nil {
+		t.Error("Diff() should fail for a missing directory")
+	}
+	incremental := ProjectSnapshot{Parent: "base.json"}
+	if _, err := Diff(context.Background(), incremental, dir, Options{}); err == nil {
+		t.Error("Diff() should reject an incremental snapshot")
+	}
+}
+
+func TestDiffFSFollowedSymlink(t *testing.T) {
+	fsys := linkFS("target", time.Now().Add(-time.Hour))
+	snapshot, err := CloneFS(context.Background(), fsys, Options{})
+	if err != nil {
+		t.Fatalf("CloneFS() error = %v", err)
+	}
+
+	changes, err := DiffFS(context.Background(), snapshot, fsys, Options{})
+	if err != nil {
+		t.Fatalf("DiffFS() error = %v", err)
+	}
+	if len(changes) != 0 {
+		t.Errorf("DiffFS() = %v, want no changes", changes)
+	}
+}
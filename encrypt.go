@@ -0,0 +1,535 @@
+package snapdir
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Encrypted snapshots start with encryptMagic, followed by a JSON header
+// line holding the file key wrapped for every recipient, a line with the
+// base64 HMAC of the header, and the snapshot split into segments that are
+// sealed with ChaCha20-Poly1305. Every segment but the last holds
+// segmentSize bytes, and the nonce of the last one is marked, so a stream
+// that was cut short, reordered or extended fails to decrypt. The last
+// segment is only empty for an empty stream, so a reader that reached the
+// end of the snapshot has always authenticated it.
+const (
+	encryptMagic  = "snapdir-encrypted/v1\n"
+	segmentSize   = 64 << 10
+	maxHeaderSize = 64 << 10
+	fileKeySize   = 32
+
+	// scryptLogN is the scrypt work factor used for new passphrase
+	// stanzas; maxScryptLogN bounds the work a snapshot can demand
+	scryptLogN    = 16
+	maxScryptLogN = 22
+
+	x25519PublicPrefix = "snapdir-pub-"
+	x25519SecretPrefix = "SNAPDIR-SECRET-KEY-"
+)
+
+var (
+	// ErrEncrypted is returned when an encrypted snapshot is read without
+	// a key
+	ErrEncrypted = errors.New("snapshot is encrypted, a key is needed to read it")
+
+	// ErrWrongKey is returned when none of the given keys can decrypt a
+	// snapshot
+	ErrWrongKey = errors.New("no key matches the encrypted snapshot")
+
+	// errNoMatch tells that a stanza was not made for an identity
+	errNoMatch = errors.New("stanza does not match")
+)
+
+// Recipient is a key snapshots can be encrypted to
+type Recipient interface {
+	wrap(fileKey []byte) (keyStanza, error)
+}
+
+// Identity is a key that decrypts snapshots encrypted to its recipient
+type Identity interface {
+	unwrap(stanza keyStanza) ([]byte, error)
+}
+
+// keyStanza holds the file key of an encrypted snapshot wrapped for one
+// recipient
+type keyStanza struct {
+	Type  string `json:"type"`
+	Salt  []byte `json:"salt,omitempty"`
+	LogN  int    `json:"log_n,omitempty"`
+	Share []byte `json:"share,omitempty"`
+	Key   []byte `json:"key"`
+}
+
+// encryptHeader is the header line of an encrypted snapshot
+type encryptHeader struct {
+	Recipients []keyStanza `json:"recipients"`
+	Nonce      []byte      `json:"nonce"`
+}
+
+// Passphrase is both a Recipient and an Identity. The key is derived from
+// the passphrase with scrypt and a random salt.
+type Passphrase string
+
+func (p Passphrase) wrap(fileKey []byte) (keyStanza, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return keyStanza{}, err
+	}
+	key, err := scrypt.Key([]byte(p), salt, 1<<scryptLogN, 8, 1, chacha20poly1305.KeySize)
+	if err != nil {
+		return keyStanza{}, err
+	}
+	wrapped, err := sealKey(key, fileKey)
+	if err != nil {
+		return keyStanza{}, err
+	}
+	return keyStanza{Type: "scrypt", Salt: salt, LogN: scryptLogN, Key: wrapped}, nil
+}
+
+func (p Passphrase) unwrap(stanza keyStanza) ([]byte, error) {
+	if stanza.Type != "scrypt" {
+		return nil, errNoMatch
+	}
+	if stanza.LogN < 1 || stanza.LogN > maxScryptLogN {
+		return nil, fmt.Errorf("invalid scrypt work factor %d", stanza.LogN)
+	}
+	key, err := scrypt.Key([]byte(p), stanza.Salt, 1<<stanza.LogN, 8, 1, chacha20poly1305.KeySize)
+	if err != nil {
+		return nil, err
+	}
+	return openKey(key, stanza.Key)
+}
+
+// X25519Recipient is the public half of an X25519Identity
+type X25519Recipient struct {
+	key *ecdh.PublicKey
+}
+
+// ParseX25519Recipient parses a public key as printed by
+// X25519Recipient.String
+func ParseX25519Recipient(s string) (*X25519Recipient, error) {
+	data, err := decodeKey(s, x25519PublicPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+	key, err := ecdh.X25519().NewPublicKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+	return &X25519Recipient{key: key}, nil
+}
+
+// String returns the public key in the form ParseX25519Recipient accepts
+func (r *X25519Recipient) String() string {
+	return x25519PublicPrefix + base64.RawURLEncoding.EncodeToString(r.key.Bytes())
+}
+
+func (r *X25519Recipient) wrap(fileKey []byte) (keyStanza, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return keyStanza{}, err
+	}
+	share := ephemeral.PublicKey().Bytes()
+	key, err := x25519WrapKey(ephemeral, r.key, share, r.key.Bytes())
+	if err != nil {
+		return keyStanza{}, err
+	}
+	wrapped, err := sealKey(key, fileKey)
+	if err != nil {
+		return keyStanza{}, err
+	}
+	return keyStanza{Type: "x25519", Share: share, Key: wrapped}, nil
+}
+
+// X25519Identity is a secret key for encrypting snapshots to its
+// recipient without sharing a passphrase
+type X25519Identity struct {
+	key *ecdh.PrivateKey
+}
+
+// GenerateX25519Identity creates a new random secret key
+func GenerateX25519Identity() (*X25519Identity, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	return &X25519Identity{key: key}, nil
+}
+
+// ParseX25519Identity parses a secret key as printed by
+// X25519Identity.String
+func ParseX25519Identity(s string) (*X25519Identity, error) {
+	data, err := decodeKey(s, x25519SecretPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("invalid secret key: %w", err)
+	}
+	key, err := ecdh.X25519().NewPrivateKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid secret key: %w", err)
+	}
+	return &X25519Identity{key: key}, nil
+}
+
+// String returns the secret key in the form ParseX25519Identity accepts
+func (id *X25519Identity) String() string {
+	return x25519SecretPrefix + base64.RawURLEncoding.EncodeToString(id.key.Bytes())
+}
+
+// Recipient returns the public key snapshots are encrypted to for id
+func (id *X25519Identity) Recipient() *X25519Recipient {
+	return &X25519Recipient{key: id.key.PublicKey()}
+}
+
+func (id *X25519Identity) unwrap(stanza keyStanza) ([]byte, error) {
+	if stanza.Type != "x25519" {
+		return nil, errNoMatch
+	}
+	share, err := ecdh.X25519().NewPublicKey(stanza.Share)
+	if err != nil {
+		return nil, fmt.Errorf("invalid x25519 stanza: %w", err)
+	}
+	key, err := x25519WrapKey(id.key, share, stanza.Share, id.key.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return openKey(key, stanza.Key)
+}
+
+// x25519WrapKey derives the key wrapping the file key from the shared
+// secret of the ephemeral key, whose public half is share, and the
+// recipient key. It is bound to both public keys.
+func x25519WrapKey(private *ecdh.PrivateKey, public *ecdh.PublicKey, share, recipient []byte) ([]byte, error) {
+	secret, err := private.ECDH(public)
+	if err != nil {
+		return nil, fmt.Errorf("invalid x25519 key: %w", err)
+	}
+	salt := append(append([]byte{}, share...), recipient...)
+	return deriveKey(secret, salt, "snapdir x25519"), nil
+}
+
+// decodeKey strips prefix from a printed key and decodes the rest
+func decodeKey(s, prefix string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, prefix) {
+		return nil, fmt.Errorf("missing %s prefix", prefix)
+	}
+	return base64.RawURLEncoding.DecodeString(s[len(prefix):])
+}
+
+// deriveKey expands secret into a 32 byte key for the purpose info
+func deriveKey(secret, salt []byte, info string) []byte {
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(info)), key); err != nil {
+		panic(err) // HKDF only fails when asked for too much output
+	}
+	return key
+}
+
+// sealKey encrypts the file key with a wrapping key, which is only ever
+// used once, so the nonce can be fixed
+func sealKey(key, fileKey []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nil, make([]byte, aead.NonceSize()), fileKey, nil), nil
+}
+
+// openKey decrypts a wrapped file key. A wrong key reports errNoMatch.
+func openKey(key, wrapped []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	fileKey, err := aead.Open(nil, make([]byte, aead.NonceSize()), wrapped, nil)
+	if err != nil || len(fileKey) != fileKeySize {
+		return nil, errNoMatch
+	}
+	return fileKey, nil
+}
+
+// headerMAC authenticates the magic and the header line, so stanzas cannot
+// be swapped or altered by someone who does not know the file key
+func headerMAC(fileKey, header []byte) []byte {
+	mac := hmac.New(sha256.New, deriveKey(fileKey, nil, "snapdir header"))
+	mac.Write([]byte(encryptMagic))
+	mac.Write(header)
+	return mac.Sum(nil)
+}
+
+// EncryptWriter returns a writer that encrypts everything written to it for
+// recipients and writes it to w. Close must be called to write the final
+// segment; it does not close w.
+func EncryptWriter(w io.Writer, recipients ...Recipient) (io.WriteCloser, error) {
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("no recipients to encrypt to")
+	}
+
+	fileKey := make([]byte, fileKeySize)
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(fileKey); err != nil {
+		return nil, fmt.Errorf("failed to generate file key: %w", err)
+	}
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	header := encryptHeader{Nonce: nonce}
+	for _, recipient := range recipients {
+		stanza, err := recipient.wrap(fileKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to wrap file key: %w", err)
+		}
+		header.Recipients = append(header.Recipients, stanza)
+	}
+	line, err := json.Marshal(header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal encryption header: %w", err)
+	}
+	line = append(line, '\n')
+
+	var buf bytes.Buffer
+	buf.WriteString(encryptMagic)
+	buf.Write(line)
+	buf.WriteString(base64.StdEncoding.EncodeToString(headerMAC(fileKey, line)))
+	buf.WriteByte('\n')
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return nil, fmt.Errorf("failed to write encryption header: %w", err)
+	}
+
+	aead, err := chacha20poly1305.New(deriveKey(fileKey, nonce, "snapdir payload"))
+	if err != nil {
+		return nil, err
+	}
+	return &encryptWriter{w: w, aead: aead, buf: make([]byte, 0, segmentSize)}, nil
+}
+
+// encryptWriter seals the stream segment by segment
+type encryptWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	buf     []byte
+	counter uint64
+	closed  bool
+	err     error
+}
+
+func (ew *encryptWriter) Write(p []byte) (int, error) {
+	if ew.closed {
+		return 0, fmt.Errorf("write to closed encrypted stream")
+	}
+	written := 0
+	for len(p) > 0 && ew.err == nil {
+		// A full segment is only sealed once more data follows, as it
+		// may turn out to be the last one
+		if len(ew.buf) == segmentSize {
+			ew.seal(false)
+			if ew.err != nil {
+				break
+			}
+		}
+		n := copy(ew.buf[len(ew.buf):cap(ew.buf)], p)
+		ew.buf = ew.buf[:len(ew.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, ew.err
+}
+
+// Close seals the remaining data as the final segment
+func (ew *encryptWriter) Close() error {
+	if ew.closed {
+		return ew.err
+	}
+	ew.closed = true
+	if ew.err == nil {
+		ew.seal(true)
+	}
+	return ew.err
+}
+
+func (ew *encryptWriter) seal(last bool) {
+	nonce := segmentNonce(ew.counter, last)
+	ew.counter++
+	if _, err := ew.w.Write(ew.aead.Seal(nil, nonce, ew.buf, nil)); err != nil {
+		ew.err = err
+	}
+	ew.buf = ew.buf[:0]
+}
+
+// segmentNonce returns the nonce of the segment with the given index: three
+// zero bytes, the counter as 8 bytes big-endian and a final byte that is 1
+// for the last segment
+func segmentNonce(counter uint64, last bool) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(nonce[3:11], counter)
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// IsEncrypted reports whether data starts like an encrypted snapshot
+func IsEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(encryptMagic))
+}
+
+// DecryptReader returns a reader for the snapshot in r. Encrypted snapshots
+// are decrypted with the first of identities that matches; others are
+// passed through unchanged, so callers need not know which kind they read.
+// Reading fails if the stream was tampered with or truncated.
+func DecryptReader(r io.Reader, identities ...Identity) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(len(encryptMagic))
+	if err != nil || !IsEncrypted(magic) {
+		return br, nil
+	}
+	if len(identities) == 0 {
+		return nil, ErrEncrypted
+	}
+	br.Discard(len(magic))
+
+	line, err := readHeaderLine(br)
+	if err != nil {
+		return nil, err
+	}
+	var header encryptHeader
+	if err := json.Unmarshal(line, &header); err != nil {
+		return nil, fmt.Errorf("invalid encryption header: %w", err)
+	}
+	macLine, err := readHeaderLine(br)
+	if err != nil {
+		return nil, err
+	}
+	mac, err := base64.StdEncoding.DecodeString(strings.TrimSuffix(string(macLine), "\n"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption header: %w", err)
+	}
+
+	fileKey, err := unwrapFileKey(header.Recipients, identities)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(mac, headerMAC(fileKey, line)) {
+		return nil, fmt.Errorf("encryption header was modified")
+	}
+
+	aead, err := chacha20poly1305.New(deriveKey(fileKey, header.Nonce, "snapdir payload"))
+	if err != nil {
+		return nil, err
+	}
+	return &decryptReader{
+		r:    br,
+		aead: aead,
+		buf:  make([]byte, segmentSize+aead.Overhead()),
+	}, nil
+}
+
+// readHeaderLine reads one line of the encryption header including its
+// newline, refusing overly long lines
+func readHeaderLine(br *bufio.Reader) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := br.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > maxHeaderSize {
+			return nil, fmt.Errorf("encryption header is too large")
+		}
+		if err == nil {
+			return line, nil
+		}
+		if err != bufio.ErrBufferFull {
+			return nil, fmt.Errorf("truncated encryption header: %w", err)
+		}
+	}
+}
+
+// unwrapFileKey tries every identity on every stanza
+func unwrapFileKey(stanzas []keyStanza, identities []Identity) ([]byte, error) {
+	for _, stanza := range stanzas {
+		for _, identity := range identities {
+			fileKey, err := identity.unwrap(stanza)
+			if err == nil {
+				return fileKey, nil
+			}
+			if !errors.Is(err, errNoMatch) {
+				return nil, err
+			}
+		}
+	}
+	return nil, ErrWrongKey
+}
+
+// decryptReader opens the stream segment by segment. Plaintext is only
+// returned once the segment holding it has been authenticated.
+type decryptReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	buf     []byte
+	plain   []byte
+	counter uint64
+	done    bool
+	err     error
+}
+
+func (dr *decryptReader) Read(p []byte) (int, error) {
+	for len(dr.plain) == 0 {
+		if dr.err != nil {
+			return 0, dr.err
+		}
+		if dr.done {
+			return 0, io.EOF
+		}
+		dr.err = dr.open()
+	}
+	n := copy(p, dr.plain)
+	dr.plain = dr.plain[n:]
+	return n, nil
+}
+
+// open reads and authenticates the next segment
+func (dr *decryptReader) open() error {
+	n, err := io.ReadFull(dr.r, dr.buf)
+	last := false
+	switch {
+	case err == io.EOF:
+		return fmt.Errorf("encrypted snapshot is truncated")
+	case err == io.ErrUnexpectedEOF:
+		last = true
+	case err != nil:
+		return err
+	default:
+		// A full segment is the last one if nothing follows it
+		if _, err := dr.r.Peek(1); err == io.EOF {
+			last = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	plain, err := dr.aead.Open(dr.buf[:0], segmentNonce(dr.counter, last), dr.buf[:n], nil)
+	if err != nil {
+		return fmt.Errorf("encrypted snapshot was modified or is truncated")
+	}
+	dr.counter++
+	dr.plain = plain
+	dr.done = last
+	return nil
+}
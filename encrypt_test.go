@@ -0,0 +1,330 @@
+package snapdir
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// encrypt encrypts data for recipients
+func encrypt(t *testing.T, data []byte, recipients ...Recipient) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := EncryptWriter(&buf, recipients...)
+	if err != nil {
+		t.Fatalf("EncryptWriter() error = %v", err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	return buf.Bytes()
+}
+
+// decrypt reads all of data through DecryptReader
+func decrypt(data []byte, identities ...Identity) ([]byte, error) {
+	r, err := DecryptReader(bytes.NewReader(data), identities...)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	identity, err := GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		size       int
+		recipients []Recipient
+		identity   Identity
+	}{
+		{"passphrase", 1000, []Recipient{Passphrase("secret")}, Passphrase("secret")},
+		{"x25519", 1000, []Recipient{identity.Recipient()}, identity},
+		{"second recipient", 1000, []Recipient{other.Recipient(), identity.Recipient()}, identity},
+		{"empty", 0, []Recipient{identity.Recipient()}, identity},
+		{"one segment", segmentSize, []Recipient{identity.Recipient()}, identity},
+		{"several segments", 3*segmentSize + 17, []Recipient{identity.Recipient()}, identity},
+		{"segment multiple", 2 * segmentSize, []Recipient{identity.Recipient()}, identity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := randomData(tt.size, 7)
+			encrypted := encrypt(t, data, tt.recipients...)
+			if bytes.Contains(encrypted, data[:min(len(data), 64)]) && len(data) > 0 {
+				t.Error("encrypted stream contains plaintext")
+			}
+			got, err := decrypt(encrypted, tt.identity)
+			if err != nil {
+				t.Fatalf("decrypt() error = %v", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("decrypt() returned %d bytes, want %d", len(got), len(data))
+			}
+		})
+	}
+}
+
+func TestDecryptFailsLoudly(t *testing.T) {
+	identity, err := GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stranger, err := GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := randomData(2*segmentSize+100, 3)
+	encrypted := encrypt(t, data, identity.Recipient(), Passphrase("secret"))
+	payload := bytes.LastIndexByte(encrypted[:1024], '\n') + 1
+
+	flip := func(i int) []byte {
+		tampered := bytes.Clone(encrypted)
+		tampered[i] ^= 1
+		return tampered
+	}
+
+	tests := []struct {
+		name       string
+		data       []byte
+		identities []Identity
+		wantErr    error
+	}{
+		{"no key", encrypted, nil, ErrEncrypted},
+		{"wrong key", encrypted, []Identity{stranger}, ErrWrongKey},
+		{"wrong passphrase", encrypted, []Identity{Passphrase("guess")}, ErrWrongKey},
+		{"flipped payload byte", flip(payload + 10), []Identity{identity}, nil},
+		{"flipped last byte", flip(len(encrypted) - 1), []Identity{identity}, nil},
+		{"flipped header byte", flip(len(encryptMagic) + 30), []Identity{identity}, nil},
+		{"truncated in segment", encrypted[:len(encrypted)-50], []Identity{identity}, nil},
+		{"truncated at segment", encrypted[:payload+segmentSize+16], []Identity{identity}, nil},
+		{"extended", append(bytes.Clone(encrypted), 0), []Identity{identity}, nil},
+		{"header only", encrypted[:payload], []Identity{identity}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decrypt(tt.data, tt.identities...)
+			if err == nil {
+				t.Fatalf("decrypt() returned %d bytes, want an error", len(got))
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("decrypt() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDecryptReaderPassesPlaintext(t *testing.T) {
+	data := []byte(`{"version": "1.0.0", "files": []}`)
+	got, err := decrypt(data, Passphrase("unused"))
+	if err != nil {
+		t.Fatalf("decrypt() error = %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("decrypt() = %q, want %q", got, data)
+	}
+}
+
+func TestParseX25519Keys(t *testing.T) {
+	identity, err := GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := ParseX25519Identity(identity.String())
+	if err != nil {
+		t.Fatalf("ParseX25519Identity() error = %v", err)
+	}
+	if parsed.String() != identity.String() {
+		t.Errorf("ParseX25519Identity() = %s, want %s", parsed, identity)
+	}
+
+	recipient, err := ParseX25519Recipient(identity.Recipient().String())
+	if err != nil {
+		t.Fatalf("ParseX25519Recipient() error = %v", err)
+	}
+	if recipient.String() != identity.Recipient().String() {
+		t.Errorf("ParseX25519Recipient() = %s, want %s", recipient, identity.Recipient())
+	}
+	if !strings.HasPrefix(recipient.String(), "snapdir-pub-") {
+		t.Errorf("public key %s lacks its prefix", recipient)
+	}
+
+	for _, bad := range []string{"", identity.Recipient().String(), x25519SecretPrefix + "!!", x25519SecretPrefix + "AAAA"} {
+		if _, err := ParseX25519Identity(bad); err == nil {
+			t.Errorf("ParseX25519Identity(%q) should fail", bad)
+		}
+	}
+	if _, err := ParseX25519Recipient(identity.String()); err == nil {
+		t.Error("ParseX25519Recipient() should reject a secret key")
+	}
+}
+
+func TestEncryptedCloneAndRestore(t *testing.T) {
+	identity, err := GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "secret.txt"), []byte("top secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	opts := Options{Recipients: []Recipient{identity.Recipient()}}
+	if err := Clone(context.Background(), src, &buf, opts); err != nil {
+		t.Fatalf("Clone() error = %v", err)
+	}
+	if !IsEncrypted(buf.Bytes()) || bytes.Contains(buf.Bytes(), []byte("secret.txt")) {
+		t.Fatal("Clone() did not encrypt the snapshot")
+	}
+
+	dir := t.TempDir()
+	if err := Restore(context.Background(), bytes.NewReader(buf.Bytes()), filepath.Join(dir, "plain"), Options{}); !errors.Is(err, ErrEncrypted) {
+		t.Errorf("Restore() without key error = %v, want %v", err, ErrEncrypted)
+	}
+
+	dst := filepath.Join(dir, "restored")
+	if err := Restore(context.Background(), bytes.NewReader(buf.Bytes()), dst, Options{Identities: []Identity{identity}}); err != nil {
+		t.Fatalf("Restore() error = %v", err)
+	}
+	data, err := os.ReadFile(filepath.Join(dst, "secret.txt"))
+	if err != nil || string(data) != "top secret" {
+		t.Errorf("restored file = %q, %v", data, err)
+	}
+
+	// Snapshot files and their parents decrypt through OpenSnapshot too
+	file := filepath.Join(dir, "snapshot.json")
+	if err := os.WriteFile(file, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := OpenSnapshot(file, identity)
+	if err != nil {
+		t.Fatalf("OpenSnapshot() error = %v", err)
+	}
+	if len(snapshot.Files) != 1 || snapshot.Files[0].Path != "secret.txt" {
+		t.Errorf("OpenSnapshot() files = %+v", snapshot.Files)
+	}
+	if _, err := OpenParent(file, filepath.Join(dir, "next.json"), Passphrase("wrong")); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("OpenParent() error = %v, want %v", err, ErrWrongKey)
+	}
+}
+
+func TestDecodeReader(t *testing.T) {
+	snapshot := []byte(`{"version":"1.0.0","files":[{"path":"a.txt","contents":"a"}]}`)
+	gzipped := func(data []byte) []byte {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		gz.Write(data)
+		gz.Close()
+		return buf.Bytes()
+	}
+	key := Passphrase("secret")
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"plain", snapshot},
+		{"gzip", gzipped(snapshot)},
+		{"encrypted", encrypt(t, snapshot, key)},
+		{"gzip then encrypted", encrypt(t, gzipped(snapshot), key)},
+		{"encrypted then gzip", gzipped(encrypt(t, snapshot, key))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := DecodeReader(bytes.NewReader(tt.data), key)
+			if err != nil {
+				t.Fatalf("DecodeReader() error = %v", err)
+			}
+			got, err := io.ReadAll(r)
+			if err != nil || !bytes.Equal(got, snapshot) {
+				t.Errorf("DecodeReader() = %q, %v", got, err)
+			}
+
+			read, err := ReadSnapshot(bytes.NewReader(tt.data), key)
+			if err != nil || len(read.Files) != 1 || read.Files[0].Contents != "a" {
+				t.Errorf("ReadSnapshot() = %+v, %v", read, err)
+			}
+		})
+	}
+
+	if _, err := DecodeReader(bytes.NewReader(gzipMagic)); err == nil {
+		t.Error("DecodeReader() should fail for a truncated gzip stream")
+	}
+}
+
+func TestCompressedClone(t *testing.T) {
+	src := t.TempDir()
+	contents := strings.Repeat("compressible ", 1000)
+	if err := os.WriteFile(filepath.Join(src, "a.txt"), []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	key := Passphrase("secret")
+
+	tests := []struct {
+		name string
+		opts Options
+	}{
+		{"gzip", Options{Compression: CompressGzip}},
+		{"gzip and encrypted", Options{Compression: CompressGzip, Recipients: []Recipient{key}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := Clone(context.Background(), src, &buf, tt.opts); err != nil {
+				t.Fatalf("Clone() error = %v", err)
+			}
+			if buf.Len() > len(contents)/2 {
+				t.Errorf("Clone() wrote %d bytes, want a compressed snapshot", buf.Len())
+			}
+
+			dst := filepath.Join(t.TempDir(), "restored")
+			if err := Restore(context.Background(), bytes.NewReader(buf.Bytes()), dst, Options{Identities: []Identity{key}}); err != nil {
+				t.Fatalf("Restore() error = %v", err)
+			}
+			data, err := os.ReadFile(filepath.Join(dst, "a.txt"))
+			if err != nil || string(data) != contents {
+				t.Errorf("restored file has %d bytes, %v", len(data), err)
+			}
+		})
+	}
+}
+
+func TestParseCompression(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Compression
+		wantErr bool
+	}{
+		{"gzip", CompressGzip, false},
+		{"none", CompressNone, false},
+		{"off", CompressNone, false},
+		{"zstd", "", true},
+	}
+	for _, tt := range tests {
+		got, err := ParseCompression(tt.in)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("ParseCompression(%q) = %q, %v", tt.in, got, err)
+		}
+	}
+}
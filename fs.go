@@ -0,0 +1,375 @@
+package snapdir
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultDirMode is the mode reported for directories that are implied by
+// file paths but have no entry of their own in the snapshot
+const defaultDirMode = 0755
+
+// FS provides read-only access to the files of a snapshot. It implements
+// fs.FS, fs.ReadDirFS, fs.StatFS and fs.ReadFileFS, so snapshots can be used
+// with fs.WalkDir, template.ParseFS, http.FS and friends without restoring
+// them to disk. Symlinks are followed as long as they stay inside the
+// snapshot; ReadLink and Lstat report them without following.
+type FS struct {
+	nodes map[string]*fsNode
+
+	// load, if set, reads the contents of files whose entries do not
+	// hold them
+	load loadFunc
+}
+
+var (
+	_ fs.FS         = (*FS)(nil)
+	_ fs.ReadDirFS  = (*FS)(nil)
+	_ fs.StatFS     = (*FS)(nil)
+	_ fs.ReadFileFS = (*FS)(nil)
+	_ readLinkFS    = (*FS)(nil)
+)
+
+// maxLinkHops is the number of symlinks followed while resolving one path
+const maxLinkHops = 40
+
+// fsNode is a single file or directory of an FS
+type fsNode struct {
+	name     string
+	file     FileInfo
+	mode     fs.FileMode
+	modTime  time.Time
+	size     int64
+	children []*fsNode
+}
+
+// NewFS builds a file system from a snapshot. Directories that are implied
+// by file paths but missing from the snapshot are created automatically.
+// Incremental snapshots have to be merged with their parents first, see
+// OpenSnapshot.
+func NewFS(snapshot ProjectSnapshot) (*FS, error) {
+	if snapshot.Parent != "" {
+		return nil, fmt.Errorf("snapshot is incremental, open it with OpenSnapshot to include its parent %s", snapshot.Parent)
+	}
+
+	root := &fsNode{name: ".", mode: fs.ModeDir | defaultDirMode}
+	fsys := &FS{nodes: map[string]*fsNode{".": root}}
+
+	for _, file := range snapshot.Files {
+		if !fs.ValidPath(file.Path) || file.Path == "." {
+			return nil, fmt.Errorf("invalid path in snapshot: %q", file.Path)
+		}
+
+		node, err := fsys.mkdirAll(path.Dir(file.Path))
+		if err != nil {
+			return nil, err
+		}
+
+		if existing, ok := fsys.nodes[file.Path]; ok {
+			// A directory may already exist because a file below it came first
+			if !file.IsDir || !existing.mode.IsDir() || existing.file.Path != "" {
+				return nil, fmt.Errorf("duplicate path in snapshot: %s", file.Path)
+			}
+			existing.file = file
+			existing.mode = fs.ModeDir | fs.FileMode(file.Mode).Perm()
+			existing.modTime = parseNodeTime(file.ModTime)
+			continue
+		}
+
+		child := &fsNode{
+			name:    path.Base(file.Path),
+			file:    file,
+			mode:    fs.FileMode(file.Mode).Perm(),
+			modTime: parseNodeTime(file.ModTime),
+		}
+		if file.IsDir {
+			child.mode |= fs.ModeDir
+		} else if file.Link != "" {
+			child.mode = fs.ModeSymlink | fs.ModePerm
+		} else {
+			child.size = file.DataSize()
+		}
+
+		fsys.nodes[file.Path] = child
+		node.children = append(node.children, child)
+	}
+
+	for _, node := range fsys.nodes {
+		sort.Slice(node.children, func(i, j int) bool {
+			return node.children[i].name < node.children[j].name
+		})
+	}
+
+	return fsys, nil
+}
+
+// OpenFS reads a snapshot file and returns a file system for it.
+// Incremental snapshots are merged with their parents and encrypted ones
+// decrypted with identities.
+func OpenFS(snapshotFile string, identities ...Identity) (*FS, error) {
+	snapshot, err := OpenSnapshot(snapshotFile, identities...)
+	if err != nil {
+		return nil, err
+	}
+	return NewFS(snapshot)
+}
+
+// mkdirAll returns the directory node for dir, creating it and its parents
+// as implicit directories if needed
+func (fsys *FS) mkdirAll(dir string) (*fsNode, error) {
+	if node, ok := fsys.nodes[dir]; ok {
+		if !node.mode.IsDir() {
+			return nil, fmt.Errorf("path in snapshot is below a file: %s", dir)
+		}
+		return node, nil
+	}
+
+	parent, err := fsys.mkdirAll(path.Dir(dir))
+	if err != nil {
+		return nil, err
+	}
+
+	node := &fsNode{name: path.Base(dir), mode: fs.ModeDir | defaultDirMode}
+	fsys.nodes[dir] = node
+	parent.children = append(parent.children, node)
+	return node, nil
+}
+
+// parseNodeTime parses a snapshot modification time, using the zero time
+// for entries that do not record one
+func parseNodeTime(s string) time.Time {
+	if s == "" {
+		return time.Time{}
+	}
+	t, err := ParseModTime(s)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// lookup finds the node for name, following symlinks, and reports errors
+// as *fs.PathError
+func (fsys *FS) lookup(op, name string) (*fsNode, error) {
+	return fsys.resolve(op, name, true)
+}
+
+// resolve finds the node for name. Symlinks in the directories of name are
+// always followed, a symlink at name itself only if followLast is set.
+// Links pointing outside the snapshot do not resolve.
+func (fsys *FS) resolve(op, name string, followLast bool) (*fsNode, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	notExist := &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+
+	p := name
+	for hops := 0; hops <= maxLinkHops; hops++ {
+		node, ok := fsys.nodes["."], true
+		parts := strings.Split(p, "/")
+		if p == "." {
+			parts = nil
+		}
+
+		resolved, restarted := ".", false
+		for i, part := range parts {
+			resolved = path.Join(resolved, part)
+			if node, ok = fsys.nodes[resolved]; !ok {
+				return nil, notExist
+			}
+			if node.mode&fs.ModeSymlink == 0 || (i == len(parts)-1 && !followLast) {
+				continue
+			}
+
+			target := node.file.Link
+			if path.IsAbs(target) {
+				return nil, notExist
+			}
+			target = path.Join(path.Dir(resolved), target, strings.Join(parts[i+1:], "/"))
+			if target == ".." || strings.HasPrefix(target, "../") {
+				return nil, notExist
+			}
+			p, restarted = target, true
+			break
+		}
+		if !restarted {
+			return node, nil
+		}
+	}
+	return nil, &fs.PathError{Op: op, Path: name, Err: fmt.Errorf("too many levels of symbolic links")}
+}
+
+// Open opens the named file or directory
+func (fsys *FS) Open(name string) (fs.File, error) {
+	node, err := fsys.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	if node.mode.IsDir() {
+		return &openDir{node: node}, nil
+	}
+
+	data, err := fsys.data(node)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &openFile{node: node, Reader: bytes.NewReader(data)}, nil
+}
+
+// ReadDir reads the named directory and returns its entries sorted by name
+func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	node, err := fsys.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !node.mode.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fmt.Errorf("not a directory")}
+	}
+
+	entries := make([]fs.DirEntry, len(node.children))
+	for i, child := range node.children {
+		entries[i] = nodeInfo{child}
+	}
+	return entries, nil
+}
+
+// Stat returns a fs.FileInfo describing the named file or directory
+func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
+	node, err := fsys.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return nodeInfo{node}, nil
+}
+
+// ReadFile returns the contents of the named file
+func (fsys *FS) ReadFile(name string) ([]byte, error) {
+	node, err := fsys.lookup("readfile", name)
+	if err != nil {
+		return nil, err
+	}
+	if node.mode.IsDir() {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: fmt.Errorf("is a directory")}
+	}
+
+	data, err := fsys.data(node)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: err}
+	}
+	return data, nil
+}
+
+// data returns the contents of a file node
+func (fsys *FS) data(node *fsNode) ([]byte, error) {
+	if fsys.load != nil {
+		return fsys.load(node.file)
+	}
+	return node.file.Data()
+}
+
+// Lstat returns a fs.FileInfo describing the named entry without following
+// it if it is a symlink
+func (fsys *FS) Lstat(name string) (fs.FileInfo, error) {
+	node, err := fsys.resolve("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return nodeInfo{node}, nil
+}
+
+// ReadLink returns the target of the named symlink
+func (fsys *FS) ReadLink(name string) (string, error) {
+	node, err := fsys.resolve("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	if node.mode&fs.ModeSymlink == 0 {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	return node.file.Link, nil
+}
+
+// nodeInfo implements fs.FileInfo and fs.DirEntry for a node
+type nodeInfo struct {
+	node *fsNode
+}
+
+func (i nodeInfo) Name() string               { return i.node.name }
+func (i nodeInfo) Size() int64                { return i.node.size }
+func (i nodeInfo) Mode() fs.FileMode          { return i.node.mode }
+func (i nodeInfo) ModTime() time.Time         { return i.node.modTime }
+func (i nodeInfo) IsDir() bool                { return i.node.mode.IsDir() }
+func (i nodeInfo) Sys() any                   { return nil }
+func (i nodeInfo) Type() fs.FileMode          { return i.node.mode.Type() }
+func (i nodeInfo) Info() (fs.FileInfo, error) { return i, nil }
+func (i nodeInfo) String() string             { return fs.FormatFileInfo(i) }
+
+// openFile is an open regular file of an FS
+type openFile struct {
+	*bytes.Reader
+	node   *fsNode
+	closed bool
+}
+
+func (f *openFile) Stat() (fs.FileInfo, error) {
+	return nodeInfo{f.node}, nil
+}
+
+func (f *openFile) Read(p []byte) (int, error) {
+	if f.closed {
+		return 0, &fs.PathError{Op: "read", Path: f.node.name, Err: fs.ErrClosed}
+	}
+	return f.Reader.Read(p)
+}
+
+func (f *openFile) Close() error {
+	if f.closed {
+		return &fs.PathError{Op: "close", Path: f.node.name, Err: fs.ErrClosed}
+	}
+	f.closed = true
+	return nil
+}
+
+// openDir is an open directory of an FS
+type openDir struct {
+	node   *fsNode
+	offset int
+}
+
+func (d *openDir) Stat() (fs.FileInfo, error) {
+	return nodeInfo{d.node}, nil
+}
+
+func (d *openDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.node.name, Err: fmt.Errorf("is a directory")}
+}
+
+func (d *openDir) Close() error {
+	return nil
+}
+
+// ReadDir returns the next n entries of the directory, following the
+// semantics of fs.ReadDirFile
+func (d *openDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	remaining := d.node.children[d.offset:]
+	if n > 0 && len(remaining) == 0 {
+		return nil, io.EOF
+	}
+	if n > 0 && len(remaining) > n {
+		remaining = remaining[:n]
+	}
+
+	entries := make([]fs.DirEntry, len(remaining))
+	for i, child := range remaining {
+		entries[i] = nodeInfo{child}
+	}
+	d.offset += len(remaining)
+	return entries, nil
+}
@@ -0,0 +1,216 @@
+package snapdir
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"text/template"
+)
+
+func testFSSnapshot() ProjectSnapshot {
+	binary := FileInfo{Path: "assets/logo.bin", Mode: 0644}
+	binary.SetData([]byte{0x00, 0xff, 0x10, 0x80})
+
+	return ProjectSnapshot{
+		Version: "1.0.0",
+		Files: []FileInfo{
+			{Path: "README.md", Contents: "# readme", Mode: 0644, ModTime: "2024-01-02T03:04:05Z"},
+			{Path: "assets", IsDir: true, Mode: 0755},
+			binary,
+			{Path: "templates", IsDir: true, Mode: 0750},
+			{Path: "templates/hello.tmpl", Contents: "Hello, {{.}}!", Mode: 0644},
+			// "docs" has no entry of its own and must be implied
+			{Path: "docs/guide/intro.md", Contents: "intro", Mode: 0600},
+			{Path: "empty", IsDir: true, Mode: 0755},
+		},
+	}
+}
+
+func TestFSConformance(t *testing.T) {
+	fsys, err := NewFS(testFSSnapshot())
+	if err != nil {
+		t.Fatalf("NewFS() error = %v", err)
+	}
+
+	expected := []string{
+		"README.md",
+		"assets/logo.bin",
+		"templates/hello.tmpl",
+		"docs/guide/intro.md",
+		"empty",
+	}
+	if err := fstest.TestFS(fsys, expected...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFSReadFile(t *testing.T) {
+	fsys, err := NewFS(testFSSnapshot())
+	if err != nil {
+		t.Fatalf("NewFS() error = %v", err)
+	}
+
+	data, err := fs.ReadFile(fsys, "assets/logo.bin")
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	if string(data) != "\x00\xff\x10\x80" {
+		t.Errorf("ReadFile() = %q", data)
+	}
+
+	info, err := fs.Stat(fsys, "README.md")
+	if err != nil {
+		t.Fatalf("Stat() error = %v", err)
+	}
+	if info.Size() != int64(len("# readme")) || info.Mode() != 0644 {
+		t.Errorf("Stat() = size %d, mode %v", info.Size(), info.Mode())
+	}
+	if info.ModTime().Year() != 2024 {
+		t.Errorf("Stat() mod time = %v", info.ModTime())
+	}
+
+	info, err = fs.Stat(fsys, "docs")
+	if err != nil {
+		t.Fatalf("Stat() error = %v", err)
+	}
+	if !info.IsDir() {
+		t.Error("implied directory docs should be a directory")
+	}
+}
+
+func TestFSErrors(t *testing.T) {
+	fsys, err := NewFS(testFSSnapshot())
+	if err != nil {
+		t.Fatalf("NewFS() error = %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		call    func() error
+		wantErr error
+	}{
+		{
+			name:    "open missing file",
+			call:    func() error { _, err := fsys.Open("missing.txt"); return err },
+			wantErr: fs.ErrNotExist,
+		},
+		{
+			name:    "open invalid path",
+			call:    func() error { _, err := fsys.Open("../escape"); return err },
+			wantErr: fs.ErrInvalid,
+		},
+		{
+			name: "read directory as file",
+			call: func() error { _, err := fsys.ReadFile("assets"); return err },
+		},
+		{
+			name: "read file as directory",
+			call: func() error { _, err := fsys.ReadDir("README.md"); return err },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.call()
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewFSInvalidSnapshot(t *testing.T) {
+	tests := []struct {
+		name  string
+		files []FileInfo
+	}{
+		{
+			name:  "absolute path",
+			files: []FileInfo{{Path: "/etc/passwd"}},
+		},
+		{
+			name:  "parent reference",
+			files: []FileInfo{{Path: "../outside"}},
+		},
+		{
+			name:  "duplicate file",
+			files: []FileInfo{{Path: "a.txt"}, {Path: "a.txt"}},
+		},
+		{
+			name:  "file below a file",
+			files: []FileInfo{{Path: "a.txt"}, {Path: "a.txt/b.txt"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewFS(ProjectSnapshot{Files: tt.files}); err == nil {
+				t.Error("NewFS() should fail")
+			}
+		})
+	}
+}
+
+func TestFSWithStandardLibrary(t *testing.T) {
+	fsys, err := NewFS(testFSSnapshot())
+	if err != nil {
+		t.Fatalf("NewFS() error = %v", err)
+	}
+
+	tmpl, err := template.ParseFS(fsys, "templates/*.tmpl")
+	if err != nil {
+		t.Fatalf("ParseFS() error = %v", err)
+	}
+	var out strings.Builder
+	if err := tmpl.ExecuteTemplate(&out, "hello.tmpl", "snapdir"); err != nil {
+		t.Fatalf("Execute() error = %v", err)
+	}
+	if out.String() != "Hello, snapdir!" {
+		t.Errorf("template output = %q", out.String())
+	}
+
+	var walked []string
+	err = fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		walked = append(walked, p)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("WalkDir() error = %v", err)
+	}
+	want := ". README.md assets assets/logo.bin docs docs/guide docs/guide/intro.md empty templates templates/hello.tmpl"
+	if got := strings.Join(walked, " "); got != want {
+		t.Errorf("WalkDir() visited %q, want %q", got, want)
+	}
+}
+
+func TestOpenFS(t *testing.T) {
+	snapshotFile := filepath.Join(t.TempDir(), "snapshot.json")
+	if err := writeSnapshotFile(snapshotFile, testFSSnapshot()); err != nil {
+		t.Fatalf("failed to write snapshot: %v", err)
+	}
+
+	fsys, err := OpenFS(snapshotFile)
+	if err != nil {
+		t.Fatalf("OpenFS() error = %v", err)
+	}
+	data, err := fsys.ReadFile("docs/guide/intro.md")
+	if err != nil {
+		t.Fatalf("ReadFile() error = %v", err)
+	}
+	if string(data) != "intro" {
+		t.Errorf("ReadFile() = %q, want %q", data, "intro")
+	}
+
+	if _, err := OpenFS(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("OpenFS() should fail for a missing file")
+	}
+}
@@ -0,0 +1,403 @@
+package snapdir
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNotGitRepository is returned when a directory is not inside a git
+// repository
+var ErrNotGitRepository = errors.New("not a git repository")
+
+// GitFiles selects the files of a git work tree that are snapshotted
+type GitFiles string
+
+// Selections of work tree files. The zero value applies .gitignore instead
+// of asking git.
+const (
+	GitOff GitFiles = ""
+	// GitTracked includes the files in the git index
+	GitTracked GitFiles = "tracked"
+	// GitTrackedUntracked also includes untracked files that are not
+	// ignored
+	GitTrackedUntracked GitFiles = "tracked+untracked"
+	// GitAll includes ignored files as well, but still leaves out .git
+	GitAll GitFiles = "all"
+)
+
+// ParseGitFiles parses the name of a GitFiles selection; "off" turns git
+// off
+func ParseGitFiles(s string) (GitFiles, error) {
+	switch mode := GitFiles(s); mode {
+	case GitTracked, GitTrackedUntracked, GitAll:
+		return mode, nil
+	case "off":
+		return GitOff, nil
+	default:
+		return "", fmt.Errorf("unknown git mode %q (want tracked, tracked+untracked, all or off)", s)
+	}
+}
+
+// lsFilesArgs returns the git ls-files arguments listing the selection
+func (mode GitFiles) lsFilesArgs() ([]string, error) {
+	args := []string{"ls-files", "-z", "--cached"}
+	switch mode {
+	case GitTracked:
+	case GitTrackedUntracked:
+		args = append(args, "--others", "--exclude-standard")
+	case GitAll:
+		args = append(args, "--others")
+	default:
+		return nil, fmt.Errorf("unknown git mode %q", string(mode))
+	}
+	return args, nil
+}
+
+// gitSelection holds the files git lists for a work tree and the
+// directories leading to them
+type gitSelection struct {
+	files map[string]bool
+	dirs  map[string]bool
+}
+
+// includes reports whether the entry p of the work tree was selected.
+// Directories listed as files are submodules, whose contents are not part
+// of the repository.
+func (sel *gitSelection) includes(p string, isDir bool, logger *slog.Logger) bool {
+	if !isDir {
+		return sel.files[p]
+	}
+	if sel.files[p] {
+		logger.Warn("skipping git submodule", "path", p)
+		return false
+	}
+	return sel.dirs[p]
+}
+
+// withGitFiles returns opts restricted to the files of the work tree dir
+// that opts.Git selects. Contents still come from the work tree, so
+// tracked files with uncommitted changes are included as they are.
+func (opts Options) withGitFiles(ctx context.Context, dir string) (Options, error) {
+	if opts.Git == GitOff {
+		return opts, nil
+	}
+	args, err := opts.Git.lsFilesArgs()
+	if err != nil {
+		return opts, err
+	}
+
+	out, err := runGit(ctx, dir, args...)
+	if errors.Is(err, ErrNotGitRepository) {
+		opts.logger().Debug("source is not in a git repository, using .gitignore", "source", dir)
+		return opts, nil
+	}
+	if err != nil {
+		return opts, err
+	}
+
+	sel := &gitSelection{files: make(map[string]bool), dirs: make(map[string]bool)}
+	for _, p := range strings.Split(string(out), "\x00") {
+		// Untracked nested repositories are listed as directories
+		if p == "" || strings.HasSuffix(p, "/") {
+			continue
+		}
+		sel.files[p] = true
+		for d := path.Dir(p); d != "." && !sel.dirs[d]; d = path.Dir(d) {
+			sel.dirs[d] = true
+		}
+	}
+	opts.logger().Debug("using files listed by git", "mode", string(opts.Git), "files", len(sel.files))
+
+	opts.tracked = true
+	opts.gitFiles = sel
+	return opts, nil
+}
+
+// CloneGit snapshots the tree of the commit ref in the local git
+// repository repoDir and writes it to w like Clone. Only files tracked in
+// that commit are included, so .gitignore is not applied, but opts.Ignore
+// is. Modes and symlinks come from the git tree, and every entry gets the
+// commit time as its modification time. Git is run locally and never
+// fetches missing objects.
+func CloneGit(ctx context.Context, repoDir, ref string, w io.Writer, opts Options) error {
+	tree, err := openGitTree(ctx, repoDir, ref, opts)
+	if err != nil {
+		return err
+	}
+	defer tree.Close()
+
+	// Git trees have no stat data a cache could be keyed by, and their
+	// symlinks are blobs holding the target, so they are always kept
+	opts.StatCache = nil
+	opts.Symlinks = true
+	opts.tracked = true
+
+	opts.logger().Debug("starting snapshot", "repository", repoDir, "ref", ref, "commit", tree.commit)
+	return cloneTo(ctx, tree.fsys, w, opts)
+}
+
+// CheckGitIdentity returns an error if git, run in dir, has no author or
+// committer identity to make commits with. InitGitRepository needs one,
+// so callers can find out before they create the tree to commit.
+func CheckGitIdentity(ctx context.Context, dir string) error {
+	for _, ident := range []string{"GIT_AUTHOR_IDENT", "GIT_COMMITTER_IDENT"} {
+		if _, err := runGit(ctx, dir, "var", ident); err != nil {
+			return fmt.Errorf("git has no identity to commit with, set user.name and user.email: %w", err)
+		}
+	}
+	return nil
+}
+
+// InitGitRepository creates a git repository in dir and commits everything
+// in it that is not ignored with the given message. The commit is made on
+// branch, or on git's default branch if branch is empty. Without a git
+// identity it fails before the repository is created.
+func InitGitRepository(ctx context.Context, dir, branch, message string) error {
+	if strings.HasPrefix(branch, "-") {
+		return fmt.Errorf("invalid git branch %q", branch)
+	}
+	if message == "" {
+		return fmt.Errorf("git commit message cannot be empty")
+	}
+
+	if branch != "" {
+		if _, err := runGit(ctx, dir, "check-ref-format", "--branch", branch); err != nil {
+			return fmt.Errorf("invalid git branch %q", branch)
+		}
+	}
+
+	if err := CheckGitIdentity(ctx, dir); err != nil {
+		return err
+	}
+	if _, err := runGit(ctx, dir, "init", "-q"); err != nil {
+		return err
+	}
+	if branch != "" {
+		if _, err := runGit(ctx, dir, "symbolic-ref", "HEAD", "refs/heads/"+branch); err != nil {
+			return err
+		}
+	}
+	if _, err := runGit(ctx, dir, "add", "-A"); err != nil {
+		return err
+	}
+	_, err := runGit(ctx, dir, "commit", "-q", "--allow-empty", "-m", message)
+	return err
+}
+
+// gitTree is the tree of one commit as a file system whose file contents
+// are read from git on demand
+type gitTree struct {
+	commit string
+	fsys   *FS
+	cat    *gitCatFile
+}
+
+// openGitTree lists the tree of the commit ref in repoDir
+func openGitTree(ctx context.Context, repoDir, ref string, opts Options) (*gitTree, error) {
+	if ref == "" || strings.HasPrefix(ref, "-") {
+		return nil, fmt.Errorf("invalid git ref %q", ref)
+	}
+
+	out, err := runGit(ctx, repoDir, "rev-parse", "--verify", "--quiet", ref+"^{commit}")
+	if err != nil {
+		if errors.Is(err, ErrNotGitRepository) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("unknown git revision %q", ref)
+	}
+	commit := strings.TrimSpace(string(out))
+
+	out, err = runGit(ctx, repoDir, "show", "-s", "--format=%ct", commit)
+	if err != nil {
+		return nil, err
+	}
+	seconds, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid commit time of %s: %w", commit, err)
+	}
+	modTime := FormatModTime(time.Unix(seconds, 0))
+
+	listing, err := runGit(ctx, repoDir, "ls-tree", "-r", "-t", "-l", "-z", "--full-tree", commit)
+	if err != nil {
+		return nil, err
+	}
+
+	cat, err := startGitCatFile(ctx, repoDir)
+	if err != nil {
+		return nil, err
+	}
+
+	files, objects, err := parseGitTree(listing, modTime, cat, opts)
+	if err != nil {
+		cat.Close()
+		return nil, err
+	}
+	fsys, err := NewFS(ProjectSnapshot{Version: Version, Files: files})
+	if err != nil {
+		cat.Close()
+		return nil, err
+	}
+	fsys.load = func(file FileInfo) ([]byte, error) {
+		return cat.read(objects[file.Path])
+	}
+
+	return &gitTree{commit: commit, fsys: fsys, cat: cat}, nil
+}
+
+// Close stops the git process reading file contents
+func (tree *gitTree) Close() error {
+	return tree.cat.Close()
+}
+
+// parseGitTree turns the output of git ls-tree -r -t -l -z into entries
+// and returns the git object IDs of the files by path. Symlink targets are
+// read right away.
+func parseGitTree(listing []byte, modTime string, cat *gitCatFile, opts Options) ([]FileInfo, map[string]string, error) {
+	var files []FileInfo
+	objects := make(map[string]string)
+	for _, record := range bytes.Split(listing, []byte{0}) {
+		if len(record) == 0 {
+			continue
+		}
+		// <mode> SP <type> SP <object> SP+ <size> TAB <path>
+		meta, p, ok := strings.Cut(string(record), "\t")
+		fields := strings.Fields(meta)
+		if !ok || len(fields) != 4 {
+			return nil, nil, fmt.Errorf("unexpected git ls-tree output %q", record)
+		}
+		mode, object, size := fields[0], fields[2], fields[3]
+
+		entry := FileInfo{Path: p, ModTime: modTime}
+		switch mode {
+		case "040000":
+			entry.IsDir = true
+			entry.Mode = dirPerms
+		case "100644", "100755":
+			entry.Mode = defaultPerms
+			if mode == "100755" {
+				entry.Mode = 0755
+			}
+			n, err := strconv.ParseInt(size, 10, 64)
+			if err != nil {
+				return nil, nil, fmt.Errorf("unexpected git ls-tree output %q", record)
+			}
+			entry.Size = n
+			objects[p] = object
+		case "120000":
+			target, err := cat.read(object)
+			if err != nil {
+				return nil, nil, err
+			}
+			entry.Mode = 0777
+			entry.Link = string(target)
+		case "160000":
+			opts.logger().Warn("skipping git submodule", "path", p)
+			continue
+		default:
+			return nil, nil, fmt.Errorf("unsupported git mode %s for %s", mode, p)
+		}
+		files = append(files, entry)
+	}
+	return files, objects, nil
+}
+
+// gitEnv keeps git from prompting or fetching objects of partial clones
+// from the network
+var gitEnv = []string{"GIT_TERMINAL_PROMPT=0", "GIT_NO_LAZY_FETCH=1"}
+
+// runGit runs git in dir and returns its standard output
+func runGit(ctx context.Context, dir string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "git", append([]string{"-C", dir}, args...)...)
+	cmd.Env = append(os.Environ(), gitEnv...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		if errors.Is(err, exec.ErrNotFound) {
+			return nil, fmt.Errorf("git is not installed: %w", err)
+		}
+		msg := strings.TrimSpace(stderr.String())
+		if strings.Contains(msg, "not a git repository") {
+			return nil, fmt.Errorf("%w: %s", ErrNotGitRepository, dir)
+		}
+		if msg == "" {
+			return nil, fmt.Errorf("git %s failed: %w", args[0], err)
+		}
+		return nil, fmt.Errorf("git %s failed: %s", args[0], msg)
+	}
+	return out, nil
+}
+
+// gitCatFile reads objects through one long running git cat-file --batch
+// process. Reads are serialized.
+type gitCatFile struct {
+	mu     sync.Mutex
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+}
+
+func startGitCatFile(ctx context.Context, dir string) (*gitCatFile, error) {
+	cmd := exec.CommandContext(ctx, "git", "-C", dir, "cat-file", "--batch")
+	cmd.Env = append(os.Environ(), gitEnv...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start git: %w", err)
+	}
+	return &gitCatFile{cmd: cmd, stdin: stdin, stdout: bufio.NewReader(stdout)}, nil
+}
+
+// read returns the contents of the blob with the given object ID
+func (c *gitCatFile) read(object string) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, err := io.WriteString(c.stdin, object+"\n"); err != nil {
+		return nil, fmt.Errorf("failed to read git object %s: %w", object, err)
+	}
+	header, err := c.stdout.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("failed to read git object %s: %w", object, err)
+	}
+	// <object> SP <type> SP <size> LF, or <object> SP missing LF
+	fields := strings.Fields(header)
+	if len(fields) != 3 || fields[1] != "blob" {
+		return nil, fmt.Errorf("git object %s is not a blob: %s", object, strings.TrimSpace(header))
+	}
+	size, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("unexpected git cat-file output %q", header)
+	}
+
+	data := make([]byte, size+1)
+	if _, err := io.ReadFull(c.stdout, data); err != nil {
+		return nil, fmt.Errorf("failed to read git object %s: %w", object, err)
+	}
+	return data[:size], nil
+}
+
+// Close ends the git process
+func (c *gitCatFile) Close() error {
+	c.stdin.Close()
+	return c.cmd.Wait()
+}
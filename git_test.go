@@ -0,0 +1,328 @@
+package snapdir
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// gitTestEnv gives test commits a fixed author and keeps the user's git
+// configuration out of the tests
+var gitTestEnv = []string{
+	"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+	"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com",
+	"GIT_AUTHOR_DATE=2024-03-01T10:00:00Z", "GIT_COMMITTER_DATE=2024-03-01T10:00:00Z",
+	"GIT_CONFIG_GLOBAL=/dev/null", "GIT_CONFIG_NOSYSTEM=1",
+}
+
+// unsetGitIdentity leaves git without any identity to commit with for the
+// rest of the test: no config files, no identity variables, and no
+// identity guessed from the host name
+func unsetGitIdentity(t *testing.T) {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	for _, k := range []string{"GIT_AUTHOR_NAME", "GIT_AUTHOR_EMAIL", "GIT_COMMITTER_NAME", "GIT_COMMITTER_EMAIL", "EMAIL", "GIT_CONFIG_GLOBAL"} {
+		t.Setenv(k, "")
+		os.Unsetenv(k)
+	}
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	t.Setenv("GIT_CONFIG_COUNT", "1")
+	t.Setenv("GIT_CONFIG_KEY_0", "user.useConfigOnly")
+	t.Setenv("GIT_CONFIG_VALUE_0", "true")
+}
+
+// testGit runs git in dir, skipping the test if git is not installed
+func testGit(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	cmd.Env = append(os.Environ(), gitTestEnv...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %v: %v\n%s", args, err, out)
+	}
+	return string(out)
+}
+
+// writeTestFiles creates files below dir, with their parent directories
+func writeTestFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCloneGit(t *testing.T) {
+	repo := t.TempDir()
+	testGit(t, repo, "init", "-q")
+	writeTestFiles(t, repo, map[string]string{
+		".gitignore":    "*.log\n",
+		"README.md":     "v1",
+		"bin/run.sh":    "#!/bin/sh\n",
+		"logs/keep.log": "tracked anyway",
+	})
+	if err := os.Symlink("bin/run.sh", filepath.Join(repo, "run")); err != nil {
+		t.Skipf("symlinks not supported: %v", err)
+	}
+	testGit(t, repo, "add", ".")
+	testGit(t, repo, "add", "-f", "logs/keep.log")
+	testGit(t, repo, "update-index", "--chmod=+x", "bin/run.sh")
+	testGit(t, repo, "commit", "-q", "-m", "release")
+	testGit(t, repo, "tag", "v1.2.0")
+
+	// Later changes to the work tree and history must not show up
+	writeTestFiles(t, repo, map[string]string{"README.md": "v2", "untracked.txt": "new"})
+	testGit(t, repo, "commit", "-q", "-am", "next")
+
+	var buf bytes.Buffer
+	if err := CloneGit(context.Background(), repo, "v1.2.0", &buf, Options{}); err != nil {
+		t.Fatalf("CloneGit() error = %v", err)
+	}
+	var snapshot ProjectSnapshot
+	if err := json.Unmarshal(buf.Bytes(), &snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	files := make(map[string]FileInfo)
+	for _, file := range snapshot.Files {
+		files[file.Path] = file
+		if file.ModTime != "2024-03-01T10:00:00Z" {
+			t.Errorf("entry %s has mtime %s, want the commit time", file.Path, file.ModTime)
+		}
+	}
+	if len(files) != 7 {
+		t.Errorf("CloneGit() entries = %v", snapshot.Files)
+	}
+	if f := files["README.md"]; f.Contents != "v1" || f.SHA256 != HashContents([]byte("v1")) || f.Mode != 0644 {
+		t.Errorf("README.md = %+v", f)
+	}
+	if f := files["bin/run.sh"]; f.Mode != 0755 || f.Contents != "#!/bin/sh\n" {
+		t.Errorf("bin/run.sh = %+v", f)
+	}
+	if f := files["run"]; f.Link != "bin/run.sh" {
+		t.Errorf("run = %+v", f)
+	}
+	if _, ok := files[".gitignore"]; !ok {
+		t.Error("CloneGit() left out .gitignore")
+	}
+	if f := files["logs/keep.log"]; f.Contents != "tracked anyway" {
+		t.Errorf("logs/keep.log = %+v, ignored files that are tracked should be included", f)
+	}
+	if _, ok := files["untracked.txt"]; ok {
+		t.Error("CloneGit() included an untracked file")
+	}
+}
+
+func TestCloneGitErrors(t *testing.T) {
+	repo := t.TempDir()
+	testGit(t, repo, "init", "-q")
+	writeTestFiles(t, repo, map[string]string{"a.txt": "a"})
+	testGit(t, repo, "add", ".")
+	testGit(t, repo, "commit", "-q", "-m", "initial")
+
+	ctx := context.Background()
+	for _, ref := range []string{"", "--output=x", "missing", "HEAD:a.txt"} {
+		if err := CloneGit(ctx, repo, ref, &bytes.Buffer{}, Options{}); err == nil {
+			t.Errorf("CloneGit(%q) should fail", ref)
+		}
+	}
+	err := CloneGit(ctx, t.TempDir(), "HEAD", &bytes.Buffer{}, Options{})
+	if !errors.Is(err, ErrNotGitRepository) {
+		t.Errorf("CloneGit() outside a repository error = %v, want %v", err, ErrNotGitRepository)
+	}
+}
+
+func TestInitGitRepositoryWithoutIdentity(t *testing.T) {
+	unsetGitIdentity(t)
+	ctx := context.Background()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "main.go"), []byte("package main\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CheckGitIdentity(ctx, dir); err == nil || !strings.Contains(err.Error(), "identity") {
+		t.Errorf("CheckGitIdentity() error = %v, want a missing identity", err)
+	}
+	if err := InitGitRepository(ctx, dir, "", "Restore template"); err == nil {
+		t.Error("InitGitRepository() should fail without an identity")
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".git")); !os.IsNotExist(err) {
+		t.Error("InitGitRepository() created a repository without being able to commit")
+	}
+
+	t.Setenv("GIT_AUTHOR_NAME", "test")
+	t.Setenv("GIT_AUTHOR_EMAIL", "test@example.com")
+	if err := CheckGitIdentity(ctx, dir); err == nil {
+		t.Error("CheckGitIdentity() should also require a committer identity")
+	}
+	t.Setenv("GIT_COMMITTER_NAME", "test")
+	t.Setenv("GIT_COMMITTER_EMAIL", "test@example.com")
+	if err := CheckGitIdentity(ctx, dir); err != nil {
+		t.Errorf("CheckGitIdentity() error = %v", err)
+	}
+}
+
+func TestInitGitRepository(t *testing.T) {
+	for _, kv := range gitTestEnv {
+		k, v, _ := strings.Cut(kv, "=")
+		t.Setenv(k, v)
+	}
+	ctx := context.Background()
+	snapshot := ProjectSnapshot{Version: Version, Files: []FileInfo{
+		{Path: ".gitignore", Contents: "*.log\n"},
+		{Path: "main.go", Contents: "package main\n"},
+		{Path: "debug.log", Contents: "noise"},
+	}}
+
+	tests := []struct {
+		name       string
+		branch     string
+		wantBranch string
+		wantErr    bool
+	}{
+		{name: "default branch"},
+		{name: "named branch", branch: "template/v1", wantBranch: "template/v1"},
+		{name: "invalid branch", branch: "bad..name", wantErr: true},
+		{name: "option as branch", branch: "--orphan", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "restored")
+			if err := RestoreSnapshot(ctx, snapshot, dir, Options{}); err != nil {
+				t.Fatal(err)
+			}
+
+			err := InitGitRepository(ctx, dir, tt.branch, "Restore template")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("InitGitRepository() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if _, err := os.Stat(filepath.Join(dir, ".git")); !os.IsNotExist(err) {
+					t.Error("InitGitRepository() created a repository despite failing")
+				}
+				return
+			}
+
+			if got := testGit(t, dir, "log", "--format=%s"); got != "Restore template\n" {
+				t.Errorf("git log = %q", got)
+			}
+			if got := testGit(t, dir, "ls-files"); got != ".gitignore\nmain.go\n" {
+				t.Errorf("committed files = %q", got)
+			}
+			if got := testGit(t, dir, "status", "--porcelain"); got != "" {
+				t.Errorf("work tree not clean after commit: %q", got)
+			}
+			if tt.wantBranch != "" {
+				if got := strings.TrimSpace(testGit(t, dir, "branch", "--show-current")); got != tt.wantBranch {
+					t.Errorf("branch = %q, want %q", got, tt.wantBranch)
+				}
+			}
+		})
+	}
+}
+
+func TestCloneGitFiles(t *testing.T) {
+	repo := t.TempDir()
+	testGit(t, repo, "init", "-q")
+	writeTestFiles(t, repo, map[string]string{
+		".gitignore":      "*.log\nbuild/\n",
+		"src/main.go":     "package main\n",
+		"src/debug.log":   "ignored",
+		"build/app":       "binary",
+		"notes/todo.txt":  "untracked",
+		"docs/guide.md":   "tracked, then changed",
+		"vendor/keep.log": "tracked despite .gitignore",
+	})
+	testGit(t, repo, "add", ".gitignore", "src/main.go", "docs/guide.md")
+	testGit(t, repo, "add", "-f", "vendor/keep.log")
+	testGit(t, repo, "commit", "-q", "-m", "initial")
+	writeTestFiles(t, repo, map[string]string{"docs/guide.md": "changed"})
+
+	tests := []struct {
+		mode GitFiles
+		want []string
+	}{
+		{
+			// The .gitignore approximation does not understand "build/"
+			mode: GitOff,
+			want: []string{"build", "docs", "docs/guide.md", "notes", "notes/todo.txt", "src", "src/main.go", "vendor"},
+		},
+		{
+			mode: GitTracked,
+			want: []string{".gitignore", "docs", "docs/guide.md", "src", "src/main.go", "vendor", "vendor/keep.log"},
+		},
+		{
+			mode: GitTrackedUntracked,
+			want: []string{".gitignore", "docs", "docs/guide.md", "notes", "notes/todo.txt", "src", "src/main.go", "vendor", "vendor/keep.log"},
+		},
+		{
+			mode: GitAll,
+			want: []string{".gitignore", "build", "build/app", "docs", "docs/guide.md", "notes", "notes/todo.txt", "src", "src/debug.log", "src/main.go", "vendor", "vendor/keep.log"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run("git="+string(tt.mode), func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := Clone(context.Background(), repo, &buf, Options{Git: tt.mode, Reproducible: true}); err != nil {
+				t.Fatalf("Clone() error = %v", err)
+			}
+			var snapshot ProjectSnapshot
+			if err := json.Unmarshal(buf.Bytes(), &snapshot); err != nil {
+				t.Fatal(err)
+			}
+			var paths []string
+			for _, file := range snapshot.Files {
+				paths = append(paths, file.Path)
+				if file.Path == "docs/guide.md" && file.Contents != "changed" {
+					t.Errorf("docs/guide.md = %q, want the work tree contents", file.Contents)
+				}
+			}
+			if !reflect.DeepEqual(paths, tt.want) {
+				t.Errorf("Clone() paths = %v, want %v", paths, tt.want)
+			}
+		})
+	}
+
+	// Sources outside a repository fall back to .gitignore
+	plain := t.TempDir()
+	writeTestFiles(t, plain, map[string]string{".gitignore": "*.log\n", "a.txt": "a", "b.log": "b"})
+	var buf bytes.Buffer
+	if err := Clone(context.Background(), plain, &buf, Options{Git: GitTracked}); err != nil {
+		t.Fatalf("Clone() outside a repository error = %v", err)
+	}
+	if !strings.Contains(buf.String(), `"a.txt"`) || strings.Contains(buf.String(), `"b.log"`) {
+		t.Errorf("Clone() outside a repository = %s", buf.String())
+	}
+}
+
+func TestParseGitFiles(t *testing.T) {
+	for s, want := range map[string]GitFiles{"tracked": GitTracked, "tracked+untracked": GitTrackedUntracked, "all": GitAll, "off": GitOff} {
+		if got, err := ParseGitFiles(s); err != nil || got != want {
+			t.Errorf("ParseGitFiles(%q) = %q, %v, want %q", s, got, err, want)
+		}
+	}
+	if _, err := ParseGitFiles("untracked"); err == nil {
+		t.Error("ParseGitFiles() should reject unknown modes")
+	}
+}
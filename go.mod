@@ -1,3 +1,11 @@
 module github.com/supperdoggy/snapdir
 
 go 1.23.4
+
+require (
+	github.com/BurntSushi/toml v1.4.0
+	golang.org/x/crypto v0.31.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require golang.org/x/sys v0.28.0
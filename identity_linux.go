@@ -0,0 +1,18 @@
+//go:build linux
+
+package snapdir
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// fileIdentity returns the inode number and change time of a file, or
+// zeros if the file system does not provide them
+func fileIdentity(info fs.FileInfo) (inode uint64, ctime int64) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0
+	}
+	return uint64(stat.Ino), int64(stat.Ctim.Sec)*1e9 + int64(stat.Ctim.Nsec)
+}
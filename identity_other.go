@@ -0,0 +1,12 @@
+//go:build !linux && !darwin
+
+package snapdir
+
+import "io/fs"
+
+// fileIdentity returns zeros because inode numbers and change times are not
+// read on this platform; the stat cache then relies on size and
+// modification time alone
+func fileIdentity(info fs.FileInfo) (inode uint64, ctime int64) {
+	return 0, 0
+}
@@ -0,0 +1,284 @@
+package snapdir
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// maxParentChain limits how many parents OpenSnapshot follows, which also
+// stops snapshots that name each other as parents
+const maxParentChain = 1000
+
+// ErrExternalParent is returned for an incremental snapshot whose parent is
+// an absolute path or lies outside its directory, unless
+// Options.ExternalParents allows it
+var ErrExternalParent = errors.New("parent snapshot is outside the snapshot directory")
+
+// ParentSnapshot is the snapshot an incremental snapshot is based on
+type ParentSnapshot struct {
+	// Path is recorded in the incremental snapshot to find the parent,
+	// relative to the directory the incremental snapshot is stored in
+	Path string
+
+	// SHA256 is the digest of the parent snapshot file
+	SHA256 string
+
+	// Snapshot holds every entry of the parent, with its own parents
+	// already merged in
+	Snapshot ProjectSnapshot
+}
+
+// OpenParent loads the snapshot file parentFile as the parent of an
+// incremental snapshot that will be written to outputFile. Encrypted
+// snapshots in the chain are decrypted with identities.
+func OpenParent(parentFile, outputFile string, identities ...Identity) (*ParentSnapshot, error) {
+	return OpenParentOptions(parentFile, outputFile, Options{Identities: identities})
+}
+
+// OpenParentOptions is OpenParent, reading the chain of parentFile as
+// OpenSnapshotOptions does
+func OpenParentOptions(parentFile, outputFile string, opts Options) (*ParentSnapshot, error) {
+	snapshot, sum, err := openSnapshot(parentFile, opts, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	absParent, err := filepath.Abs(parentFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve parent path: %w", err)
+	}
+	absOutput, err := filepath.Abs(outputFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve output path: %w", err)
+	}
+	rel, err := filepath.Rel(filepath.Dir(absOutput), absParent)
+	if err != nil {
+		rel = absParent
+	}
+
+	return &ParentSnapshot{
+		Path:     filepath.ToSlash(rel),
+		SHA256:   sum,
+		Snapshot: snapshot,
+	}, nil
+}
+
+// OpenSnapshot reads a snapshot file. Incremental snapshots are merged
+// with their chain of parents, so the result always holds the full tree
+// and no tombstones. Compressed and encrypted snapshots are decoded as by
+// DecodeReader, with identities. Every file of the chain is held to the
+// default RestoreLimits, see OpenSnapshotOptions.
+func OpenSnapshot(snapshotFile string, identities ...Identity) (ProjectSnapshot, error) {
+	return OpenSnapshotOptions(snapshotFile, Options{Identities: identities})
+}
+
+// OpenSnapshotOptions reads a snapshot file like OpenSnapshot, decrypting
+// it with opts.Identities. Each file of the chain is decoded one entry at a
+// time and rejected as soon as it breaks opts.Limits, so a parent cannot
+// exhaust memory either. Parents must be relative paths that stay inside
+// the directory of the snapshot naming them, unless opts.ExternalParents
+// is set.
+func OpenSnapshotOptions(snapshotFile string, opts Options) (ProjectSnapshot, error) {
+	snapshot, _, err := openSnapshot(snapshotFile, opts, 0)
+	return snapshot, err
+}
+
+// ReadSnapshot reads a full snapshot from a stream, decoding it as by
+// DecodeReader. Incremental snapshots are rejected, because their parents
+// are found relative to the snapshot file. The snapshot is held to the
+// default RestoreLimits, see ReadSnapshotOptions.
+func ReadSnapshot(r io.Reader, identities ...Identity) (ProjectSnapshot, error) {
+	return ReadSnapshotOptions(r, Options{Identities: identities})
+}
+
+// ReadSnapshotOptions reads a full snapshot from a stream like
+// ReadSnapshot, decrypting it with opts.Identities. It is decoded one entry
+// at a time and rejected as soon as it breaks opts.Limits.
+func ReadSnapshotOptions(r io.Reader, opts Options) (ProjectSnapshot, error) {
+	snapshot := ProjectSnapshot{Files: []FileInfo{}}
+	header, err := ScanSnapshotOptions(r, opts, func(file FileInfo) error {
+		snapshot.Files = append(snapshot.Files, file)
+		return nil
+	})
+	if err != nil {
+		return ProjectSnapshot{}, fmt.Errorf("failed to parse snapshot: %w", err)
+	}
+	if header.Parent != "" {
+		return ProjectSnapshot{}, fmt.Errorf("snapshot is incremental, its parent %s can only be found from a snapshot file", header.Parent)
+	}
+	header.Files = snapshot.Files
+	return header, nil
+}
+
+// openSnapshot reads and flattens a snapshot file and returns it with the
+// digest of the file
+func openSnapshot(snapshotFile string, opts Options, depth int) (ProjectSnapshot, string, error) {
+	if depth > maxParentChain {
+		return ProjectSnapshot{}, "", fmt.Errorf("parent chain is longer than %d snapshots", maxParentChain)
+	}
+
+	snapshot, sum, err := readSnapshotFile(snapshotFile, opts)
+	if err != nil {
+		return ProjectSnapshot{}, "", err
+	}
+	snapshot, err = mergeParents(snapshotFile, snapshot, opts, depth)
+	if err != nil {
+		return ProjectSnapshot{}, "", err
+	}
+	return snapshot, sum, nil
+}
+
+// readSnapshotFile decodes a single snapshot file without following its
+// parents and returns it with the digest of the file. The file is decoded
+// one entry at a time and checked against opts.Limits, like Restore does.
+func readSnapshotFile(snapshotFile string, opts Options) (ProjectSnapshot, string, error) {
+	f, err := os.Open(snapshotFile)
+	if err != nil {
+		return ProjectSnapshot{}, "", fmt.Errorf("failed to read snapshot: %w", err)
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	r, err := DecodeReader(io.TeeReader(f, hash), opts.Identities...)
+	if err != nil {
+		return ProjectSnapshot{}, "", fmt.Errorf("failed to read snapshot %s: %w", snapshotFile, err)
+	}
+	snapshot := ProjectSnapshot{Files: []FileInfo{}}
+	checker := newLimitChecker(opts)
+	err = scanSnapshot(checker.limit(r), &snapshot, func(file FileInfo) error {
+		if err := checker.check(file); err != nil {
+			return err
+		}
+		snapshot.Files = append(snapshot.Files, file)
+		return nil
+	})
+	if err != nil {
+		return ProjectSnapshot{}, "", fmt.Errorf("failed to parse snapshot %s: %w", snapshotFile, err)
+	}
+	// The digest covers the whole file, including anything after the JSON
+	if _, err := io.Copy(hash, f); err != nil {
+		return ProjectSnapshot{}, "", fmt.Errorf("failed to read snapshot %s: %w", snapshotFile, err)
+	}
+	return snapshot, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// mergeParents merges snapshot, read from snapshotFile at the given depth
+// of a chain, with its parents
+func mergeParents(snapshotFile string, snapshot ProjectSnapshot, opts Options, depth int) (ProjectSnapshot, error) {
+	if snapshot.Parent == "" {
+		return snapshot, nil
+	}
+
+	parentFile := filepath.FromSlash(snapshot.Parent)
+	if !opts.ExternalParents && !filepath.IsLocal(parentFile) {
+		return ProjectSnapshot{}, fmt.Errorf("%w: parent %s of %s is outside its directory", ErrExternalParent, snapshot.Parent, snapshotFile)
+	}
+	if !filepath.IsAbs(parentFile) {
+		parentFile = filepath.Join(filepath.Dir(snapshotFile), parentFile)
+	}
+	parent, parentSum, err := openSnapshot(parentFile, opts, depth+1)
+	if err != nil {
+		return ProjectSnapshot{}, fmt.Errorf("failed to open parent of %s: %w", snapshotFile, err)
+	}
+	if snapshot.ParentSHA256 != "" && snapshot.ParentSHA256 != parentSum {
+		return ProjectSnapshot{}, fmt.Errorf("parent snapshot %s has changed since %s was created", parentFile, snapshotFile)
+	}
+
+	return mergeSnapshots(parent, snapshot), nil
+}
+
+// mergeSnapshots applies the incremental snapshot delta to the full
+// snapshot parent. Entries are returned in the order Clone walks a tree.
+func mergeSnapshots(parent, delta ProjectSnapshot) ProjectSnapshot {
+	entries := make(map[string]FileInfo, len(parent.Files))
+	for _, file := range parent.Files {
+		entries[file.Path] = file
+	}
+	for _, file := range delta.Files {
+		if file.Deleted {
+			delete(entries, file.Path)
+			continue
+		}
+		entries[file.Path] = file
+	}
+
+	merged := ProjectSnapshot{
+		Version: delta.Version,
+		Files:   make([]FileInfo, 0, len(entries)),
+	}
+	for _, file := range entries {
+		merged.Files = append(merged.Files, file)
+	}
+	sort.Slice(merged.Files, func(i, j int) bool {
+		return walkOrderLess(merged.Files[i].Path, merged.Files[j].Path)
+	})
+	return merged
+}
+
+// walkOrderLess orders slash separated paths the way fs.WalkDir visits
+// them: directory by directory, each sorted by name
+func walkOrderLess(a, b string) bool {
+	for {
+		aName, aRest, aMore := strings.Cut(a, "/")
+		bName, bRest, bMore := strings.Cut(b, "/")
+		if aName != bName {
+			return aName < bName
+		}
+		if !aMore || !bMore {
+			return !aMore && bMore
+		}
+		a, b = aRest, bRest
+	}
+}
+
+// diffParent reduces entries to those that were added or changed since
+// parent and appends a tombstone for every entry of parent that no longer
+// exists. Entries that did not change are dropped, so their files are never
+// read.
+func diffParent(entries []FileInfo, parent ProjectSnapshot) []FileInfo {
+	previous := make(map[string]FileInfo, len(parent.Files))
+	for _, file := range parent.Files {
+		previous[file.Path] = file
+	}
+
+	changed := make([]FileInfo, 0)
+	seen := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		seen[entry.Path] = true
+		if old, ok := previous[entry.Path]; ok && unchanged(old, entry) {
+			continue
+		}
+		changed = append(changed, entry)
+	}
+
+	for _, file := range parent.Files {
+		if !seen[file.Path] {
+			changed = append(changed, FileInfo{Path: file.Path, IsDir: file.IsDir, Deleted: true})
+		}
+	}
+	return changed
+}
+
+// unchanged reports whether a freshly collected entry, which has no
+// contents yet, still matches its entry in the parent. Entries without a
+// modification time are always treated as changed. A followed symlink is
+// compared by the size, mode and time of its target, as it is stored.
+func unchanged(old, entry FileInfo) bool {
+	if old.IsDir != entry.IsDir || old.Link != entry.Link || old.Mode != entry.Mode {
+		return false
+	}
+	if entry.ModTime == "" || old.ModTime != entry.ModTime {
+		return false
+	}
+	if (old.Owner == nil) != (entry.Owner == nil) || (old.Owner != nil && *old.Owner != *entry.Owner) {
+		return false
+	}
+	return !entry.hasData() || old.DataSize() == entry.Size
+}
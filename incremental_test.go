@@ -0,0 +1,354 @@
+package snapdir
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// writeCloneFS snapshots fsys into a file, optionally against a parent file
+func writeCloneFS(t *testing.T, fsys fstest.MapFS, file, parentFile string) ProjectSnapshot {
+	t.Helper()
+	opts := Options{}
+	if parentFile != "" {
+		parent, err := OpenParent(parentFile, file)
+		if err != nil {
+			t.Fatalf("OpenParent() error = %v", err)
+		}
+		opts.Parent = parent
+	}
+	snapshot, err := CloneFS(context.Background(), fsys, opts)
+	if err != nil {
+		t.Fatalf("CloneFS() error = %v", err)
+	}
+	if err := writeSnapshotFile(file, snapshot); err != nil {
+		t.Fatalf("failed to write snapshot: %v", err)
+	}
+	return snapshot
+}
+
+func TestIncrementalClone(t *testing.T) {
+	dir := t.TempDir()
+	day1 := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	day2 := day1.Add(24 * time.Hour)
+
+	base := fstest.MapFS{
+		"keep.txt":       {Data: []byte("unchanged"), ModTime: day1, Mode: 0644},
+		"edit.txt":       {Data: []byte("old"), ModTime: day1, Mode: 0644},
+		"gone/file.txt":  {Data: []byte("removed"), ModTime: day1, Mode: 0644},
+		"gone":           {Mode: fs.ModeDir | 0755, ModTime: day1},
+		"chmod.txt":      {Data: []byte("mode"), ModTime: day1, Mode: 0644},
+		"same/inner.txt": {Data: []byte("inner"), ModTime: day1, Mode: 0644},
+		"same":           {Mode: fs.ModeDir | 0755, ModTime: day1},
+	}
+	writeCloneFS(t, base, filepath.Join(dir, "base.json"), "")
+
+	current := fstest.MapFS{
+		"keep.txt":       base["keep.txt"],
+		"edit.txt":       {Data: []byte("new contents"), ModTime: day2, Mode: 0644},
+		"chmod.txt":      {Data: []byte("mode"), ModTime: day1, Mode: 0600},
+		"same/inner.txt": base["same/inner.txt"],
+		"same":           base["same"],
+		"added.txt":      {Data: []byte("added"), ModTime: day2, Mode: 0644},
+	}
+	counting := &countingFS{FS: current}
+	parent, err := OpenParent(filepath.Join(dir, "base.json"), filepath.Join(dir, "inc.json"))
+	if err != nil {
+		t.Fatalf("OpenParent() error = %v", err)
+	}
+	delta, err := CloneFS(context.Background(), counting, Options{Parent: parent})
+	if err != nil {
+		t.Fatalf("CloneFS() error = %v", err)
+	}
+	if err := writeSnapshotFile(filepath.Join(dir, "inc.json"), delta); err != nil {
+		t.Fatalf("failed to write snapshot: %v", err)
+	}
+
+	if delta.Parent != "base.json" || delta.ParentSHA256 == "" {
+		t.Errorf("parent = %q (%q), want base.json with a digest", delta.Parent, delta.ParentSHA256)
+	}
+
+	var got []string
+	for _, file := range delta.Files {
+		entry := file.Path
+		if file.Deleted {
+			entry = "-" + entry
+		}
+		got = append(got, entry)
+	}
+	want := []string{"added.txt", "chmod.txt", "edit.txt", "-gone", "-gone/file.txt"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("incremental entries = %v, want %v", got, want)
+	}
+	if opened := counting.opened.Load(); opened != 3 {
+		t.Errorf("read %d files, want 3 (unchanged files are not read)", opened)
+	}
+
+	// The chain must restore the same tree as a full snapshot
+	merged, err := OpenSnapshot(filepath.Join(dir, "inc.json"))
+	if err != nil {
+		t.Fatalf("OpenSnapshot() error = %v", err)
+	}
+	full, err := CloneFS(context.Background(), current, Options{})
+	if err != nil {
+		t.Fatalf("CloneFS() error = %v", err)
+	}
+	if !reflect.DeepEqual(merged, full) {
+		t.Errorf("merged chain differs from a full snapshot:\n got %+v\nwant %+v", merged.Files, full.Files)
+	}
+
+	dst := filepath.Join(t.TempDir(), "restored")
+	if err := RestoreSnapshot(context.Background(), merged, dst, Options{}); err != nil {
+		t.Fatalf("RestoreSnapshot() error = %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dst, "edit.txt")); err != nil || string(data) != "new contents" {
+		t.Errorf("restored edit.txt = %q, %v", data, err)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "gone")); !os.IsNotExist(err) {
+		t.Error("deleted directory should not be restored")
+	}
+}
+
+func TestIncrementalCloneFollowedSymlink(t *testing.T) {
+	dir := t.TempDir()
+	fsys := linkFS("target", time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC))
+	base, err := CloneFS(context.Background(), fsys, Options{})
+	if err != nil {
+		t.Fatalf("CloneFS() error = %v", err)
+	}
+	if err := writeSnapshotFile(filepath.Join(dir, "base.json"), base); err != nil {
+		t.Fatalf("failed to write snapshot: %v", err)
+	}
+
+	parent, err := OpenParent(filepath.Join(dir, "base.json"), filepath.Join(dir, "inc.json"))
+	if err != nil {
+		t.Fatalf("OpenParent() error = %v", err)
+	}
+	delta, err := CloneFS(context.Background(), fsys, Options{Parent: parent})
+	if err != nil {
+		t.Fatalf("CloneFS() error = %v", err)
+	}
+	if len(delta.Files) != 0 {
+		t.Errorf("incremental snapshot of an unchanged tree has entries %+v", delta.Files)
+	}
+}
+
+func TestOpenSnapshotChain(t *testing.T) {
+	dir := t.TempDir()
+	sub := filepath.Join(dir, "nightly")
+	if err := os.MkdirAll(sub, 0755); err != nil {
+		t.Fatalf("failed to create directory: %v", err)
+	}
+	day := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+
+	fsys := fstest.MapFS{"a.txt": {Data: []byte("1"), ModTime: day}}
+	writeCloneFS(t, fsys, filepath.Join(sub, "full.json"), "")
+	fsys["b.txt"] = &fstest.MapFile{Data: []byte("2"), ModTime: day}
+	writeCloneFS(t, fsys, filepath.Join(sub, "mon.json"), filepath.Join(sub, "full.json"))
+	delete(fsys, "a.txt")
+	tue := writeCloneFS(t, fsys, filepath.Join(sub, "tue.json"), filepath.Join(sub, "mon.json"))
+
+	if tue.Parent != "mon.json" {
+		t.Errorf("Parent = %q, want path relative to the snapshot", tue.Parent)
+	}
+
+	merged, err := OpenSnapshot(filepath.Join(sub, "tue.json"))
+	if err != nil {
+		t.Fatalf("OpenSnapshot() error = %v", err)
+	}
+	if len(merged.Files) != 1 || merged.Files[0].Path != "b.txt" || merged.Parent != "" {
+		t.Errorf("OpenSnapshot() = %+v, want only b.txt and no parent", merged)
+	}
+
+	fsys2, err := OpenFS(filepath.Join(sub, "tue.json"))
+	if err != nil {
+		t.Fatalf("OpenFS() error = %v", err)
+	}
+	if data, err := fsys2.ReadFile("b.txt"); err != nil || string(data) != "2" {
+		t.Errorf("ReadFile(b.txt) = %q, %v", data, err)
+	}
+
+	// Replacing a parent breaks the chain instead of restoring wrong data
+	writeCloneFS(t, fstest.MapFS{"other.txt": {Data: []byte("x")}}, filepath.Join(sub, "mon.json"), "")
+	_, err = OpenSnapshot(filepath.Join(sub, "tue.json"))
+	if err == nil || !strings.Contains(err.Error(), "has changed") {
+		t.Errorf("OpenSnapshot() error = %v, want changed parent error", err)
+	}
+
+	if err := os.Remove(filepath.Join(sub, "mon.json")); err != nil {
+		t.Fatalf("failed to remove parent: %v", err)
+	}
+	if _, err := OpenSnapshot(filepath.Join(sub, "tue.json")); err == nil {
+		t.Error("OpenSnapshot() should fail for a missing parent")
+	}
+}
+
+func TestOpenSnapshotExternalParent(t *testing.T) {
+	dir := t.TempDir()
+	sub := filepath.Join(dir, "nightly")
+	if err := os.MkdirAll(sub, 0755); err != nil {
+		t.Fatalf("failed to create directory: %v", err)
+	}
+	fsys := fstest.MapFS{"a.txt": {Data: []byte("1")}}
+	writeCloneFS(t, fsys, filepath.Join(dir, "full.json"), "")
+	fsys["b.txt"] = &fstest.MapFile{Data: []byte("2")}
+	up := writeCloneFS(t, fsys, filepath.Join(sub, "up.json"), filepath.Join(dir, "full.json"))
+	if up.Parent != "../full.json" {
+		t.Fatalf("Parent = %q, want ../full.json", up.Parent)
+	}
+
+	abs := up
+	abs.Parent = filepath.ToSlash(filepath.Join(dir, "full.json"))
+	if err := writeSnapshotFile(filepath.Join(sub, "abs.json"), abs); err != nil {
+		t.Fatalf("failed to write snapshot: %v", err)
+	}
+
+	for _, name := range []string{"up.json", "abs.json"} {
+		t.Run(name, func(t *testing.T) {
+			file := filepath.Join(sub, name)
+			if _, err := OpenSnapshot(file); !errors.Is(err, ErrExternalParent) {
+				t.Errorf("OpenSnapshot() error = %v, want %v", err, ErrExternalParent)
+			}
+			merged, err := OpenSnapshotOptions(file, Options{ExternalParents: true})
+			if err != nil || len(merged.Files) != 2 {
+				t.Errorf("OpenSnapshotOptions() with ExternalParents = %+v, %v", merged.Files, err)
+			}
+		})
+	}
+}
+
+func TestOpenSnapshotParentLimits(t *testing.T) {
+	dir := t.TempDir()
+	large := strings.Repeat("x", 4096)
+	writeCloneFS(t, fstest.MapFS{"large.txt": {Data: []byte(large)}}, filepath.Join(dir, "full.json"), "")
+	writeCloneFS(t, fstest.MapFS{"small.txt": {Data: []byte("1")}}, filepath.Join(dir, "inc.json"), filepath.Join(dir, "full.json"))
+
+	// The parent breaks the limits even though the snapshot naming it
+	// does not
+	opts := Options{Limits: RestoreLimits{MaxFileSize: 1024}}
+	if _, err := OpenSnapshotOptions(filepath.Join(dir, "inc.json"), opts); !errors.Is(err, ErrLimitExceeded) {
+		t.Errorf("OpenSnapshotOptions() error = %v, want %v", err, ErrLimitExceeded)
+	}
+
+	// A parent entry that is too large is rejected before it is read
+	// whole, even though it is never terminated
+	huge := `{"version":"1.0.0","files":[{"path":"a.txt","contents":"` + strings.Repeat("x", 1<<20)
+	if err := os.WriteFile(filepath.Join(dir, "huge.json"), []byte(huge), 0644); err != nil {
+		t.Fatal(err)
+	}
+	child := ProjectSnapshot{Version: Version, Parent: "huge.json", Files: []FileInfo{}}
+	if err := writeSnapshotFile(filepath.Join(dir, "child.json"), child); err != nil {
+		t.Fatalf("failed to write snapshot: %v", err)
+	}
+	_, err := OpenSnapshotOptions(filepath.Join(dir, "child.json"), opts)
+	if !errors.Is(err, ErrLimitExceeded) || !strings.Contains(err.Error(), "entry is too large") {
+		t.Errorf("OpenSnapshotOptions() error = %v, want the entry rejected", err)
+	}
+
+	// Parents outside the directory, like /dev/zero, are not even opened
+	child.Parent = "/dev/zero"
+	if err := writeSnapshotFile(filepath.Join(dir, "zero.json"), child); err != nil {
+		t.Fatalf("failed to write snapshot: %v", err)
+	}
+	if _, err := OpenSnapshot(filepath.Join(dir, "zero.json")); !errors.Is(err, ErrExternalParent) {
+		t.Errorf("OpenSnapshot() error = %v, want %v", err, ErrExternalParent)
+	}
+}
+
+func TestIncrementalSnapshotNeedsParent(t *testing.T) {
+	incremental := ProjectSnapshot{Version: Version, Parent: "base.json", Files: []FileInfo{
+		{Path: "a.txt", Contents: "a"},
+	}}
+
+	if err := RestoreSnapshot(context.Background(), incremental, filepath.Join(t.TempDir(), "out"), Options{}); err == nil {
+		t.Error("RestoreSnapshot() should reject an incremental snapshot")
+	}
+	data, err := json.Marshal(incremental)
+	if err != nil {
+		t.Fatalf("failed to marshal snapshot: %v", err)
+	}
+	if err := Restore(context.Background(), strings.NewReader(string(data)), filepath.Join(t.TempDir(), "out"), Options{}); err == nil {
+		t.Error("Restore() should reject an incremental snapshot")
+	}
+	if _, err := NewFS(incremental); err == nil {
+		t.Error("NewFS() should reject an incremental snapshot")
+	}
+	if _, err := ReadSnapshot(strings.NewReader(string(data))); err == nil {
+		t.Error("ReadSnapshot() should reject an incremental snapshot")
+	}
+}
+
+func TestWalkOrderLess(t *testing.T) {
+	paths := []string{"a.b", "a/b", "a", "b", "a/b/c", "a-b", "a/a"}
+	want := []string{"a", "a/a", "a/b", "a/b/c", "a-b", "a.b", "b"}
+
+	sorted := ProjectSnapshot{}
+	for _, p := range paths {
+		sorted.Files = append(sorted.Files, FileInfo{Path: p})
+	}
+	sorted = mergeSnapshots(sorted, ProjectSnapshot{})
+
+	var got []string
+	for _, file := range sorted.Files {
+		got = append(got, file.Path)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("walk order = %v, want %v", got, want)
+	}
+}
+
+func TestIncrementalCloneOutput(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	if err := os.MkdirAll(src, 0755); err != nil {
+		t.Fatalf("failed to create source: %v", err)
+	}
+	for name, content := range map[string]string{"a.txt": "a", "b.txt": "b"} {
+		if err := os.WriteFile(filepath.Join(src, name), []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+	}
+
+	var full strings.Builder
+	if err := Clone(context.Background(), src, &full, Options{}); err != nil {
+		t.Fatalf("Clone() error = %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "full.json"), []byte(full.String()), 0644); err != nil {
+		t.Fatalf("failed to write snapshot: %v", err)
+	}
+
+	if err := os.Remove(filepath.Join(src, "b.txt")); err != nil {
+		t.Fatalf("failed to remove file: %v", err)
+	}
+	parent, err := OpenParent(filepath.Join(dir, "full.json"), filepath.Join(dir, "inc.json"))
+	if err != nil {
+		t.Fatalf("OpenParent() error = %v", err)
+	}
+
+	var streamed strings.Builder
+	if err := Clone(context.Background(), src, &streamed, Options{Parent: parent}); err != nil {
+		t.Fatalf("Clone() error = %v", err)
+	}
+	snapshot, err := CloneFS(context.Background(), os.DirFS(src), Options{Parent: parent})
+	if err != nil {
+		t.Fatalf("CloneFS() error = %v", err)
+	}
+	want, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		t.Fatalf("failed to marshal snapshot: %v", err)
+	}
+	if streamed.String() != string(want) {
+		t.Errorf("Clone() output differs from MarshalIndent:\n%s\nwant:\n%s", streamed.String(), want)
+	}
+	if !strings.Contains(streamed.String(), `"deleted": true`) {
+		t.Errorf("incremental snapshot should hold a tombstone for b.txt:\n%s", streamed.String())
+	}
+}
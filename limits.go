@@ -0,0 +1,245 @@
+package snapdir
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"path/filepath"
+	"strings"
+)
+
+// Default restore limits. They are generous for real projects but stop a
+// snapshot from filling the disk or memory with made-up entries.
+const (
+	DefaultMaxEntries    = 1 << 20
+	DefaultMaxTotalSize  = 32 << 30
+	DefaultMaxDepth      = 256
+	DefaultMaxPathLength = 4096
+)
+
+// ErrLimitExceeded is returned when a snapshot exceeds a RestoreLimits
+// limit
+var ErrLimitExceeded = errors.New("snapshot exceeds restore limits")
+
+// RestoreLimits bounds what a snapshot may demand of a restore. Zero fields
+// use the defaults; negative fields disable a limit.
+type RestoreLimits struct {
+	// MaxEntries is the number of files and directories a snapshot may
+	// have
+	MaxEntries int
+
+	// MaxTotalSize is the sum of the sizes of all files in bytes
+	MaxTotalSize int64
+
+	// MaxFileSize is the size of a single file in bytes. It defaults to
+	// DefaultMaxFileSize, the largest file Clone records by default.
+	MaxFileSize int64
+
+	// MaxDepth is the number of path elements an entry path may have
+	MaxDepth int
+
+	// MaxPathLength is the length of an entry path in bytes
+	MaxPathLength int
+}
+
+// NoLimits disables all restore limits. Paths are still checked.
+var NoLimits = RestoreLimits{MaxEntries: -1, MaxTotalSize: -1, MaxFileSize: -1, MaxDepth: -1, MaxPathLength: -1}
+
+// effective returns the limits with zero fields replaced by defaults
+func (l RestoreLimits) effective() RestoreLimits {
+	if l.MaxEntries == 0 {
+		l.MaxEntries = DefaultMaxEntries
+	}
+	if l.MaxTotalSize == 0 {
+		l.MaxTotalSize = DefaultMaxTotalSize
+	}
+	if l.MaxFileSize == 0 {
+		l.MaxFileSize = DefaultMaxFileSize
+	}
+	if l.MaxDepth == 0 {
+		l.MaxDepth = DefaultMaxDepth
+	}
+	if l.MaxPathLength == 0 {
+		l.MaxPathLength = DefaultMaxPathLength
+	}
+	return l
+}
+
+// limitChecker checks the entries of one snapshot against restore limits,
+// keeping running totals
+type limitChecker struct {
+	limits  RestoreLimits
+	entries int
+	total   int64
+	input   *limitedReader
+}
+
+// newLimitChecker returns a checker for opts.Limits
+func newLimitChecker(opts Options) *limitChecker {
+	return &limitChecker{limits: opts.Limits.effective()}
+}
+
+// check validates the path of an entry and adds it to the totals
+func (c *limitChecker) check(file FileInfo) error {
+	if c.input != nil {
+		c.input.nextEntry()
+	}
+	if err := checkEntryPath(file.Path); err != nil {
+		return err
+	}
+	if c.limits.MaxPathLength > 0 && len(file.Path) > c.limits.MaxPathLength {
+		return fmt.Errorf("%w: path %.64q... is longer than %d bytes", ErrLimitExceeded, file.Path, c.limits.MaxPathLength)
+	}
+	if c.limits.MaxPathLength > 0 && len(file.Link) > c.limits.MaxPathLength {
+		return fmt.Errorf("%w: target of symlink %s is longer than %d bytes", ErrLimitExceeded, file.Path, c.limits.MaxPathLength)
+	}
+	if c.limits.MaxDepth > 0 && strings.Count(file.Path, "/")+1 > c.limits.MaxDepth {
+		return fmt.Errorf("%w: %s is nested deeper than %d levels", ErrLimitExceeded, file.Path, c.limits.MaxDepth)
+	}
+
+	c.entries++
+	if c.limits.MaxEntries > 0 && c.entries > c.limits.MaxEntries {
+		return fmt.Errorf("%w: more than %d entries", ErrLimitExceeded, c.limits.MaxEntries)
+	}
+
+	if !file.hasData() {
+		return nil
+	}
+	size := claimedSize(file)
+	if err := c.checkSize(file, size); err != nil {
+		return err
+	}
+	c.total += size
+	if c.limits.MaxTotalSize > 0 && c.total > c.limits.MaxTotalSize {
+		return fmt.Errorf("%w: files add up to more than %d bytes", ErrLimitExceeded, c.limits.MaxTotalSize)
+	}
+	return nil
+}
+
+// checkSize checks the size of a single file, including contents loaded
+// from elsewhere such as a repository, whose entries only claim a size
+func (c *limitChecker) checkSize(file FileInfo, size int64) error {
+	if c.limits.MaxFileSize > 0 && size > c.limits.MaxFileSize {
+		return fmt.Errorf("%w: %s is larger than %d bytes", ErrLimitExceeded, file.Path, c.limits.MaxFileSize)
+	}
+	return nil
+}
+
+// checkAll checks every entry of a snapshot that is already in memory
+func (c *limitChecker) checkAll(files []FileInfo) error {
+	for _, file := range files {
+		if err := c.check(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// claimedSize returns the larger of the recorded size of a file entry and
+// the size of its inline contents, so an entry cannot understate its size
+func claimedSize(file FileInfo) int64 {
+	size := int64(len(file.Contents))
+	if file.Encoding == EncodingBase64 {
+		size = int64(base64.StdEncoding.DecodedLen(len(file.Contents)))
+	}
+	return max(size, file.Size)
+}
+
+// checkEntryPath rejects entry paths that would be written outside the
+// destination: absolute paths, paths with ".." or empty elements,
+// backslashes and, on Windows, reserved names
+func checkEntryPath(p string) error {
+	if !fs.ValidPath(p) || p == "." || strings.Contains(p, `\`) || !filepath.IsLocal(filepath.FromSlash(p)) {
+		return fmt.Errorf("unsafe path in snapshot: %q", p)
+	}
+	return nil
+}
+
+// limit wraps the snapshot input r so that reading fails once a single
+// entry, or the whole snapshot, is larger than the limits allow. Without
+// it, one entry with enormous contents would be buffered whole by the JSON
+// decoder before its size could be checked.
+func (c *limitChecker) limit(r io.Reader) io.Reader {
+	l := c.limits
+	if l.MaxFileSize < 0 || l.MaxPathLength < 0 {
+		return r
+	}
+	// Contents can grow up to six times when escaped in JSON
+	perEntry := addBudget(mulBudget(6, l.MaxFileSize), int64(l.MaxPathLength)+64<<10)
+	c.input = &limitedReader{r: r, perEntry: perEntry, total: -1}
+	if l.MaxTotalSize >= 0 && l.MaxEntries >= 0 {
+		c.input.total = addBudget(mulBudget(6, l.MaxTotalSize), mulBudget(int64(l.MaxEntries), int64(l.MaxPathLength)+1024))
+	}
+	c.input.nextEntry()
+	return c.input
+}
+
+// mulBudget returns a*b for non-negative a and b, or math.MaxInt64 if the
+// product does not fit, so a huge limit gives a huge budget instead of a
+// negative one
+func mulBudget(a, b int64) int64 {
+	if a != 0 && b > math.MaxInt64/a {
+		return math.MaxInt64
+	}
+	return a * b
+}
+
+// addBudget returns a+b for non-negative a and b, or math.MaxInt64 if the
+// sum does not fit
+func addBudget(a, b int64) int64 {
+	if b > math.MaxInt64-a {
+		return math.MaxInt64
+	}
+	return a + b
+}
+
+// CheckSnapshot reads a snapshot from r one entry at a time and returns an
+// error if it has unsafe paths or exceeds opts.Limits, so an untrusted
+// snapshot can be vetted before it is decoded as a whole and before
+// anything is written. Compressed and encrypted snapshots are decoded as by
+// DecodeReader, with opts.Identities.
+func CheckSnapshot(r io.Reader, opts Options) error {
+	r, err := DecodeReader(r, opts.Identities...)
+	if err != nil {
+		return err
+	}
+	checker := newLimitChecker(opts)
+	_, err = ScanSnapshot(checker.limit(r), checker.check)
+	return err
+}
+
+// limitedReader fails once perEntry bytes were read since the last call to
+// nextEntry, or total bytes overall if total is not negative
+type limitedReader struct {
+	r         io.Reader
+	perEntry  int64
+	remaining int64
+	total     int64
+}
+
+// nextEntry resets the budget of the entry being read
+func (lr *limitedReader) nextEntry() {
+	lr.remaining = lr.perEntry
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	if lr.remaining <= 0 {
+		return 0, fmt.Errorf("%w: snapshot entry is too large", ErrLimitExceeded)
+	}
+	if lr.total == 0 {
+		return 0, fmt.Errorf("%w: snapshot is too large", ErrLimitExceeded)
+	}
+	p = p[:min(int64(len(p)), lr.remaining)]
+	if lr.total > 0 {
+		p = p[:min(int64(len(p)), lr.total)]
+	}
+	n, err := lr.r.Read(p)
+	lr.remaining -= int64(n)
+	if lr.total > 0 {
+		lr.total -= int64(n)
+	}
+	return n, err
+}
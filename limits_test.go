@@ -0,0 +1,108 @@
+package snapdir
+
+import (
+	"context"
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckSnapshot(t *testing.T) {
+	small := RestoreLimits{MaxEntries: 3, MaxTotalSize: 10, MaxFileSize: 6, MaxDepth: 2, MaxPathLength: 8}
+	huge := RestoreLimits{MaxEntries: math.MaxInt, MaxTotalSize: math.MaxInt64, MaxFileSize: math.MaxInt64, MaxDepth: 8, MaxPathLength: math.MaxInt}
+
+	tests := []struct {
+		name    string
+		files   string
+		limits  RestoreLimits
+		wantErr error
+	}{
+		{"within limits", `{"path": "a", "is_dir": true}, {"path": "a/b.txt", "contents": "hello"}`, small, nil},
+		{"too many entries", `{"path": "a"}, {"path": "b"}, {"path": "c"}, {"path": "d"}`, small, ErrLimitExceeded},
+		{"file too large", `{"path": "a", "contents": "1234567"}`, small, ErrLimitExceeded},
+		{"size understated", `{"path": "a", "size": 1, "contents": "1234567"}`, small, ErrLimitExceeded},
+		{"size overstated", `{"path": "a", "size": 1000000}`, small, ErrLimitExceeded},
+		{"total too large", `{"path": "a", "contents": "123456"}, {"path": "b", "contents": "123456"}`, small, ErrLimitExceeded},
+		{"too deep", `{"path": "a/b/c"}`, small, ErrLimitExceeded},
+		{"path too long", `{"path": "abcdefghi"}`, small, ErrLimitExceeded},
+		{"no limits", `{"path": "a/b/c/d/e", "size": 1000000}`, NoLimits, nil},
+		{"huge limits", `{"path": "a", "contents": "hello"}`, huge, nil},
+		{"defaults", `{"path": "a", "size": 200000000}`, RestoreLimits{}, ErrLimitExceeded},
+		{"absolute path", `{"path": "/etc/passwd"}`, NoLimits, errUnsafePath},
+		{"parent path", `{"path": "a/../../b"}`, NoLimits, errUnsafePath},
+		{"backslash", `{"path": "..\\b"}`, NoLimits, errUnsafePath},
+		{"empty path", `{"path": ""}`, NoLimits, errUnsafePath},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input := `{"version": "1.0.0", "files": [` + tt.files + `]}`
+			err := CheckSnapshot(strings.NewReader(input), Options{Limits: tt.limits})
+			if tt.wantErr == nil && err != nil {
+				t.Errorf("CheckSnapshot() error = %v", err)
+			}
+			if tt.wantErr == errUnsafePath && (err == nil || !strings.Contains(err.Error(), "unsafe path")) {
+				t.Errorf("CheckSnapshot() error = %v, want unsafe path", err)
+			}
+			if tt.wantErr == ErrLimitExceeded && !errors.Is(err, ErrLimitExceeded) {
+				t.Errorf("CheckSnapshot() error = %v, want %v", err, ErrLimitExceeded)
+			}
+		})
+	}
+}
+
+// errUnsafePath marks test cases expecting checkEntryPath to fail
+var errUnsafePath = errors.New("unsafe path")
+
+func TestCheckSnapshotHugeEntry(t *testing.T) {
+	// The entry is rejected while it is read, not after it was buffered
+	input := `{"version": "1.0.0", "files": [{"path": "a", "contents": "` + strings.Repeat("x", 1<<20) + `"}]}`
+	limits := RestoreLimits{MaxFileSize: 1024, MaxPathLength: 64}
+	r := &countingReader{r: strings.NewReader(input)}
+	if err := CheckSnapshot(r, Options{Limits: limits}); !errors.Is(err, ErrLimitExceeded) {
+		t.Fatalf("CheckSnapshot() error = %v, want %v", err, ErrLimitExceeded)
+	}
+	if r.n >= 1<<19 {
+		t.Errorf("CheckSnapshot() read %d bytes before rejecting the entry", r.n)
+	}
+}
+
+func TestRestoreLimits(t *testing.T) {
+	ctx := context.Background()
+	opts := Options{Limits: RestoreLimits{MaxEntries: 1}}
+
+	dst := filepath.Join(t.TempDir(), "dst")
+	input := `{"version": "1.0.0", "files": [{"path": "a", "contents": "1"}, {"path": "b", "contents": "2"}]}`
+	if err := Restore(ctx, strings.NewReader(input), dst, opts); !errors.Is(err, ErrLimitExceeded) {
+		t.Errorf("Restore() error = %v, want %v", err, ErrLimitExceeded)
+	}
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Error("Restore() created the destination of a rejected snapshot")
+	}
+
+	snapshot := ProjectSnapshot{Version: Version, Files: []FileInfo{{Path: "../escape", Contents: "x"}}}
+	if err := RestoreSnapshot(ctx, snapshot, dst, Options{}); err == nil {
+		t.Error("RestoreSnapshot() should reject paths outside the destination")
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(dst), "escape")); !os.IsNotExist(err) {
+		t.Error("RestoreSnapshot() wrote outside the destination")
+	}
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Error("RestoreSnapshot() created the destination of a rejected snapshot")
+	}
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r *strings.Reader
+	n int
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += n
+	return n, err
+}
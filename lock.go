@@ -0,0 +1,44 @@
+package snapdir
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// repoLockFile is locked by every process changing a repository
+const repoLockFile = "lock"
+
+// ErrRepositoryLocked is returned when another process holds a lock on a
+// repository that conflicts with the requested operation
+var ErrRepositoryLocked = errors.New("repository is locked by another process")
+
+// repoLock is a lock on a repository held until unlock is called
+type repoLock struct {
+	file *os.File
+}
+
+// lock locks the repository, shared for saving snapshots and exclusive for
+// deleting them or their contents. It fails at once with
+// ErrRepositoryLocked instead of waiting for a conflicting lock.
+func (repo *Repository) lock(exclusive bool) (*repoLock, error) {
+	file, err := os.OpenFile(filepath.Join(repo.root, repoLockFile), os.O_RDWR|os.O_CREATE, defaultPerms)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock repository: %w", err)
+	}
+	if err := lockFile(file, exclusive); err != nil {
+		file.Close()
+		if errors.Is(err, ErrRepositoryLocked) {
+			return nil, fmt.Errorf("%w: %s", ErrRepositoryLocked, repo.root)
+		}
+		return nil, fmt.Errorf("failed to lock repository: %w", err)
+	}
+	return &repoLock{file: file}, nil
+}
+
+// unlock releases the lock
+func (l *repoLock) unlock() {
+	// Closing the file releases the lock
+	l.file.Close()
+}
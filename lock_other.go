@@ -0,0 +1,11 @@
+//go:build !unix && !windows
+
+package snapdir
+
+import "os"
+
+// lockFile does nothing on platforms without file locks, so repositories
+// are not protected against concurrent GC there
+func lockFile(file *os.File, exclusive bool) error {
+	return nil
+}
@@ -0,0 +1,64 @@
+package snapdir
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+func TestRepositoryLock(t *testing.T) {
+	ctx := context.Background()
+	repo, err := InitRepository(filepath.Join(t.TempDir(), "repo"))
+	if err != nil {
+		t.Fatalf("InitRepository() error = %v", err)
+	}
+	src := fstest.MapFS{"a.txt": {Data: []byte("a")}}
+	save := func() error {
+		_, err := repo.SaveFS(ctx, src, "/src", Options{})
+		return err
+	}
+	forget := func() error {
+		_, err := repo.Forget(RetentionPolicy{KeepLast: 1})
+		return err
+	}
+	gc := func() error {
+		_, err := repo.GC()
+		return err
+	}
+
+	tests := []struct {
+		name      string
+		exclusive bool
+		op        func() error
+		wantErr   bool
+	}{
+		{name: "save during save", op: save},
+		{name: "gc during save", op: gc, wantErr: true},
+		{name: "forget during save", op: forget, wantErr: true},
+		{name: "save during gc", exclusive: true, op: save, wantErr: true},
+		{name: "gc during gc", exclusive: true, op: gc, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The lock file of another process conflicts the same way as a
+			// second open file of this one
+			held, err := repo.lock(tt.exclusive)
+			if err != nil {
+				t.Fatalf("lock() error = %v", err)
+			}
+			err = tt.op()
+			held.unlock()
+			if tt.wantErr != errors.Is(err, ErrRepositoryLocked) {
+				t.Fatalf("error = %v, want ErrRepositoryLocked: %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if err := tt.op(); err != nil {
+					t.Errorf("error after unlock = %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,196 @@
+package snapdir
+
+import (
+	"io"
+	"log/slog"
+	"math"
+	"runtime"
+	"time"
+)
+
+const (
+	// Version is the snapdir version recorded in new snapshots
+	Version = "1.0.0"
+
+	// DefaultMaxFileSize is the size above which files are left out of a
+	// snapshot unless Options.MaxFileSize says otherwise
+	DefaultMaxFileSize = 100 * 1024 * 1024 // 100MB limit
+
+	defaultPerms = 0644
+	dirPerms     = 0755
+	jsonIndent   = "  "
+)
+
+// Options configures Clone, CloneFS, Restore and the Repository methods.
+// The zero value is ready to use; Options values are never modified, so
+// one can be shared between concurrent calls.
+type Options struct {
+	// Ignore holds patterns applied in addition to the .gitignore of the
+	// source and the default .git pattern
+	Ignore []string
+
+	// MaxFileSize is the size above which files are skipped. Zero means
+	// DefaultMaxFileSize and a negative value includes files of any size.
+	MaxFileSize int64
+
+	// Logger receives progress messages at debug level and warnings about
+	// skipped input. A nil Logger discards everything.
+	Logger *slog.Logger
+
+	// Symlinks records symbolic links as links to their target, which
+	// Restore recreates, instead of following them and storing what they
+	// point to. It applies to directories read by Clone, Diff and
+	// Repository.Save, and to file systems with a ReadLink method read by
+	// CloneFS.
+	Symlinks bool
+
+	// PreserveOwner records file ownership when cloning and restores it
+	// when restoring. Restoring ownership usually requires root.
+	PreserveOwner bool
+
+	// Reproducible makes snapshots of identical trees byte-identical:
+	// entries are sorted by path and modification times are dropped, or
+	// clamped to SourceDateEpoch if it is set.
+	Reproducible bool
+
+	// SourceDateEpoch, if not zero, is the latest modification time
+	// recorded in reproducible snapshots, following the SOURCE_DATE_EPOCH
+	// convention of reproducible builds. Later times are clamped to it.
+	SourceDateEpoch time.Time
+
+	// Jobs is the number of files read or written in parallel. Zero means
+	// one per CPU.
+	Jobs int
+
+	// Parent, if set, makes Clone and CloneFS produce an incremental
+	// snapshot that only records entries added, changed or deleted since
+	// the parent. Files whose size, mode and modification time match the
+	// parent are not read again. See OpenParent.
+	Parent *ParentSnapshot
+
+	// StatCache, if set, provides the hashes of files that did not change
+	// since it was last saved, so they are not hashed again. Clone still
+	// reads them for their contents; Repository.Save does not read them if
+	// their contents are stored already.
+	StatCache *StatCache
+
+	// Message is recorded with snapshots saved to a repository
+	Message string
+
+	// Git, if set, makes Clone, Diff and Repository.Save take the files
+	// of a source inside a git work tree from git instead of applying its
+	// .gitignore. Sources outside a repository fall back to .gitignore.
+	Git GitFiles
+
+	// Secrets decides what Clone and CloneFS do with secrets such as
+	// private keys and API tokens found in text files. The zero value
+	// does not scan; every finding is logged as a warning otherwise.
+	Secrets SecretAction
+
+	// SecretRules replaces DefaultSecretRules when it is not nil
+	SecretRules []SecretRule
+
+	// SecretValues fill in the placeholders of redacted secrets when
+	// restoring, keyed by placeholder name
+	SecretValues map[string]string
+
+	// Recipients, if set, make Clone encrypt the snapshot it writes so
+	// that only their identities can read it. See EncryptWriter.
+	Recipients []Recipient
+
+	// Compression, if set, makes Clone compress the snapshot it writes,
+	// before encrypting it. Readers detect compression by themselves.
+	Compression Compression
+
+	// Identities decrypt encrypted snapshots read by Restore
+	Identities []Identity
+
+	// Limits bounds the entries, sizes and paths of snapshots being
+	// restored, and of every file of a chain read by OpenSnapshotOptions.
+	// The zero value applies the defaults.
+	Limits RestoreLimits
+
+	// ExternalParents lets incremental snapshots name parents by absolute
+	// paths or paths leading out of their directory. Without it, such a
+	// snapshot cannot make OpenSnapshot read arbitrary files.
+	ExternalParents bool
+
+	// Progress, if set, is called with the number of files and bytes
+	// processed so far: once with the totals before the first file and
+	// again after every file. Calls are never concurrent.
+	Progress func(Progress)
+
+	// tracked is set when git chose the files of the source, so
+	// .gitignore must not filter them again
+	tracked bool
+
+	// gitFiles, if set, holds the only files of the source to include
+	gitFiles *gitSelection
+}
+
+// Progress reports how far a clone or restore has come
+type Progress struct {
+	FilesDone  int
+	FilesTotal int
+	BytesDone  int64
+	BytesTotal int64
+}
+
+// logger returns the configured logger or one that discards all records
+func (opts Options) logger() *slog.Logger {
+	if opts.Logger != nil {
+		return opts.Logger
+	}
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// maxFileSize returns the effective file size limit
+func (opts Options) maxFileSize() int64 {
+	switch {
+	case opts.MaxFileSize > 0:
+		return opts.MaxFileSize
+	case opts.MaxFileSize < 0:
+		return math.MaxInt64
+	}
+	return DefaultMaxFileSize
+}
+
+// normalizeModTime returns the modification time to record for an entry.
+// In reproducible mode it is dropped or clamped to SourceDateEpoch.
+func (opts Options) normalizeModTime(t time.Time) time.Time {
+	if !opts.Reproducible {
+		return t
+	}
+	if opts.SourceDateEpoch.IsZero() {
+		return time.Time{}
+	}
+	if t.After(opts.SourceDateEpoch) {
+		return opts.SourceDateEpoch
+	}
+	return t
+}
+
+// snapshotHeader returns the snapshot fields written before the file list
+func (opts Options) snapshotHeader() ProjectSnapshot {
+	header := ProjectSnapshot{Version: Version}
+	if opts.Parent != nil {
+		header.Parent = opts.Parent.Path
+		header.ParentSHA256 = opts.Parent.SHA256
+	}
+	return header
+}
+
+// jobs returns the effective number of parallel workers
+func (opts Options) jobs() int {
+	if opts.Jobs > 0 {
+		return opts.Jobs
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+// reportProgress passes p to the progress callback, if any
+func (opts Options) reportProgress(p Progress) {
+	if opts.Progress != nil {
+		opts.Progress(p)
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !unix
+
+package snapdir
+
+import (
+	"fmt"
+	"io/fs"
+)
+
+// fileOwner returns nil because file ownership is not available on this
+// platform
+func fileOwner(info fs.FileInfo) *Owner {
+	return nil
+}
+
+// applyOwner fails because file ownership is not supported on this platform
+func applyOwner(path string, owner *Owner) error {
+	return fmt.Errorf("file ownership is not supported on this platform")
+}
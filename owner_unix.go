@@ -0,0 +1,24 @@
+//go:build unix
+
+package snapdir
+
+import (
+	"io/fs"
+	"os"
+	"syscall"
+)
+
+// fileOwner returns the owner of a file from the system specific part of
+// its fs.FileInfo, or nil if the file system does not provide one
+func fileOwner(info fs.FileInfo) *Owner {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	return &Owner{UID: int(stat.Uid), GID: int(stat.Gid)}
+}
+
+// applyOwner changes the owner of the file at path without following symlinks
+func applyOwner(path string, owner *Owner) error {
+	return os.Lchown(path, owner.UID, owner.GID)
+}
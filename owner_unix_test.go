@@ -0,0 +1,47 @@
+//go:build unix
+
+package snapdir
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPreserveOwner(t *testing.T) {
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "file.txt"), []byte("content"), 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	without, err := CloneFS(context.Background(), os.DirFS(src), Options{})
+	if err != nil {
+		t.Fatalf("CloneFS() error = %v", err)
+	}
+	if without.Files[0].Owner != nil {
+		t.Errorf("owner recorded without PreserveOwner: %+v", without.Files[0].Owner)
+	}
+
+	opts := Options{PreserveOwner: true}
+	snapshot, err := CloneFS(context.Background(), os.DirFS(src), opts)
+	if err != nil {
+		t.Fatalf("CloneFS() error = %v", err)
+	}
+	want := Owner{UID: os.Getuid(), GID: os.Getgid()}
+	if owner := snapshot.Files[0].Owner; owner == nil || *owner != want {
+		t.Fatalf("owner = %+v, want %+v", owner, want)
+	}
+
+	// Changing ownership to ourselves is always allowed
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		t.Fatalf("failed to marshal snapshot: %v", err)
+	}
+	dst := filepath.Join(t.TempDir(), "dst")
+	if err := Restore(context.Background(), bytes.NewReader(data), dst, opts); err != nil {
+		t.Fatalf("Restore() error = %v", err)
+	}
+}
@@ -0,0 +1,153 @@
+package snapdir
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// RetentionPolicy decides which snapshots Forget keeps. A snapshot is kept
+// if any rule selects it; tagged snapshots are always kept.
+type RetentionPolicy struct {
+	// KeepLast keeps the n most recent snapshots
+	KeepLast int
+
+	// KeepDaily keeps the most recent snapshot of each of the last n days
+	// that have snapshots, using local time to tell days apart
+	KeepDaily int
+}
+
+// Forget removes the manifests of all snapshots that policy does not keep
+// and returns the removed manifests. File contents stay in the repository
+// until GC is run. Forget fails with ErrRepositoryLocked while another
+// process saves to the repository or runs Forget or GC.
+func (repo *Repository) Forget(policy RetentionPolicy) ([]Manifest, error) {
+	if policy.KeepLast < 0 || policy.KeepDaily < 0 {
+		return nil, fmt.Errorf("retention counts cannot be negative")
+	}
+	if policy.KeepLast == 0 && policy.KeepDaily == 0 {
+		return nil, fmt.Errorf("retention policy keeps no snapshots")
+	}
+
+	lock, err := repo.lock(true)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.unlock()
+
+	manifests, err := repo.List()
+	if err != nil {
+		return nil, err
+	}
+	tags, err := repo.Tags()
+	if err != nil {
+		return nil, err
+	}
+
+	keep := make(map[string]bool)
+	for _, id := range tags {
+		keep[id] = true
+	}
+
+	days := make(map[string]bool)
+	for i := len(manifests) - 1; i >= 0; i-- {
+		manifest := manifests[i]
+
+		if len(manifests)-i <= policy.KeepLast {
+			keep[manifest.ID] = true
+		}
+
+		saved, err := ParseModTime(manifest.Time)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time in snapshot %s: %w", manifest.ID, err)
+		}
+		day := saved.Local().Format("2006-01-02")
+		if !days[day] && len(days) < policy.KeepDaily {
+			days[day] = true
+			keep[manifest.ID] = true
+		}
+	}
+
+	var removed []Manifest
+	for _, manifest := range manifests {
+		if keep[manifest.ID] {
+			continue
+		}
+		if err := os.Remove(repo.manifestPath(manifest.ID)); err != nil {
+			return removed, fmt.Errorf("failed to remove snapshot %s: %w", manifest.ID, err)
+		}
+		removed = append(removed, manifest)
+	}
+	return removed, nil
+}
+
+// GCStats reports what GC removed
+type GCStats struct {
+	Blobs int
+	Bytes int64
+}
+
+// GC deletes all blobs that no snapshot refers to. Blobs of a snapshot
+// whose manifest is not written yet would be deleted too, so GC fails with
+// ErrRepositoryLocked while another process saves to the repository or
+// runs Forget or GC, and saves fail while GC runs.
+func (repo *Repository) GC() (GCStats, error) {
+	var stats GCStats
+
+	lock, err := repo.lock(true)
+	if err != nil {
+		return stats, err
+	}
+	defer lock.unlock()
+
+	ids, err := repo.snapshotIDs()
+	if err != nil {
+		return stats, err
+	}
+
+	referenced := make(map[string]bool)
+	for _, id := range ids {
+		manifest, err := repo.Manifest(id)
+		if err != nil {
+			return stats, err
+		}
+		for _, file := range manifest.Files {
+			if file.IsDir {
+				continue
+			}
+			if len(file.Chunks) == 0 {
+				referenced[file.SHA256] = true
+			}
+			for _, sum := range file.Chunks {
+				referenced[sum] = true
+			}
+		}
+	}
+
+	blobsDir := filepath.Join(repo.root, repoBlobsDir)
+	err = filepath.WalkDir(blobsDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || referenced[d.Name()] {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(p); err != nil {
+			return err
+		}
+		stats.Blobs++
+		stats.Bytes += info.Size()
+		return nil
+	})
+	if err != nil {
+		return stats, fmt.Errorf("failed to collect garbage: %w", err)
+	}
+
+	return stats, nil
+}
@@ -0,0 +1,147 @@
+package snapdir
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestForget(t *testing.T) {
+	day := func(d, hour int) time.Time {
+		return time.Date(2024, 3, d, hour, 0, 0, 0, time.Local)
+	}
+	// One snapshot on the 1st, two on the 2nd and two on the 3rd
+	times := []time.Time{day(1, 9), day(2, 9), day(2, 18), day(3, 9), day(3, 18)}
+
+	tests := []struct {
+		name    string
+		policy  RetentionPolicy
+		tag     int
+		want    []int
+		wantErr bool
+	}{
+		{name: "keep last", policy: RetentionPolicy{KeepLast: 2}, tag: -1, want: []int{3, 4}},
+		{name: "keep daily", policy: RetentionPolicy{KeepDaily: 2}, tag: -1, want: []int{2, 4}},
+		{name: "combined", policy: RetentionPolicy{KeepLast: 2, KeepDaily: 3}, tag: -1, want: []int{0, 2, 3, 4}},
+		{name: "tags are kept", policy: RetentionPolicy{KeepLast: 1}, tag: 0, want: []int{0, 4}},
+		{name: "more than available", policy: RetentionPolicy{KeepDaily: 10}, tag: -1, want: []int{0, 2, 4}},
+		{name: "empty policy", policy: RetentionPolicy{}, tag: -1, wantErr: true},
+		{name: "negative", policy: RetentionPolicy{KeepLast: -1, KeepDaily: 1}, tag: -1, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo, err := InitRepository(filepath.Join(t.TempDir(), "repo"))
+			if err != nil {
+				t.Fatalf("InitRepository() error = %v", err)
+			}
+
+			var ids []string
+			for i, saved := range times {
+				manifest, err := repo.writeManifest(Manifest{
+					Version: Version,
+					Time:    FormatModTime(saved),
+					Source:  "/src",
+					Message: string(rune('a' + i)),
+				})
+				if err != nil {
+					t.Fatalf("writeManifest() error = %v", err)
+				}
+				ids = append(ids, manifest.ID)
+			}
+			if tt.tag >= 0 {
+				if err := repo.Tag("keep", ids[tt.tag]); err != nil {
+					t.Fatalf("Tag() error = %v", err)
+				}
+			}
+
+			removed, err := repo.Forget(tt.policy)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Forget() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			remaining, err := repo.List()
+			if err != nil {
+				t.Fatalf("List() error = %v", err)
+			}
+			var got []int
+			for _, manifest := range remaining {
+				got = append(got, int(manifest.Message[0]-'a'))
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("kept %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("kept %v, want %v", got, tt.want)
+				}
+			}
+			if len(removed) != len(times)-len(tt.want) {
+				t.Errorf("removed %d snapshots, want %d", len(removed), len(times)-len(tt.want))
+			}
+		})
+	}
+}
+
+func TestGC(t *testing.T) {
+	ctx := context.Background()
+	dir := filepath.Join(t.TempDir(), "repo")
+	repo, err := InitRepository(dir)
+	if err != nil {
+		t.Fatalf("InitRepository() error = %v", err)
+	}
+
+	old, err := repo.SaveFS(ctx, fstest.MapFS{
+		"shared.txt": {Data: []byte("shared")},
+		"old.txt":    {Data: []byte("only in the old snapshot")},
+	}, "/src", Options{})
+	if err != nil {
+		t.Fatalf("SaveFS() error = %v", err)
+	}
+	current, err := repo.SaveFS(ctx, fstest.MapFS{
+		"shared.txt": {Data: []byte("shared")},
+	}, "/src", Options{})
+	if err != nil {
+		t.Fatalf("SaveFS() error = %v", err)
+	}
+
+	// Nothing is garbage while both snapshots exist
+	stats, err := repo.GC()
+	if err != nil {
+		t.Fatalf("GC() error = %v", err)
+	}
+	if stats.Blobs != 0 {
+		t.Errorf("GC() removed %d blobs, want 0", stats.Blobs)
+	}
+
+	if err := repo.Tag("current", current.ID); err != nil {
+		t.Fatalf("Tag() error = %v", err)
+	}
+	if _, err := repo.Forget(RetentionPolicy{KeepLast: 1}); err != nil {
+		t.Fatalf("Forget() error = %v", err)
+	}
+	if _, err := repo.Manifest(old.ID); err == nil {
+		t.Fatal("old snapshot should have been forgotten")
+	}
+
+	stats, err = repo.GC()
+	if err != nil {
+		t.Fatalf("GC() error = %v", err)
+	}
+	want := GCStats{Blobs: 1, Bytes: int64(len("only in the old snapshot"))}
+	if stats != want {
+		t.Errorf("GC() = %+v, want %+v", stats, want)
+	}
+	if got := countBlobs(t, dir); got != 1 {
+		t.Errorf("blobs after GC = %d, want 1", got)
+	}
+
+	if err := repo.Restore(ctx, current.ID, filepath.Join(t.TempDir(), "out"), Options{}); err != nil {
+		t.Errorf("Restore() after GC error = %v", err)
+	}
+}
@@ -0,0 +1,574 @@
+package snapdir
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	repoConfigFile   = "config.json"
+	repoBlobsDir     = "blobs"
+	repoSnapshotsDir = "snapshots"
+	repoTagsDir      = "tags"
+)
+
+// ErrNotRepository is returned when a directory is not a snapdir repository
+var ErrNotRepository = errors.New("not a snapdir repository")
+
+// Repository stores snapshots with deduplicated file contents. Every
+// distinct file content is kept once under blobs/, named by its SHA-256
+// digest, and every snapshot is a small manifest under snapshots/ that
+// refers to its blobs by digest.
+type Repository struct {
+	root string
+}
+
+// repoConfig is the contents of a repository's config.json
+type repoConfig struct {
+	Version string `json:"version"`
+}
+
+// Manifest describes a snapshot stored in a repository. Its file entries
+// record the SHA-256 digest of their contents instead of the contents.
+type Manifest struct {
+	// ID is the SHA-256 digest of the stored manifest
+	ID string `json:"-"`
+
+	Version string     `json:"version"`
+	Time    string     `json:"time"`
+	Source  string     `json:"source"`
+	Message string     `json:"message,omitempty"`
+	Files   []FileInfo `json:"files"`
+}
+
+// TotalSize returns the combined size of all files of the snapshot
+func (manifest Manifest) TotalSize() int64 {
+	var total int64
+	for _, file := range manifest.Files {
+		total += file.DataSize()
+	}
+	return total
+}
+
+// InitRepository creates an empty repository in dir, which must not exist
+// or be an empty directory
+func InitRepository(dir string) (*Repository, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read repository directory: %w", err)
+	}
+	if len(entries) > 0 {
+		return nil, fmt.Errorf("repository directory is not empty: %s", dir)
+	}
+
+	for _, sub := range []string{repoBlobsDir, repoSnapshotsDir, repoTagsDir} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), dirPerms); err != nil {
+			return nil, fmt.Errorf("failed to create repository: %w", err)
+		}
+	}
+
+	data, err := json.MarshalIndent(repoConfig{Version: Version}, "", jsonIndent)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal JSON: %w", err)
+	}
+	if err := writeFileAtomic(filepath.Join(dir, repoConfigFile), data); err != nil {
+		return nil, fmt.Errorf("failed to create repository: %w", err)
+	}
+
+	return &Repository{root: dir}, nil
+}
+
+// OpenRepository opens an existing repository
+func OpenRepository(dir string) (*Repository, error) {
+	data, err := os.ReadFile(filepath.Join(dir, repoConfigFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%w: %s", ErrNotRepository, dir)
+		}
+		return nil, fmt.Errorf("failed to open repository: %w", err)
+	}
+
+	var config repoConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse repository config: %w", err)
+	}
+
+	return &Repository{root: dir}, nil
+}
+
+// Save snapshots the directory src into the repository. Only file contents
+// that are not stored yet are written.
+func (repo *Repository) Save(ctx context.Context, src string, opts Options) (Manifest, error) {
+	if src == "" {
+		return Manifest{}, fmt.Errorf("source path cannot be empty")
+	}
+
+	sourceInfo, err := os.Stat(src)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return Manifest{}, fmt.Errorf("source does not exist: %s", src)
+		}
+		return Manifest{}, fmt.Errorf("failed to stat source: %w", err)
+	}
+	if !sourceInfo.IsDir() {
+		return Manifest{}, fmt.Errorf("source must be a directory: %s", src)
+	}
+
+	source, err := filepath.Abs(src)
+	if err != nil {
+		return Manifest{}, fmt.Errorf("failed to resolve source path: %w", err)
+	}
+	opts, err = opts.withGitFiles(ctx, src)
+	if err != nil {
+		return Manifest{}, err
+	}
+
+	return repo.SaveFS(ctx, dirFS(src), source, opts)
+}
+
+// SaveFS snapshots fsys into the repository, recording source as where the
+// snapshot was taken from. Saves may run concurrently with each other but
+// fail with ErrRepositoryLocked while Forget or GC runs.
+func (repo *Repository) SaveFS(ctx context.Context, fsys fs.FS, source string, opts Options) (Manifest, error) {
+	logger := opts.logger()
+
+	lock, err := repo.lock(false)
+	if err != nil {
+		return Manifest{}, err
+	}
+	defer lock.unlock()
+
+	// Repositories deduplicate by content, manifests are always complete
+	opts.Parent = nil
+
+	entries, err := collectEntries(ctx, fsys, opts)
+	if err != nil {
+		return Manifest{}, err
+	}
+
+	manifest := Manifest{
+		Version: Version,
+		Time:    FormatModTime(time.Now()),
+		Source:  source,
+		Message: opts.Message,
+		Files:   make([]FileInfo, 0, len(entries)),
+	}
+
+	// Files whose hash is known from the stat cache and whose blob exists
+	// already do not have to be read at all
+	stored := make(map[string]bool)
+	skip := func(entry FileInfo) bool {
+		if entry.SHA256 == "" || entry.Size > chunkThreshold || !repo.hasBlob(entry.SHA256) {
+			return false
+		}
+		stored[entry.Path] = true
+		return true
+	}
+
+	err = readFiles(ctx, fsys, entries, opts, skip, func(entry FileInfo) error {
+		if entry.hasData() && !stored[entry.Path] {
+			data, err := entry.Data()
+			if err != nil {
+				return err
+			}
+			chunks, err := repo.putFile(entry.SHA256, data)
+			if err != nil {
+				return fmt.Errorf("failed to store %s: %w", entry.Path, err)
+			}
+			logger.Debug("stored file", "path", entry.Path, "chunks", len(chunks))
+			entry.Chunks = chunks
+			entry.Contents = ""
+			entry.Encoding = ""
+		}
+		manifest.Files = append(manifest.Files, entry)
+		return nil
+	})
+	if err != nil {
+		return Manifest{}, err
+	}
+
+	manifest, err = repo.writeManifest(manifest)
+	if err != nil {
+		return Manifest{}, err
+	}
+
+	logger.Debug("saved snapshot", "id", manifest.ID, "entries", len(manifest.Files))
+	return manifest, nil
+}
+
+// writeManifest stores a manifest and returns it with its ID set
+func (repo *Repository) writeManifest(manifest Manifest) (Manifest, error) {
+	data, err := json.MarshalIndent(manifest, "", jsonIndent)
+	if err != nil {
+		return Manifest{}, fmt.Errorf("failed to marshal JSON: %w", err)
+	}
+	manifest.ID = HashContents(data)
+
+	if err := writeFileAtomic(repo.manifestPath(manifest.ID), data); err != nil {
+		return Manifest{}, fmt.Errorf("failed to store manifest: %w", err)
+	}
+	return manifest, nil
+}
+
+// Restore recreates the snapshot with the given ID in the directory dst,
+// which must not exist yet. File contents are read from the repository as
+// they are written, so large snapshots do not have to fit in memory.
+func (repo *Repository) Restore(ctx context.Context, id, dst string, opts Options) error {
+	if dst == "" {
+		return fmt.Errorf("destination path cannot be empty")
+	}
+
+	manifest, err := repo.Manifest(id)
+	if err != nil {
+		return err
+	}
+
+	snapshot := ProjectSnapshot{Version: manifest.Version, Files: manifest.Files}
+	return restoreSnapshot(ctx, snapshot, dst, opts, repo.readFile)
+}
+
+// Manifest loads the manifest of the snapshot with the given ID
+func (repo *Repository) Manifest(id string) (Manifest, error) {
+	if !isDigest(id) {
+		return Manifest{}, fmt.Errorf("invalid snapshot ID %q", id)
+	}
+
+	data, err := os.ReadFile(repo.manifestPath(id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return Manifest{}, fmt.Errorf("snapshot not found: %s", id)
+		}
+		return Manifest{}, fmt.Errorf("failed to read snapshot %s: %w", id, err)
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return Manifest{}, fmt.Errorf("failed to parse snapshot %s: %w", id, err)
+	}
+	manifest.ID = id
+	return manifest, nil
+}
+
+// Resolve returns the full ID of the snapshot that ref refers to. ref is a
+// tag name, "latest" for the most recently saved snapshot, or a unique
+// prefix of a snapshot ID.
+func (repo *Repository) Resolve(ref string) (string, error) {
+	if ref == "" {
+		return "", fmt.Errorf("snapshot ID cannot be empty")
+	}
+
+	if ref == "latest" {
+		manifests, err := repo.List()
+		if err != nil {
+			return "", err
+		}
+		if len(manifests) == 0 {
+			return "", fmt.Errorf("repository has no snapshots")
+		}
+		return manifests[len(manifests)-1].ID, nil
+	}
+
+	tags, err := repo.Tags()
+	if err != nil {
+		return "", err
+	}
+	if id, ok := tags[ref]; ok {
+		return id, nil
+	}
+
+	ids, err := repo.snapshotIDs()
+	if err != nil {
+		return "", err
+	}
+
+	var matches []string
+	for _, id := range ids {
+		if strings.HasPrefix(id, ref) {
+			matches = append(matches, id)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("snapshot not found: %s", ref)
+	case 1:
+		return matches[0], nil
+	default:
+		return "", fmt.Errorf("snapshot ID %s is ambiguous (%d matches)", ref, len(matches))
+	}
+}
+
+// List returns the manifests of all snapshots, oldest first
+func (repo *Repository) List() ([]Manifest, error) {
+	ids, err := repo.snapshotIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	manifests := make([]Manifest, 0, len(ids))
+	times := make(map[string]time.Time, len(ids))
+	for _, id := range ids {
+		manifest, err := repo.Manifest(id)
+		if err != nil {
+			return nil, err
+		}
+		saved, err := ParseModTime(manifest.Time)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time in snapshot %s: %w", id, err)
+		}
+		times[id] = saved
+		manifests = append(manifests, manifest)
+	}
+
+	sort.SliceStable(manifests, func(i, j int) bool {
+		return times[manifests[i].ID].Before(times[manifests[j].ID])
+	})
+	return manifests, nil
+}
+
+// Tag gives the snapshot with the given ID a name that can be used in place
+// of its ID. An existing tag with the same name is moved.
+func (repo *Repository) Tag(name, id string) error {
+	if err := validateTagName(name); err != nil {
+		return err
+	}
+	if _, err := repo.Manifest(id); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(repo.root, repoTagsDir), dirPerms); err != nil {
+		return fmt.Errorf("failed to create tag: %w", err)
+	}
+	if err := writeFileAtomic(repo.tagPath(name), []byte(id+"\n")); err != nil {
+		return fmt.Errorf("failed to create tag: %w", err)
+	}
+	return nil
+}
+
+// Untag removes a tag. The snapshot it pointed to is kept.
+func (repo *Repository) Untag(name string) error {
+	if err := validateTagName(name); err != nil {
+		return err
+	}
+	if err := os.Remove(repo.tagPath(name)); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("tag not found: %s", name)
+		}
+		return fmt.Errorf("failed to remove tag: %w", err)
+	}
+	return nil
+}
+
+// Tags returns all tags, mapping tag names to snapshot IDs
+func (repo *Repository) Tags() (map[string]string, error) {
+	tags := make(map[string]string)
+
+	entries, err := os.ReadDir(filepath.Join(repo.root, repoTagsDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return tags, nil
+		}
+		return nil, fmt.Errorf("failed to list tags: %w", err)
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || validateTagName(entry.Name()) != nil {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(repo.root, repoTagsDir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tag %s: %w", entry.Name(), err)
+		}
+		id := strings.TrimSpace(string(data))
+		if !isDigest(id) {
+			return nil, fmt.Errorf("tag %s does not point to a snapshot ID", entry.Name())
+		}
+		tags[entry.Name()] = id
+	}
+	return tags, nil
+}
+
+// validateTagName checks that a tag name can be stored as a file name and
+// is not mistaken for a snapshot reference
+func validateTagName(name string) error {
+	switch {
+	case name == "":
+		return fmt.Errorf("tag name cannot be empty")
+	case name == "latest":
+		return fmt.Errorf("tag name %q is reserved", name)
+	case strings.HasPrefix(name, "."):
+		return fmt.Errorf("tag name cannot start with a dot: %s", name)
+	case strings.ContainsAny(name, "/\\@"):
+		return fmt.Errorf("tag name cannot contain '/', '\\' or '@': %s", name)
+	}
+	return nil
+}
+
+// tagPath returns where the tag with the given name is stored
+func (repo *Repository) tagPath(name string) string {
+	return filepath.Join(repo.root, repoTagsDir, name)
+}
+
+// snapshotIDs returns the IDs of all stored snapshots in sorted order
+func (repo *Repository) snapshotIDs() ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(repo.root, repoSnapshotsDir))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots: %w", err)
+	}
+
+	var ids []string
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if ok && isDigest(id) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// manifestPath returns where the manifest with the given ID is stored
+func (repo *Repository) manifestPath(id string) string {
+	return filepath.Join(repo.root, repoSnapshotsDir, id+".json")
+}
+
+// blobPath returns where the blob with the given digest is stored. Blobs
+// are spread over subdirectories named after the first two hex digits.
+func (repo *Repository) blobPath(sum string) string {
+	return filepath.Join(repo.root, repoBlobsDir, sum[:2], sum)
+}
+
+// putBlob stores data under its digest unless a blob with that digest
+// exists already. It reports whether the blob was written.
+func (repo *Repository) putBlob(sum string, data []byte) (bool, error) {
+	if !isDigest(sum) {
+		return false, fmt.Errorf("invalid blob digest %q", sum)
+	}
+
+	if repo.hasBlob(sum) {
+		return false, nil
+	}
+
+	path := repo.blobPath(sum)
+	if err := os.MkdirAll(filepath.Dir(path), dirPerms); err != nil {
+		return false, err
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// hasBlob reports whether a blob with the given digest is stored
+func (repo *Repository) hasBlob(sum string) bool {
+	if !isDigest(sum) {
+		return false
+	}
+	_, err := os.Stat(repo.blobPath(sum))
+	return err == nil
+}
+
+// putFile stores the contents of a file whose digest is sum. Files larger
+// than chunkThreshold are split into chunks that are stored as separate
+// blobs; their digests are returned in order. Smaller files are stored as a
+// single blob and no chunks are returned.
+func (repo *Repository) putFile(sum string, data []byte) ([]string, error) {
+	if len(data) <= chunkThreshold {
+		_, err := repo.putBlob(sum, data)
+		return nil, err
+	}
+
+	chunks := defaultChunker.Split(data)
+	sums := make([]string, len(chunks))
+	for i, chunk := range chunks {
+		sums[i] = HashContents(chunk)
+		if _, err := repo.putBlob(sums[i], chunk); err != nil {
+			return nil, err
+		}
+	}
+	return sums, nil
+}
+
+// readFile returns the contents of a manifest file entry, reassembling
+// chunked files and checking the result against the file's digest
+func (repo *Repository) readFile(file FileInfo) ([]byte, error) {
+	if len(file.Chunks) == 0 {
+		return repo.readBlob(file.SHA256)
+	}
+
+	data := make([]byte, 0, file.Size)
+	for _, sum := range file.Chunks {
+		chunk, err := repo.readBlob(sum)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, chunk...)
+	}
+	if HashContents(data) != file.SHA256 {
+		return nil, fmt.Errorf("chunks of %s do not match its digest", file.Path)
+	}
+	return data, nil
+}
+
+// readBlob returns the contents of the blob with the given digest and checks
+// that they still match it
+func (repo *Repository) readBlob(sum string) ([]byte, error) {
+	if !isDigest(sum) {
+		return nil, fmt.Errorf("invalid blob digest %q", sum)
+	}
+
+	data, err := os.ReadFile(repo.blobPath(sum))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("blob %s is missing from the repository", sum)
+		}
+		return nil, fmt.Errorf("failed to read blob %s: %w", sum, err)
+	}
+	if HashContents(data) != sum {
+		return nil, fmt.Errorf("blob %s is corrupt", sum)
+	}
+	return data, nil
+}
+
+// isDigest reports whether s is a lowercase hex encoded SHA-256 digest
+func isDigest(s string) bool {
+	if len(s) != 64 {
+		return false
+	}
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames
+// it into place, so readers never see a partially written file
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".snapdir-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(defaultPerms); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
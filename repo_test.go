@@ -0,0 +1,361 @@
+package snapdir
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// countBlobs returns the number of blobs stored in a repository
+func countBlobs(t *testing.T, dir string) int {
+	t.Helper()
+	count := 0
+	err := filepath.WalkDir(filepath.Join(dir, repoBlobsDir), func(p string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			count++
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatalf("failed to walk blobs: %v", err)
+	}
+	return count
+}
+
+func TestInitRepository(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "repo")
+	if _, err := InitRepository(dir); err != nil {
+		t.Fatalf("InitRepository() error = %v", err)
+	}
+	if _, err := OpenRepository(dir); err != nil {
+		t.Fatalf("OpenRepository() error = %v", err)
+	}
+
+	if _, err := InitRepository(dir); err == nil {
+		t.Error("InitRepository() should refuse a non-empty directory")
+	}
+
+	_, err := OpenRepository(t.TempDir())
+	if !errors.Is(err, ErrNotRepository) {
+		t.Errorf("OpenRepository() error = %v, want ErrNotRepository", err)
+	}
+}
+
+func TestRepositorySaveAndRestore(t *testing.T) {
+	ctx := context.Background()
+	dir := filepath.Join(t.TempDir(), "repo")
+	repo, err := InitRepository(dir)
+	if err != nil {
+		t.Fatalf("InitRepository() error = %v", err)
+	}
+
+	first := fstest.MapFS{
+		"README.md":      {Data: []byte("# Project")},
+		"src/main.go":    {Data: []byte("package main")},
+		"src/copy.go":    {Data: []byte("package main")},
+		"assets/img.bin": {Data: []byte{0x00, 0xff, 0x10}},
+	}
+	m1, err := repo.SaveFS(ctx, first, "/project", Options{})
+	if err != nil {
+		t.Fatalf("SaveFS() error = %v", err)
+	}
+	if got := countBlobs(t, dir); got != 3 {
+		t.Errorf("blobs after first save = %d, want 3 (identical contents stored once)", got)
+	}
+	for _, file := range m1.Files {
+		if file.Contents != "" {
+			t.Errorf("manifest entry %s holds contents", file.Path)
+		}
+	}
+
+	// Changing one file only adds one blob
+	second := fstest.MapFS{}
+	for name, file := range first {
+		second[name] = file
+	}
+	second["README.md"] = &fstest.MapFile{Data: []byte("# Project v2")}
+	m2, err := repo.SaveFS(ctx, second, "/project", Options{})
+	if err != nil {
+		t.Fatalf("SaveFS() error = %v", err)
+	}
+	if got := countBlobs(t, dir); got != 4 {
+		t.Errorf("blobs after second save = %d, want 4", got)
+	}
+	if m1.ID == m2.ID {
+		t.Error("different snapshots should have different IDs")
+	}
+
+	for _, tt := range []struct {
+		manifest Manifest
+		fsys     fstest.MapFS
+	}{{m1, first}, {m2, second}} {
+		dst := filepath.Join(t.TempDir(), "restored")
+		if err := repo.Restore(ctx, tt.manifest.ID, dst, Options{}); err != nil {
+			t.Fatalf("Restore() error = %v", err)
+		}
+		for name, file := range tt.fsys {
+			data, err := os.ReadFile(filepath.Join(dst, filepath.FromSlash(name)))
+			if err != nil {
+				t.Errorf("failed to read %s: %v", name, err)
+				continue
+			}
+			if string(data) != string(file.Data) {
+				t.Errorf("%s: content = %q, want %q", name, data, file.Data)
+			}
+		}
+	}
+}
+
+func TestRepositorySave(t *testing.T) {
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "file.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	repo, err := InitRepository(filepath.Join(t.TempDir(), "repo"))
+	if err != nil {
+		t.Fatalf("InitRepository() error = %v", err)
+	}
+
+	manifest, err := repo.Save(context.Background(), src, Options{})
+	if err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	if !filepath.IsAbs(manifest.Source) {
+		t.Errorf("Source = %q, want an absolute path", manifest.Source)
+	}
+
+	loaded, err := repo.Manifest(manifest.ID)
+	if err != nil {
+		t.Fatalf("Manifest() error = %v", err)
+	}
+	if len(loaded.Files) != 1 || loaded.Files[0].SHA256 != HashContents([]byte("hello")) {
+		t.Errorf("Manifest() files = %+v", loaded.Files)
+	}
+
+	if _, err := repo.Save(context.Background(), filepath.Join(src, "missing"), Options{}); err == nil {
+		t.Error("Save() should fail for a missing source")
+	}
+}
+
+func TestRepositoryResolve(t *testing.T) {
+	repo, err := InitRepository(filepath.Join(t.TempDir(), "repo"))
+	if err != nil {
+		t.Fatalf("InitRepository() error = %v", err)
+	}
+
+	if _, err := repo.Resolve("latest"); err == nil {
+		t.Error("Resolve(latest) should fail for an empty repository")
+	}
+
+	var ids []string
+	for _, content := range []string{"one", "two", "three"} {
+		fsys := fstest.MapFS{"file.txt": {Data: []byte(content)}}
+		manifest, err := repo.SaveFS(context.Background(), fsys, "/src", Options{})
+		if err != nil {
+			t.Fatalf("SaveFS() error = %v", err)
+		}
+		ids = append(ids, manifest.ID)
+	}
+
+	tests := []struct {
+		ref     string
+		want    string
+		wantErr string
+	}{
+		{ref: ids[0], want: ids[0]},
+		{ref: ids[1][:12], want: ids[1]},
+		{ref: "latest", want: ids[2]},
+		{ref: "", wantErr: "cannot be empty"},
+		{ref: "zzzz", wantErr: "not found"},
+	}
+	for _, tt := range tests {
+		got, err := repo.Resolve(tt.ref)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Resolve(%q) error = %v, want %q", tt.ref, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Resolve(%q) error = %v", tt.ref, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Resolve(%q) = %s, want %s", tt.ref, got, tt.want)
+		}
+	}
+}
+
+func TestRepositoryRestoreErrors(t *testing.T) {
+	ctx := context.Background()
+	dir := filepath.Join(t.TempDir(), "repo")
+	repo, err := InitRepository(dir)
+	if err != nil {
+		t.Fatalf("InitRepository() error = %v", err)
+	}
+
+	fsys := fstest.MapFS{"file.txt": {Data: []byte("original")}}
+	manifest, err := repo.SaveFS(ctx, fsys, "/src", Options{})
+	if err != nil {
+		t.Fatalf("SaveFS() error = %v", err)
+	}
+
+	if err := repo.Restore(ctx, "not-an-id", filepath.Join(t.TempDir(), "out"), Options{}); err == nil {
+		t.Error("Restore() should fail for an invalid ID")
+	}
+
+	// A blob whose contents no longer match its digest must not be restored
+	blob := repo.blobPath(manifest.Files[0].SHA256)
+	if err := os.WriteFile(blob, []byte("tampered"), 0644); err != nil {
+		t.Fatalf("failed to overwrite blob: %v", err)
+	}
+	dst := filepath.Join(t.TempDir(), "out")
+	err = repo.Restore(ctx, manifest.ID, dst, Options{})
+	if err == nil || !strings.Contains(err.Error(), "corrupt") {
+		t.Errorf("Restore() error = %v, want corrupt blob error", err)
+	}
+	if _, statErr := os.Stat(dst); !os.IsNotExist(statErr) {
+		t.Error("failed restore should remove the destination")
+	}
+
+	if err := os.Remove(blob); err != nil {
+		t.Fatalf("failed to remove blob: %v", err)
+	}
+	err = repo.Restore(ctx, manifest.ID, dst, Options{})
+	if err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Errorf("Restore() error = %v, want missing blob error", err)
+	}
+}
+
+func TestRepositoryTags(t *testing.T) {
+	repo, err := InitRepository(filepath.Join(t.TempDir(), "repo"))
+	if err != nil {
+		t.Fatalf("InitRepository() error = %v", err)
+	}
+	manifest, err := repo.SaveFS(context.Background(), fstest.MapFS{
+		"file.txt": {Data: []byte("v1")},
+	}, "/src", Options{Message: "first release"})
+	if err != nil {
+		t.Fatalf("SaveFS() error = %v", err)
+	}
+
+	if err := repo.Tag("v1-template", manifest.ID); err != nil {
+		t.Fatalf("Tag() error = %v", err)
+	}
+	got, err := repo.Resolve("v1-template")
+	if err != nil || got != manifest.ID {
+		t.Errorf("Resolve(v1-template) = %s, %v, want %s", got, err, manifest.ID)
+	}
+
+	loaded, err := repo.Manifest(manifest.ID)
+	if err != nil {
+		t.Fatalf("Manifest() error = %v", err)
+	}
+	if loaded.Message != "first release" {
+		t.Errorf("Message = %q, want %q", loaded.Message, "first release")
+	}
+
+	for _, name := range []string{"", "latest", ".hidden", "a/b", "a@b"} {
+		if err := repo.Tag(name, manifest.ID); err == nil {
+			t.Errorf("Tag(%q) should fail", name)
+		}
+	}
+	if err := repo.Tag("missing", strings.Repeat("0", 64)); err == nil {
+		t.Error("Tag() should fail for an unknown snapshot")
+	}
+
+	if err := repo.Untag("v1-template"); err != nil {
+		t.Fatalf("Untag() error = %v", err)
+	}
+	if err := repo.Untag("v1-template"); err == nil {
+		t.Error("Untag() should fail for a missing tag")
+	}
+	tags, err := repo.Tags()
+	if err != nil {
+		t.Fatalf("Tags() error = %v", err)
+	}
+	if len(tags) != 0 {
+		t.Errorf("Tags() = %v, want none", tags)
+	}
+}
+
+func TestRepositoryChunkedFiles(t *testing.T) {
+	ctx := context.Background()
+	dir := filepath.Join(t.TempDir(), "repo")
+	repo, err := InitRepository(dir)
+	if err != nil {
+		t.Fatalf("InitRepository() error = %v", err)
+	}
+
+	large := randomData(3*chunkThreshold, 4)
+	m1, err := repo.SaveFS(ctx, fstest.MapFS{"large.bin": {Data: large}}, "/src", Options{})
+	if err != nil {
+		t.Fatalf("SaveFS() error = %v", err)
+	}
+	if len(m1.Files[0].Chunks) < 2 {
+		t.Fatalf("large file stored in %d chunks, want several", len(m1.Files[0].Chunks))
+	}
+	before := countBlobs(t, dir)
+
+	// Changing a single byte only stores the chunk containing it again
+	changed := bytes.Clone(large)
+	changed[len(changed)/2] ^= 0xff
+	m2, err := repo.SaveFS(ctx, fstest.MapFS{"large.bin": {Data: changed}}, "/src", Options{})
+	if err != nil {
+		t.Fatalf("SaveFS() error = %v", err)
+	}
+	if added := countBlobs(t, dir) - before; added != 1 {
+		t.Errorf("changing one byte added %d blobs, want 1", added)
+	}
+
+	dst := filepath.Join(t.TempDir(), "restored")
+	if err := repo.Restore(ctx, m2.ID, dst, Options{}); err != nil {
+		t.Fatalf("Restore() error = %v", err)
+	}
+	restored, err := os.ReadFile(filepath.Join(dst, "large.bin"))
+	if err != nil {
+		t.Fatalf("failed to read restored file: %v", err)
+	}
+	if !bytes.Equal(restored, changed) {
+		t.Error("restored file does not match the saved one")
+	}
+
+	report, err := repo.Verify(ctx)
+	if err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+	if report.Snapshots != 2 || report.Files != 2 || len(report.Problems) != 0 {
+		t.Errorf("Verify() = %+v, want 2 snapshots, 2 files and no problems", report)
+	}
+
+	// Damage a chunk shared by both snapshots
+	chunk := repo.blobPath(m1.Files[0].Chunks[0])
+	if err := os.WriteFile(chunk, []byte("damaged"), 0644); err != nil {
+		t.Fatalf("failed to damage chunk: %v", err)
+	}
+	report, err = repo.Verify(ctx)
+	if err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+	if len(report.Problems) != 2 {
+		t.Errorf("Verify() problems = %v, want one per snapshot", report.Problems)
+	}
+
+	// Chunks still in use survive garbage collection
+	if _, err := repo.Forget(RetentionPolicy{KeepLast: 1}); err != nil {
+		t.Fatalf("Forget() error = %v", err)
+	}
+	stats, err := repo.GC()
+	if err != nil {
+		t.Fatalf("GC() error = %v", err)
+	}
+	if stats.Blobs != 1 {
+		t.Errorf("GC() removed %d blobs, want only the replaced chunk", stats.Blobs)
+	}
+}
@@ -0,0 +1,329 @@
+package snapdir
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Restore reads a JSON snapshot from r and recreates it in the directory dst,
+// which must not exist yet. Compressed and encrypted snapshots are decoded
+// as by DecodeReader, with opts.Identities. The snapshot is decoded one
+// entry at a time and rejected as soon as it breaks opts.Limits or has a
+// path that leads outside dst, before anything is written. If the restore
+// fails or ctx is canceled, the partially restored destination is removed
+// again.
+//
+// Directories are created first, then files are written by opts.Jobs
+// workers and symlinks are created, and finally directory modes and
+// modification times are applied from the deepest directory up, so
+// read-only directories can still be filled and writing files does not
+// disturb directory times.
+func Restore(ctx context.Context, r io.Reader, dst string, opts Options) error {
+	if dst == "" {
+		return fmt.Errorf("destination path cannot be empty")
+	}
+
+	r, err := DecodeReader(r, opts.Identities...)
+	if err != nil {
+		return err
+	}
+
+	var snapshot ProjectSnapshot
+	checker := newLimitChecker(opts)
+	err = scanSnapshot(checker.limit(r), &snapshot, func(file FileInfo) error {
+		if err := checker.check(file); err != nil {
+			return err
+		}
+		snapshot.Files = append(snapshot.Files, file)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to parse snapshot: %w", err)
+	}
+
+	return RestoreSnapshot(ctx, snapshot, dst, opts)
+}
+
+// RestoreSnapshot recreates a snapshot that is already in memory in the
+// directory dst, like Restore. Incremental snapshots have to be merged with
+// their parents first, see OpenSnapshot.
+func RestoreSnapshot(ctx context.Context, snapshot ProjectSnapshot, dst string, opts Options) error {
+	if dst == "" {
+		return fmt.Errorf("destination path cannot be empty")
+	}
+	if snapshot.Parent != "" {
+		return fmt.Errorf("snapshot is incremental, open it with OpenSnapshot to restore it together with its parent %s", snapshot.Parent)
+	}
+	return restoreSnapshot(ctx, snapshot, dst, opts, FileInfo.Data)
+}
+
+// loadFunc returns the contents of a file entry that is being restored
+type loadFunc func(FileInfo) ([]byte, error)
+
+// restoreSnapshot recreates snapshot in dst, reading file contents with load.
+// The snapshot is checked against opts.Limits before anything is written.
+func restoreSnapshot(ctx context.Context, snapshot ProjectSnapshot, dst string, opts Options, load loadFunc) (err error) {
+	logger := opts.logger()
+	logger.Debug("restoring snapshot", "version", snapshot.Version, "destination", dst)
+
+	if err := newLimitChecker(opts).checkAll(snapshot.Files); err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(dst); err == nil {
+		return fmt.Errorf("destination already exists: %s (remove it first or choose a different location)", dst)
+	}
+
+	if err := os.MkdirAll(dst, dirPerms); err != nil {
+		return fmt.Errorf("failed to create destination directory: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			logger.Debug("removing partially restored destination", "destination", dst)
+			if removeErr := os.RemoveAll(dst); removeErr != nil {
+				logger.Warn("failed to clean up destination", "destination", dst, "error", removeErr)
+			}
+		}
+	}()
+
+	var dirs, files, links []FileInfo
+	for _, file := range snapshot.Files {
+		switch {
+		case file.IsDir:
+			dirs = append(dirs, file)
+		case file.Link != "":
+			links = append(links, file)
+		default:
+			files = append(files, file)
+		}
+	}
+
+	if err := createDirs(dst, dirs, append(files, links...)); err != nil {
+		return err
+	}
+
+	if err := writeFiles(ctx, dst, files, opts, load); err != nil {
+		return err
+	}
+
+	if err := createLinks(dst, links, opts); err != nil {
+		return err
+	}
+
+	if err := applyDirMetadata(dst, dirs, opts); err != nil {
+		return err
+	}
+
+	logger.Debug("restore complete", "entries", len(snapshot.Files))
+	return nil
+}
+
+// createDirs creates every directory of the snapshot and the parent
+// directories of all files. Directories are created writable; their final
+// modes are applied by applyDirMetadata once all files are in place.
+func createDirs(dst string, dirs, files []FileInfo) error {
+	for _, dir := range dirs {
+		path := filepath.Join(dst, filepath.FromSlash(dir.Path))
+		if err := os.MkdirAll(path, dirPerms); err != nil {
+			return fmt.Errorf("failed to create directory %s: %w", dir.Path, err)
+		}
+	}
+
+	for _, file := range files {
+		parentDir := filepath.Dir(filepath.Join(dst, filepath.FromSlash(file.Path)))
+		if err := os.MkdirAll(parentDir, dirPerms); err != nil {
+			return fmt.Errorf("failed to create parent directory for %s: %w", file.Path, err)
+		}
+	}
+
+	return nil
+}
+
+// writeFiles writes all files using opts.Jobs workers. Every file is written
+// to a temporary name and renamed into place once complete, so a failing or
+// canceled worker never leaves a half-written file behind. After a failure,
+// files later in the snapshot are skipped while earlier ones still finish,
+// so the error returned is always the one for the first failing file in
+// snapshot order.
+func writeFiles(ctx context.Context, dst string, files []FileInfo, opts Options, load loadFunc) error {
+	logger := opts.logger()
+
+	var (
+		mu          sync.Mutex
+		progress    Progress
+		firstFailed = len(files)
+	)
+	for _, file := range files {
+		progress.FilesTotal++
+		progress.BytesTotal += file.DataSize()
+	}
+	opts.reportProgress(progress)
+
+	// skip reports whether file i comes after a file that already failed
+	skip := func(i int) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return i > firstFailed
+	}
+
+	errs := make([]error, len(files))
+	work := make(chan int)
+
+	var wg sync.WaitGroup
+	for n := 0; n < opts.jobs(); n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				if skip(i) || ctx.Err() != nil {
+					continue
+				}
+
+				written, err := writeFile(dst, files[i], opts, load)
+
+				mu.Lock()
+				if err != nil {
+					errs[i] = err
+					firstFailed = min(firstFailed, i)
+				} else {
+					logger.Debug("restored file", "path", files[i].Path)
+					progress.FilesDone++
+					progress.BytesDone += written
+					opts.reportProgress(progress)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+feed:
+	for i := range files {
+		if skip(i) {
+			break
+		}
+		select {
+		case work <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	if firstFailed < len(files) {
+		return errs[firstFailed]
+	}
+	return ctx.Err()
+}
+
+// writeFile writes a single file with its mode, modification time and,
+// if requested, owner. It returns the number of bytes written.
+func writeFile(dst string, file FileInfo, opts Options, load loadFunc) (int64, error) {
+	path := filepath.Join(dst, filepath.FromSlash(file.Path))
+
+	data, err := load(file)
+	if err != nil {
+		return 0, err
+	}
+	if err := newLimitChecker(opts).checkSize(file, int64(len(data))); err != nil {
+		return 0, err
+	}
+	if len(opts.SecretValues) > 0 && file.Redacted {
+		var missing []string
+		data, missing = FillSecrets(data, opts.SecretValues)
+		for _, name := range missing {
+			opts.logger().Warn("no value for redacted secret", "path", file.Path, "placeholder", name)
+		}
+	}
+
+	mode := fs.FileMode(file.Mode).Perm()
+	if mode == 0 {
+		mode = defaultPerms
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".snapdir-*.tmp")
+	if err != nil {
+		return 0, fmt.Errorf("failed to write file %s: %w", file.Path, err)
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName)
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return 0, fmt.Errorf("failed to write file %s: %w", file.Path, err)
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return 0, fmt.Errorf("failed to set mode of %s: %w", file.Path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, fmt.Errorf("failed to write file %s: %w", file.Path, err)
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		return 0, fmt.Errorf("failed to write file %s: %w", file.Path, err)
+	}
+
+	if err := applyMetadata(path, file, opts); err != nil {
+		return 0, err
+	}
+
+	return int64(len(data)), nil
+}
+
+// applyDirMetadata sets the final mode, modification time and owner of
+// every directory, deepest first so that changing a directory does not
+// affect its parent's modification time and read-only directories are only
+// locked once everything below them exists
+func applyDirMetadata(dst string, dirs []FileInfo, opts Options) error {
+	sorted := make([]FileInfo, len(dirs))
+	copy(sorted, dirs)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return strings.Count(sorted[i].Path, "/") > strings.Count(sorted[j].Path, "/")
+	})
+
+	for _, dir := range sorted {
+		path := filepath.Join(dst, filepath.FromSlash(dir.Path))
+
+		mode := fs.FileMode(dir.Mode).Perm()
+		if mode == 0 {
+			mode = dirPerms
+		}
+		if err := os.Chmod(path, mode); err != nil {
+			return fmt.Errorf("failed to set mode of %s: %w", dir.Path, err)
+		}
+
+		if err := applyMetadata(path, dir, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyMetadata sets the modification time and, if requested, the owner of
+// a restored entry
+func applyMetadata(path string, file FileInfo, opts Options) error {
+	if opts.PreserveOwner && file.Owner != nil {
+		if err := applyOwner(path, file.Owner); err != nil {
+			return fmt.Errorf("failed to set owner of %s: %w", file.Path, err)
+		}
+	}
+
+	if file.ModTime != "" {
+		modTime, err := ParseModTime(file.ModTime)
+		if err != nil {
+			return fmt.Errorf("invalid modification time for %s: %w", file.Path, err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			return fmt.Errorf("failed to set modification time of %s: %w", file.Path, err)
+		}
+	}
+
+	return nil
+}
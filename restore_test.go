@@ -0,0 +1,256 @@
+package snapdir
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRestore(t *testing.T) {
+	input := `{
+  "version": "1.0.0",
+  "files": [
+    {"path": "dir", "is_dir": true, "mode": 493},
+    {"path": "dir/file.txt", "contents": "content", "is_dir": false, "mode": 384},
+    {"path": "data.bin", "contents": "AP8=", "encoding": "base64", "is_dir": false}
+  ]
+}`
+
+	dst := filepath.Join(t.TempDir(), "restored")
+	if err := Restore(context.Background(), strings.NewReader(input), dst, Options{}); err != nil {
+		t.Fatalf("Restore() error = %v", err)
+	}
+
+	tests := []struct {
+		path     string
+		contents string
+		mode     os.FileMode
+	}{
+		{path: "dir/file.txt", contents: "content", mode: 0600},
+		{path: "data.bin", contents: "\x00\xff", mode: defaultPerms},
+	}
+	for _, tt := range tests {
+		restored := filepath.Join(dst, filepath.FromSlash(tt.path))
+		data, err := os.ReadFile(restored)
+		if err != nil {
+			t.Errorf("failed to read %s: %v", tt.path, err)
+			continue
+		}
+		if string(data) != tt.contents {
+			t.Errorf("%s: content = %q, want %q", tt.path, data, tt.contents)
+		}
+		info, err := os.Stat(restored)
+		if err != nil {
+			t.Fatalf("failed to stat %s: %v", tt.path, err)
+		}
+		if info.Mode().Perm() != tt.mode {
+			t.Errorf("%s: mode = %v, want %v", tt.path, info.Mode().Perm(), tt.mode)
+		}
+	}
+}
+
+func TestRestoreErrors(t *testing.T) {
+	existing := t.TempDir()
+
+	tests := []struct {
+		name  string
+		input string
+		dst   string
+	}{
+		{
+			name:  "invalid JSON",
+			input: "invalid json",
+			dst:   filepath.Join(t.TempDir(), "dst"),
+		},
+		{
+			name:  "existing destination",
+			input: `{"version": "1.0.0", "files": []}`,
+			dst:   existing,
+		},
+		{
+			name:  "empty destination",
+			input: `{"version": "1.0.0", "files": []}`,
+			dst:   "",
+		},
+		{
+			name:  "corrupt contents",
+			input: `{"version": "1.0.0", "files": [{"path": "a.bin", "contents": "!!", "encoding": "base64"}]}`,
+			dst:   filepath.Join(t.TempDir(), "dst"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := Restore(context.Background(), strings.NewReader(tt.input), tt.dst, Options{}); err == nil {
+				t.Error("Restore() should fail")
+			}
+		})
+	}
+}
+
+func TestRestoreCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	input := `{"version": "1.0.0", "files": [{"path": "a.txt", "contents": "a"}]}`
+	dst := filepath.Join(t.TempDir(), "dst")
+	if err := Restore(ctx, strings.NewReader(input), dst, Options{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Restore() error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestRestoreProgressAndCleanup(t *testing.T) {
+	input := `{"version": "1.0.0", "files": [
+		{"path": "a.txt", "contents": "aaa"},
+		{"path": "b.txt", "contents": "bb"},
+		{"path": "c.txt", "contents": "c"}
+	]}`
+
+	t.Run("progress", func(t *testing.T) {
+		var last Progress
+		calls := 0
+		opts := Options{Progress: func(p Progress) { last = p; calls++ }}
+
+		dst := filepath.Join(t.TempDir(), "dst")
+		if err := Restore(context.Background(), strings.NewReader(input), dst, opts); err != nil {
+			t.Fatalf("Restore() error = %v", err)
+		}
+
+		want := Progress{FilesDone: 3, FilesTotal: 3, BytesDone: 6, BytesTotal: 6}
+		if last != want || calls != 4 {
+			t.Errorf("last progress = %+v after %d calls, want %+v after 4 calls", last, calls, want)
+		}
+	})
+
+	t.Run("canceled midway", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		// Cancel as soon as the first file has been written
+		opts := Options{Progress: func(p Progress) {
+			if p.FilesDone == 1 {
+				cancel()
+			}
+		}}
+
+		dst := filepath.Join(t.TempDir(), "dst")
+		err := Restore(ctx, strings.NewReader(input), dst, opts)
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("Restore() error = %v, want %v", err, context.Canceled)
+		}
+		if _, err := os.Stat(dst); !os.IsNotExist(err) {
+			t.Errorf("partially restored destination was not removed: %v", err)
+		}
+	})
+}
+
+func TestRestoreMetadata(t *testing.T) {
+	input := `{"version": "1.0.0", "files": [
+		{"path": "locked", "is_dir": true, "mode": 365, "mtime": "2020-01-02T03:04:05Z"},
+		{"path": "locked/inner", "is_dir": true, "mode": 493, "mtime": "2021-06-07T08:09:10Z"},
+		{"path": "locked/inner/file.txt", "contents": "content", "mode": 292, "mtime": "2019-12-31T23:59:59.5Z"}
+	]}`
+
+	dst := filepath.Join(t.TempDir(), "dst")
+	if err := Restore(context.Background(), strings.NewReader(input), dst, Options{Jobs: 4}); err != nil {
+		t.Fatalf("Restore() error = %v", err)
+	}
+	// Allow the test's temp dir cleanup to remove the read-only tree
+	defer os.Chmod(filepath.Join(dst, "locked"), 0755)
+
+	tests := []struct {
+		path    string
+		mode    os.FileMode
+		modTime string
+	}{
+		{path: "locked", mode: 0555, modTime: "2020-01-02T03:04:05Z"},
+		{path: "locked/inner", mode: 0755, modTime: "2021-06-07T08:09:10Z"},
+		{path: "locked/inner/file.txt", mode: 0444, modTime: "2019-12-31T23:59:59.5Z"},
+	}
+	for _, tt := range tests {
+		info, err := os.Stat(filepath.Join(dst, filepath.FromSlash(tt.path)))
+		if err != nil {
+			t.Fatalf("failed to stat %s: %v", tt.path, err)
+		}
+		if info.Mode().Perm() != tt.mode {
+			t.Errorf("%s: mode = %v, want %v", tt.path, info.Mode().Perm(), tt.mode)
+		}
+		if got := FormatModTime(info.ModTime()); got != tt.modTime {
+			t.Errorf("%s: mtime = %s, want %s", tt.path, got, tt.modTime)
+		}
+	}
+}
+
+func TestRestoreParallelMatchesSnapshot(t *testing.T) {
+	snapshot := ProjectSnapshot{Version: Version}
+	for i := 0; i < 200; i++ {
+		snapshot.Files = append(snapshot.Files, FileInfo{
+			Path:     fmt.Sprintf("dir%d/file%03d.txt", i%5, i),
+			Contents: fmt.Sprintf("content %d", i),
+			Mode:     0644,
+		})
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		t.Fatalf("failed to marshal snapshot: %v", err)
+	}
+
+	dst := filepath.Join(t.TempDir(), "dst")
+	if err := Restore(context.Background(), bytes.NewReader(data), dst, Options{Jobs: 16}); err != nil {
+		t.Fatalf("Restore() error = %v", err)
+	}
+
+	for _, file := range snapshot.Files {
+		got, err := os.ReadFile(filepath.Join(dst, filepath.FromSlash(file.Path)))
+		if err != nil {
+			t.Errorf("failed to read %s: %v", file.Path, err)
+			continue
+		}
+		if string(got) != file.Contents {
+			t.Errorf("%s: content = %q, want %q", file.Path, got, file.Contents)
+		}
+	}
+}
+
+func TestWriteFilesFailure(t *testing.T) {
+	dst := t.TempDir()
+
+	// "b" and "d" already exist as directories, so renaming the finished
+	// files into place fails for both of them
+	for _, dir := range []string{"b", "d"} {
+		if err := os.MkdirAll(filepath.Join(dst, dir, "child"), 0755); err != nil {
+			t.Fatalf("failed to create directory: %v", err)
+		}
+	}
+
+	files := []FileInfo{
+		{Path: "a", Contents: "a"},
+		{Path: "b", Contents: "b"},
+		{Path: "c", Contents: "c"},
+		{Path: "d", Contents: "d"},
+	}
+
+	for i := 0; i < 10; i++ {
+		err := writeFiles(context.Background(), dst, files, Options{Jobs: 4}, FileInfo.Data)
+		if err == nil {
+			t.Fatal("writeFiles() should fail")
+		}
+		if !strings.Contains(err.Error(), "failed to write file b") {
+			t.Fatalf("writeFiles() error = %v, want the failure for b", err)
+		}
+	}
+
+	leftovers, err := filepath.Glob(filepath.Join(dst, ".snapdir-*"))
+	if err != nil {
+		t.Fatalf("Glob() error = %v", err)
+	}
+	if len(leftovers) != 0 {
+		t.Errorf("failed writes left temporary files behind: %v", leftovers)
+	}
+}
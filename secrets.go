@@ -0,0 +1,328 @@
+package snapdir
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// SecretAction decides what Clone does with secrets found in files
+type SecretAction string
+
+// Actions for found secrets. The zero value disables scanning.
+const (
+	SecretsIgnore SecretAction = ""
+	SecretsWarn   SecretAction = "warn"
+	SecretsFail   SecretAction = "fail"
+	SecretsRedact SecretAction = "redact"
+)
+
+// ParseSecretAction parses the name of a SecretAction; "off" and "ignore"
+// disable scanning
+func ParseSecretAction(s string) (SecretAction, error) {
+	switch action := SecretAction(s); action {
+	case SecretsWarn, SecretsFail, SecretsRedact:
+		return action, nil
+	case "off", "ignore":
+		return SecretsIgnore, nil
+	default:
+		return "", fmt.Errorf("unknown secrets action %q (want warn, fail, redact or off)", s)
+	}
+}
+
+// ErrSecretsFound is returned by Clone when secrets are found with
+// SecretsFail, before any of the snapshot is written
+var ErrSecretsFound = errors.New("secrets found")
+
+var (
+	// placeholderPattern matches the placeholders redaction leaves behind
+	placeholderPattern = regexp.MustCompile(`\{\{snapdir-secret:([A-Za-z0-9_.-]+)\}\}`)
+
+	// ruleNamePattern matches the names rules can have, which end up in
+	// placeholders
+	ruleNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+)
+
+// SecretRule describes one kind of secret
+type SecretRule struct {
+	// Name identifies the rule in findings and placeholders
+	Name string `json:"name"`
+
+	// Pattern matches the secret. If it has a capture group, the first
+	// group is the secret value and the rest of the match is context that
+	// is kept when redacting.
+	Pattern *regexp.Regexp `json:"-"`
+
+	// MinEntropy, if set, is the Shannon entropy in bits per character a
+	// value needs to count as a secret, which filters out placeholders
+	// and words like "changeme"
+	MinEntropy float64 `json:"min_entropy,omitempty"`
+
+	// Paths limits the rule to files whose base name matches one of
+	// these glob patterns
+	Paths []string `json:"paths,omitempty"`
+}
+
+// DefaultSecretRules find private keys, well known token formats, values
+// assigned to names like password or api_key, and values in .env files
+var DefaultSecretRules = []SecretRule{
+	{
+		Name:    "private-key",
+		Pattern: regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY( BLOCK)?-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY( BLOCK)?-----`),
+	},
+	{
+		Name:    "aws-access-key-id",
+		Pattern: regexp.MustCompile(`\b((?:AKIA|ASIA)[0-9A-Z]{16})\b`),
+	},
+	{
+		Name:       "aws-secret-access-key",
+		Pattern:    regexp.MustCompile(`(?i)aws_?secret_?access_?key["']?\s*[:=]\s*["']?([A-Za-z0-9/+=]{40})\b`),
+		MinEntropy: 3.5,
+	},
+	{
+		Name:    "github-token",
+		Pattern: regexp.MustCompile(`\b((?:gh[pousr]_[A-Za-z0-9]{36,})|(?:github_pat_[A-Za-z0-9_]{60,}))\b`),
+	},
+	{
+		Name:    "slack-token",
+		Pattern: regexp.MustCompile(`\b(xox[abposr]-[A-Za-z0-9-]{10,})\b`),
+	},
+	{
+		Name:       "generic-secret",
+		Pattern:    regexp.MustCompile(`(?i)(?:secret|token|passw(?:or)?d|api[_-]?key|access[_-]?key)[A-Za-z0-9_]*["']?\s*[:=]\s*["']?([A-Za-z0-9/+_.=-]{12,})`),
+		MinEntropy: 3.5,
+	},
+	{
+		Name:    "dotenv-value",
+		Pattern: regexp.MustCompile(`(?m)^[ \t]*(?:export[ \t]+)?[A-Za-z_][A-Za-z0-9_]*[ \t]*=[ \t]*["']?([^"'\s#][^"'\r\n#]*?)["']?[ \t]*(?:#.*)?$`),
+		Paths:   []string{".env", ".env.*", "*.env"},
+	},
+}
+
+// LoadSecretRules reads a ruleset from r: a JSON array of rules with a
+// "pattern" holding a regular expression in Go syntax
+func LoadSecretRules(r io.Reader) ([]SecretRule, error) {
+	var raw []struct {
+		SecretRule
+		Pattern string `json:"pattern"`
+	}
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return nil, fmt.Errorf("failed to parse secret rules: %w", err)
+	}
+
+	rules := make([]SecretRule, 0, len(raw))
+	for i, rule := range raw {
+		if !ruleNamePattern.MatchString(rule.Name) {
+			return nil, fmt.Errorf("secret rule %d: invalid name %q", i+1, rule.Name)
+		}
+		pattern, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("secret rule %s: %w", rule.Name, err)
+		}
+		for _, p := range rule.Paths {
+			if _, err := path.Match(p, ""); err != nil {
+				return nil, fmt.Errorf("secret rule %s: invalid path pattern %q: %w", rule.Name, p, err)
+			}
+		}
+		rule.SecretRule.Pattern = pattern
+		rules = append(rules, rule.SecretRule)
+	}
+	return rules, nil
+}
+
+// SecretFinding is a secret found in a file
+type SecretFinding struct {
+	Path string
+	Line int
+	Rule string
+
+	// Placeholder is the name the secret was replaced with when redacting
+	Placeholder string
+
+	start, end int
+}
+
+// appliesTo reports whether the rule covers the file at p
+func (rule SecretRule) appliesTo(p string) bool {
+	if len(rule.Paths) == 0 {
+		return true
+	}
+	for _, pattern := range rule.Paths {
+		if matched, _ := path.Match(pattern, path.Base(p)); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// binarySniffLen is how much of a file is checked for NUL bytes to tell
+// binary files from text, as git does
+const binarySniffLen = 8000
+
+// looksBinary reports whether data is binary rather than text. Text with a
+// few bytes that are not valid UTF-8 still counts as text.
+func looksBinary(data []byte) bool {
+	return bytes.IndexByte(data[:min(len(data), binarySniffLen)], 0) >= 0
+}
+
+// ScanSecrets returns the secrets rules find in the contents of the file
+// at p, in order and without overlaps. Binary contents, with a NUL byte
+// near the start, are not scanned.
+func ScanSecrets(p string, data []byte, rules []SecretRule) []SecretFinding {
+	if looksBinary(data) {
+		return nil
+	}
+	var findings []SecretFinding
+	for _, rule := range rules {
+		if !rule.appliesTo(p) {
+			continue
+		}
+		for _, m := range rule.Pattern.FindAllSubmatchIndex(data, -1) {
+			start, end := m[0], m[1]
+			if len(m) >= 4 && m[2] >= 0 {
+				start, end = m[2], m[3]
+			}
+			value := data[start:end]
+			if len(value) == 0 || placeholderPattern.Match(value) {
+				continue
+			}
+			if rule.MinEntropy > 0 && shannonEntropy(value) < rule.MinEntropy {
+				continue
+			}
+			findings = append(findings, SecretFinding{Path: p, Rule: rule.Name, start: start, end: end})
+		}
+	}
+
+	// Rules are tried in order, so where findings overlap the earlier rule
+	// wins
+	sort.SliceStable(findings, func(i, j int) bool { return findings[i].start < findings[j].start })
+	kept := findings[:0]
+	for _, finding := range findings {
+		if len(kept) > 0 && finding.start < kept[len(kept)-1].end {
+			continue
+		}
+		finding.Line = 1 + strings.Count(string(data[:finding.start]), "\n")
+		kept = append(kept, finding)
+	}
+	return kept
+}
+
+// shannonEntropy returns the entropy of data in bits per byte
+func shannonEntropy(data []byte) float64 {
+	var counts [256]int
+	for _, b := range data {
+		counts[b]++
+	}
+	var entropy float64
+	for _, n := range counts {
+		if n == 0 {
+			continue
+		}
+		p := float64(n) / float64(len(data))
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
+
+// secretScanner applies opts.Secrets to the entries of one clone. Entries
+// must be passed in snapshot order, so placeholders are numbered the same
+// way every time.
+type secretScanner struct {
+	opts     Options
+	rules    []SecretRule
+	counts   map[string]int
+	findings int
+}
+
+// newSecretScanner returns a scanner for opts, or nil if scanning is off
+func newSecretScanner(opts Options) *secretScanner {
+	if opts.Secrets == SecretsIgnore {
+		return nil
+	}
+	rules := opts.SecretRules
+	if rules == nil {
+		rules = DefaultSecretRules
+	}
+	return &secretScanner{opts: opts, rules: rules, counts: make(map[string]int)}
+}
+
+// scan checks a file entry that has been read and, when redacting, replaces
+// its secrets with placeholders
+func (s *secretScanner) scan(entry *FileInfo) {
+	if s == nil || !entry.hasData() {
+		return
+	}
+
+	data, err := entry.Data()
+	if err != nil {
+		return
+	}
+	findings := ScanSecrets(entry.Path, data, s.rules)
+	if len(findings) == 0 {
+		return
+	}
+	s.findings += len(findings)
+
+	var redacted []byte
+	last := 0
+	for i := range findings {
+		finding := &findings[i]
+		if s.opts.Secrets == SecretsRedact {
+			s.counts[finding.Rule]++
+			finding.Placeholder = fmt.Sprintf("%s-%d", finding.Rule, s.counts[finding.Rule])
+			redacted = append(redacted, data[last:finding.start]...)
+			redacted = append(redacted, "{{snapdir-secret:"+finding.Placeholder+"}}"...)
+			last = finding.end
+		}
+		s.report(*finding)
+	}
+
+	if s.opts.Secrets == SecretsRedact {
+		redacted = append(redacted, data[last:]...)
+		entry.SetData(redacted)
+		entry.Size = int64(len(redacted))
+		entry.SHA256 = HashContents(redacted)
+		entry.Redacted = true
+	}
+}
+
+// report logs a finding as a warning
+func (s *secretScanner) report(finding SecretFinding) {
+	attrs := []any{"path", finding.Path, "line", finding.Line, "rule", finding.Rule}
+	if finding.Placeholder != "" {
+		attrs = append(attrs, "placeholder", finding.Placeholder)
+	}
+	s.opts.logger().Warn("possible secret", attrs...)
+}
+
+// finish returns ErrSecretsFound if secrets were found with SecretsFail
+func (s *secretScanner) finish() error {
+	if s == nil || s.opts.Secrets != SecretsFail || s.findings == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w: %d possible secrets, remove them or use redact", ErrSecretsFound, s.findings)
+}
+
+// FillSecrets replaces the placeholders left by redaction with their values
+// and returns the names of placeholders that have no value, which are left
+// in place. Restore only fills in files marked as Redacted.
+func FillSecrets(data []byte, values map[string]string) ([]byte, []string) {
+	var missing []string
+	filled := placeholderPattern.ReplaceAllFunc(data, func(m []byte) []byte {
+		name := string(placeholderPattern.FindSubmatch(m)[1])
+		value, ok := values[name]
+		if !ok {
+			missing = append(missing, name)
+			return m
+		}
+		return []byte(value)
+	})
+	return filled, missing
+}
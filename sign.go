@@ -0,0 +1,265 @@
+package snapdir
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+const (
+	// signatureVersion is the format version of signature files
+	signatureVersion = 1
+
+	// signatureContext is prepended to the digest that is signed, so a
+	// snapshot signature cannot be mistaken for a signature of anything else
+	signatureContext = "snapdir-signature-v1:"
+
+	// SignatureSuffix is appended to a snapshot file name to get the name
+	// of its detached signature file
+	SignatureSuffix = ".sig"
+
+	signingPublicPrefix = "snapdir-sign-"
+	signingSecretPrefix = "SNAPDIR-SIGNING-KEY-"
+)
+
+var (
+	// ErrNotSigned is returned when a snapshot has no signature by any
+	// trusted key
+	ErrNotSigned = errors.New("snapshot is not signed by a trusted key")
+
+	// ErrBadSignature is returned when a signature by a trusted key does
+	// not match the snapshot, which means it was changed after signing
+	ErrBadSignature = errors.New("snapshot signature is invalid")
+)
+
+// SigningKey is an ed25519 secret key that signs snapshots
+type SigningKey struct {
+	key ed25519.PrivateKey
+}
+
+// VerifyKey is the public half of a SigningKey
+type VerifyKey struct {
+	key ed25519.PublicKey
+}
+
+// GenerateSigningKey creates a new random signing key
+func GenerateSigningKey() (*SigningKey, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	return &SigningKey{key: key}, nil
+}
+
+// ParseSigningKey parses a key as printed by SigningKey.String
+func ParseSigningKey(s string) (*SigningKey, error) {
+	seed, err := decodeKey(s, signingSecretPrefix)
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("invalid signing key")
+	}
+	return &SigningKey{key: ed25519.NewKeyFromSeed(seed)}, nil
+}
+
+// String returns the key in the form ParseSigningKey accepts
+func (k *SigningKey) String() string {
+	return signingSecretPrefix + base64.RawURLEncoding.EncodeToString(k.key.Seed())
+}
+
+// Public returns the key that verifies signatures made with k
+func (k *SigningKey) Public() *VerifyKey {
+	return &VerifyKey{key: k.key.Public().(ed25519.PublicKey)}
+}
+
+// ParseVerifyKey parses a key as printed by VerifyKey.String
+func ParseVerifyKey(s string) (*VerifyKey, error) {
+	data, err := decodeKey(s, signingPublicPrefix)
+	if err != nil || len(data) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid verification key %q", s)
+	}
+	return &VerifyKey{key: ed25519.PublicKey(data)}, nil
+}
+
+// String returns the key in the form ParseVerifyKey accepts
+func (k *VerifyKey) String() string {
+	return signingPublicPrefix + base64.RawURLEncoding.EncodeToString(k.key)
+}
+
+// Signature is one signature over the canonical digest of a snapshot
+type Signature struct {
+	Key       string `json:"key"`
+	Digest    string `json:"digest"`
+	Signature []byte `json:"signature"`
+}
+
+// signatureFile is the format of a detached signature file
+type signatureFile struct {
+	Version    int         `json:"version"`
+	Signatures []Signature `json:"signatures"`
+}
+
+// SnapshotDigest returns the canonical digest of a snapshot: the SHA-256 of
+// its compact JSON encoding. It does not depend on indentation or on
+// whether the file is encrypted, so a snapshot keeps its signatures when it
+// is re-encrypted. An incremental snapshot covers its parent through
+// parent_sha256.
+func SnapshotDigest(snapshot ProjectSnapshot) (string, error) {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal JSON: %w", err)
+	}
+	return HashContents(data), nil
+}
+
+// Sign signs the canonical digest of snapshot with key
+func Sign(snapshot ProjectSnapshot, key *SigningKey) (Signature, error) {
+	digest, err := SnapshotDigest(snapshot)
+	if err != nil {
+		return Signature{}, err
+	}
+	return Signature{
+		Key:       key.Public().String(),
+		Digest:    digest,
+		Signature: ed25519.Sign(key.key, []byte(signatureContext+digest)),
+	}, nil
+}
+
+// VerifySignatures checks that one of signatures is a valid signature of
+// snapshot by one of the trusted keys and returns that key. A signature by
+// a trusted key that does not match fails with ErrBadSignature even if
+// another one is valid.
+func VerifySignatures(snapshot ProjectSnapshot, signatures []Signature, trusted []*VerifyKey) (*VerifyKey, error) {
+	if len(trusted) == 0 {
+		return nil, fmt.Errorf("no trusted keys given")
+	}
+	digest, err := SnapshotDigest(snapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	var signer *VerifyKey
+	for _, sig := range signatures {
+		for _, key := range trusted {
+			if sig.Key != key.String() {
+				continue
+			}
+			if sig.Digest != digest || !ed25519.Verify(key.key, []byte(signatureContext+digest), sig.Signature) {
+				return nil, fmt.Errorf("%w: signed by %s", ErrBadSignature, key)
+			}
+			signer = key
+		}
+	}
+	if signer == nil {
+		return nil, ErrNotSigned
+	}
+	return signer, nil
+}
+
+// SignFile adds a signature by key to the detached signature file of
+// snapshotFile, keeping the signatures of other keys. Encrypted snapshots
+// are decrypted with identities to compute their digest.
+func SignFile(snapshotFile string, key *SigningKey, identities ...Identity) (Signature, error) {
+	snapshot, _, err := readSnapshotFile(snapshotFile, Options{Identities: identities})
+	if err != nil {
+		return Signature{}, err
+	}
+	sig, err := Sign(snapshot, key)
+	if err != nil {
+		return Signature{}, err
+	}
+
+	signatures, err := ReadSignatures(snapshotFile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return Signature{}, err
+	}
+	kept := []Signature{sig}
+	for _, other := range signatures {
+		if other.Key != sig.Key {
+			kept = append(kept, other)
+		}
+	}
+
+	data, err := json.MarshalIndent(signatureFile{Version: signatureVersion, Signatures: kept}, "", jsonIndent)
+	if err != nil {
+		return Signature{}, fmt.Errorf("failed to marshal signatures: %w", err)
+	}
+	if err := writeFileAtomic(snapshotFile+SignatureSuffix, append(data, '\n')); err != nil {
+		return Signature{}, fmt.Errorf("failed to write signature file: %w", err)
+	}
+	return sig, nil
+}
+
+// ReadSignatures reads the detached signatures of snapshotFile
+func ReadSignatures(snapshotFile string) ([]Signature, error) {
+	data, err := os.ReadFile(snapshotFile + SignatureSuffix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signature file: %w", err)
+	}
+	var file signatureFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("invalid signature file: %w", err)
+	}
+	if file.Version != signatureVersion {
+		return nil, fmt.Errorf("unsupported signature file version %d", file.Version)
+	}
+	return file.Signatures, nil
+}
+
+// VerifyFile checks the detached signatures of snapshotFile against the
+// trusted keys, like VerifySignatures. A missing signature file fails with
+// ErrNotSigned.
+func VerifyFile(snapshotFile string, trusted []*VerifyKey, identities ...Identity) (*VerifyKey, error) {
+	_, signer, err := verifySnapshotFile(snapshotFile, trusted, Options{Identities: identities})
+	return signer, err
+}
+
+// OpenSignedSnapshot reads a snapshot file like OpenSnapshot, but only
+// after checking its detached signatures against the trusted keys. The
+// signature is checked on the same data that is returned. Parents of an
+// incremental snapshot are covered by its parent_sha256, which must be set.
+func OpenSignedSnapshot(snapshotFile string, trusted []*VerifyKey, identities ...Identity) (ProjectSnapshot, *VerifyKey, error) {
+	return OpenSignedSnapshotOptions(snapshotFile, trusted, Options{Identities: identities})
+}
+
+// OpenSignedSnapshotOptions is OpenSignedSnapshot, reading the snapshot and
+// its parents as OpenSnapshotOptions does
+func OpenSignedSnapshotOptions(snapshotFile string, trusted []*VerifyKey, opts Options) (ProjectSnapshot, *VerifyKey, error) {
+	snapshot, signer, err := verifySnapshotFile(snapshotFile, trusted, opts)
+	if err != nil {
+		return ProjectSnapshot{}, nil, err
+	}
+	if snapshot.Parent != "" && snapshot.ParentSHA256 == "" {
+		return ProjectSnapshot{}, nil, fmt.Errorf("signed snapshot does not pin its parent %s", snapshot.Parent)
+	}
+
+	snapshot, err = mergeParents(snapshotFile, snapshot, opts, 0)
+	if err != nil {
+		return ProjectSnapshot{}, nil, err
+	}
+	return snapshot, signer, nil
+}
+
+// verifySnapshotFile reads a single snapshot file and checks its detached
+// signatures
+func verifySnapshotFile(snapshotFile string, trusted []*VerifyKey, opts Options) (ProjectSnapshot, *VerifyKey, error) {
+	signatures, err := ReadSignatures(snapshotFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return ProjectSnapshot{}, nil, ErrNotSigned
+	}
+	if err != nil {
+		return ProjectSnapshot{}, nil, err
+	}
+
+	snapshot, _, err := readSnapshotFile(snapshotFile, opts)
+	if err != nil {
+		return ProjectSnapshot{}, nil, err
+	}
+	signer, err := VerifySignatures(snapshot, signatures, trusted)
+	if err != nil {
+		return ProjectSnapshot{}, nil, err
+	}
+	return snapshot, signer, nil
+}
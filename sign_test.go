@@ -0,0 +1,133 @@
+package snapdir
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestSignAndVerifyFile(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "snapshot.json")
+	writeCloneFS(t, fstest.MapFS{"a.txt": {Data: []byte("a"), Mode: 0644}}, file, "")
+
+	alice, err := GenerateSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := GenerateSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mallory, err := GenerateSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := VerifyFile(file, []*VerifyKey{alice.Public()}); !errors.Is(err, ErrNotSigned) {
+		t.Errorf("VerifyFile() of unsigned snapshot error = %v, want %v", err, ErrNotSigned)
+	}
+
+	if _, err := SignFile(file, alice); err != nil {
+		t.Fatalf("SignFile() error = %v", err)
+	}
+	if _, err := SignFile(file, bob); err != nil {
+		t.Fatalf("SignFile() error = %v", err)
+	}
+	signatures, err := ReadSignatures(file)
+	if err != nil || len(signatures) != 2 {
+		t.Fatalf("ReadSignatures() = %d signatures, %v, want 2", len(signatures), err)
+	}
+
+	signer, err := VerifyFile(file, []*VerifyKey{mallory.Public(), bob.Public()})
+	if err != nil {
+		t.Fatalf("VerifyFile() error = %v", err)
+	}
+	if signer.String() != bob.Public().String() {
+		t.Errorf("VerifyFile() signer = %s, want %s", signer, bob.Public())
+	}
+	if _, err := VerifyFile(file, []*VerifyKey{mallory.Public()}); !errors.Is(err, ErrNotSigned) {
+		t.Errorf("VerifyFile() with untrusted signers error = %v, want %v", err, ErrNotSigned)
+	}
+
+	// Reformatting keeps the canonical digest, changing contents does not
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, bytes.ReplaceAll(data, []byte("\n  "), []byte("\n\t")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyFile(file, []*VerifyKey{alice.Public()}); err != nil {
+		t.Errorf("VerifyFile() after reformatting error = %v", err)
+	}
+	if err := os.WriteFile(file, bytes.Replace(data, []byte(`"a"`), []byte(`"b"`), 1), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyFile(file, []*VerifyKey{alice.Public()}); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("VerifyFile() after tampering error = %v, want %v", err, ErrBadSignature)
+	}
+	if _, _, err := OpenSignedSnapshot(file, []*VerifyKey{alice.Public()}); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("OpenSignedSnapshot() after tampering error = %v, want %v", err, ErrBadSignature)
+	}
+}
+
+func TestOpenSignedSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	day := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	base := filepath.Join(dir, "base.json")
+	next := filepath.Join(dir, "next.json")
+	writeCloneFS(t, fstest.MapFS{"a.txt": {Data: []byte("a"), Mode: 0644, ModTime: day}}, base, "")
+	writeCloneFS(t, fstest.MapFS{
+		"a.txt": {Data: []byte("a"), Mode: 0644, ModTime: day},
+		"b.txt": {Data: []byte("b"), Mode: 0644, ModTime: day},
+	}, next, base)
+
+	key, err := GenerateSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SignFile(next, key); err != nil {
+		t.Fatalf("SignFile() error = %v", err)
+	}
+
+	snapshot, signer, err := OpenSignedSnapshot(next, []*VerifyKey{key.Public()})
+	if err != nil {
+		t.Fatalf("OpenSignedSnapshot() error = %v", err)
+	}
+	if signer.String() != key.Public().String() || len(snapshot.Files) != 2 {
+		t.Errorf("OpenSignedSnapshot() = %d files signed by %s", len(snapshot.Files), signer)
+	}
+
+	// The parent is pinned by the signed parent_sha256
+	writeCloneFS(t, fstest.MapFS{"a.txt": {Data: []byte("changed"), Mode: 0644, ModTime: day}}, base, "")
+	if _, _, err := OpenSignedSnapshot(next, []*VerifyKey{key.Public()}); err == nil {
+		t.Error("OpenSignedSnapshot() should fail when the parent was replaced")
+	}
+}
+
+func TestParseSigningKeys(t *testing.T) {
+	key, err := GenerateSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseSigningKey(key.String())
+	if err != nil || parsed.String() != key.String() {
+		t.Errorf("ParseSigningKey() = %v, %v", parsed, err)
+	}
+	public, err := ParseVerifyKey(key.Public().String())
+	if err != nil || public.String() != key.Public().String() {
+		t.Errorf("ParseVerifyKey() = %v, %v", public, err)
+	}
+
+	if _, err := ParseSigningKey(key.Public().String()); err == nil {
+		t.Error("ParseSigningKey() should reject a public key")
+	}
+	if _, err := ParseVerifyKey(signingPublicPrefix + "AAAA"); err == nil {
+		t.Error("ParseVerifyKey() should reject short keys")
+	}
+}
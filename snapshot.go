@@ -0,0 +1,437 @@
+// Package snapdir reads and writes directory snapshots: JSON documents that
+// capture a directory tree, its file contents and permissions.
+package snapdir
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// EncodingBase64 marks file contents that are stored base64-encoded because
+// they are not valid UTF-8 and would be mangled by a plain JSON string
+const EncodingBase64 = "base64"
+
+// ErrStopScan can be returned from a ScanSnapshot callback to stop reading
+// the remaining entries without reporting an error
+var ErrStopScan = errors.New("stop scan")
+
+// FileInfo represents a file or directory in the snapshot
+type FileInfo struct {
+	Path     string `json:"path"`
+	Contents string `json:"contents,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	IsDir    bool   `json:"is_dir"`
+	Mode     uint32 `json:"mode,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	ModTime  string `json:"mtime,omitempty"`
+	SHA256   string `json:"sha256,omitempty"`
+	Owner    *Owner `json:"owner,omitempty"`
+
+	// Link is the target of a symbolic link. Link entries have no
+	// contents.
+	Link string `json:"link,omitempty"`
+
+	// Redacted marks a file whose secrets were replaced with placeholders.
+	// Only such files have their placeholders filled in on restore.
+	Redacted bool `json:"redacted,omitempty"`
+
+	// Deleted marks a tombstone in an incremental snapshot: the entry
+	// existed in the parent snapshot and has been removed since
+	Deleted bool `json:"deleted,omitempty"`
+
+	// Chunks lists the digests of the blobs a large file is split into.
+	// It is only set in repository manifests.
+	Chunks []string `json:"chunks,omitempty"`
+}
+
+// Owner holds the numeric user and group that own a file
+type Owner struct {
+	UID int `json:"uid"`
+	GID int `json:"gid"`
+}
+
+// ProjectSnapshot represents the complete directory snapshot
+type ProjectSnapshot struct {
+	Version string `json:"version"`
+
+	// Parent is set for incremental snapshots, which only record the
+	// entries that differ from their parent snapshot. It holds the path of
+	// the parent snapshot file, relative to the directory of this one.
+	Parent string `json:"parent,omitempty"`
+
+	// ParentSHA256 is the digest of the parent snapshot file, used to
+	// detect a parent that was changed or replaced
+	ParentSHA256 string `json:"parent_sha256,omitempty"`
+
+	Files []FileInfo `json:"files"`
+}
+
+// SetData stores data as the contents of a file entry, base64-encoding
+// binary contents
+func (file *FileInfo) SetData(data []byte) {
+	if utf8.Valid(data) {
+		file.Contents = string(data)
+		file.Encoding = ""
+		return
+	}
+	file.Contents = base64.StdEncoding.EncodeToString(data)
+	file.Encoding = EncodingBase64
+}
+
+// Data returns the raw bytes of a file entry
+func (file FileInfo) Data() ([]byte, error) {
+	switch file.Encoding {
+	case "":
+		return []byte(file.Contents), nil
+	case EncodingBase64:
+		data, err := base64.StdEncoding.DecodeString(file.Contents)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode contents of %s: %w", file.Path, err)
+		}
+		return data, nil
+	default:
+		return nil, fmt.Errorf("unsupported encoding %q for %s", file.Encoding, file.Path)
+	}
+}
+
+// HashContents returns the hex encoded SHA-256 digest of file contents
+func HashContents(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// FormatModTime formats a modification time the way it is stored in snapshots
+func FormatModTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// ParseModTime parses a modification time stored in a snapshot
+func ParseModTime(s string) (time.Time, error) {
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+// DataSize returns the size of a file entry, falling back to the length of
+// its decoded contents for snapshots that do not record sizes
+func (file FileInfo) DataSize() int64 {
+	if !file.hasData() {
+		return 0
+	}
+	if file.Size > 0 {
+		return file.Size
+	}
+	if file.Encoding == EncodingBase64 {
+		padding := len(file.Contents) - len(strings.TrimRight(file.Contents, "="))
+		return int64(base64.StdEncoding.DecodedLen(len(file.Contents)) - padding)
+	}
+	return int64(len(file.Contents))
+}
+
+// snapshotWriter writes a snapshot one entry at a time. The output is
+// byte-for-byte what json.MarshalIndent produces for the whole snapshot.
+type snapshotWriter struct {
+	w       *bufio.Writer
+	entries int
+}
+
+// newSnapshotWriter returns a snapshotWriter that writes to w
+func newSnapshotWriter(w io.Writer) *snapshotWriter {
+	return &snapshotWriter{w: bufio.NewWriter(w)}
+}
+
+// Begin writes the snapshot header: the fields of header other than Files
+func (sw *snapshotWriter) Begin(header ProjectSnapshot) error {
+	fields := []struct {
+		key, value string
+	}{
+		{"version", header.Version},
+		{"parent", header.Parent},
+		{"parent_sha256", header.ParentSHA256},
+	}
+
+	if _, err := sw.w.WriteString("{\n"); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	for _, field := range fields {
+		if field.value == "" && field.key != "version" {
+			continue
+		}
+		valueJSON, err := json.Marshal(field.value)
+		if err != nil {
+			return fmt.Errorf("failed to marshal JSON: %w", err)
+		}
+		if _, err := fmt.Fprintf(sw.w, "%s%q: %s,\n", jsonIndent, field.key, valueJSON); err != nil {
+			return fmt.Errorf("failed to write snapshot: %w", err)
+		}
+	}
+	if _, err := fmt.Fprintf(sw.w, "%s\"files\": [", jsonIndent); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	return nil
+}
+
+// Write appends one entry to the file list
+func (sw *snapshotWriter) Write(file FileInfo) error {
+	prefix := jsonIndent + jsonIndent
+	data, err := json.MarshalIndent(file, prefix, jsonIndent)
+	if err != nil {
+		return fmt.Errorf("failed to marshal JSON: %w", err)
+	}
+
+	sep := ",\n"
+	if sw.entries == 0 {
+		sep = "\n"
+	}
+	sw.entries++
+
+	if _, err := sw.w.WriteString(sep + prefix); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if _, err := sw.w.Write(data); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	return nil
+}
+
+// End closes the file list and the snapshot and flushes buffered output
+func (sw *snapshotWriter) End() error {
+	closing := "]\n}"
+	if sw.entries > 0 {
+		closing = "\n" + jsonIndent + closing
+	}
+	if _, err := sw.w.WriteString(closing); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := sw.w.Flush(); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	return nil
+}
+
+// gzipMagic starts every gzip stream
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// Compression says how snapshots are compressed when they are written
+type Compression string
+
+// Compressions of written snapshots. The zero value writes plain JSON.
+const (
+	CompressNone Compression = ""
+	CompressGzip Compression = "gzip"
+)
+
+// ParseCompression parses the name of a Compression; "none" and "off"
+// write uncompressed snapshots
+func ParseCompression(s string) (Compression, error) {
+	switch compression := Compression(s); compression {
+	case CompressGzip:
+		return compression, nil
+	case "none", "off":
+		return CompressNone, nil
+	default:
+		return "", fmt.Errorf("unknown compression %q (want gzip or none)", s)
+	}
+}
+
+// EncodeWriter returns a writer that compresses everything written to it
+// and then encrypts it for recipients, if there are any, before writing it
+// to w. DecodeReader undoes both. Close must be called to finish the
+// stream; it does not close w.
+func EncodeWriter(w io.Writer, compression Compression, recipients ...Recipient) (io.WriteCloser, error) {
+	var closers []io.Closer
+	if len(recipients) > 0 {
+		ew, err := EncryptWriter(w, recipients...)
+		if err != nil {
+			return nil, err
+		}
+		w = ew
+		closers = append(closers, ew)
+	}
+	switch compression {
+	case CompressNone:
+	case CompressGzip:
+		gw := gzip.NewWriter(w)
+		w = gw
+		closers = append(closers, gw)
+	default:
+		return nil, fmt.Errorf("unknown compression %q", compression)
+	}
+	return &encodeWriter{Writer: w, closers: closers}, nil
+}
+
+// encodeWriter is the writer returned by EncodeWriter
+type encodeWriter struct {
+	io.Writer
+	closers []io.Closer
+}
+
+// Close finishes the compressed stream before the encrypted one
+func (ew *encodeWriter) Close() error {
+	for i := len(ew.closers) - 1; i >= 0; i-- {
+		if err := ew.closers[i].Close(); err != nil {
+			return fmt.Errorf("failed to write snapshot: %w", err)
+		}
+	}
+	return nil
+}
+
+// DecodeReader returns a reader for the JSON of the snapshot stream r,
+// which may be compressed with gzip, encrypted, or both in either order.
+// Both are detected from the stream itself and undone; encrypted snapshots
+// are decrypted with identities like DecryptReader does.
+func DecodeReader(r io.Reader, identities ...Identity) (io.Reader, error) {
+	r, err := gunzipReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress snapshot: %w", err)
+	}
+	if r, err = DecryptReader(r, identities...); err != nil {
+		return nil, err
+	}
+	if r, err = gunzipReader(r); err != nil {
+		return nil, fmt.Errorf("failed to decompress snapshot: %w", err)
+	}
+	return r, nil
+}
+
+// gunzipReader decompresses r if it starts like a gzip stream and passes
+// it through otherwise
+func gunzipReader(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(len(gzipMagic)); !bytes.Equal(magic, gzipMagic) {
+		return br, nil
+	}
+	return gzip.NewReader(br)
+}
+
+// ScanSnapshot reads a snapshot from r one entry at a time, calling fn for
+// every file entry without holding the whole file list in memory. Scanning
+// stops early when fn returns ErrStopScan. The returned version is empty if
+// the scan stopped before the version field was read.
+func ScanSnapshot(r io.Reader, fn func(FileInfo) error) (string, error) {
+	var header ProjectSnapshot
+	err := scanSnapshot(r, &header, fn)
+	return header.Version, err
+}
+
+// ScanSnapshotOptions reads a snapshot stream like ScanSnapshot, decoding
+// it as by DecodeReader with opts.Identities and checking every entry
+// against opts.Limits before fn sees it. It returns the fields other than
+// the file list. Incremental snapshots are not scanned: fn is not called
+// and the returned Parent is set, so the caller can open the snapshot with
+// OpenSnapshotOptions to merge it with its parents.
+func ScanSnapshotOptions(r io.Reader, opts Options, fn func(FileInfo) error) (ProjectSnapshot, error) {
+	r, err := DecodeReader(r, opts.Identities...)
+	if err != nil {
+		return ProjectSnapshot{}, err
+	}
+
+	var (
+		header  ProjectSnapshot
+		scanned bool
+	)
+	checker := newLimitChecker(opts)
+	err = scanSnapshot(checker.limit(r), &header, func(file FileInfo) error {
+		if header.Parent != "" {
+			return ErrStopScan
+		}
+		scanned = true
+		if err := checker.check(file); err != nil {
+			return err
+		}
+		return fn(file)
+	})
+	if err != nil {
+		return ProjectSnapshot{}, err
+	}
+	if scanned && header.Parent != "" {
+		return ProjectSnapshot{}, fmt.Errorf("malformed snapshot: parent %s follows the file entries", header.Parent)
+	}
+	return header, nil
+}
+
+// scanSnapshot is ScanSnapshot, reading the fields other than the file list
+// into header
+func scanSnapshot(r io.Reader, header *ProjectSnapshot, fn func(FileInfo) error) error {
+	dec := json.NewDecoder(r)
+
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return fmt.Errorf("failed to read snapshot: %w", err)
+		}
+		key, ok := tok.(string)
+		if !ok {
+			return fmt.Errorf("unexpected token %v in snapshot", tok)
+		}
+
+		switch key {
+		case "version":
+			if err := dec.Decode(&header.Version); err != nil {
+				return fmt.Errorf("failed to read snapshot version: %w", err)
+			}
+		case "parent":
+			if err := dec.Decode(&header.Parent); err != nil {
+				return fmt.Errorf("failed to read snapshot parent: %w", err)
+			}
+		case "parent_sha256":
+			if err := dec.Decode(&header.ParentSHA256); err != nil {
+				return fmt.Errorf("failed to read snapshot parent: %w", err)
+			}
+		case "files":
+			if err := expectDelim(dec, '['); err != nil {
+				return err
+			}
+			for dec.More() {
+				var file FileInfo
+				if err := dec.Decode(&file); err != nil {
+					return fmt.Errorf("failed to read snapshot entry: %w", err)
+				}
+				if err := fn(file); err != nil {
+					if errors.Is(err, ErrStopScan) {
+						return nil
+					}
+					return err
+				}
+			}
+			if err := expectDelim(dec, ']'); err != nil {
+				return err
+			}
+		default:
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return fmt.Errorf("failed to read snapshot field %q: %w", key, err)
+			}
+		}
+	}
+
+	if err := expectDelim(dec, '}'); err != nil {
+		return err
+	}
+	return nil
+}
+
+// expectDelim reads the next JSON token and checks that it is the given delimiter
+func expectDelim(dec *json.Decoder, want json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot: %w", err)
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != want {
+		return fmt.Errorf("malformed snapshot: expected %q, got %v", want, tok)
+	}
+	return nil
+}
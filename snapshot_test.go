@@ -0,0 +1,244 @@
+package snapdir
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestFileInfoData(t *testing.T) {
+	tests := []struct {
+		name         string
+		data         []byte
+		wantEncoding string
+	}{
+		{
+			name:         "text",
+			data:         []byte("hello, world\n"),
+			wantEncoding: "",
+		},
+		{
+			name:         "utf-8 text",
+			data:         []byte("привіт"),
+			wantEncoding: "",
+		},
+		{
+			name:         "binary",
+			data:         []byte{0x89, 'P', 'N', 'G', 0x00, 0xff},
+			wantEncoding: EncodingBase64,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := FileInfo{Path: "file"}
+			file.SetData(tt.data)
+
+			if file.Encoding != tt.wantEncoding {
+				t.Errorf("encoding = %q, want %q", file.Encoding, tt.wantEncoding)
+			}
+
+			got, err := file.Data()
+			if err != nil {
+				t.Fatalf("Data() error = %v", err)
+			}
+			if !bytes.Equal(got, tt.data) {
+				t.Errorf("Data() = %q, want %q", got, tt.data)
+			}
+		})
+	}
+}
+
+func TestFileInfoDataInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		file FileInfo
+	}{
+		{
+			name: "unknown encoding",
+			file: FileInfo{Path: "file", Contents: "abc", Encoding: "rot13"},
+		},
+		{
+			name: "corrupt base64",
+			file: FileInfo{Path: "file", Contents: "!!!", Encoding: EncodingBase64},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.file.Data(); err == nil {
+				t.Error("Data() should fail")
+			}
+		})
+	}
+}
+
+func TestScanSnapshot(t *testing.T) {
+	input := `{
+  "version": "1.0.0",
+  "extra": {"ignored": [1, 2, 3]},
+  "files": [
+    {"path": "a.txt", "contents": "a", "is_dir": false},
+    {"path": "b", "is_dir": true},
+    {"path": "b/c.txt", "contents": "c", "is_dir": false}
+  ]
+}`
+
+	var paths []string
+	gotVersion, err := ScanSnapshot(strings.NewReader(input), func(file FileInfo) error {
+		paths = append(paths, file.Path)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ScanSnapshot() error = %v", err)
+	}
+	if gotVersion != "1.0.0" {
+		t.Errorf("version = %q, want %q", gotVersion, "1.0.0")
+	}
+	if strings.Join(paths, ",") != "a.txt,b,b/c.txt" {
+		t.Errorf("scanned paths = %v", paths)
+	}
+}
+
+func TestScanSnapshotStopsEarly(t *testing.T) {
+	// Everything after the second entry is garbage, so the scan only succeeds
+	// if it really stops once the callback asks it to
+	input := `{"version": "1.0.0", "files": [{"path": "a.txt"}, {"path": "b.txt"}, garbage`
+
+	var paths []string
+	_, err := ScanSnapshot(strings.NewReader(input), func(file FileInfo) error {
+		paths = append(paths, file.Path)
+		if file.Path == "b.txt" {
+			return ErrStopScan
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ScanSnapshot() error = %v", err)
+	}
+	if len(paths) != 2 {
+		t.Errorf("scanned %d entries, want 2", len(paths))
+	}
+}
+
+func TestScanSnapshotOptions(t *testing.T) {
+	tests := []struct {
+		name       string
+		input      string
+		opts       Options
+		wantPaths  string
+		wantParent string
+		wantErr    error
+	}{
+		{
+			// Garbage after b.txt is never read
+			name:      "full snapshot stops early",
+			input:     `{"version": "1.0.0", "files": [{"path": "a.txt"}, {"path": "b.txt"}, garbage`,
+			wantPaths: "a.txt,b.txt",
+		},
+		{
+			name:       "incremental snapshot",
+			input:      `{"version": "1.0.0", "parent": "base.json", "files": [{"path": "a.txt"}, garbage`,
+			wantParent: "base.json",
+		},
+		{
+			name:    "limits",
+			input:   `{"version": "1.0.0", "files": [{"path": "a.txt"}, {"path": "b.txt"}]}`,
+			opts:    Options{Limits: RestoreLimits{MaxEntries: 1}},
+			wantErr: ErrLimitExceeded,
+		},
+		{
+			name:  "unsafe path",
+			input: `{"version": "1.0.0", "files": [{"path": "../escape.txt"}]}`,
+		},
+		{
+			name:  "parent after files",
+			input: `{"version": "1.0.0", "files": [{"path": "a.txt"}], "parent": "base.json"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var paths []string
+			header, err := ScanSnapshotOptions(strings.NewReader(tt.input), tt.opts, func(file FileInfo) error {
+				paths = append(paths, file.Path)
+				if file.Path == "b.txt" {
+					return ErrStopScan
+				}
+				return nil
+			})
+			wantErr := tt.wantErr != nil || (tt.wantPaths == "" && tt.wantParent == "")
+			if (err != nil) != wantErr || (tt.wantErr != nil && !errors.Is(err, tt.wantErr)) {
+				t.Fatalf("ScanSnapshotOptions() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := strings.Join(paths, ","); got != tt.wantPaths {
+				t.Errorf("scanned paths = %q, want %q", got, tt.wantPaths)
+			}
+			if header.Parent != tt.wantParent {
+				t.Errorf("parent = %q, want %q", header.Parent, tt.wantParent)
+			}
+		})
+	}
+}
+
+func TestScanSnapshotErrors(t *testing.T) {
+	callbackErr := errors.New("callback failed")
+
+	tests := []struct {
+		name    string
+		input   string
+		fn      func(FileInfo) error
+		wantErr error
+	}{
+		{
+			name:  "not an object",
+			input: `[1, 2, 3]`,
+		},
+		{
+			name:  "truncated",
+			input: `{"version": "1.0.0", "files": [{"path": "a.txt"}`,
+		},
+		{
+			name:  "files not an array",
+			input: `{"files": {}}`,
+		},
+		{
+			name:    "callback error",
+			input:   `{"files": [{"path": "a.txt"}]}`,
+			fn:      func(FileInfo) error { return callbackErr },
+			wantErr: callbackErr,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fn := tt.fn
+			if fn == nil {
+				fn = func(FileInfo) error { return nil }
+			}
+
+			_, err := ScanSnapshot(strings.NewReader(tt.input), fn)
+			if err == nil {
+				t.Fatal("ScanSnapshot() should fail")
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("ScanSnapshot() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// writeSnapshotFile writes a snapshot to disk for tests that read files
+func writeSnapshotFile(name string, snapshot ProjectSnapshot) error {
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, data, 0644)
+}
@@ -0,0 +1,137 @@
+package snapdir
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+)
+
+// statCacheVersion is the format version of stat cache files
+const statCacheVersion = 1
+
+// racyWindow is how recently a file may have been modified and still be
+// cached. A file changed again within the timestamp granularity of its
+// file system would keep its size and mtime, so such files are hashed again
+// on the next run instead, like git's "racily clean" index entries.
+const racyWindow = 2 * time.Second
+
+// StatCache remembers the content hash of every file of a tree together
+// with its size, modification time, inode number and change time. Files
+// whose stat data did not change since the last run are not hashed again,
+// and not read at all where their contents are not needed.
+//
+// A cache belongs to one tree. It is safe for concurrent use.
+type StatCache struct {
+	path string
+
+	mu      sync.Mutex
+	entries map[string]statEntry
+	next    map[string]statEntry
+}
+
+// statEntry is the cached stat data and hash of one file
+type statEntry struct {
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"`
+	Inode   uint64 `json:"inode,omitempty"`
+	Ctime   int64  `json:"ctime,omitempty"`
+	SHA256  string `json:"sha256"`
+}
+
+// statCacheFile is the on-disk format of a stat cache
+type statCacheFile struct {
+	Version int                  `json:"version"`
+	Entries map[string]statEntry `json:"entries"`
+}
+
+// OpenStatCache loads the stat cache stored at path. A missing file gives
+// an empty cache; an unreadable or outdated one is discarded, as the cache
+// only saves work and can always be rebuilt.
+func OpenStatCache(path string) (*StatCache, error) {
+	cache := &StatCache{
+		path:    path,
+		entries: make(map[string]statEntry),
+		next:    make(map[string]statEntry),
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cache, nil
+		}
+		return nil, fmt.Errorf("failed to read stat cache: %w", err)
+	}
+
+	var file statCacheFile
+	if err := json.Unmarshal(data, &file); err != nil || file.Version != statCacheVersion {
+		return cache, nil
+	}
+	if file.Entries != nil {
+		cache.entries = file.Entries
+	}
+	return cache, nil
+}
+
+// Save writes the cache back to its file. Only files seen since the cache
+// was opened are kept, so entries for deleted files are dropped.
+func (c *StatCache) Save() error {
+	c.mu.Lock()
+	data, err := json.Marshal(statCacheFile{Version: statCacheVersion, Entries: c.next})
+	c.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to marshal stat cache: %w", err)
+	}
+
+	if err := writeFileAtomic(c.path, data); err != nil {
+		return fmt.Errorf("failed to write stat cache: %w", err)
+	}
+	return nil
+}
+
+// lookup records the stat data of the file at p and returns its cached hash
+// if the file is unchanged, or an empty string if it has to be hashed
+func (c *StatCache) lookup(p string, info fs.FileInfo) string {
+	inode, ctime := fileIdentity(info)
+	current := statEntry{
+		Size:    info.Size(),
+		ModTime: info.ModTime().UnixNano(),
+		Inode:   inode,
+		Ctime:   ctime,
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Hashes stored during this run are newer than the loaded ones
+	cached, ok := c.next[p]
+	if !ok || cached.SHA256 == "" {
+		cached, ok = c.entries[p]
+	}
+	if ok && cached.SHA256 != "" {
+		current.SHA256 = cached.SHA256
+		if current == cached {
+			c.next[p] = current
+			return cached.SHA256
+		}
+		current.SHA256 = ""
+	}
+
+	if time.Since(info.ModTime()) >= racyWindow {
+		c.next[p] = current
+	}
+	return ""
+}
+
+// setHash stores the hash of a file that lookup reported as changed
+func (c *StatCache) setHash(p, sum string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if entry, ok := c.next[p]; ok {
+		entry.SHA256 = sum
+		c.next[p] = entry
+	}
+}
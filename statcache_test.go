@@ -0,0 +1,204 @@
+package snapdir
+
+import (
+	"context"
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// editStatCache rewrites the cached hash of p in the cache file at path
+func editStatCache(t *testing.T, path, p, sum string) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read stat cache: %v", err)
+	}
+	var file statCacheFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		t.Fatalf("failed to parse stat cache: %v", err)
+	}
+	entry, ok := file.Entries[p]
+	if !ok {
+		t.Fatalf("stat cache has no entry for %s", p)
+	}
+	entry.SHA256 = sum
+	file.Entries[p] = entry
+	data, err = json.Marshal(file)
+	if err != nil {
+		t.Fatalf("failed to marshal stat cache: %v", err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("failed to write stat cache: %v", err)
+	}
+}
+
+func TestStatCache(t *testing.T) {
+	src := t.TempDir()
+	cachePath := filepath.Join(t.TempDir(), "statcache.json")
+	old := time.Now().Add(-time.Hour)
+
+	for name, content := range map[string]string{"a.txt": "alpha", "b.txt": "beta"} {
+		path := filepath.Join(src, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+		if err := os.Chtimes(path, old, old); err != nil {
+			t.Fatalf("failed to set times: %v", err)
+		}
+	}
+	// Just written, so its mtime could still change unnoticed
+	if err := os.WriteFile(filepath.Join(src, "racy.txt"), []byte("racy"), 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	clone := func() map[string]string {
+		t.Helper()
+		cache, err := OpenStatCache(cachePath)
+		if err != nil {
+			t.Fatalf("OpenStatCache() error = %v", err)
+		}
+		snapshot, err := CloneFS(context.Background(), os.DirFS(src), Options{StatCache: cache})
+		if err != nil {
+			t.Fatalf("CloneFS() error = %v", err)
+		}
+		if err := cache.Save(); err != nil {
+			t.Fatalf("Save() error = %v", err)
+		}
+		hashes := make(map[string]string)
+		for _, file := range snapshot.Files {
+			hashes[file.Path] = file.SHA256
+		}
+		return hashes
+	}
+
+	first := clone()
+	if first["a.txt"] != HashContents([]byte("alpha")) {
+		t.Fatalf("first clone hash = %s, want the real hash", first["a.txt"])
+	}
+
+	// A hash planted in the cache shows that unchanged files are not hashed
+	fake := HashContents([]byte("from the cache"))
+	editStatCache(t, cachePath, "a.txt", fake)
+	if got := clone()["a.txt"]; got != fake {
+		t.Errorf("unchanged file hash = %s, want the cached hash", got)
+	}
+
+	// A change in size invalidates the entry
+	editStatCache(t, cachePath, "b.txt", fake)
+	if err := os.WriteFile(filepath.Join(src, "b.txt"), []byte("beta, longer"), 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if got := clone()["b.txt"]; got != HashContents([]byte("beta, longer")) {
+		t.Errorf("changed file hash = %s, want the real hash", got)
+	}
+
+	cache, err := OpenStatCache(cachePath)
+	if err != nil {
+		t.Fatalf("OpenStatCache() error = %v", err)
+	}
+	if _, ok := cache.entries["racy.txt"]; ok {
+		t.Error("recently modified file should not be cached")
+	}
+}
+
+func TestOpenStatCacheInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "statcache.json")
+	if err := os.WriteFile(path, []byte("not json"), 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	cache, err := OpenStatCache(path)
+	if err != nil {
+		t.Fatalf("OpenStatCache() error = %v, a broken cache should be discarded", err)
+	}
+	if len(cache.entries) != 0 {
+		t.Errorf("broken cache has %d entries", len(cache.entries))
+	}
+}
+
+func TestRepositorySaveWithStatCache(t *testing.T) {
+	old := time.Now().Add(-time.Hour)
+	fsys := manyFilesFS(20)
+	for _, file := range fsys {
+		file.ModTime = old
+	}
+
+	repo, err := InitRepository(filepath.Join(t.TempDir(), "repo"))
+	if err != nil {
+		t.Fatalf("InitRepository() error = %v", err)
+	}
+	cachePath := filepath.Join(t.TempDir(), "statcache.json")
+
+	save := func() (Manifest, int64) {
+		t.Helper()
+		cache, err := OpenStatCache(cachePath)
+		if err != nil {
+			t.Fatalf("OpenStatCache() error = %v", err)
+		}
+		counting := &countingFS{FS: fsys}
+		manifest, err := repo.SaveFS(context.Background(), counting, "/src", Options{StatCache: cache})
+		if err != nil {
+			t.Fatalf("SaveFS() error = %v", err)
+		}
+		if err := cache.Save(); err != nil {
+			t.Fatalf("Save() error = %v", err)
+		}
+		return manifest, counting.opened.Load()
+	}
+
+	first, opened := save()
+	if opened != 20 {
+		t.Errorf("first save read %d files, want 20", opened)
+	}
+	second, opened := save()
+	if opened != 0 {
+		t.Errorf("second save read %d files, want 0", opened)
+	}
+
+	firstFiles, _ := json.Marshal(first.Files)
+	secondFiles, _ := json.Marshal(second.Files)
+	if string(firstFiles) != string(secondFiles) {
+		t.Error("manifests of an unchanged tree differ")
+	}
+}
+
+func TestRepositorySaveFollowedSymlink(t *testing.T) {
+	repo, err := InitRepository(filepath.Join(t.TempDir(), "repo"))
+	if err != nil {
+		t.Fatalf("InitRepository() error = %v", err)
+	}
+	cachePath := filepath.Join(t.TempDir(), "statcache.json")
+
+	save := func(fsys fs.FS) Manifest {
+		t.Helper()
+		cache, err := OpenStatCache(cachePath)
+		if err != nil {
+			t.Fatalf("OpenStatCache() error = %v", err)
+		}
+		manifest, err := repo.SaveFS(context.Background(), fsys, "/src", Options{StatCache: cache})
+		if err != nil {
+			t.Fatalf("SaveFS() error = %v", err)
+		}
+		if err := cache.Save(); err != nil {
+			t.Fatalf("Save() error = %v", err)
+		}
+		return manifest
+	}
+
+	// Rewriting the target leaves the link itself untouched, so the link
+	// must be cached by the stat data of its target
+	old := time.Now().Add(-time.Hour)
+	save(linkFS("version one", old))
+	manifest := save(linkFS("VERSION TWO", old.Add(time.Minute)))
+
+	dst := filepath.Join(t.TempDir(), "restored")
+	if err := repo.Restore(context.Background(), manifest.ID, dst, Options{}); err != nil {
+		t.Fatalf("Restore() error = %v", err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dst, "link.txt")); err != nil || string(data) != "VERSION TWO" {
+		t.Errorf("restored link.txt = %q, %v, want the new contents of its target", data, err)
+	}
+}
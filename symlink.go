@@ -0,0 +1,65 @@
+package snapdir
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// readLinkFS is implemented by file systems that can report the target of
+// a symbolic link instead of following it. With Options.Symlinks, Clone
+// records symlinks as link entries when the file system implements it and
+// follows them otherwise.
+type readLinkFS interface {
+	fs.FS
+	ReadLink(name string) (string, error)
+}
+
+// linkDirFS is os.DirFS with symlinks reported by ReadLink
+type linkDirFS struct {
+	fs.FS
+	dir string
+}
+
+// dirFS returns a file system for the directory dir that reports symlinks
+func dirFS(dir string) fs.FS {
+	return linkDirFS{FS: os.DirFS(dir), dir: dir}
+}
+
+// ReadLink returns the target of the symlink name
+func (fsys linkDirFS) ReadLink(name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	target, err := os.Readlink(filepath.Join(fsys.dir, filepath.FromSlash(name)))
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(target), nil
+}
+
+// hasData reports whether an entry is a regular file with contents, as
+// opposed to a directory, symlink or tombstone
+func (file FileInfo) hasData() bool {
+	return !file.IsDir && !file.Deleted && file.Link == ""
+}
+
+// createLinks creates the symlinks of a snapshot. They are created after all
+// files and directories, so no file of the snapshot is written through a
+// symlink the snapshot itself planted.
+func createLinks(dst string, links []FileInfo, opts Options) error {
+	for _, link := range links {
+		path := filepath.Join(dst, filepath.FromSlash(link.Path))
+		if err := os.Symlink(filepath.FromSlash(link.Link), path); err != nil {
+			return fmt.Errorf("failed to create symlink %s: %w", link.Path, err)
+		}
+		if opts.PreserveOwner && link.Owner != nil {
+			if err := applyOwner(path, link.Owner); err != nil {
+				return fmt.Errorf("failed to set owner of %s: %w", link.Path, err)
+			}
+		}
+		opts.logger().Debug("restored symlink", "path", link.Path, "target", link.Link)
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+//go:build unix
+
+package snapdir
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCloneRestoreSymlinks(t *testing.T) {
+	src := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(src, "docs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "docs", "README.md"), []byte("# docs"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for link, target := range map[string]string{
+		"README.md": "docs/README.md",
+		"latest":    "docs",
+		"dangling":  "missing.txt",
+		"outside":   "/etc/hostname",
+	} {
+		if err := os.Symlink(target, filepath.Join(src, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx := context.Background()
+	var buf bytes.Buffer
+	if err := Clone(ctx, src, &buf, Options{Symlinks: true}); err != nil {
+		t.Fatalf("Clone() error = %v", err)
+	}
+	var snapshot ProjectSnapshot
+	if err := json.Unmarshal(buf.Bytes(), &snapshot); err != nil {
+		t.Fatal(err)
+	}
+	links := make(map[string]string)
+	for _, file := range snapshot.Files {
+		if file.Link != "" {
+			links[file.Path] = file.Link
+			if file.Contents != "" || file.Size != 0 {
+				t.Errorf("link entry %s has contents", file.Path)
+			}
+		}
+	}
+	if len(links) != 4 || links["latest"] != "docs" || links["outside"] != "/etc/hostname" {
+		t.Errorf("Clone() recorded links %v", links)
+	}
+
+	dst := filepath.Join(t.TempDir(), "restored")
+	if err := RestoreSnapshot(ctx, snapshot, dst, Options{}); err != nil {
+		t.Fatalf("RestoreSnapshot() error = %v", err)
+	}
+	for link, target := range links {
+		got, err := os.Readlink(filepath.Join(dst, link))
+		if err != nil || got != target {
+			t.Errorf("restored link %s = %q, %v, want %q", link, got, err, target)
+		}
+	}
+
+	changes, err := Diff(ctx, snapshot, dst, Options{Symlinks: true})
+	if err != nil || len(changes) != 0 {
+		t.Errorf("Diff() = %v, %v, want no changes", changes, err)
+	}
+	if err := os.Remove(filepath.Join(dst, "latest")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("docs/README.md", filepath.Join(dst, "latest")); err != nil {
+		t.Fatal(err)
+	}
+	changes, err = Diff(ctx, snapshot, dst, Options{Symlinks: true})
+	if err != nil || len(changes) != 1 || changes[0] != (Change{Path: "latest", Kind: Modified}) {
+		t.Errorf("Diff() after retargeting = %v, %v", changes, err)
+	}
+}
+
+func TestCloneFollowsSymlinksByDefault(t *testing.T) {
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "target.txt"), []byte("target"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("target.txt", filepath.Join(src, "link.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := Clone(context.Background(), src, &buf, Options{}); err != nil {
+		t.Fatalf("Clone() error = %v", err)
+	}
+	var snapshot ProjectSnapshot
+	if err := json.Unmarshal(buf.Bytes(), &snapshot); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range snapshot.Files {
+		if file.Path == "link.txt" && (file.Link != "" || file.Contents != "target") {
+			t.Errorf("Clone() entry for link.txt = %+v, want the contents of its target", file)
+		}
+	}
+}
+
+func TestRestoreDoesNotWriteThroughLinks(t *testing.T) {
+	outside := t.TempDir()
+	snapshot := ProjectSnapshot{Version: Version, Files: []FileInfo{
+		{Path: "escape", Link: outside},
+		{Path: "escape/planted.txt", Contents: "gotcha"},
+	}}
+
+	dst := filepath.Join(t.TempDir(), "restored")
+	if err := RestoreSnapshot(context.Background(), snapshot, dst, Options{}); err == nil {
+		t.Error("RestoreSnapshot() should fail for a file below a link")
+	}
+	if _, err := os.Stat(filepath.Join(outside, "planted.txt")); !os.IsNotExist(err) {
+		t.Error("RestoreSnapshot() wrote through a symlink")
+	}
+}
+
+func TestFSSymlinks(t *testing.T) {
+	fsys, err := NewFS(ProjectSnapshot{Version: Version, Files: []FileInfo{
+		{Path: "docs", IsDir: true},
+		{Path: "docs/a.txt", Contents: "a"},
+		{Path: "latest", Link: "docs"},
+		{Path: "docs/self", Link: "../latest/a.txt"},
+		{Path: "loop", Link: "loop"},
+		{Path: "escape", Link: "../outside"},
+		{Path: "absolute", Link: "/etc/passwd"},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"latest/a.txt", "docs/self"} {
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil || string(data) != "a" {
+			t.Errorf("ReadFile(%s) = %q, %v", name, data, err)
+		}
+	}
+	for _, name := range []string{"escape", "absolute"} {
+		if _, err := fsys.Open(name); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Open(%s) error = %v, want %v", name, err, fs.ErrNotExist)
+		}
+	}
+	if _, err := fsys.Open("loop"); err == nil {
+		t.Error("Open() of a symlink loop should fail")
+	}
+
+	if target, err := fsys.ReadLink("latest"); err != nil || target != "docs" {
+		t.Errorf("ReadLink() = %q, %v", target, err)
+	}
+	if info, err := fsys.Lstat("latest"); err != nil || info.Mode()&fs.ModeSymlink == 0 {
+		t.Errorf("Lstat() = %v, %v", info, err)
+	}
+	if info, err := fsys.Stat("latest"); err != nil || !info.IsDir() {
+		t.Errorf("Stat() = %v, %v", info, err)
+	}
+
+	// Cloning the FS with Symlinks keeps the links instead of following
+	// them
+	snapshot, err := CloneFS(context.Background(), fsys, Options{Symlinks: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range snapshot.Files {
+		if file.Path == "latest" && file.Link != "docs" {
+			t.Errorf("CloneFS() entry for latest = %+v", file)
+		}
+	}
+}
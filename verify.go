@@ -0,0 +1,71 @@
+package snapdir
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// VerifyReport summarizes a repository check
+type VerifyReport struct {
+	Snapshots int
+	Files     int
+	Problems  []string
+}
+
+// Verify checks every snapshot of the repository: manifests must match
+// their IDs, and every blob and chunk a file refers to must exist and match
+// its digest. Files shared between snapshots are checked once. Problems are
+// collected in the report; the returned error is only set if the check
+// itself could not run.
+func (repo *Repository) Verify(ctx context.Context) (VerifyReport, error) {
+	var report VerifyReport
+
+	ids, err := repo.snapshotIDs()
+	if err != nil {
+		return report, err
+	}
+
+	checked := make(map[string]bool)
+	for _, id := range ids {
+		report.Snapshots++
+
+		data, err := os.ReadFile(repo.manifestPath(id))
+		if err != nil {
+			return report, fmt.Errorf("failed to read snapshot %s: %w", id, err)
+		}
+		if HashContents(data) != id {
+			report.Problems = append(report.Problems, fmt.Sprintf("snapshot %s: manifest does not match its ID", id))
+			continue
+		}
+
+		manifest, err := repo.Manifest(id)
+		if err != nil {
+			report.Problems = append(report.Problems, err.Error())
+			continue
+		}
+
+		for _, file := range manifest.Files {
+			if err := ctx.Err(); err != nil {
+				return report, err
+			}
+			if !file.hasData() {
+				continue
+			}
+
+			key := file.SHA256 + ":" + strings.Join(file.Chunks, ",")
+			if checked[key] {
+				continue
+			}
+			checked[key] = true
+			report.Files++
+
+			if _, err := repo.readFile(file); err != nil {
+				report.Problems = append(report.Problems, fmt.Sprintf("snapshot %s: %s: %v", id, file.Path, err))
+			}
+		}
+	}
+
+	return report, nil
+}